@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminHandler serves POST /sync/ticket/{class}/{ref}: the ticket is fetched
+// from iTop, mapped and upserted right away, and the written document returned
+func (s *syncer) adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminRequest(w, r) {
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/sync/ticket/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			http.Error(w, "expected /sync/ticket/{class}/{ref}", http.StatusNotFound)
+			return
+		}
+		ref := ticketRef{Class: parts[0], ID: parts[1]}
+		if !s.classConfigured(ref.Class) {
+			http.Error(w, "class not synced: "+ref.Class, http.StatusBadRequest)
+			return
+		}
+
+		// The run loop owns the writer, so the request is handed over to it
+		done := make(chan syncResult, 1)
+		select {
+		case s.hooks <- syncRequest{ref: ref, done: done}:
+		default:
+			http.Error(w, "queue full", http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case res := <-done:
+			switch {
+			case res.err == errTicketNotFound:
+				http.Error(w, res.err.Error(), http.StatusNotFound)
+			case res.err == errOtherShard:
+				http.Error(w, res.err.Error(), http.StatusMisdirectedRequest)
+			case res.err == errStandby:
+				http.Error(w, res.err.Error(), http.StatusServiceUnavailable)
+			case res.err != nil:
+				http.Error(w, res.err.Error(), http.StatusBadGateway)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(res.doc)
+			}
+		case <-time.After(2 * time.Minute):
+			// Still queued behind a running cycle; it will complete on its own
+			http.Error(w, "timed out waiting for the sync loop, request stays queued", http.StatusGatewayTimeout)
+		}
+	})
+}
+
+// sltCacheHandler serves POST /sync/slt-cache: the SLT and coverage window
+// caches are emptied, so the next lookups read iTop
+func (s *syncer) sltCacheHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminRequest(w, r) {
+			return
+		}
+		n := s.itop.FlushSLTCache()
+		slog.Info("Flushed the SLT cache", "lookups", n)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"flushed": n})
+	})
+}
+
+// cachesHandler serves POST /sync/caches: the SLT, coverage window and
+// person-team caches are emptied
+func (s *syncer) cachesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminRequest(w, r) {
+			return
+		}
+		flushed := map[string]int{"slt": s.itop.FlushSLTCache(), "person_teams": s.itop.FlushTeamCache()}
+		slog.Info("Flushed the iTop caches", "slt", flushed["slt"], "person_teams", flushed["person_teams"])
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]map[string]int{"flushed": flushed})
+	})
+}
+
+// fullSyncHandler serves POST /sync/full: the run loop starts a full sync
+// as soon as the running cycle, if any, is over
+func (s *syncer) fullSyncHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminRequest(w, r) {
+			return
+		}
+		select {
+		case s.fullSyncs <- struct{}{}:
+			slog.Info("Full sync requested")
+		default: // one is already pending
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]bool{"queued": true})
+	})
+}
+
+// adminRequest accepts POST requests bearing http.admin_token and answers
+// the others
+func (s *syncer) adminRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	token := s.cfg.HTTP.AdminToken
+	if token == "" || !tokenMatches(r.Header.Get("Authorization"), "Bearer "+token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// tokenMatches compares a presented token in constant time
+func tokenMatches(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
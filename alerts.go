@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	es "itop-sla-exporter/internal/es"
+	notify "itop-sla-exporter/internal/notify"
+)
+
+// checkSyncHealth notifies when notify.failed_cycles consecutive cycles
+// failed, or when the share of writes Elasticsearch rejected in this cycle
+// reaches notify.error_rate; each condition is notified once, then again
+// when it clears
+func (s *syncer) checkSyncHealth(ok bool, err error, res es.BulkResult) {
+	failed := s.failedCycles
+	if ok {
+		s.failedCycles = 0
+	} else {
+		s.failedCycles++
+	}
+	if s.notifier == nil {
+		return
+	}
+	conf := s.cfg.Notify
+	if ok {
+		if s.failureNotified {
+			s.notify(notify.Message{Event: "sync_failure", Subject: "iTop sync recovered",
+				Text: fmt.Sprintf("Sync cycle %d succeeded after %d failed cycles", s.cycleID, failed)})
+		}
+		s.failureNotified = false
+	} else {
+		if conf.FailedCycles > 0 && s.failedCycles >= conf.FailedCycles && !s.failureNotified {
+			s.failureNotified = true
+			reason := "fetching tickets from iTop failed"
+			if err != nil {
+				reason = "writing to Elasticsearch failed: " + err.Error()
+			}
+			s.notify(notify.Message{Event: "sync_failure", Subject: "iTop sync failing",
+				Text:   fmt.Sprintf("%d consecutive sync cycles failed", s.failedCycles),
+				Fields: map[string]string{"cycle_id": fmt.Sprint(s.cycleID), "last_error": reason}})
+		}
+	}
+	if conf.ErrorRate <= 0 {
+		return
+	}
+	writes := res.Indexed + res.Updated + res.Deleted + len(res.Errors)
+	if writes == 0 {
+		return
+	}
+	rate := float64(len(res.Errors)) / float64(writes)
+	switch {
+	case rate >= conf.ErrorRate && !s.errorRateNotified:
+		s.errorRateNotified = true
+		fields := map[string]string{"cycle_id": fmt.Sprint(s.cycleID), "rejected": fmt.Sprint(len(res.Errors)), "writes": fmt.Sprint(writes)}
+		if len(res.Errors) > 0 {
+			fields["first_error"] = res.Errors[0].Reason
+		}
+		s.notify(notify.Message{Event: "sync_failure", Subject: "Elasticsearch rejecting writes",
+			Text: fmt.Sprintf("%.1f%% of the writes of sync cycle %d were rejected", rate*100, s.cycleID), Fields: fields})
+	case rate < conf.ErrorRate && s.errorRateNotified:
+		s.errorRateNotified = false
+		s.notify(notify.Message{Event: "sync_failure", Subject: "Elasticsearch write errors recovered",
+			Text: fmt.Sprintf("%.1f%% of the writes of sync cycle %d were rejected", rate*100, s.cycleID)})
+	}
+}
+
+// notify sends a message, naming the source of the syncer's tickets
+func (s *syncer) notify(m notify.Message) {
+	if s.cfg.Source != "" {
+		if m.Fields == nil {
+			m.Fields = map[string]string{}
+		}
+		m.Fields["source"] = s.cfg.Source
+	}
+	s.notifier.Send(m)
+}
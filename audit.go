@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+)
+
+// auditEntry is a document of the audit index (elastic.audit): one write
+// the synchronizer performed, and why
+type auditEntry struct {
+	Timestamp time.Time `json:"@timestamp"`
+	CycleID   int       `json:"cycle_id"` // 0 outside sync cycles (backfill)
+	Trigger   string    `json:"trigger"`  // sync or resync (webhook, admin endpoint)
+	Action    string    `json:"action"`   // upsert, delete, soft_delete or purge
+	Reason    string    `json:"reason"`   // new, changed, restored, relocated, orphan or expired
+	DocID     string    `json:"doc_id,omitempty"`
+	Index     string    `json:"index,omitempty"`
+	Ref       string    `json:"ref,omitempty"`
+	Class     string    `json:"class,omitempty"`
+	Diff      string    `json:"diff,omitempty"`  // e.g. "status: assigned → resolved"
+	Count     int       `json:"count,omitempty"` // documents removed by a purge
+}
+
+// newAuditSink creates the writer of the audit index, nil when elastic.audit
+// is off
+func newAuditSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.Audit()
+	if !ok {
+		return nil, nil
+	}
+	return newSideSink(cfg, conf, "es_audit", reflect.TypeOf(auditEntry{}), writer)
+}
+
+// auditUpsert records the upsert of doc, compared with the last version
+// written; call it before the shadow is updated
+func (s *syncer) auditUpsert(trigger, key, index string, doc ESTicket) {
+	if s.audit == nil {
+		return
+	}
+	e := auditEntry{Trigger: trigger, Action: "upsert", DocID: key, Index: index, Ref: doc.Ref, Class: doc.Class}
+	old, known := s.shadow[key]
+	switch {
+	case !known:
+		e.Reason = "new"
+	case old.Deleted:
+		e.Reason = "restored"
+	default:
+		e.Reason = "changed"
+		e.Diff = shadowDiff(old, doc)
+	}
+	s.queueAudit(e)
+}
+
+// auditRemoval records the deletion (or soft deletion) of a document
+func (s *syncer) auditRemoval(action, reason, key string, d shadowDoc, diff string) {
+	if s.audit == nil {
+		return
+	}
+	s.queueAudit(auditEntry{Trigger: "sync", Action: action, Reason: reason, DocID: key, Index: d.Index, Ref: d.Ref, Class: d.Class, Diff: diff})
+}
+
+func (s *syncer) queueAudit(e auditEntry) {
+	e.Timestamp = time.Now().UTC()
+	e.CycleID = s.cycleID
+	id := strconv.Itoa(e.CycleID) + "-" + e.Action + "-" + e.DocID + "-" + strconv.FormatInt(e.Timestamp.UnixNano(), 10)
+	if err := s.audit.Upsert("", id, e); err != nil {
+		s.log.Error("Failed to queue audit entry", "id", e.DocID, "action", e.Action, "err", err)
+	}
+}
+
+// flushAudit writes the queued audit entries
+func (s *syncer) flushAudit() {
+	if s.audit == nil {
+		return
+	}
+	if _, err := s.audit.Flush(); err != nil {
+		s.log.Error("Failed to write audit entries", "err", err)
+	}
+}
+
+// shadowDiff summarizes what changed between the last version written and
+// doc: the tracked fields, else the content hash (SLA figures, ages, ...)
+func shadowDiff(old shadowDoc, doc ESTicket) string {
+	var parts []string
+	for _, f := range []struct{ name, from, to string }{
+		{"status", old.Status, doc.Status},
+		{"agent", old.Agent, doc.Agent},
+		{"team", old.Team, doc.Team},
+	} {
+		if f.from != f.to {
+			parts = append(parts, fmt.Sprintf("%s: %s → %s", f.name, f.from, f.to))
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, fmt.Sprintf("content_hash: %s → %s", old.Hash, doc.ContentHash))
+	}
+	return strings.Join(parts, "; ")
+}
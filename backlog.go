@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+)
+
+// backlogDoc is a document of the backlog index (elastic.backlog): the
+// number of open tickets with a status, priority or team at a point in time.
+// The documents of a snapshot share their @timestamp; the dimension "all"
+// counts every open ticket.
+type backlogDoc struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Dimension string    `json:"dimension"` // all, status, priority or team
+	Value     string    `json:"value"`     // empty for all, and for tickets without a team
+	Open      int       `json:"open"`
+}
+
+// newBacklogSink creates the writer of the backlog index, nil when
+// elastic.backlog is off
+func newBacklogSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.Backlog()
+	if !ok {
+		return nil, nil
+	}
+	if cfg.Shard.Enabled() {
+		return nil, fmt.Errorf("elastic.backlog: %w", errShardSummary)
+	}
+	return newSideSink(cfg, conf, "es_backlog", reflect.TypeOf(backlogDoc{}), writer)
+}
+
+// snapshotBacklog writes the counts of the open tickets, once every
+// elastic.backlog_interval
+func (s *syncer) snapshotBacklog() {
+	if s.backlog == nil || time.Since(s.lastBacklog) < s.cfg.Elastic.BacklogInterval {
+		return
+	}
+	now := time.Now().UTC()
+	s.lastBacklog = now
+	counts := map[[2]string]int{}
+	for _, t := range s.openTickets {
+		counts[[2]string{"all", ""}]++
+		counts[[2]string{"status", t.Status}]++
+		counts[[2]string{"priority", priorityLabel(t.Priority)}]++
+		counts[[2]string{"team", t.Team}]++
+	}
+	if len(counts) == 0 {
+		counts[[2]string{"all", ""}] = 0 // an empty backlog is a data point too
+	}
+	prefix := strconv.FormatInt(now.UnixNano(), 10) + "-"
+	for k, n := range counts {
+		sum := sha1.Sum([]byte(k[1]))
+		doc := backlogDoc{Timestamp: now, Dimension: k[0], Value: k[1], Open: n}
+		if err := s.backlog.Upsert("", prefix+k[0]+"-"+hex.EncodeToString(sum[:6]), doc); err != nil {
+			s.log.Error("Failed to queue backlog snapshot", "err", err)
+			return
+		}
+	}
+	if _, err := s.backlog.Flush(); err != nil {
+		s.log.Error("Failed to write backlog snapshot", "err", err)
+		return
+	}
+	s.log.Debug("Wrote backlog snapshot", "open", counts[[2]string{"all", ""}])
+}
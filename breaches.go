@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	notify "itop-sla-exporter/internal/notify"
+)
+
+// breachCheck is one compliance of a ticket document watched for breaches
+type breachCheck struct {
+	metric     string // TTO or TTR
+	variant    string // raw, business_hour or 24bh
+	compliance string
+	remaining  *float64 // business-hour time left, nil when unknown
+}
+
+// breachChecks lists the compliances of a document
+func breachChecks(doc ESTicket) []breachCheck {
+	return []breachCheck{
+		{"TTO", "raw", doc.SLAComplianceResponseRaw, nil},
+		{"TTO", "business_hour", doc.SLAComplianceResponseBusinessHour, doc.TTORemainingSeconds},
+		{"TTO", "24bh", doc.SLAComplianceResponse24BH, nil},
+		{"TTR", "raw", doc.SLAComplianceResolveRaw, nil},
+		{"TTR", "business_hour", doc.SLAComplianceResolveBusinessHour, doc.TTRRemainingSeconds},
+		{"TTR", "24bh", doc.SLAComplianceResolve24BH, nil},
+	}
+}
+
+// checkBreaches notifies (notify.breaches) the compliances of a ticket that
+// became overdue or at_risk, each once. Until the first cycle is over the
+// breaches are only recorded, so those already in the index when the
+// synchronizer starts without a state file are not notified.
+func (s *syncer) checkBreaches(key string, doc ESTicket) {
+	if s.notifier == nil || !s.cfg.Notify.Breaches || doc.Deleted {
+		return
+	}
+	sent := s.breaches[key]
+	for _, c := range breachChecks(doc) {
+		if c.compliance != "overdue" && c.compliance != "at_risk" {
+			continue
+		}
+		id := c.metric + "_" + c.variant + ":" + c.compliance
+		if contains(sent, id) {
+			continue
+		}
+		sent = append(sent, id)
+		if s.breachesReady {
+			s.notify(breachMessage(doc, c))
+		}
+	}
+	if len(sent) > 0 {
+		s.breaches[key] = sent
+	}
+}
+
+// breachMessage describes a breach or an at-risk ticket
+func breachMessage(doc ESTicket, c breachCheck) notify.Message {
+	event, subject, text := "breach", "SLA breach", fmt.Sprintf("%s missed its %s target (%s)", doc.Ref, c.metric, c.variant)
+	if c.compliance == "at_risk" {
+		event, subject, text = "at_risk", "SLA at risk", fmt.Sprintf("%s is at risk of missing its %s target (%s)", doc.Ref, c.metric, c.variant)
+	}
+	fields := map[string]string{
+		"ref": doc.Ref, "title": doc.Title, "class": doc.Class, "priority": doc.Priority,
+		"team": doc.Team, "agent": doc.Agent, "metric": c.metric, "variant": c.variant,
+	}
+	if c.remaining != nil {
+		fields["remaining"] = (time.Duration(*c.remaining) * time.Second).String()
+	}
+	return notify.Message{Event: event, Subject: fmt.Sprintf("%s: %s %s - %s", subject, doc.Ref, c.metric, doc.Title), Text: text, Fields: fields}
+}
+
+// pruneBreaches drops the notified breaches of tickets not seen in a
+// complete full fetch
+func (s *syncer) pruneBreaches(seen map[string]bool) {
+	for key := range s.breaches {
+		if !seen[key] {
+			delete(s.breaches, key)
+		}
+	}
+}
+
+func contains(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
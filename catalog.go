@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	itop "itop-sla-exporter/internal/itop"
+)
+
+// serviceDoc is a document of the service catalog index (elastic.services)
+type serviceDoc struct {
+	SyncedAt      time.Time `json:"synced_at"`
+	ID            string    `json:"id"`
+	Class         string    `json:"class"` // Service or ServiceSubcategory
+	Name          string    `json:"name"`
+	Description   string    `json:"description,omitempty" es:"text"`
+	Status        string    `json:"status"`
+	OrgID         string    `json:"org_id"`
+	OrgName       string    `json:"org_name"`
+	ServiceFamily string    `json:"servicefamily_name,omitempty"`
+	ServiceID     string    `json:"service_id,omitempty"` // parent service of a subcategory
+	ServiceName   string    `json:"service_name,omitempty"`
+	RequestType   string    `json:"request_type,omitempty"`
+}
+
+// newServicesSink creates the writer of the service catalog index, nil when
+// elastic.services is off
+func newServicesSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.Services()
+	if !ok {
+		return nil, nil
+	}
+	return newSideSink(cfg, conf, "es_services", reflect.TypeOf(serviceDoc{}), writer)
+}
+
+// syncServices writes the service catalog, then removes the entries gone
+// from iTop: those not rewritten by this sync
+func (s *syncer) syncServices() {
+	if s.services == nil {
+		return
+	}
+	items, err := s.itop.FetchCatalog()
+	if err != nil {
+		s.log.Error("Failed to fetch the service catalog from iTop", "err", err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, it := range items {
+		doc := serviceDoc{
+			SyncedAt: now, ID: it.ID, Class: it.Class, Name: it.Name, Description: it.Description, Status: it.Status,
+			OrgID: it.OrgID, OrgName: it.OrgName, ServiceFamily: it.ServiceFamily,
+			ServiceID: it.ServiceID, ServiceName: it.ServiceName, RequestType: it.RequestType,
+		}
+		if err := s.services.Upsert("", it.Class+"-"+it.ID, doc); err != nil {
+			s.log.Error("Failed to queue service catalog entry", "class", it.Class, "id", it.ID, "err", err)
+			return
+		}
+	}
+	n, err := replaceSideDocs(s.services, now)
+	if err != nil {
+		s.log.Error("Failed to write the service catalog", "err", err)
+		return
+	}
+	s.log.Info("Synced service catalog", "entries", len(items), "removed", n)
+}
+
+// replaceSideDocs flushes the documents just queued on a snapshot index
+// (catalog, teams, persons), then removes those not rewritten since now
+func replaceSideDocs(w sink, now time.Time) (int, error) {
+	if _, err := w.Flush(); err != nil {
+		return 0, err
+	}
+	side, ok := w.(*esSink)
+	if !ok {
+		return 0, nil // dry run
+	}
+	n, err := side.client.DeleteByQuery(map[string]interface{}{
+		"range": map[string]interface{}{"synced_at": map[string]interface{}{"lt": now.Format(time.RFC3339Nano)}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("remove stale documents: %w", err)
+	}
+	return n, nil
+}
+
+// sltDoc is a document of the SLT index (elastic.slt): one version of an
+// SLT as linked to an SLA. A changed target is written as a new document,
+// so superseded versions stay behind with the synced_at of the last sync
+// that saw them.
+type sltDoc struct {
+	SyncedAt      time.Time `json:"synced_at"`
+	Version       string    `json:"version"` // hash of the target
+	SLTID         string    `json:"slt_id"`
+	SLTName       string    `json:"slt_name"`
+	SLAID         string    `json:"sla_id,omitempty"`
+	SLAName       string    `json:"sla_name,omitempty"`
+	Priority      string    `json:"priority"` // label, as on tickets
+	RequestType   string    `json:"request_type"`
+	Metric        string    `json:"metric"`
+	Value         int       `json:"value"`
+	Unit          string    `json:"unit"`
+	TargetSeconds float64   `json:"target_seconds"`
+	Services      []string  `json:"services"` // services whose contracts use the SLA
+
+	// TargetBusinessDays is set instead of target_seconds for targets in
+	// business days
+	TargetBusinessDays int `json:"target_business_days,omitempty"`
+}
+
+// newSLTSink creates the writer of the SLT index, nil when elastic.slt is
+// off
+func newSLTSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.SLT()
+	if !ok {
+		return nil, nil
+	}
+	return newSideSink(cfg, conf, "es_slt", reflect.TypeOf(sltDoc{}), writer)
+}
+
+// syncSLTs writes the current SLA/SLT definitions
+func (s *syncer) syncSLTs() {
+	if s.slts == nil {
+		return
+	}
+	defs, err := s.itop.FetchSLTDefinitions()
+	if err != nil {
+		s.log.Error("Failed to fetch SLT definitions from iTop", "err", err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, d := range defs {
+		target := fmt.Sprintf("%s|%s|%s|%d|%s", d.Priority, d.RequestType, d.Metric, d.Value, d.Unit)
+		sum := sha1.Sum([]byte(target))
+		doc := sltDoc{SyncedAt: now, Version: hex.EncodeToString(sum[:6]), SLTID: d.SLTID, SLTName: d.SLTName,
+			SLAID: d.SLAID, SLAName: d.SLAName, Priority: priorityLabel(d.Priority), RequestType: d.RequestType,
+			Metric: d.Metric, Value: d.Value, Unit: d.Unit, TargetSeconds: d.Target.Seconds(), Services: d.Services}
+		if doc.Services == nil {
+			doc.Services = []string{}
+		}
+		if itop.IsBusinessDayUnit(d.Unit) {
+			doc.TargetBusinessDays = d.Value
+		}
+		if err := s.slts.Upsert("", d.SLAID+"-"+d.SLTID+"-"+doc.Version, doc); err != nil {
+			s.log.Error("Failed to queue SLT definition", "slt", d.SLTName, "sla", d.SLAName, "err", err)
+			return
+		}
+	}
+	if _, err := s.slts.Flush(); err != nil {
+		s.log.Error("Failed to write SLT definitions", "err", err)
+		return
+	}
+	s.log.Info("Synced SLT definitions", "definitions", len(defs))
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
+	itop "itop-sla-exporter/internal/itop"
+	notify "itop-sla-exporter/internal/notify"
+)
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: itop-sla-exporter <command> [flags]
+
+Commands:
+  run        sync continuously (default)
+  once       run a single full sync and exit (cron-friendly)
+  backfill   re-sync tickets whose start_date is in --from/--to
+  recalculate  recompute tickets resolved in --from/--to with the current holidays and SLTs
+  validate   check configuration and iTop/Elasticsearch connectivity
+  replay-dlq resend the documents of elastic.dead_letter_file to Elasticsearch
+  reindex    copy elastic.index into a new index with the current mapping and switch the alias
+  flush-slt-cache  empty the SLT cache of the running synchronizer
+
+Run "itop-sla-exporter <command> -h" for command flags.
+`)
+}
+
+// newFlagSet returns a flag set with the -config flag shared by all commands
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "path to YAML config file (default config.yaml if present)")
+	return fs, configPath
+}
+
+// addDryRunFlag registers -dry-run on commands that write to ES
+func addDryRunFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("dry-run", false, "compute and log planned upserts/deletes without writing to Elasticsearch")
+}
+
+// addForceDeletesFlag registers -force-deletes on commands that run the delete phase
+func addForceDeletesFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("force-deletes", false, "delete orphaned documents even above sync.max_delete_ratio")
+}
+
+// addPipelineFlag registers -pipeline on commands working on one pipeline
+func addPipelineFlag(fs *flag.FlagSet) *string {
+	return fs.String("pipeline", "", "name of the pipeline to work on, when pipelines are configured")
+}
+
+// setup loads the config of a pipeline (the top-level config when pipeline
+// is empty) and builds the iTop and ES clients
+func setup(configPath, pipeline string, dryRun bool) (*config.Config, *itop.ITopClient, *es.Client, error) {
+	cfg, err := config.LoadPipeline(configPath, pipeline)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if pipeline == "" && len(cfg.Pipelines) > 0 {
+		return nil, nil, nil, fmt.Errorf("pipelines are configured: select one with -pipeline")
+	}
+	setupLogging(cfg.Log, cfg.Debug)
+	if dryRun {
+		cfg.Sync.DryRun = true
+	}
+	if cfg.Sync.DryRun {
+		slog.Info("Dry-run mode: no documents will be written to Elasticsearch")
+	}
+	esClient, err := es.NewClient(cfg.Elastic, cfg.Retry)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	itopClient, err := itop.NewClient(cfg.ITop, cfg.Retry, cfg.Location())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, itopClient, esClient, nil
+}
+
+// setupPipelines runs setup for every pipeline, or for the top-level config
+// when none is configured
+func setupPipelines(configPath string, dryRun bool) ([]*config.Config, []*itop.ITopClient, []*es.Client, error) {
+	cfgs, err := config.LoadPipelines(configPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	var itopClients []*itop.ITopClient
+	var esClients []*es.Client
+	for _, c := range cfgs {
+		cfg, itopClient, esClient, err := setup(configPath, c.Pipeline, dryRun)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cfgs[len(itopClients)] = cfg
+		itopClients = append(itopClients, itopClient)
+		esClients = append(esClients, esClient)
+	}
+	return cfgs, itopClients, esClients, nil
+}
+
+// bootstrapTemplate creates/updates the index template so dates and keywords get the right types
+func bootstrapTemplate(cfg *config.Config, esClient *es.Client) {
+	if cfg.Elastic.SkipTemplate || cfg.Sync.DryRun || cfg.Output.Type != "elasticsearch" {
+		return
+	}
+	if cfg.Elastic.DataStream {
+		if err := esClient.EnsureLifecyclePolicy(); err != nil {
+			slog.Error("Failed to install the lifecycle policy", "policy", esClient.LifecyclePolicyName(), "err", err)
+		}
+	}
+	templateName := cfg.Elastic.TemplateName
+	if templateName == "" {
+		templateName = esClient.BaseName() + "-template"
+	}
+	if err := esClient.EnsureIndexTemplate(templateName, es.MappingProperties(reflect.TypeOf(ESTicket{}))); err != nil {
+		slog.Error("Failed to bootstrap ES index template", "template", templateName, "err", err)
+	}
+}
+
+// warmCaches pre-fetches every Person's teams when itop.warm_cache is set so
+// the first cycle doesn't look callers up one chunk at a time
+func warmCaches(cfg *config.Config, itopClient *itop.ITopClient) {
+	if !cfg.ITop.WarmCache {
+		return
+	}
+	start := time.Now()
+	n, err := itopClient.WarmPersonTeams(1000)
+	if err != nil {
+		slog.Warn("Failed to warm the person-team cache", "persons", n, "err", err)
+		return
+	}
+	if cfg.ITop.TeamCacheSize > 0 && n > cfg.ITop.TeamCacheSize {
+		slog.Warn("More persons than itop.team_cache_size, part of the warm cache was evicted", "persons", n, "team_cache_size", cfg.ITop.TeamCacheSize)
+	}
+	slog.Info("Warmed the person-team cache", "persons", n, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// refreshSLTCache re-fetches the cached SLT lookups every
+// itop.slt_refresh_interval
+func refreshSLTCache(interval time.Duration, itopClient *itop.ITopClient) {
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		n, err := itopClient.RefreshSLTCache()
+		if err != nil {
+			slog.Warn("Failed to refresh part of the SLT cache", "refreshed", n, "err", err)
+			continue
+		}
+		slog.Debug("Refreshed the SLT cache", "lookups", n)
+	}
+}
+
+// runCmd syncs every pipeline continuously, each on its own loop; the
+// endpoints of a pipeline are served under /pipelines/<name>
+func runCmd(args []string) error {
+	fs, configPath := newFlagSet("run")
+	dryRun := addDryRunFlag(fs)
+	forceDeletes := addForceDeletesFlag(fs)
+	fs.Parse(args)
+	cfgs, itopClients, esClients, err := setupPipelines(*configPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	var syncers []*syncer
+	for i, cfg := range cfgs {
+		itopClient, esClient := itopClients[i], esClients[i]
+		cfg.Sync.ForceDeletes = cfg.Sync.ForceDeletes || *forceDeletes
+		bootstrapTemplate(cfg, esClient)
+		warmCaches(cfg, itopClient)
+
+		s, err := newSyncer(cfg, itopClient, esClient)
+		if err != nil {
+			return pipelineError(cfg, err)
+		}
+		s.notifier = notify.New(cfg.Notify, cfg.Retry, cfg.Sync.DryRun)
+		if cfg.Leader.Enabled && !cfg.Sync.DryRun {
+			if s.leader, err = newLeaderElection(cfg, esClient); err != nil {
+				return pipelineError(cfg, err)
+			}
+			go s.leader.campaign()
+		}
+		// Refresh holidays in the background; reload the config on SIGHUP
+		go s.calendar.watch()
+		go refreshSLTCache(cfg.ITop.SLTRefreshInterval, itopClient)
+		go s.watchConfig(*configPath, func(c *config.Config) {
+			c.Sync.DryRun = c.Sync.DryRun || *dryRun
+			c.Sync.ForceDeletes = c.Sync.ForceDeletes || *forceDeletes
+		})
+		syncers = append(syncers, s)
+	}
+	routes := syncers[0].routes()
+	if len(cfgs[0].Pipelines) > 0 {
+		routes = map[string]http.Handler{"/readyz": pipelinesReadyHandler(syncers)}
+		for _, s := range syncers {
+			prefix := "/pipelines/" + s.cfg.Pipeline
+			for pattern, h := range s.routes() {
+				routes[prefix+pattern] = http.StripPrefix(prefix, h)
+			}
+		}
+	}
+	startHTTPServer(cfgs[0].HTTP, routes)
+	for _, s := range syncers {
+		go s.run()
+	}
+	select {} // block forever
+}
+
+// pipelineError names the pipeline an error is about, if any
+func pipelineError(cfg *config.Config, err error) error {
+	if cfg.Pipeline == "" {
+		return err
+	}
+	return fmt.Errorf("pipeline %s: %w", cfg.Pipeline, err)
+}
+
+func onceCmd(args []string) error {
+	fs, configPath := newFlagSet("once")
+	dryRun := addDryRunFlag(fs)
+	forceDeletes := addForceDeletesFlag(fs)
+	fs.Parse(args)
+	cfgs, itopClients, esClients, err := setupPipelines(*configPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	// One pipeline after the other
+	for i, cfg := range cfgs {
+		if err := syncOnce(cfg, itopClients[i], esClients[i], *forceDeletes); err != nil {
+			return pipelineError(cfg, err)
+		}
+	}
+	return nil
+}
+
+// syncOnce runs a single cycle of a pipeline
+func syncOnce(cfg *config.Config, itopClient *itop.ITopClient, esClient *es.Client, forceDeletes bool) error {
+	cfg.Sync.ForceDeletes = cfg.Sync.ForceDeletes || forceDeletes
+	bootstrapTemplate(cfg, esClient)
+	warmCaches(cfg, itopClient)
+
+	s, err := newSyncer(cfg, itopClient, esClient)
+	if err != nil {
+		return err
+	}
+	s.notifier = notify.New(cfg.Notify, cfg.Retry, cfg.Sync.DryRun)
+	defer s.notifier.Close()
+	s.cycle()
+	return s.close()
+}
+
+func backfillCmd(args []string) error {
+	fs, configPath := newFlagSet("backfill")
+	dryRun := addDryRunFlag(fs)
+	pipeline := addPipelineFlag(fs)
+	fromStr := fs.String("from", "", "start of start_date range, YYYY-MM-DD (inclusive)")
+	toStr := fs.String("to", "", "end of start_date range, YYYY-MM-DD (exclusive, default now)")
+	fs.Parse(args)
+	cfg, itopClient, esClient, err := setup(*configPath, *pipeline, *dryRun)
+	if err != nil {
+		return err
+	}
+	from, to, err := parseDateRange("backfill", *fromStr, *toStr, cfg.Location())
+	if err != nil {
+		return err
+	}
+	bootstrapTemplate(cfg, esClient)
+	warmCaches(cfg, itopClient)
+
+	s, err := newSyncer(cfg, itopClient, esClient)
+	if err != nil {
+		return err
+	}
+	s.backfill(from, to)
+	return s.close()
+}
+
+func recalculateCmd(args []string) error {
+	fs, configPath := newFlagSet("recalculate")
+	dryRun := addDryRunFlag(fs)
+	pipeline := addPipelineFlag(fs)
+	fromStr := fs.String("from", "", "start of resolution_date range, YYYY-MM-DD (inclusive)")
+	toStr := fs.String("to", "", "end of resolution_date range, YYYY-MM-DD (exclusive, default now)")
+	fs.Parse(args)
+	cfg, itopClient, esClient, err := setup(*configPath, *pipeline, *dryRun)
+	if err != nil {
+		return err
+	}
+	from, to, err := parseDateRange("recalculate", *fromStr, *toStr, cfg.Location())
+	if err != nil {
+		return err
+	}
+	bootstrapTemplate(cfg, esClient)
+	warmCaches(cfg, itopClient)
+
+	s, err := newSyncer(cfg, itopClient, esClient)
+	if err != nil {
+		return err
+	}
+	s.recalculate(from, to)
+	return s.close()
+}
+
+// parseDateRange parses the --from (required) and --to (default now) flags
+// of a command
+func parseDateRange(cmd, fromStr, toStr string, loc *time.Location) (time.Time, time.Time, error) {
+	if fromStr == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s: --from is required", cmd)
+	}
+	from, err := time.ParseInLocation("2006-01-02", fromStr, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s: invalid --from: %w", cmd, err)
+	}
+	to := time.Now().In(loc)
+	if toStr != "" {
+		if to, err = time.ParseInLocation("2006-01-02", toStr, loc); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%s: invalid --to: %w", cmd, err)
+		}
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s: --to must be after --from", cmd)
+	}
+	return from, to, nil
+}
+
+func validateCmd(args []string) error {
+	fs, configPath := newFlagSet("validate")
+	pipeline := addPipelineFlag(fs)
+	fs.Parse(args)
+	cfg, itopClient, esClient, err := setup(*configPath, *pipeline, false)
+	if err != nil {
+		return err
+	}
+	fmt.Println("config: OK")
+	failed := false
+	if err := itopClient.CheckCredentials(); err != nil {
+		fmt.Printf("iTop (%s): FAILED: %v\n", cfg.ITop.URL, err)
+		failed = true
+	} else {
+		fmt.Printf("iTop (%s): OK\n", cfg.ITop.URL)
+	}
+	if cfg.Output.Type == "elasticsearch" {
+		failed = !checkElastic("Elasticsearch", esClient) || failed
+	}
+	if conf, ok := cfg.Secondary(); ok {
+		secondary, err := es.NewClient(conf, cfg.Retry)
+		if err != nil {
+			return err
+		}
+		failed = !checkElastic("Secondary Elasticsearch", secondary) || failed
+	}
+	if failed {
+		return fmt.Errorf("validation failed")
+	}
+	return nil
+}
+
+// checkElastic prints whether a cluster answers and matches elastic.flavor
+func checkElastic(name string, esClient *es.Client) bool {
+	conf := esClient.Config
+	dist, version, err := esClient.Info()
+	switch {
+	case err != nil:
+		fmt.Printf("%s (%s): FAILED: %v\n", name, conf.URL, err)
+	case dist != conf.Flavor:
+		fmt.Printf("%s (%s): FAILED: cluster is %s %s but elastic.flavor is %s\n", name, conf.URL, dist, version, conf.Flavor)
+	default:
+		fmt.Printf("%s (%s): OK (%s %s)\n", name, conf.URL, dist, version)
+		return true
+	}
+	return false
+}
+
+func replayDLQCmd(args []string) error {
+	fs, configPath := newFlagSet("replay-dlq")
+	pipeline := addPipelineFlag(fs)
+	fs.Parse(args)
+	cfg, _, esClient, err := setup(*configPath, *pipeline, false)
+	if err != nil {
+		return err
+	}
+	path := cfg.Elastic.DeadLetterFile
+	if path == "" {
+		return fmt.Errorf("replay-dlq: elastic.dead_letter_file is not configured")
+	}
+	letters, err := es.ReadDeadLetters(path)
+	if os.IsNotExist(err) || (err == nil && len(letters) == 0) {
+		fmt.Println("no dead letters to replay")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("replay-dlq: %w", err)
+	}
+	// Move the file aside: operations rejected again are appended to a fresh one
+	backup := path + ".replay"
+	if err := os.Rename(path, backup); err != nil {
+		return fmt.Errorf("replay-dlq: %w", err)
+	}
+	// Send directly, the queue file belongs to the running syncer
+	esClient.Config.QueueFile = ""
+	w, err := es.NewBulkWriter(esClient)
+	if err != nil {
+		return err
+	}
+	for _, dl := range letters {
+		if err := w.Replay(dl); err != nil {
+			w.Close()
+			return fmt.Errorf("replay-dlq: %w (dead letters kept in %s)", err, backup)
+		}
+	}
+	res, err := w.Flush()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("replay-dlq: %w (dead letters kept in %s)", err, backup)
+	}
+	os.Remove(backup)
+	fmt.Printf("replayed %d dead letters: %d written, %d rejected again\n", len(letters), res.Indexed+res.Updated+res.Deleted, len(res.Errors))
+	return nil
+}
+
+// flushSLTCacheCmd asks the running synchronizer (its HTTP server) to empty
+// its SLT cache
+func flushSLTCacheCmd(args []string) error {
+	fs, configPath := newFlagSet("flush-slt-cache")
+	url := fs.String("url", "", "base URL of the running synchronizer (default from http.listen_addr)")
+	pipeline := addPipelineFlag(fs)
+	fs.Parse(args)
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if cfg.HTTP.AdminToken == "" {
+		return fmt.Errorf("flush-slt-cache: http.admin_token is not set, the admin endpoints are off")
+	}
+	base := *url
+	if base == "" {
+		addr := cfg.HTTP.ListenAddr
+		if addr == "" || addr == "off" {
+			return fmt.Errorf("flush-slt-cache: http.listen_addr is off, pass -url")
+		}
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		base = "http://" + addr
+	}
+	path := "/sync/slt-cache"
+	if *pipeline != "" {
+		path = "/pipelines/" + *pipeline + path
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(base, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.HTTP.AdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("flush-slt-cache: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("flush-slt-cache: HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+	return nil
+}
+
+func reindexCmd(args []string) error {
+	fs, configPath := newFlagSet("reindex")
+	replaceIndex := fs.Bool("replace-index", false, "elastic.index is a concrete index: delete it and create an alias of that name")
+	deleteOld := fs.Bool("delete-old", false, "delete the previous indices once the alias is switched")
+	pipeline := addPipelineFlag(fs)
+	fs.Parse(args)
+	cfg, _, esClient, err := setup(*configPath, *pipeline, false)
+	if err != nil {
+		return err
+	}
+	if esClient.Templated() || cfg.Elastic.DataStream {
+		return fmt.Errorf("reindex: needs a plain elastic.index, not a templated index or data stream")
+	}
+	alias := cfg.Elastic.Index
+	old, isAlias, err := esClient.ResolveAlias(alias)
+	if err != nil {
+		return fmt.Errorf("reindex: %w", err)
+	}
+	if !isAlias && !*replaceIndex {
+		return fmt.Errorf("reindex: %s is not an alias; run with -replace-index to turn it into one (the index is deleted once copied)", alias)
+	}
+	target := alias + "-" + time.Now().UTC().Format("20060102150405")
+	if err := esClient.CreateIndex(target, es.MappingProperties(reflect.TypeOf(ESTicket{}))); err != nil {
+		return fmt.Errorf("reindex: create %s: %w", target, err)
+	}
+	start := time.Now()
+	slog.Info("Copying documents", "from", alias, "to", target)
+	copied, err := esClient.Reindex(alias, target, nil)
+	if err != nil {
+		return fmt.Errorf("reindex: copy to %s: %w", target, err)
+	}
+	// Catch up with tickets edited in iTop during the copy. last_update is
+	// iTop's modification time, not the write time: documents the running
+	// syncer rewrote without an iTop edit (SLT or holiday recalculations, age
+	// refreshes, soft deletes) are not caught up here but by its next ES
+	// reconciliation (sync.es_reconcile_interval) and age refresh
+	since := start.Add(-5 * time.Minute).UTC().Format(time.RFC3339)
+	caught, err := esClient.Reindex(alias, target, map[string]interface{}{
+		"range": map[string]interface{}{"last_update": map[string]interface{}{"gte": since}},
+	})
+	if err != nil {
+		return fmt.Errorf("reindex: catch-up copy to %s: %w", target, err)
+	}
+	if err := esClient.SwapAlias(alias, target, old, !isAlias); err != nil {
+		return fmt.Errorf("reindex: switch alias %s to %s: %w", alias, target, err)
+	}
+	fmt.Printf("reindexed %d documents (+%d edited in iTop during the copy) into %s; alias %s now points to it\n", copied, caught, target, alias)
+	if *deleteOld {
+		for _, index := range old {
+			if err := esClient.DeleteIndex(index); err != nil {
+				return fmt.Errorf("reindex: delete %s: %w", index, err)
+			}
+			fmt.Printf("deleted %s\n", index)
+		}
+	}
+	return nil
+}
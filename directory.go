@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+)
+
+// teamDoc is a document of the team index (elastic.teams)
+type teamDoc struct {
+	SyncedAt    time.Time `json:"synced_at"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Email       string    `json:"email,omitempty"`
+	Status      string    `json:"status"`
+	OrgID       string    `json:"org_id"`
+	OrgName     string    `json:"org_name"`
+	MemberIDs   []string  `json:"member_ids"`
+	Members     []string  `json:"members"`
+	MemberCount int       `json:"member_count"`
+}
+
+// personDoc is a document of the person index (elastic.persons)
+type personDoc struct {
+	SyncedAt  time.Time `json:"synced_at"`
+	ID        string    `json:"id"`
+	Name      string    `json:"name"` // friendlyname, as agent_id_friendlyname on tickets
+	FirstName string    `json:"first_name,omitempty"`
+	LastName  string    `json:"last_name,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Function  string    `json:"function,omitempty"`
+	Status    string    `json:"status"`
+	OrgID     string    `json:"org_id"`
+	OrgName   string    `json:"org_name"`
+	Teams     []string  `json:"teams"`
+	TeamCount int       `json:"team_count"`
+}
+
+// newTeamsSink creates the writer of the team index, nil when elastic.teams
+// is off
+func newTeamsSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.Teams()
+	if !ok {
+		return nil, nil
+	}
+	return newSideSink(cfg, conf, "es_teams", reflect.TypeOf(teamDoc{}), writer)
+}
+
+// newPersonsSink creates the writer of the person index, nil when
+// elastic.persons is off
+func newPersonsSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.Persons()
+	if !ok {
+		return nil, nil
+	}
+	return newSideSink(cfg, conf, "es_persons", reflect.TypeOf(personDoc{}), writer)
+}
+
+// syncTeams writes every team, then removes the teams gone from iTop
+func (s *syncer) syncTeams() {
+	if s.teams == nil {
+		return
+	}
+	teams, err := s.itop.FetchTeams()
+	if err != nil {
+		s.log.Error("Failed to fetch teams from iTop", "err", err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, t := range teams {
+		doc := teamDoc{SyncedAt: now, ID: t.ID, Name: t.Name, Email: t.Email, Status: t.Status, OrgID: t.OrgID, OrgName: t.OrgName,
+			MemberIDs: []string{}, Members: []string{}, MemberCount: len(t.Members)}
+		for _, m := range t.Members {
+			doc.MemberIDs = append(doc.MemberIDs, m.ID)
+			doc.Members = append(doc.Members, m.Name)
+		}
+		if err := s.teams.Upsert("", t.ID, doc); err != nil {
+			s.log.Error("Failed to queue team", "id", t.ID, "err", err)
+			return
+		}
+	}
+	n, err := replaceSideDocs(s.teams, now)
+	if err != nil {
+		s.log.Error("Failed to write teams", "err", err)
+		return
+	}
+	s.log.Info("Synced teams", "teams", len(teams), "removed", n)
+}
+
+// syncPersons writes every person, then removes the persons gone from iTop
+func (s *syncer) syncPersons() {
+	if s.persons == nil {
+		return
+	}
+	persons, err := s.itop.FetchPersons()
+	if err != nil {
+		s.log.Error("Failed to fetch persons from iTop", "err", err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, p := range persons {
+		doc := personDoc{SyncedAt: now, ID: p.ID, Name: p.Name, FirstName: p.FirstName, LastName: p.LastName, Email: p.Email,
+			Function: p.Function, Status: p.Status, OrgID: p.OrgID, OrgName: p.OrgName, Teams: p.Teams, TeamCount: len(p.Teams)}
+		if doc.Teams == nil {
+			doc.Teams = []string{}
+		}
+		if err := s.persons.Upsert("", p.ID, doc); err != nil {
+			s.log.Error("Failed to queue person", "id", p.ID, "err", err)
+			return
+		}
+	}
+	n, err := replaceSideDocs(s.persons, now)
+	if err != nil {
+		s.log.Error("Failed to write persons", "err", err)
+		return
+	}
+	s.log.Info("Synced persons", "persons", len(persons), "removed", n)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+
+	es "itop-sla-exporter/internal/es"
+)
+
+// dryRunWriter logs planned writes (and optionally appends them as NDJSON
+// to a file) without touching the output; documents are still listed from it
+type dryRunWriter struct {
+	mu      sync.Mutex
+	out     *os.File
+	list    func() ([]ESTicket, error)
+	upserts int
+	updates int
+	deletes int
+}
+
+func newDryRunWriter(outputPath string, list func() ([]ESTicket, error)) (*dryRunWriter, error) {
+	w := &dryRunWriter{list: list}
+	if outputPath != "" {
+		f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w.out = f
+	}
+	return w, nil
+}
+
+func (w *dryRunWriter) Upsert(index, id string, doc interface{}) error {
+	ref := ""
+	if t, ok := doc.(ESTicket); ok {
+		ref = t.Class + " " + t.Ref
+	}
+	slog.Info("[dry-run] would upsert", "index", index, "id", id, "ticket_ref", ref)
+	return w.record(map[string]interface{}{"action": "upsert", "index": index, "id": id, "doc": doc})
+}
+
+func (w *dryRunWriter) Update(index, id string, partial interface{}) error {
+	slog.Info("[dry-run] would update", "index", index, "id", id)
+	return w.record(map[string]interface{}{"action": "update", "index": index, "id": id, "doc": partial})
+}
+
+func (w *dryRunWriter) Delete(index, id string) error {
+	slog.Info("[dry-run] would delete", "index", index, "id", id)
+	return w.record(map[string]interface{}{"action": "delete", "index": index, "id": id})
+}
+
+func (w *dryRunWriter) List() ([]ESTicket, error) {
+	return w.list()
+}
+
+func (w *dryRunWriter) record(op map[string]interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch op["action"] {
+	case "delete":
+		w.deletes++
+	case "update":
+		w.updates++
+	default:
+		w.upserts++
+	}
+	if w.out == nil {
+		return nil
+	}
+	line, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	_, err = w.out.Write(append(line, '\n'))
+	return err
+}
+
+// Flush logs the number of planned writes since the last flush
+func (w *dryRunWriter) Flush() (es.BulkResult, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.upserts > 0 || w.updates > 0 || w.deletes > 0 {
+		slog.Info("[dry-run] cycle planned writes", "upserts", w.upserts, "updates", w.updates, "deletes", w.deletes)
+	}
+	w.upserts, w.updates, w.deletes = 0, 0, 0
+	return es.BulkResult{}, nil
+}
+
+func (w *dryRunWriter) Close() error {
+	w.Flush()
+	if w.out != nil {
+		return w.out.Close()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"strconv"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
+)
+
+// ticketEvent is a document of the history index (elastic.history): one
+// state change of a ticket as seen by the synchronizer. Events are never
+// updated; their id is derived from the ticket and its last_update so a
+// change written twice (e.g. after a restart) stays one event.
+type ticketEvent struct {
+	Timestamp time.Time  `json:"@timestamp"`           // when the change was synced
+	ChangedAt *time.Time `json:"changed_at,omitempty"` // the ticket's last_update in iTop
+	Event     string     `json:"event"`                // created, changed or deleted
+	TicketKey string     `json:"ticket_key"`
+	ID        string     `json:"id"`
+	Ref       string     `json:"ref"`
+	Class     string     `json:"class"`
+
+	FromStatus string `json:"from_status,omitempty"`
+	ToStatus   string `json:"to_status,omitempty"`
+	FromAgent  string `json:"from_agent,omitempty"`
+	ToAgent    string `json:"to_agent,omitempty"`
+	FromTeam   string `json:"from_team,omitempty"`
+	ToTeam     string `json:"to_team,omitempty"`
+
+	StatusChanged bool `json:"status_changed"`
+	Reassigned    bool `json:"reassigned"` // agent or team changed
+}
+
+// newEventSink creates the writer of the history index, nil when
+// elastic.history is off
+func newEventSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.History()
+	if !ok {
+		return nil, nil
+	}
+	return newSideSink(cfg, conf, "es_history", reflect.TypeOf(ticketEvent{}), writer)
+}
+
+// newSideSink creates the writer of an append-only index kept next to the
+// tickets (history, audit), with its own template and metrics target. Dry
+// runs list its documents with the other writes.
+func newSideSink(cfg *config.Config, conf config.ElasticConfig, target string, doc reflect.Type, writer sink) (sink, error) {
+	if cfg.Sync.DryRun {
+		return writer, nil
+	}
+	client, err := es.NewClient(conf, cfg.Retry)
+	if err != nil {
+		return nil, err
+	}
+	client.SetTarget(target)
+	if !cfg.Elastic.SkipTemplate {
+		name := client.BaseName() + "-template"
+		if err := client.EnsureIndexTemplate(name, es.MappingProperties(doc)); err != nil {
+			slog.Error("Failed to bootstrap ES index template", "template", name, "err", err)
+		}
+	}
+	w, err := es.NewBulkWriter(client)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Writing side index", "index", conf.Index, "target", target)
+	return &esSink{BulkWriter: w, client: client}, nil
+}
+
+// recordChange queues an event when a ticket appears or its status, agent
+// or team differ from the last version written. A previous version whose
+// state is unknown (read back from an index without those fields) only
+// becomes the baseline.
+func (s *syncer) recordChange(key string, old shadowDoc, known bool, doc ESTicket) {
+	if s.events == nil {
+		return
+	}
+	ev := ticketEvent{
+		ChangedAt: doc.LastUpdate, TicketKey: key, ID: doc.ID, Ref: doc.Ref, Class: doc.Class,
+		ToStatus: doc.Status, ToAgent: doc.Agent, ToTeam: doc.Team,
+	}
+	switch {
+	case !known || old.Deleted:
+		ev.Event = "created"
+	case old.Status == "" && old.Agent == "" && old.Team == "":
+		return
+	default:
+		ev.FromStatus, ev.FromAgent, ev.FromTeam = old.Status, old.Agent, old.Team
+		ev.StatusChanged = old.Status != doc.Status
+		ev.Reassigned = old.Agent != doc.Agent || old.Team != doc.Team
+		if !ev.StatusChanged && !ev.Reassigned {
+			return
+		}
+		ev.Event = "changed"
+	}
+	s.queueEvent(ev)
+}
+
+// recordDeletion queues the event of a ticket gone from iTop
+func (s *syncer) recordDeletion(key string, old shadowDoc) {
+	if s.events == nil {
+		return
+	}
+	s.queueEvent(ticketEvent{
+		Event: "deleted", TicketKey: key, ID: old.ID, Ref: old.Ref, Class: old.Class,
+		FromStatus: old.Status, FromAgent: old.Agent, FromTeam: old.Team,
+	})
+}
+
+func (s *syncer) queueEvent(ev ticketEvent) {
+	ev.Timestamp = time.Now().UTC()
+	at := ev.Timestamp
+	if ev.ChangedAt != nil {
+		at = *ev.ChangedAt
+	}
+	id := ev.TicketKey + "-" + ev.Event + "-" + strconv.FormatInt(at.UnixMilli(), 10)
+	if err := s.events.Upsert("", id, ev); err != nil {
+		s.log.Error("Failed to queue ticket history event", "id", ev.TicketKey, "ticket_ref", ev.Ref, "err", err)
+	}
+}
+
+// flushEvents writes the queued history events
+func (s *syncer) flushEvents() {
+	if s.events == nil {
+		return
+	}
+	if _, err := s.events.Flush(); err != nil {
+		s.log.Error("Failed to write ticket history", "err", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"itop-sla-exporter/internal/metrics"
+)
+
+// SLA gauges published when EXPORTER_MODE=true, recomputed on every full sync
+var (
+	openTicketsGauge = metrics.NewGaugeVec("itop_sla_open_tickets", "Open (not resolved/closed) tickets.", "class", "priority", "team")
+	complianceGauge  = metrics.NewGaugeVec("itop_sla_compliance_tickets", "Tickets per SLA compliance state.", "class", "variant", "metric", "state")
+	mttaGauge        = metrics.NewGaugeVec("itop_sla_mtta_seconds", "Mean time to acknowledge (assignment) of tickets.", "class", "priority", "variant")
+	mttrGauge        = metrics.NewGaugeVec("itop_sla_mttr_seconds", "Mean time to resolve of resolved/closed tickets.", "class", "priority", "variant")
+)
+
+type meanAcc struct {
+	sum   float64
+	count int
+}
+
+func (m *meanAcc) add(v float64) {
+	if v > 0 {
+		m.sum += v
+		m.count++
+	}
+}
+
+// exportSLAMetrics rebuilds the SLA gauges from the mapped tickets of a full sync
+func exportSLAMetrics(tickets []ESTicket) {
+	open := map[[3]string]int{}
+	compliance := map[[4]string]int{}
+	mtta := map[[3]string]*meanAcc{}
+	mttr := map[[3]string]*meanAcc{}
+	acc := func(m map[[3]string]*meanAcc, k [3]string) *meanAcc {
+		if m[k] == nil {
+			m[k] = &meanAcc{}
+		}
+		return m[k]
+	}
+
+	for _, t := range tickets {
+		resolved := t.Status == "resolved" || t.Status == "closed"
+		if !resolved {
+			open[[3]string{t.Class, t.Priority, t.Team}]++
+		}
+		variants := []struct {
+			name              string
+			response, resolve string
+			tto, ttr          float64
+		}{
+			{"raw", t.SLAComplianceResponseRaw, t.SLAComplianceResolveRaw, t.TimeToResponseRaw, t.TimeToResolveRaw},
+			{"business_hour", t.SLAComplianceResponseBusinessHour, t.SLAComplianceResolveBusinessHour, t.TimeToResponseBusinessHr, t.TimeToResolveBusinessHr},
+			{"24bh", t.SLAComplianceResponse24BH, t.SLAComplianceResolve24BH, t.TimeToResponse24BH, t.TimeToResolve24BH},
+		}
+		for _, v := range variants {
+			if v.response != "" {
+				compliance[[4]string{t.Class, v.name, "response", v.response}]++
+			}
+			if v.resolve != "" {
+				compliance[[4]string{t.Class, v.name, "resolve", v.resolve}]++
+			}
+			acc(mtta, [3]string{t.Class, t.Priority, v.name}).add(v.tto)
+			if resolved {
+				acc(mttr, [3]string{t.Class, t.Priority, v.name}).add(v.ttr)
+			}
+		}
+	}
+
+	openTicketsGauge.Reset()
+	for k, n := range open {
+		openTicketsGauge.Set(float64(n), k[0], k[1], k[2])
+	}
+	complianceGauge.Reset()
+	for k, n := range compliance {
+		complianceGauge.Set(float64(n), k[0], k[1], k[2], k[3])
+	}
+	mttaGauge.Reset()
+	for k, m := range mtta {
+		if m.count > 0 {
+			mttaGauge.Set(m.sum/float64(m.count), k[0], k[1], k[2])
+		}
+	}
+	mttrGauge.Reset()
+	for k, m := range mttr {
+		if m.count > 0 {
+			mttrGauge.Set(m.sum/float64(m.count), k[0], k[1], k[2])
+		}
+	}
+}
@@ -3,3 +3,5 @@ module itop-sla-exporter
 go 1.21
 
 require github.com/joho/godotenv v1.5.1
+
+require gopkg.in/yaml.v3 v3.0.1
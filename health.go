@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyCacheTTL bounds how often /readyz probes reach iTop and Elasticsearch
+const readyCacheTTL = 10 * time.Second
+
+// healthHandler serves /healthz: the process is up and serving HTTP
+func healthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// readyHandler serves /readyz: a sync cycle has completed and both iTop and
+// Elasticsearch are reachable. Backend checks are cached for readyCacheTTL.
+func (s *syncer) readyHandler() http.Handler {
+	check := s.readyCheck()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok, last successful sync %s\n", time.Unix(0, s.lastSuccess.Load()).Format(time.RFC3339))
+	})
+}
+
+// pipelinesReadyHandler serves /readyz when pipelines are configured: ready
+// once every pipeline is
+func pipelinesReadyHandler(syncers []*syncer) http.Handler {
+	checks := make([]func() error, len(syncers))
+	for i, s := range syncers {
+		checks[i] = s.readyCheck()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, check := range checks {
+			if err := check(); err != nil {
+				http.Error(w, fmt.Sprintf("pipeline %s: %v", syncers[i].cfg.Pipeline, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		for _, s := range syncers {
+			fmt.Fprintf(w, "%s: ok, last successful sync %s\n", s.cfg.Pipeline, time.Unix(0, s.lastSuccess.Load()).Format(time.RFC3339))
+		}
+	})
+}
+
+// readyCheck returns the readiness check of the syncer, caching backend
+// checks for readyCacheTTL
+func (s *syncer) readyCheck() func() error {
+	var (
+		mu      sync.Mutex
+		checked time.Time
+		lastErr error
+	)
+	return func() error {
+		if s.lastSuccess.Load() == 0 {
+			return errors.New("waiting for the first successful sync")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(checked) >= readyCacheTTL {
+			lastErr = nil
+			if err := s.itop.CheckCredentials(); err != nil {
+				lastErr = fmt.Errorf("iTop: %v", err)
+			} else if s.cfg.Output.Type == "elasticsearch" {
+				if err := s.es.Ping(); err != nil {
+					lastErr = fmt.Errorf("Elasticsearch: %v", err)
+				}
+			}
+			checked = time.Now()
+		}
+		return lastErr
+	}
+}
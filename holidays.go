@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	itop "itop-sla-exporter/internal/itop"
+	utils "itop-sla-exporter/internal/utils"
+)
+
+// holidayYearsBack and holidayYearsAhead bound the years of public
+// holidays fetched and the expansion of recurring iCal events: tickets are
+// rarely measured over older periods
+const (
+	holidayYearsBack  = 5
+	holidayYearsAhead = 1
+)
+
+// holidayCalendar holds the holidays of iTop, of the iCal calendars and of
+// the public holiday API in memory, refreshed in the background; the
+// holiday file is read on each use and applied on top, so edits take effect
+// on the next cycle
+type holidayCalendar struct {
+	itop *itop.ITopClient
+	loc  *time.Location
+	http *http.Client
+
+	mu        sync.RWMutex
+	settings  config.HolidaysConfig // conf as last reloaded
+	itopLines []string              // last successful fetch, kept while iTop is unreachable
+	icalLines map[string][]string   // per calendar, likewise
+	public    map[string]publicHolidays
+}
+
+// publicRetry is the delay before fetching again public holidays whose
+// last fetch failed, when shorter than holidays.public_ttl
+const publicRetry = time.Hour
+
+// publicHolidays are the public holidays of a country and year
+type publicHolidays struct {
+	fetched time.Time // last attempt, successful or not
+	lines   []string
+}
+
+func newHolidayCalendar(conf config.HolidaysConfig, client *itop.ITopClient, loc *time.Location) *holidayCalendar {
+	return &holidayCalendar{settings: conf, itop: client, loc: loc, http: &http.Client{Timeout: 30 * time.Second},
+		icalLines: make(map[string][]string), public: make(map[string]publicHolidays)}
+}
+
+// refresh fetches the holidays of iTop, of the iCal calendars and the
+// public holidays due; a source that fails keeps its previous holidays
+func (c *holidayCalendar) refresh() error {
+	conf := c.conf()
+	var errs []error
+	if conf.FromITop {
+		lines, err := c.itop.FetchHolidays()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			c.mu.Lock()
+			c.itopLines = lines
+			c.mu.Unlock()
+		}
+	}
+	for _, source := range conf.ICal {
+		lines, err := c.fetchICal(source)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+		}
+		if lines == nil {
+			continue // nothing usable: keep the previous holidays
+		}
+		c.mu.Lock()
+		c.icalLines[source] = lines
+		c.mu.Unlock()
+	}
+	if err := c.refreshPublic(conf); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// refreshPublic fetches the public holidays of each country and year not
+// fetched within holidays.public_ttl
+func (c *holidayCalendar) refreshPublic(conf config.HolidaysConfig) error {
+	var errs []error
+	year := time.Now().In(c.loc).Year()
+	for _, country := range conf.Countries {
+		country = strings.ToUpper(country)
+		for y := year - holidayYearsBack; y <= year+holidayYearsAhead; y++ {
+			key := fmt.Sprintf("%s-%d", country, y)
+			c.mu.RLock()
+			cached, ok := c.public[key]
+			c.mu.RUnlock()
+			if ok && time.Since(cached.fetched) < conf.PublicTTL {
+				continue
+			}
+			lines, err := c.fetchPublic(conf.PublicAPI, country, y)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("public holidays %s: %w", key, err))
+				// keep the previous holidays, and retry after publicRetry
+				// rather than on every refresh
+				retry := time.Now().Add(min(publicRetry, conf.PublicTTL) - conf.PublicTTL)
+				c.mu.Lock()
+				c.public[key] = publicHolidays{fetched: retry, lines: cached.lines}
+				c.mu.Unlock()
+				continue
+			}
+			c.mu.Lock()
+			c.public[key] = publicHolidays{fetched: time.Now(), lines: lines}
+			c.mu.Unlock()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fetchPublic reads the national public holidays of a country and year from
+// the Nager.Date API; regional ones (global false) are skipped
+func (c *holidayCalendar) fetchPublic(api, country string, year int) ([]string, error) {
+	resp, err := c.http.Get(fmt.Sprintf("%s/api/v3/PublicHolidays/%d/%s", strings.TrimRight(api, "/"), year, country))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil, fmt.Errorf("unknown country")
+	default:
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var holidays []struct {
+		Date   string `json:"date"`
+		Global bool   `json:"global"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&holidays); err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, h := range holidays {
+		if h.Global {
+			lines = append(lines, h.Date)
+		}
+	}
+	return lines, nil
+}
+
+// fetchICal reads an iCal calendar, from a URL or a file, as holiday lines;
+// an invalid event is reported but does not discard the others
+func (c *holidayCalendar) fetchICal(source string) ([]string, error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := c.http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		body = f
+	}
+	defer body.Close()
+	year := time.Now().In(c.loc).Year()
+	from := time.Date(year-holidayYearsBack, 1, 1, 0, 0, 0, 0, c.loc)
+	to := time.Date(year+holidayYearsAhead+1, 1, 1, 0, 0, 0, 0, c.loc)
+	lines, err := utils.ParseICal(body, c.loc, from, to)
+	if lines == nil && err == nil {
+		lines = []string{} // an empty calendar replaces the previous holidays
+	}
+	return lines, err
+}
+
+// watch refreshes the holidays every holidays.sync_interval; without any
+// source to fetch, it only waits for a reload to add one
+func (c *holidayCalendar) watch() {
+	for {
+		conf := c.conf()
+		if !conf.FromITop && len(conf.ICal) == 0 && len(conf.Countries) == 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(conf.SyncInterval)
+		if err := c.refresh(); err != nil {
+			slog.Error("Failed to fetch holidays", "err", err)
+		}
+	}
+}
+
+func (c *holidayCalendar) conf() config.HolidaysConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.settings
+}
+
+// reconfigure applies reloaded holiday settings; the holidays of a removed
+// source are dropped, those of a new one are fetched by the next refresh
+func (c *holidayCalendar) reconfigure(conf config.HolidaysConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settings = conf
+	if !conf.FromITop {
+		c.itopLines = nil
+	}
+	sources := map[string]bool{}
+	for _, source := range conf.ICal {
+		sources[source] = true
+	}
+	for source := range c.icalLines {
+		if !sources[source] {
+			delete(c.icalLines, source)
+		}
+	}
+	countries := map[string]bool{}
+	for _, cc := range conf.Countries {
+		countries[strings.ToUpper(cc)] = true
+	}
+	for key := range c.public {
+		if country, _, _ := strings.Cut(key, "-"); !countries[country] {
+			delete(c.public, key)
+		}
+	}
+}
+
+// Holidays merges the holidays of iTop, of the iCal calendars and of the
+// public holiday API with the holiday file
+func (c *holidayCalendar) Holidays() utils.Holidays {
+	c.mu.RLock()
+	conf := c.settings
+	lines := append([]string(nil), c.itopLines...)
+	for _, source := range conf.ICal {
+		lines = append(lines, c.icalLines[source]...)
+	}
+	for _, p := range c.public {
+		lines = append(lines, p.lines...)
+	}
+	c.mu.RUnlock()
+	if conf.File != "" {
+		extra, _ := utils.ReadHolidayFile(conf.File) // the file is optional
+		lines = append(lines, extra...)
+	}
+	holidays, err := utils.ParseHolidays(lines)
+	if err != nil {
+		slog.Warn("Invalid holiday", "file", conf.File, "err", err)
+	}
+	return holidays
+}
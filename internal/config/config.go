@@ -0,0 +1,1863 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"itop-sla-exporter/internal/utils"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the full synchronizer configuration. Values are resolved in
+// order: built-in defaults, then the YAML file, then environment variables.
+type Config struct {
+	ITop          ITopConfig          `yaml:"itop"`
+	Elastic       ElasticConfig       `yaml:"elastic"`
+	Sync          SyncConfig          `yaml:"sync"`
+	BusinessHours BusinessHoursConfig `yaml:"business_hours"`
+	Holidays      HolidaysConfig      `yaml:"holidays"`
+	SLA           SLAConfig           `yaml:"sla"`
+	HTTP          HTTPConfig          `yaml:"http"`
+	Log           LogConfig           `yaml:"log"`
+	State         StateConfig         `yaml:"state"`
+	Retry         RetryConfig         `yaml:"retry"`
+	Timezone      string              `yaml:"timezone"`
+	Debug         bool                `yaml:"debug"` // shorthand for log.level: debug
+
+	// ElasticSecondary mirrors every write to a second cluster (e.g. while
+	// migrating); disabled unless its url is set
+	ElasticSecondary SecondaryElasticConfig `yaml:"elastic_secondary"`
+
+	// Output selects where documents go: Elasticsearch, or NDJSON lines
+	Output OutputConfig `yaml:"output"`
+
+	// ReloadInterval is how often the run command checks the config file
+	// for changes (0: only on SIGHUP); see Reload for what is applied
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Notify sends notifications (SLA breaches, sync failures) through
+	// webhooks, Slack, Microsoft Teams or email
+	Notify NotifyConfig `yaml:"notify"`
+
+	// Leader elects one of several replicas to sync, the others standing by
+	Leader LeaderConfig `yaml:"leader"`
+
+	// Shard splits the tickets between replicas of the run command
+	Shard ShardConfig `yaml:"shard"`
+
+	// Source fills the source field of every document, to tell apart the
+	// tickets of several iTop instances; pipelines set it to their name
+	Source string `yaml:"source"`
+
+	// Pipelines syncs several iTop instances from one process, see
+	// PipelineConfig; Pipeline names the one a Config was loaded for
+	Pipelines []PipelineConfig `yaml:"pipelines"`
+	Pipeline  string           `yaml:"-"`
+}
+
+// ITopConfig holds iTop REST API connection info
+type ITopConfig struct {
+	URL          string            `yaml:"url"`
+	User         string            `yaml:"user"`
+	Password     string            `yaml:"password"`
+	Version      string            `yaml:"version"`
+	Classes      []string          `yaml:"classes"`
+	OutputFields map[string]string `yaml:"output_fields"` // per-class output_fields overrides
+	RateLimit    time.Duration     `yaml:"rate_limit"`    // average delay between person lookups
+	RateBurst    int               `yaml:"rate_burst"`    // person lookups allowed back to back
+
+	// TeamCacheTTL and TeamCacheSize bound the person -> teams cache
+	TeamCacheTTL  time.Duration `yaml:"team_cache_ttl"`
+	TeamCacheSize int           `yaml:"team_cache_size"`
+	WarmCache     bool          `yaml:"warm_cache"` // load all Persons' teams at startup
+
+	// CoverageWindows uses the CoverageWindow linked to a ticket's service in
+	// the customer contract for business hours instead of the global window
+	CoverageWindows bool `yaml:"coverage_windows"`
+
+	// OQL overrides the query selecting a class's tickets, e.g. "SELECT
+	// Incident WHERE org_id = 3" to scope the sync to one organization or
+	// time window; incremental, backfill and single-ticket conditions are
+	// ANDed to it. Tickets outside it are deleted from the index like any
+	// ticket gone from iTop.
+	OQL map[string]string `yaml:"oql"`
+
+	// PageSize fetches tickets in pages of that many (core/get limit/page,
+	// iTop 3.0+), handed to mapping as they arrive; 0 fetches each class in
+	// one request. Servers ignoring the parameters return everything at once.
+	PageSize int `yaml:"page_size"`
+
+	// ExtraFields are additional output_fields (e.g. custom vendor_ref,
+	// location_name) requested for every class and copied verbatim into the
+	// document under their own names; fields the document already has win
+	ExtraFields []string `yaml:"extra_fields"`
+
+	// Token authenticates with an iTop application or personal token
+	// (auth_token, iTop 3.0+ with the token login mode enabled) instead of
+	// User/Password
+	Token string `yaml:"token"`
+
+	// RequestTimeout bounds each API call (response included), DialTimeout
+	// the TCP connection. Proxy is the URL of an HTTP(S) proxy; empty uses
+	// HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	DialTimeout    time.Duration `yaml:"dial_timeout"`
+	Proxy          string        `yaml:"proxy"`
+
+	// TLS, as for elastic: CAFile trusts a private CA in addition to the
+	// system pool, CertFile/KeyFile authenticate with a client certificate.
+	// InsecureSkipVerify defaults to true, as the client always skipped
+	// verification before these options existed.
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	// Compression asks iTop for gzipped responses (Accept-Encoding: gzip),
+	// decoded transparently; request bodies stay form-encoded as PHP expects
+	Compression bool `yaml:"compression"`
+
+	// Organizations restricts the sync to the tickets of these
+	// organizations, by name or id (empty syncs all); tickets of other
+	// organizations are never fetched
+	Organizations []string `yaml:"organizations"`
+
+	// ImpactedCIs requests each ticket's functionalcis_list, stored as the
+	// names and ids of its impacted CIs
+	ImpactedCIs bool `yaml:"impacted_cis"`
+
+	// PublicLog requests the public_log of incidents and user requests, to
+	// count its entries, date the last caller and agent updates and find
+	// the first agent reply (first response)
+	PublicLog bool `yaml:"public_log"`
+
+	// SolutionStripHTML turns the solution of tickets into plain text and
+	// SolutionMaxLength truncates it to that many characters (0 = whole)
+	SolutionStripHTML bool `yaml:"solution_strip_html"`
+	SolutionMaxLength int  `yaml:"solution_max_length"`
+
+	// Escalation requests the escalation deadlines of the TTO and TTR
+	// stopwatches and the escalation flag and reason of incidents and user
+	// requests
+	Escalation bool `yaml:"escalation"`
+
+	// TicketLinks requests the parent request, incident, problem and change
+	// of incidents and user requests, and the tickets attached to them
+	TicketLinks bool `yaml:"ticket_links"`
+
+	// SLTCacheTTL is how long an SLT lookup (and coverage window) is reused
+	// before being fetched again (0 = until restart or flush);
+	// SLTRefreshInterval re-fetches every cached SLT in the background
+	// (0 = off), so changes land without a lookup on the sync path
+	SLTCacheTTL        time.Duration `yaml:"slt_cache_ttl"`
+	SLTRefreshInterval time.Duration `yaml:"slt_refresh_interval"`
+
+	// TicketRate and SLTRate limit the ticket fetches (one request per
+	// page) and the SLT and coverage window lookups, in requests per
+	// second, with TicketBurst and SLTBurst allowed back to back (0 =
+	// unlimited); person lookups follow RateLimit and RateBurst
+	TicketRate  float64 `yaml:"ticket_rate"`
+	TicketBurst int     `yaml:"ticket_burst"`
+	SLTRate     float64 `yaml:"slt_rate"`
+	SLTBurst    int     `yaml:"slt_burst"`
+}
+
+// ElasticConfig holds elasticsearch connection info
+type ElasticConfig struct {
+	URL               string        `yaml:"url"`
+	User              string        `yaml:"user"`
+	Password          string        `yaml:"password"`
+	Index             string        `yaml:"index"`
+	TemplateName      string        `yaml:"template_name"`
+	SkipTemplate      bool          `yaml:"skip_template"`
+	BulkSize          int           `yaml:"bulk_size"`
+	BulkFlushInterval time.Duration `yaml:"bulk_flush_interval"`
+
+	// BreakerThreshold consecutive failed requests open the circuit breaker:
+	// ES is then only probed, every BreakerProbeInterval, until it answers
+	// again (0 disables the breaker). Failed writes are buffered either way
+	BreakerThreshold     int           `yaml:"breaker_threshold"`
+	BreakerProbeInterval time.Duration `yaml:"breaker_probe_interval"`
+
+	// QueueFile stages bulk operations on disk until ES acknowledges them, so
+	// writes buffered during an outage survive a restart (empty disables)
+	QueueFile string `yaml:"queue_file"`
+
+	// DeadLetterFile receives operations ES rejects (e.g. mapping errors) as
+	// NDJSON with the error, for the replay-dlq command (empty only counts them)
+	DeadLetterFile string `yaml:"dead_letter_file"`
+
+	// TLS: CAFile trusts a private CA in addition to the system pool,
+	// CertFile/KeyFile authenticate with a client certificate
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	// Flavor is "elasticsearch" or "opensearch". AWSSigV4 signs requests for
+	// Amazon OpenSearch Service (AWSService "es", or "aoss" for Serverless)
+	// with credentials from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or IRSA
+	Flavor     string `yaml:"flavor"`
+	AWSSigV4   bool   `yaml:"aws_sigv4"`
+	AWSRegion  string `yaml:"aws_region"` // default AWS_REGION
+	AWSService string `yaml:"aws_service"`
+
+	// DataStream appends a snapshot of every changed ticket to the data stream
+	// named Index instead of updating documents in place (deletes become
+	// tombstone snapshots). Backing indices follow the lifecycle policy
+	// ILMPolicy (ISM on OpenSearch), installed at startup: rollover after
+	// ILMRolloverMaxAge/ILMRolloverMaxSize, warm after ILMWarmAfter, deleted
+	// after ILMDeleteAfter (empty keeps them)
+	DataStream         bool   `yaml:"data_stream"`
+	ILMPolicy          string `yaml:"ilm_policy"` // default <index>-policy
+	ILMRolloverMaxAge  string `yaml:"ilm_rollover_max_age"`
+	ILMRolloverMaxSize string `yaml:"ilm_rollover_max_size"`
+	ILMWarmAfter       string `yaml:"ilm_warm_after"`
+	ILMDeleteAfter     string `yaml:"ilm_delete_after"`
+
+	// Alias is a read alias over every index Index resolves to when it is
+	// templated ({class}, {yyyy.MM}, ...); searches and deletes by query go
+	// through it, else through the index pattern
+	Alias string `yaml:"alias"`
+
+	// ExternalVersioning writes each ticket with its last_update (epoch ms)
+	// as an external version, so ES refuses writes older than the document
+	// it holds (e.g. from a second replica or a concurrent backfill)
+	ExternalVersioning bool `yaml:"external_versioning"`
+
+	// WriteMode "index" replaces whole documents; "update" merges the
+	// synchronizer's fields into them (_update with doc_as_upsert), keeping
+	// fields added by hand such as postmortem links
+	WriteMode string `yaml:"write_mode"`
+
+	// Connection pool: MaxIdleConns keep-alive connections per node,
+	// RequestTimeout bounds each request (0 waits forever) and Compression
+	// gzips request bodies (responses are always accepted gzipped)
+	MaxIdleConns   int           `yaml:"max_idle_conns"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	Compression    bool          `yaml:"compression"`
+
+	// URL may list several nodes separated by commas: requests rotate over
+	// them and skip unreachable ones. Sniff replaces the list with the nodes
+	// the cluster publishes, refreshed every SniffInterval (not for clusters
+	// behind a load balancer or proxy)
+	Sniff         bool          `yaml:"sniff"`
+	SniffInterval time.Duration `yaml:"sniff_interval"`
+
+	// History appends an event to HistoryIndex (default <index>-history)
+	// whenever a ticket is created, deleted, or changes status, agent or
+	// team, for status-transition and reassignment analytics
+	History      bool   `yaml:"history"`
+	HistoryIndex string `yaml:"history_index"`
+
+	// Audit records every upsert and delete the synchronizer performs (doc
+	// id, reason, diff summary, cycle id) in AuditIndex (default
+	// <index>-audit), to explain why a document changed or disappeared
+	Audit      bool   `yaml:"audit"`
+	AuditIndex string `yaml:"audit_index"`
+
+	// Services syncs the service catalog (Service and ServiceSubcategory:
+	// name, description, organization, status) into ServicesIndex on every
+	// full sync, for lookups from ticket dashboards
+	Services      bool   `yaml:"services"`
+	ServicesIndex string `yaml:"services_index"`
+
+	// Teams and Persons export the Team (members, organization, status)
+	// and Person (teams, organization, status) objects into TeamsIndex and
+	// PersonsIndex on every full sync, for rosters and per-agent workload
+	Teams        bool   `yaml:"teams"`
+	TeamsIndex   string `yaml:"teams_index"`
+	Persons      bool   `yaml:"persons"`
+	PersonsIndex string `yaml:"persons_index"`
+
+	// SLT exports the SLA/SLT definitions (priority, request type, metric,
+	// value, unit) into SLTIndex on every full sync, keeping a document per
+	// version of each target
+	SLT      bool   `yaml:"slt"`
+	SLTIndex string `yaml:"slt_index"`
+
+	// WorkOrders exports the work orders logged against tickets (team,
+	// agent, start and end, duration) into WorkOrdersIndex on every full
+	// sync, for effort versus SLA analysis
+	WorkOrders      bool   `yaml:"work_orders"`
+	WorkOrdersIndex string `yaml:"work_orders_index"`
+
+	// Rollups writes SLA compliance rollups (volumes, compliance
+	// percentages, MTTA, MTTR) per day, week and month and per team,
+	// service and priority into RollupsIndex on every full sync, so
+	// dashboards don't aggregate the tickets at query time
+	Rollups      bool   `yaml:"rollups"`
+	RollupsIndex string `yaml:"rollups_index"`
+
+	// Backlog appends the counts of open tickets by status, priority and
+	// team to BacklogIndex (default <index>-backlog) every BacklogInterval
+	// (0: every cycle), to chart the backlog over time
+	Backlog         bool          `yaml:"backlog"`
+	BacklogIndex    string        `yaml:"backlog_index"`
+	BacklogInterval time.Duration `yaml:"backlog_interval"`
+}
+
+// SyncConfig controls the sync loop
+type SyncConfig struct {
+	Interval     time.Duration `yaml:"interval"`
+	Incremental  bool          `yaml:"incremental"`
+	FullInterval time.Duration `yaml:"full_interval"`
+	ExporterMode bool          `yaml:"exporter_mode"`
+	Workers      int           `yaml:"workers"`        // concurrent ticket mapping / caller-team lookups
+	DryRun       bool          `yaml:"dry_run"`        // compute and log writes without sending them to ES
+	DryRunOutput string        `yaml:"dry_run_output"` // optional NDJSON file receiving planned writes
+
+	// MaxDeleteRatio aborts the delete phase when more than this fraction of
+	// ES documents would be removed in one cycle (1 disables the guard)
+	MaxDeleteRatio float64 `yaml:"max_delete_ratio"`
+	ForceDeletes   bool    `yaml:"force_deletes"` // bypass MaxDeleteRatio
+
+	// SoftDelete marks orphaned documents deleted=true/deleted_at instead of
+	// removing them; they are purged PurgeAfterDays later (0 keeps them forever)
+	SoftDelete     bool `yaml:"soft_delete"`
+	PurgeAfterDays int  `yaml:"purge_after_days"`
+
+	// ReconcileInterval replaces Interval when the iTop webhook receiver is
+	// enabled: tickets are pushed as they change, polling only reconciles
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+
+	// ESReconcileInterval is how often a full sync re-reads the ES index;
+	// in between, it compares against the locally tracked document hashes
+	// (0 reads ES on every full sync)
+	ESReconcileInterval time.Duration `yaml:"es_reconcile_interval"`
+
+	// Tiers replace Interval, Incremental, FullInterval and
+	// ReconcileInterval when set: each tier re-syncs the tickets in its
+	// window every tier interval, and the tier without a window is the
+	// full sync, deletes included
+	Tiers []SyncTier `yaml:"tiers"`
+
+	// Jitter delays each cycle by a random duration up to Jitter, so
+	// deployments started together don't hit iTop at the same moment
+	Jitter time.Duration `yaml:"jitter"`
+
+	// Throttle slows the synchronizer down while iTop struggles: a cycle
+	// whose mean iTop latency exceeds ThrottleLatency, or whose share of
+	// failed iTop requests exceeds ThrottleErrorRate, doubles a slowdown
+	// factor (up to ThrottleMaxFactor) stretching the interval and the iTop
+	// request rate and dividing the workers; a cycle under half of both
+	// halves it back
+	Throttle          bool          `yaml:"throttle"`
+	ThrottleLatency   time.Duration `yaml:"throttle_latency"`
+	ThrottleErrorRate float64       `yaml:"throttle_error_rate"`
+	ThrottleMaxFactor float64       `yaml:"throttle_max_factor"`
+
+	// AgeRefreshInterval is how often the fields of open tickets that only
+	// move with the clock (age_*, *_remaining_seconds, at_risk) are
+	// refreshed, with a partial update on an ES index and the whole document
+	// on other outputs; they are left out of content_hash so they don't
+	// rewrite the document every cycle (0 refreshes them every cycle)
+	AgeRefreshInterval time.Duration `yaml:"age_refresh_interval"`
+}
+
+// SyncTier is a tier of sync.tiers. Its window is the tickets matching the
+// OQL condition Where (e.g. "status NOT IN ('resolved', 'closed')") and,
+// when UpdatedWithin is set, updated within that duration.
+type SyncTier struct {
+	Name          string        `yaml:"name"`
+	Interval      time.Duration `yaml:"interval"`
+	Where         string        `yaml:"where"`
+	UpdatedWithin time.Duration `yaml:"updated_within"`
+}
+
+// Full reports whether the tier covers every ticket
+func (t SyncTier) Full() bool {
+	return strings.TrimSpace(t.Where) == "" && t.UpdatedWithin <= 0
+}
+
+// BusinessHoursConfig is the working-hours window used for business-hour
+// durations: WorkStart–WorkEnd Monday to Friday, with optional per-weekday
+// overrides such as friday: "08:00-12:00" or saturday: "closed"
+type BusinessHoursConfig struct {
+	WorkStart string            `yaml:"work_start"`
+	WorkEnd   string            `yaml:"work_end"`
+	Weekdays  map[string]string `yaml:"weekdays"`
+
+	// Breaks are daily windows (e.g. "12:00-13:00") excluded from business
+	// hours; CoverageBreaks overrides them per iTop coverage window name
+	Breaks         []string            `yaml:"breaks"`
+	CoverageBreaks map[string][]string `yaml:"coverage_breaks"`
+
+	// TeamTimezones and OrgTimezones map a team or organization name to the
+	// IANA timezone its business hours are counted in, the team handling a
+	// ticket first; other tickets use the global timezone
+	TeamTimezones map[string]string `yaml:"team_timezones"`
+	OrgTimezones  map[string]string `yaml:"org_timezones"`
+}
+
+// Schedule builds the weekly schedule from the global window and weekday overrides
+func (b BusinessHoursConfig) Schedule() (utils.WeeklySchedule, error) {
+	schedule, err := utils.NewWorkweekSchedule(b.WorkStart, b.WorkEnd)
+	if err != nil {
+		return schedule, err
+	}
+	for name, spec := range b.Weekdays {
+		day, ok := utils.ParseWeekday(name)
+		if !ok {
+			return schedule, fmt.Errorf("unknown weekday %q", name)
+		}
+		intervals, err := utils.ParseIntervals(spec)
+		if err != nil {
+			return schedule, fmt.Errorf("%s: %w", name, err)
+		}
+		schedule[day] = intervals
+	}
+	breaks, err := parseBreaks(b.Breaks)
+	if err != nil {
+		return schedule, err
+	}
+	return schedule.WithBreaks(breaks), nil
+}
+
+// Calendar returns the business calendar of the configured working hours
+func (b BusinessHoursConfig) Calendar(holidays utils.Holidays) (utils.BusinessCalendar, error) {
+	schedule, err := b.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewCalendar(schedule, holidays), nil
+}
+
+// LocationFor returns the timezone of a ticket's business hours: that of
+// its team, else of its organization, else def
+func (b BusinessHoursConfig) LocationFor(team, org string, def *time.Location) *time.Location {
+	name, ok := b.TeamTimezones[team]
+	if !ok {
+		name, ok = b.OrgTimezones[org]
+	}
+	if !ok {
+		return def
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return def // validated at startup
+	}
+	locations.Store(name, loc)
+	return loc
+}
+
+// locations caches the timezones of LocationFor, loaded from disk otherwise
+var locations sync.Map
+
+// BreaksFor returns the break intervals for a coverage window, falling back to the global breaks
+func (b BusinessHoursConfig) BreaksFor(coverageWindow string) []utils.Interval {
+	specs, ok := b.CoverageBreaks[coverageWindow]
+	if !ok {
+		specs = b.Breaks
+	}
+	breaks, _ := parseBreaks(specs) // validated at startup
+	return breaks
+}
+
+func parseBreaks(specs []string) ([]utils.Interval, error) {
+	var breaks []utils.Interval
+	for _, spec := range specs {
+		intervals, err := utils.ParseIntervals(spec)
+		if err != nil {
+			return nil, fmt.Errorf("breaks: %w", err)
+		}
+		breaks = append(breaks, intervals...)
+	}
+	return breaks, nil
+}
+
+// SLAConfig controls how SLA durations and compliance are computed
+type SLAConfig struct {
+	// PauseEnabled loads each ticket's status history and stops the TTR clock
+	// while the ticket is in one of PauseStatuses
+	PauseEnabled  bool     `yaml:"pause_enabled"`
+	PauseStatuses []string `yaml:"pause_statuses"`
+
+	// AtRiskThreshold is the fraction of the TTR budget after which an open
+	// ticket is reported as "at_risk" (0 disables)
+	AtRiskThreshold float64 `yaml:"at_risk_threshold"`
+
+	// TrackReopens loads each ticket's status history to count the times it
+	// went from resolved or closed back to an open status
+	TrackReopens bool `yaml:"track_reopens"`
+
+	// TrackReassignments loads each ticket's agent and team history to
+	// count reassignments and list the teams it passed through, and flags
+	// resolved tickets resolved at first assignment or without escalation
+	TrackReassignments bool `yaml:"track_reassignments"`
+
+	// SLTOverrides set SLT targets in the config, ahead of those of iTop
+	SLTOverrides []SLTOverride `yaml:"slt_overrides"`
+}
+
+// SLTOverride sets the SLT targets of the tickets it matches; empty
+// criteria match any ticket. A target left unset comes from iTop.
+type SLTOverride struct {
+	Class       string `yaml:"class"`
+	Priority    string `yaml:"priority"` // iTop value ("1") or label ("Critical")
+	Service     string `yaml:"service"`
+	Subcategory string `yaml:"subcategory"`
+	RequestType string `yaml:"request_type"`
+
+	TTO             time.Duration `yaml:"tto"`
+	TTR             time.Duration `yaml:"ttr"`
+	TTOBusinessDays int           `yaml:"tto_business_days"`
+	TTRBusinessDays int           `yaml:"ttr_business_days"`
+}
+
+// SLTKey describes a ticket for SLTOverrideFor
+type SLTKey struct {
+	Class, Priority, PriorityLabel, Service, Subcategory, RequestType string
+}
+
+// SLTOverrideFor returns the override matching a ticket, the one with the
+// most criteria when several do (the first of those in the list)
+func (s SLAConfig) SLTOverrideFor(k SLTKey) (SLTOverride, bool) {
+	best, bestScore := SLTOverride{}, -1
+	for _, o := range s.SLTOverrides {
+		score := 0
+		for _, c := range []struct{ want, got, alt string }{
+			{o.Class, k.Class, ""},
+			{o.Priority, k.Priority, k.PriorityLabel},
+			{o.Service, k.Service, ""},
+			{o.Subcategory, k.Subcategory, ""},
+			{o.RequestType, k.RequestType, ""},
+		} {
+			switch {
+			case c.want == "":
+			case strings.EqualFold(c.want, c.got) || (c.alt != "" && strings.EqualFold(c.want, c.alt)):
+				score++
+			default:
+				score = -1
+			}
+			if score < 0 {
+				break
+			}
+		}
+		if score > bestScore {
+			best, bestScore = o, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// HolidaysConfig controls where holidays come from: the Holiday objects of
+// iTop, the ICal calendars and the public holidays of Countries, kept in
+// memory and refreshed every SyncInterval, and File, an optional list of
+// extra holidays and "!date" cancellations applied on top
+type HolidaysConfig struct {
+	File         string        `yaml:"file"`
+	SyncInterval time.Duration `yaml:"sync_interval"`
+
+	// FromITop reads the Holiday class; off, File is the only source
+	FromITop bool `yaml:"from_itop"`
+
+	// ICal lists iCal (.ics) calendars, URLs or file paths, whose events
+	// are holidays; they are refreshed with the holidays of iTop
+	ICal []string `yaml:"ical"`
+
+	// Countries lists ISO 3166-1 alpha-2 codes whose national public
+	// holidays are read from PublicAPI (a Nager.Date server); each country
+	// and year is fetched again once PublicTTL has passed
+	Countries []string      `yaml:"countries"`
+	PublicAPI string        `yaml:"public_api"`
+	PublicTTL time.Duration `yaml:"public_ttl"`
+}
+
+// HTTPConfig controls the operational HTTP server ("off" disables it)
+type HTTPConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+
+	// WebhookEnabled serves /hooks/itop for iTop triggers; requests must carry
+	// WebhookToken (X-Webhook-Token header or ?token=) when it is set
+	WebhookEnabled bool   `yaml:"webhook_enabled"`
+	WebhookToken   string `yaml:"webhook_token"`
+
+	// AdminToken protects the admin endpoints (POST /sync/ticket/{class}/{ref},
+	// /sync/full, /sync/caches, /sync/slt-cache) as "Authorization: Bearer
+	// <token>"; they are only served when it is set
+	AdminToken string `yaml:"admin_token"`
+}
+
+// NotifyConfig lists the channels notifications are sent through, and the
+// events that are notified
+type NotifyConfig struct {
+	Channels []NotifyChannel `yaml:"channels"`
+
+	// Breaches notifies, once per ticket, metric (TTO, TTR) and variant
+	// (raw, business hours, 24BH), when a compliance becomes overdue or
+	// at_risk; the breaches found by the first cycle are not notified
+	Breaches bool `yaml:"breaches"`
+
+	// FailedCycles notifies when that many consecutive cycles failed to
+	// fetch from iTop or to write to Elasticsearch, and ErrorRate when the
+	// fraction of a cycle's writes rejected reaches it (0 disables either);
+	// each once, until the synchronizer recovers
+	FailedCycles int     `yaml:"failed_cycles"`
+	ErrorRate    float64 `yaml:"error_rate"`
+}
+
+// NotifyChannel is a destination of notifications: type webhook (the
+// notification POSTed as JSON to URL, with Headers), slack or teams (an
+// incoming webhook URL), or email (through the SMTP server SMTPAddr, from
+// From to To). Events limits the channel to some events (breach, at_risk,
+// sync_failure), all when empty.
+type NotifyChannel struct {
+	Name         string            `yaml:"name"`
+	Type         string            `yaml:"type"`
+	URL          string            `yaml:"url"`
+	Headers      map[string]string `yaml:"headers"`
+	SMTPAddr     string            `yaml:"smtp_addr"` // host:port
+	SMTPUser     string            `yaml:"smtp_user"` // PLAIN authentication when set
+	SMTPPassword string            `yaml:"smtp_password"`
+	From         string            `yaml:"from"`
+	To           []string          `yaml:"to"`
+	Events       []string          `yaml:"events"`
+}
+
+// NotifyEvents are the events a notification channel can be limited to
+var NotifyEvents = []string{"breach", "at_risk", "sync_failure"}
+
+func isNotifyEvent(ev string) bool {
+	for _, known := range NotifyEvents {
+		if ev == known {
+			return true
+		}
+	}
+	return false
+}
+
+// LeaderConfig enables leader election between replicas of the run
+// command, through a lease document in Index (default <index>-leader):
+// only the replica holding the lease syncs, renewing it every TTL/3; a
+// standby takes over once the lease has not been renewed for TTL. ID names
+// the replica (default: the host name). Dry runs don't take part.
+type LeaderConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Index   string        `yaml:"index"`
+	ID      string        `yaml:"id"`
+	TTL     time.Duration `yaml:"ttl"`
+}
+
+// ShardConfig splits the tickets between Total replicas, each syncing
+// those whose id hashes to its Index modulo Total (a Total of 0 or 1 syncs
+// everything). iTop returns every ticket to every replica; other shards'
+// tickets are dropped before enrichment and writes. The service, team,
+// person, SLT and work order indexes are written by shard 0 only; the
+// rollup and backlog indexes summarize every ticket and cannot be sharded.
+// Each replica needs its own state file.
+type ShardConfig struct {
+	Index int `yaml:"index"`
+	Total int `yaml:"total"`
+}
+
+// Enabled reports whether the tickets are split between replicas
+func (c ShardConfig) Enabled() bool {
+	return c.Total > 1
+}
+
+// PipelineConfig is one iTop instance of a multi-pipeline deployment,
+// synced by its own loop. Its itop, business_hours and holidays sections
+// are applied over the top-level ones, and Timezone replaces the global
+// one when set. Its documents go to Index (default <elastic.index>-<name>);
+// the other index names and local files of the top-level configuration
+// get the pipeline name appended, so pipelines never share a document.
+// Adding or removing a pipeline needs a restart.
+type PipelineConfig struct {
+	Name          string    `yaml:"name"`
+	ITop          yaml.Node `yaml:"itop"`
+	BusinessHours yaml.Node `yaml:"business_hours"`
+	Holidays      yaml.Node `yaml:"holidays"`
+	Timezone      string    `yaml:"timezone"`
+	Index         string    `yaml:"index"`
+}
+
+// StateConfig enables the persistent state file holding checkpoints,
+// document hashes and the iTop caches across restarts
+type StateConfig struct {
+	File string `yaml:"file"` // empty disables persistence
+}
+
+// OutputConfig selects the sink of the mapped documents. The ndjson sink
+// writes one {"action", "index", "id", "doc"} line per operation, for
+// Logstash, offline tests or pipes; elastic.index still names the index.
+type OutputConfig struct {
+	Type     string         `yaml:"type"` // elasticsearch, ndjson, kafka or postgres
+	File     string         `yaml:"file"` // ndjson: file appended to, empty for stdout
+	Kafka    KafkaConfig    `yaml:"kafka"`
+	Postgres PostgresConfig `yaml:"postgres"`
+}
+
+// PostgresConfig is the postgres output: tickets are upserted into Table
+// (keyed by doc_id, created and extended with new columns at startup).
+// Alongside writes to PostgreSQL in addition to Elasticsearch. SSLMode is
+// disable, prefer, require or verify-full.
+type PostgresConfig struct {
+	Host      string        `yaml:"host"`
+	Port      int           `yaml:"port"`
+	User      string        `yaml:"user"`
+	Password  string        `yaml:"password"`
+	Database  string        `yaml:"database"`
+	SSLMode   string        `yaml:"sslmode"`
+	Table     string        `yaml:"table"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Alongside bool          `yaml:"alongside"`
+}
+
+// KafkaConfig is the kafka output: every upsert is published to Topic keyed
+// by document id, every delete as a tombstone. Acks is -1 (all in-sync
+// replicas) or 1 (leader only); SASLUser enables SASL/PLAIN.
+type KafkaConfig struct {
+	Brokers            []string      `yaml:"brokers"`
+	Topic              string        `yaml:"topic"`
+	ClientID           string        `yaml:"client_id"`
+	Acks               int           `yaml:"acks"`
+	Timeout            time.Duration `yaml:"timeout"`
+	TLS                bool          `yaml:"tls"`
+	CAFile             string        `yaml:"ca_file"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	SASLUser           string        `yaml:"sasl_user"`
+	SASLPassword       string        `yaml:"sasl_password"`
+}
+
+// RetryConfig controls retries of transient iTop and Elasticsearch failures
+// (network errors, 429 and 5xx): the delay doubles from BaseDelay up to
+// MaxDelay with full jitter, and a server Retry-After is honoured
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"` // 1 disables retries
+	BaseDelay   time.Duration `yaml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+}
+
+// LogConfig controls the structured logger
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // json or text
+}
+
+// Elasticsearch time units and byte sizes accepted in lifecycle policies,
+// and the date placeholders of a templated index
+var (
+	esTimeUnit = regexp.MustCompile(`^[0-9]+(d|h|m|s)$`)
+	esByteSize = regexp.MustCompile(`^[0-9]+(b|kb|mb|gb|tb)$`)
+
+	// indexDateFormat is a date placeholder of a templated elastic.index
+	indexDateFormat = regexp.MustCompile(`^(yyyy|MM|dd)([.\-_]?(yyyy|MM|dd))*$`)
+
+	// sqlTable is output.postgres.table: [schema.]table, unquoted
+	sqlTable = regexp.MustCompile(`^([a-z_][a-z0-9_]*\.)?[a-z_][a-z0-9_]*$`)
+
+	// attCode is an iTop attribute code, as listed in itop.extra_fields
+	attCode = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// pipelineName is a pipeline name, appended to index names
+	pipelineName = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]*$`)
+)
+
+// DefaultClasses are the ticket classes synced when none are configured
+var DefaultClasses = []string{"Incident", "UserRequest"}
+
+// Default returns the built-in defaults
+func Default() Config {
+	return Config{
+		ITop: ITopConfig{
+			Version:         "1.3",
+			Classes:         DefaultClasses,
+			RateLimit:       200 * time.Millisecond,
+			RateBurst:       1,
+			TeamCacheTTL:    time.Hour,
+			TeamCacheSize:   10000,
+			CoverageWindows: true,
+			SLTCacheTTL:     time.Hour,
+
+			PageSize: 1000,
+
+			RequestTimeout: 10 * time.Second,
+			DialTimeout:    10 * time.Second,
+
+			InsecureSkipVerify: true,
+
+			Compression: true,
+		},
+		Elastic: ElasticConfig{
+			BulkSize:          500,
+			BulkFlushInterval: 5 * time.Second,
+
+			BreakerThreshold:     5,
+			BreakerProbeInterval: 30 * time.Second,
+
+			Flavor:     "elasticsearch",
+			AWSService: "es",
+
+			ILMRolloverMaxAge:  "1d",
+			ILMRolloverMaxSize: "50gb",
+			ILMWarmAfter:       "7d",
+			ILMDeleteAfter:     "90d",
+
+			WriteMode: "index",
+
+			MaxIdleConns:   10,
+			RequestTimeout: 2 * time.Minute,
+
+			SniffInterval: 5 * time.Minute,
+
+			ServicesIndex: "itop-services",
+			TeamsIndex:    "itop-teams",
+			PersonsIndex:  "itop-persons",
+			SLTIndex:      "itop-slt",
+
+			WorkOrdersIndex: "itop-workorders",
+			RollupsIndex:    "itop-rollups",
+		},
+		Sync: SyncConfig{
+			Interval:       3 * time.Second,
+			FullInterval:   time.Hour,
+			Workers:        4,
+			MaxDeleteRatio: 0.1,
+
+			ReconcileInterval:   5 * time.Minute,
+			ESReconcileInterval: 6 * time.Hour,
+
+			ThrottleLatency:   2 * time.Second,
+			ThrottleErrorRate: 0.1,
+			ThrottleMaxFactor: 8,
+
+			AgeRefreshInterval: 5 * time.Minute,
+		},
+		BusinessHours: BusinessHoursConfig{
+			WorkStart: "08:00",
+			WorkEnd:   "17:00",
+		},
+		SLA: SLAConfig{
+			PauseStatuses:   []string{"pending", "waiting_for_approval"},
+			AtRiskThreshold: 0.8,
+		},
+		Holidays: HolidaysConfig{
+			File:         "holidays.txt",
+			SyncInterval: 10 * time.Second,
+
+			FromITop: true,
+
+			PublicAPI: "https://date.nager.at",
+			PublicTTL: 24 * time.Hour,
+		},
+		HTTP: HTTPConfig{
+			ListenAddr: ":8080",
+		},
+		Retry: RetryConfig{
+			MaxAttempts: 4,
+			BaseDelay:   500 * time.Millisecond,
+			MaxDelay:    30 * time.Second,
+		},
+		Leader: LeaderConfig{
+			TTL: 30 * time.Second,
+		},
+		Output: OutputConfig{
+			Type: "elasticsearch",
+			Kafka: KafkaConfig{
+				ClientID: "itop-sync",
+				Acks:     -1,
+				Timeout:  10 * time.Second,
+			},
+			Postgres: PostgresConfig{
+				Port:    5432,
+				SSLMode: "prefer",
+				Table:   "itop_tickets",
+				Timeout: 30 * time.Second,
+			},
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Timezone: "Asia/Jakarta",
+	}
+}
+
+// Load builds the configuration from defaults, the YAML file at path (if
+// any) and environment overrides, then validates it. When path is empty,
+// config.yaml is used if it exists.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path = Path(path); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// LoadPipelines loads the configuration of each pipeline, or the top-level
+// configuration alone when no pipeline is defined
+func LoadPipelines(path string) ([]*Config, error) {
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Pipelines) == 0 {
+		return []*Config{cfg}, nil
+	}
+	cfgs := make([]*Config, 0, len(cfg.Pipelines))
+	for _, p := range cfg.Pipelines {
+		c, err := LoadPipeline(path, p.Name)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, c)
+	}
+	return cfgs, nil
+}
+
+// LoadPipeline loads the configuration of the named pipeline: the top-level
+// configuration (environment included) with the pipeline's settings
+// applied over it. An empty name loads the top-level configuration.
+func LoadPipeline(path, name string) (*Config, error) {
+	cfg, err := Load(path)
+	if err != nil || name == "" {
+		return cfg, err
+	}
+	for _, p := range cfg.Pipelines {
+		if p.Name != name {
+			continue
+		}
+		for section, dst := range map[string]struct {
+			node *yaml.Node
+			v    interface{}
+		}{
+			"itop":           {&p.ITop, &cfg.ITop},
+			"business_hours": {&p.BusinessHours, &cfg.BusinessHours},
+			"holidays":       {&p.Holidays, &cfg.Holidays},
+		} {
+			if dst.node.Kind == 0 {
+				continue
+			}
+			if err := dst.node.Decode(dst.v); err != nil {
+				return nil, fmt.Errorf("pipelines[%s].%s: %w", name, section, err)
+			}
+		}
+		if p.Timezone != "" {
+			cfg.Timezone = p.Timezone
+		}
+		cfg.forPipeline(p)
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("pipelines[%s]: %w", name, err)
+		}
+		return cfg, nil
+	}
+	return nil, fmt.Errorf("no pipeline named %q", name)
+}
+
+// forPipeline gives the indexes, template, policy, alias, lease and local
+// files of c names of their own for pipeline p
+func (c *Config) forPipeline(p PipelineConfig) {
+	index := func(v *string) {
+		if *v != "" {
+			*v += "-" + p.Name
+		}
+	}
+	file := func(v *string) {
+		if *v != "" {
+			*v += "." + p.Name
+		}
+	}
+	c.Pipeline, c.Source = p.Name, p.Name
+	if p.Index != "" {
+		c.Elastic.Index = p.Index
+	} else {
+		index(&c.Elastic.Index)
+	}
+	for _, v := range []*string{
+		&c.Elastic.TemplateName, &c.Elastic.ILMPolicy, &c.Elastic.Alias,
+		&c.Elastic.HistoryIndex, &c.Elastic.AuditIndex, &c.Elastic.ServicesIndex, &c.Elastic.TeamsIndex,
+		&c.Elastic.PersonsIndex, &c.Elastic.SLTIndex, &c.Elastic.WorkOrdersIndex, &c.Elastic.RollupsIndex,
+		&c.Elastic.BacklogIndex, &c.ElasticSecondary.Index, &c.Leader.Index,
+	} {
+		index(v)
+	}
+	for _, v := range []*string{
+		&c.Elastic.QueueFile, &c.Elastic.DeadLetterFile, &c.ElasticSecondary.QueueFile,
+		&c.ElasticSecondary.DeadLetterFile, &c.State.File, &c.Sync.DryRunOutput,
+	} {
+		file(v)
+	}
+}
+
+// Path returns the config file Load reads: path, or config.yaml when path
+// is empty and that file exists
+func Path(path string) string {
+	if path == "" {
+		if _, err := os.Stat("config.yaml"); err == nil {
+			return "config.yaml"
+		}
+	}
+	return path
+}
+
+// applyEnv overrides config values with the environment variables the
+// synchronizer has always used
+func (c *Config) applyEnv() error {
+	e := &envReader{}
+	e.str("ITOP_API_URL", &c.ITop.URL)
+	e.str("ITOP_API_USER", &c.ITop.User)
+	e.str("ITOP_API_PWD", &c.ITop.Password)
+	e.str("ITOP_API_TOKEN", &c.ITop.Token)
+	e.duration("ITOP_REQUEST_TIMEOUT", &c.ITop.RequestTimeout)
+	e.duration("ITOP_DIAL_TIMEOUT", &c.ITop.DialTimeout)
+	e.str("ITOP_PROXY", &c.ITop.Proxy)
+	e.str("ITOP_CA_FILE", &c.ITop.CAFile)
+	e.str("ITOP_CERT_FILE", &c.ITop.CertFile)
+	e.str("ITOP_KEY_FILE", &c.ITop.KeyFile)
+	e.boolean("ITOP_INSECURE_SKIP_VERIFY", &c.ITop.InsecureSkipVerify)
+	e.boolean("ITOP_COMPRESSION", &c.ITop.Compression)
+	e.str("ITOP_API_VERSION", &c.ITop.Version)
+	e.list("ITOP_CLASSES", &c.ITop.Classes)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "ITOP_OUTPUT_FIELDS_") {
+			parts := strings.SplitN(strings.TrimPrefix(kv, "ITOP_OUTPUT_FIELDS_"), "=", 2)
+			if c.ITop.OutputFields == nil {
+				c.ITop.OutputFields = make(map[string]string)
+			}
+			c.ITop.OutputFields[strings.ToUpper(parts[0])] = parts[1]
+		}
+		if strings.HasPrefix(kv, "ITOP_OQL_") {
+			parts := strings.SplitN(strings.TrimPrefix(kv, "ITOP_OQL_"), "=", 2)
+			if c.ITop.OQL == nil {
+				c.ITop.OQL = make(map[string]string)
+			}
+			c.ITop.OQL[strings.ToUpper(parts[0])] = parts[1]
+		}
+	}
+	e.millis("ITOP_API_RATE_LIMIT_MS", &c.ITop.RateLimit)
+	e.integer("ITOP_API_RATE_BURST", &c.ITop.RateBurst)
+	e.duration("ITOP_TEAM_CACHE_TTL", &c.ITop.TeamCacheTTL)
+	e.integer("ITOP_TEAM_CACHE_SIZE", &c.ITop.TeamCacheSize)
+	e.boolean("ITOP_WARM_CACHE", &c.ITop.WarmCache)
+	e.boolean("ITOP_COVERAGE_WINDOWS", &c.ITop.CoverageWindows)
+	e.integer("ITOP_PAGE_SIZE", &c.ITop.PageSize)
+	e.list("ITOP_EXTRA_FIELDS", &c.ITop.ExtraFields)
+	e.list("ITOP_ORGANIZATIONS", &c.ITop.Organizations)
+	e.boolean("ITOP_IMPACTED_CIS", &c.ITop.ImpactedCIs)
+	e.boolean("ITOP_PUBLIC_LOG", &c.ITop.PublicLog)
+	e.boolean("ITOP_SOLUTION_STRIP_HTML", &c.ITop.SolutionStripHTML)
+	e.integer("ITOP_SOLUTION_MAX_LENGTH", &c.ITop.SolutionMaxLength)
+	e.boolean("ITOP_ESCALATION", &c.ITop.Escalation)
+	e.boolean("ITOP_TICKET_LINKS", &c.ITop.TicketLinks)
+	e.duration("ITOP_SLT_CACHE_TTL", &c.ITop.SLTCacheTTL)
+	e.duration("ITOP_SLT_REFRESH_INTERVAL", &c.ITop.SLTRefreshInterval)
+	e.float("ITOP_TICKET_RATE", &c.ITop.TicketRate)
+	e.integer("ITOP_TICKET_BURST", &c.ITop.TicketBurst)
+	e.float("ITOP_SLT_RATE", &c.ITop.SLTRate)
+	e.integer("ITOP_SLT_BURST", &c.ITop.SLTBurst)
+
+	e.str("ELASTIC_URL", &c.Elastic.URL)
+	e.str("ELASTIC_USER", &c.Elastic.User)
+	e.str("ELASTIC_PWD", &c.Elastic.Password)
+	e.str("ELASTIC_INDEX", &c.Elastic.Index)
+	e.str("ELASTIC_TEMPLATE_NAME", &c.Elastic.TemplateName)
+	e.boolean("ELASTIC_SKIP_TEMPLATE", &c.Elastic.SkipTemplate)
+	e.integer("ELASTIC_BULK_SIZE", &c.Elastic.BulkSize)
+	e.duration("ELASTIC_BULK_FLUSH_INTERVAL", &c.Elastic.BulkFlushInterval)
+	e.integer("ELASTIC_BREAKER_THRESHOLD", &c.Elastic.BreakerThreshold)
+	e.duration("ELASTIC_BREAKER_PROBE_INTERVAL", &c.Elastic.BreakerProbeInterval)
+	e.str("ELASTIC_QUEUE_FILE", &c.Elastic.QueueFile)
+	e.str("ELASTIC_DEAD_LETTER_FILE", &c.Elastic.DeadLetterFile)
+	e.str("ELASTIC_CA_FILE", &c.Elastic.CAFile)
+	e.str("ELASTIC_CERT_FILE", &c.Elastic.CertFile)
+	e.str("ELASTIC_KEY_FILE", &c.Elastic.KeyFile)
+	e.boolean("ELASTIC_INSECURE_SKIP_VERIFY", &c.Elastic.InsecureSkipVerify)
+	e.str("ELASTIC_FLAVOR", &c.Elastic.Flavor)
+	e.boolean("ELASTIC_AWS_SIGV4", &c.Elastic.AWSSigV4)
+	e.str("ELASTIC_AWS_REGION", &c.Elastic.AWSRegion)
+	e.str("ELASTIC_AWS_SERVICE", &c.Elastic.AWSService)
+	e.boolean("ELASTIC_DATA_STREAM", &c.Elastic.DataStream)
+	e.str("ELASTIC_ILM_POLICY", &c.Elastic.ILMPolicy)
+	e.str("ELASTIC_ILM_ROLLOVER_MAX_AGE", &c.Elastic.ILMRolloverMaxAge)
+	e.str("ELASTIC_ILM_ROLLOVER_MAX_SIZE", &c.Elastic.ILMRolloverMaxSize)
+	e.str("ELASTIC_ILM_WARM_AFTER", &c.Elastic.ILMWarmAfter)
+	e.str("ELASTIC_ILM_DELETE_AFTER", &c.Elastic.ILMDeleteAfter)
+	e.str("ELASTIC_ALIAS", &c.Elastic.Alias)
+	e.boolean("ELASTIC_EXTERNAL_VERSIONING", &c.Elastic.ExternalVersioning)
+	e.str("ELASTIC_WRITE_MODE", &c.Elastic.WriteMode)
+	e.integer("ELASTIC_MAX_IDLE_CONNS", &c.Elastic.MaxIdleConns)
+	e.duration("ELASTIC_REQUEST_TIMEOUT", &c.Elastic.RequestTimeout)
+	e.boolean("ELASTIC_COMPRESSION", &c.Elastic.Compression)
+	e.boolean("ELASTIC_SNIFF", &c.Elastic.Sniff)
+	e.duration("ELASTIC_SNIFF_INTERVAL", &c.Elastic.SniffInterval)
+	e.boolean("ELASTIC_HISTORY", &c.Elastic.History)
+	e.str("ELASTIC_HISTORY_INDEX", &c.Elastic.HistoryIndex)
+	e.boolean("ELASTIC_AUDIT", &c.Elastic.Audit)
+	e.str("ELASTIC_AUDIT_INDEX", &c.Elastic.AuditIndex)
+	e.boolean("ELASTIC_SERVICES", &c.Elastic.Services)
+	e.str("ELASTIC_SERVICES_INDEX", &c.Elastic.ServicesIndex)
+	e.boolean("ELASTIC_TEAMS", &c.Elastic.Teams)
+	e.str("ELASTIC_TEAMS_INDEX", &c.Elastic.TeamsIndex)
+	e.boolean("ELASTIC_PERSONS", &c.Elastic.Persons)
+	e.str("ELASTIC_PERSONS_INDEX", &c.Elastic.PersonsIndex)
+	e.boolean("ELASTIC_SLT", &c.Elastic.SLT)
+	e.str("ELASTIC_SLT_INDEX", &c.Elastic.SLTIndex)
+	e.boolean("ELASTIC_WORK_ORDERS", &c.Elastic.WorkOrders)
+	e.str("ELASTIC_WORK_ORDERS_INDEX", &c.Elastic.WorkOrdersIndex)
+	e.boolean("ELASTIC_ROLLUPS", &c.Elastic.Rollups)
+	e.str("ELASTIC_ROLLUPS_INDEX", &c.Elastic.RollupsIndex)
+	e.boolean("ELASTIC_BACKLOG", &c.Elastic.Backlog)
+	e.str("ELASTIC_BACKLOG_INDEX", &c.Elastic.BacklogIndex)
+	e.duration("ELASTIC_BACKLOG_INTERVAL", &c.Elastic.BacklogInterval)
+
+	e.str("ELASTIC_SECONDARY_URL", &c.ElasticSecondary.URL)
+	e.str("ELASTIC_SECONDARY_USER", &c.ElasticSecondary.User)
+	e.str("ELASTIC_SECONDARY_PWD", &c.ElasticSecondary.Password)
+	e.str("ELASTIC_SECONDARY_INDEX", &c.ElasticSecondary.Index)
+	e.str("ELASTIC_SECONDARY_CA_FILE", &c.ElasticSecondary.CAFile)
+	e.str("ELASTIC_SECONDARY_CERT_FILE", &c.ElasticSecondary.CertFile)
+	e.str("ELASTIC_SECONDARY_KEY_FILE", &c.ElasticSecondary.KeyFile)
+	e.boolean("ELASTIC_SECONDARY_INSECURE_SKIP_VERIFY", &c.ElasticSecondary.InsecureSkipVerify)
+	e.str("ELASTIC_SECONDARY_QUEUE_FILE", &c.ElasticSecondary.QueueFile)
+	e.str("ELASTIC_SECONDARY_DEAD_LETTER_FILE", &c.ElasticSecondary.DeadLetterFile)
+
+	e.duration("SYNC_INTERVAL", &c.Sync.Interval)
+	e.boolean("INCREMENTAL_SYNC", &c.Sync.Incremental)
+	e.duration("FULL_SYNC_INTERVAL", &c.Sync.FullInterval)
+	e.boolean("EXPORTER_MODE", &c.Sync.ExporterMode)
+	e.integer("SYNC_WORKERS", &c.Sync.Workers)
+	e.boolean("DRY_RUN", &c.Sync.DryRun)
+	e.str("DRY_RUN_OUTPUT", &c.Sync.DryRunOutput)
+	e.float("MAX_DELETE_RATIO", &c.Sync.MaxDeleteRatio)
+	e.boolean("FORCE_DELETES", &c.Sync.ForceDeletes)
+	e.boolean("SOFT_DELETE", &c.Sync.SoftDelete)
+	e.integer("SOFT_DELETE_PURGE_AFTER_DAYS", &c.Sync.PurgeAfterDays)
+	e.duration("RECONCILE_INTERVAL", &c.Sync.ReconcileInterval)
+	e.duration("SYNC_JITTER", &c.Sync.Jitter)
+	e.boolean("SYNC_THROTTLE", &c.Sync.Throttle)
+	e.duration("SYNC_THROTTLE_LATENCY", &c.Sync.ThrottleLatency)
+	e.float("SYNC_THROTTLE_ERROR_RATE", &c.Sync.ThrottleErrorRate)
+	e.float("SYNC_THROTTLE_MAX_FACTOR", &c.Sync.ThrottleMaxFactor)
+	e.duration("SYNC_AGE_REFRESH_INTERVAL", &c.Sync.AgeRefreshInterval)
+	e.duration("ES_RECONCILE_INTERVAL", &c.Sync.ESReconcileInterval)
+
+	e.str("WORK_START", &c.BusinessHours.WorkStart)
+	e.str("WORK_END", &c.BusinessHours.WorkEnd)
+	e.list("WORK_BREAKS", &c.BusinessHours.Breaks)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if v := os.Getenv("WORK_HOURS_" + strings.ToUpper(name)); v != "" {
+			if c.BusinessHours.Weekdays == nil {
+				c.BusinessHours.Weekdays = make(map[string]string)
+			}
+			c.BusinessHours.Weekdays[name] = v
+		}
+	}
+
+	e.boolean("SLA_PAUSE_ENABLED", &c.SLA.PauseEnabled)
+	e.list("SLA_PAUSE_STATUSES", &c.SLA.PauseStatuses)
+	e.boolean("SLA_TRACK_REOPENS", &c.SLA.TrackReopens)
+	e.boolean("SLA_TRACK_REASSIGNMENTS", &c.SLA.TrackReassignments)
+	e.float("SLA_AT_RISK_THRESHOLD", &c.SLA.AtRiskThreshold)
+
+	e.str("HOLIDAYS_FILE", &c.Holidays.File)
+	e.duration("HOLIDAY_SYNC_INTERVAL", &c.Holidays.SyncInterval)
+	e.boolean("HOLIDAYS_FROM_ITOP", &c.Holidays.FromITop)
+	e.list("HOLIDAYS_ICAL", &c.Holidays.ICal)
+	e.list("HOLIDAYS_COUNTRIES", &c.Holidays.Countries)
+	e.str("HOLIDAYS_PUBLIC_API", &c.Holidays.PublicAPI)
+	e.duration("HOLIDAYS_PUBLIC_TTL", &c.Holidays.PublicTTL)
+
+	e.str("HTTP_LISTEN_ADDR", &c.HTTP.ListenAddr)
+	e.boolean("WEBHOOK_ENABLED", &c.HTTP.WebhookEnabled)
+	e.str("WEBHOOK_TOKEN", &c.HTTP.WebhookToken)
+	e.str("ADMIN_TOKEN", &c.HTTP.AdminToken)
+	e.str("STATE_FILE", &c.State.File)
+	e.boolean("LEADER_ELECTION", &c.Leader.Enabled)
+	e.str("LEADER_INDEX", &c.Leader.Index)
+	e.str("LEADER_ID", &c.Leader.ID)
+	e.duration("LEADER_TTL", &c.Leader.TTL)
+	e.integer("SHARD_INDEX", &c.Shard.Index)
+	e.integer("SHARD_TOTAL", &c.Shard.Total)
+	e.str("SOURCE", &c.Source)
+	e.integer("RETRY_MAX_ATTEMPTS", &c.Retry.MaxAttempts)
+	e.duration("RETRY_BASE_DELAY", &c.Retry.BaseDelay)
+	e.duration("RETRY_MAX_DELAY", &c.Retry.MaxDelay)
+	e.str("OUTPUT_TYPE", &c.Output.Type)
+	e.str("OUTPUT_FILE", &c.Output.File)
+	e.list("KAFKA_BROKERS", &c.Output.Kafka.Brokers)
+	e.str("KAFKA_TOPIC", &c.Output.Kafka.Topic)
+	e.str("KAFKA_CLIENT_ID", &c.Output.Kafka.ClientID)
+	e.integer("KAFKA_ACKS", &c.Output.Kafka.Acks)
+	e.duration("KAFKA_TIMEOUT", &c.Output.Kafka.Timeout)
+	e.boolean("KAFKA_TLS", &c.Output.Kafka.TLS)
+	e.str("KAFKA_CA_FILE", &c.Output.Kafka.CAFile)
+	e.boolean("KAFKA_INSECURE_SKIP_VERIFY", &c.Output.Kafka.InsecureSkipVerify)
+	e.str("KAFKA_SASL_USER", &c.Output.Kafka.SASLUser)
+	e.str("KAFKA_SASL_PASSWORD", &c.Output.Kafka.SASLPassword)
+	e.str("POSTGRES_HOST", &c.Output.Postgres.Host)
+	e.integer("POSTGRES_PORT", &c.Output.Postgres.Port)
+	e.str("POSTGRES_USER", &c.Output.Postgres.User)
+	e.str("POSTGRES_PASSWORD", &c.Output.Postgres.Password)
+	e.str("POSTGRES_DB", &c.Output.Postgres.Database)
+	e.str("POSTGRES_SSLMODE", &c.Output.Postgres.SSLMode)
+	e.str("POSTGRES_TABLE", &c.Output.Postgres.Table)
+	e.duration("POSTGRES_TIMEOUT", &c.Output.Postgres.Timeout)
+	e.boolean("POSTGRES_ALONGSIDE", &c.Output.Postgres.Alongside)
+	e.str("LOG_LEVEL", &c.Log.Level)
+	e.str("LOG_FORMAT", &c.Log.Format)
+	e.str("TIMEZONE", &c.Timezone)
+	e.boolean("DEBUG", &c.Debug)
+	e.duration("RELOAD_INTERVAL", &c.ReloadInterval)
+	e.boolean("NOTIFY_BREACHES", &c.Notify.Breaches)
+	e.integer("NOTIFY_FAILED_CYCLES", &c.Notify.FailedCycles)
+	e.float("NOTIFY_ERROR_RATE", &c.Notify.ErrorRate)
+	return e.err()
+}
+
+// Validate checks required values and formats
+func (c *Config) Validate() error {
+	var errs []string
+	if c.ITop.URL == "" || c.ITop.Token == "" && (c.ITop.User == "" || c.ITop.Password == "") {
+		errs = append(errs, "itop.url and either itop.token or itop.user and itop.password are required (ITOP_API_URL, ITOP_API_TOKEN, ITOP_API_USER, ITOP_API_PWD)")
+	}
+	if len(c.ITop.Classes) == 0 {
+		errs = append(errs, "itop.classes must not be empty")
+	}
+	for _, class := range c.ITop.Classes {
+		if oql := c.ITop.OQLFor(class); !strings.HasPrefix(strings.ToUpper(oql), "SELECT ") {
+			errs = append(errs, fmt.Sprintf("itop.oql for %s must be a SELECT query", class))
+		}
+	}
+	if c.ITop.RequestTimeout <= 0 || c.ITop.DialTimeout <= 0 {
+		errs = append(errs, "itop.request_timeout and itop.dial_timeout must be positive")
+	}
+	if u, err := url.Parse(c.ITop.Proxy); c.ITop.Proxy != "" && (err != nil || u.Host == "") {
+		errs = append(errs, fmt.Sprintf("itop.proxy: invalid URL %q", c.ITop.Proxy))
+	}
+	if (c.ITop.CertFile == "") != (c.ITop.KeyFile == "") {
+		errs = append(errs, "itop.cert_file and itop.key_file must be set together")
+	}
+	if (c.Holidays.FromITop || len(c.Holidays.ICal) > 0 || len(c.Holidays.Countries) > 0) && c.Holidays.SyncInterval <= 0 {
+		errs = append(errs, "holidays.sync_interval must be positive")
+	}
+	if len(c.Holidays.Countries) > 0 {
+		for _, cc := range c.Holidays.Countries {
+			if len(cc) != 2 {
+				errs = append(errs, fmt.Sprintf("holidays.countries: invalid country code %q", cc))
+			}
+		}
+		if u, err := url.Parse(c.Holidays.PublicAPI); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("holidays.public_api: invalid URL %q", c.Holidays.PublicAPI))
+		}
+		if c.Holidays.PublicTTL <= 0 {
+			errs = append(errs, "holidays.public_ttl must be positive")
+		}
+	}
+	if c.ITop.SolutionMaxLength < 0 {
+		errs = append(errs, "itop.solution_max_length must not be negative")
+	}
+	if c.ITop.PageSize < 0 {
+		errs = append(errs, "itop.page_size must not be negative")
+	}
+	if c.ITop.TicketRate < 0 || c.ITop.TicketBurst < 0 || c.ITop.SLTRate < 0 || c.ITop.SLTBurst < 0 {
+		errs = append(errs, "itop.ticket_rate, ticket_burst, slt_rate and slt_burst must not be negative")
+	}
+	for _, f := range c.ITop.ExtraFields {
+		if !attCode.MatchString(f) {
+			errs = append(errs, fmt.Sprintf("itop.extra_fields: invalid attribute code %q", f))
+		}
+	}
+	for _, org := range c.ITop.Organizations {
+		if strings.TrimSpace(org) == "" {
+			errs = append(errs, "itop.organizations must not contain empty names")
+			break
+		}
+	}
+	switch c.Output.Type {
+	case "elasticsearch":
+		if c.Elastic.URL == "" || c.Elastic.Index == "" {
+			errs = append(errs, "elastic.url and elastic.index are required (ELASTIC_URL, ELASTIC_INDEX)")
+		}
+	case "ndjson", "kafka", "postgres":
+		if c.Elastic.Index == "" {
+			errs = append(errs, "elastic.index is required (ELASTIC_INDEX)")
+		}
+		if c.ElasticSecondary.URL != "" {
+			errs = append(errs, "elastic_secondary requires output.type elasticsearch")
+		}
+	default:
+		errs = append(errs, "output.type must be elasticsearch, ndjson, kafka or postgres")
+	}
+	if pg := c.Output.Postgres; c.Output.Type == "postgres" || pg.Alongside {
+		if pg.Host == "" || pg.User == "" || pg.Database == "" {
+			errs = append(errs, "output.postgres.host, user and database are required (POSTGRES_HOST, POSTGRES_USER, POSTGRES_DB)")
+		}
+		if !sqlTable.MatchString(pg.Table) {
+			errs = append(errs, "output.postgres.table must be a plain table name, optionally schema-qualified")
+		}
+		switch pg.SSLMode {
+		case "disable", "prefer", "require", "verify-full":
+		default:
+			errs = append(errs, "output.postgres.sslmode must be disable, prefer, require or verify-full")
+		}
+		if pg.Timeout <= 0 {
+			errs = append(errs, "output.postgres.timeout must be positive")
+		}
+		if pg.Alongside && c.Output.Type != "elasticsearch" {
+			errs = append(errs, "output.postgres.alongside requires output.type elasticsearch")
+		}
+	}
+	if k := c.Output.Kafka; c.Output.Type == "kafka" {
+		if len(k.Brokers) == 0 || k.Topic == "" {
+			errs = append(errs, "output.kafka.brokers and output.kafka.topic are required (KAFKA_BROKERS, KAFKA_TOPIC)")
+		}
+		if k.Acks != -1 && k.Acks != 1 {
+			errs = append(errs, "output.kafka.acks must be -1 or 1")
+		}
+		if k.Timeout <= 0 {
+			errs = append(errs, "output.kafka.timeout must be positive")
+		}
+	}
+	for _, node := range strings.Split(c.Elastic.URL, ",") {
+		node = strings.TrimSpace(node)
+		if u, err := url.Parse(node); c.Elastic.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			errs = append(errs, fmt.Sprintf("elastic.url: invalid node URL %q", node))
+		}
+	}
+	if c.Elastic.Sniff {
+		if c.Elastic.SniffInterval <= 0 {
+			errs = append(errs, "elastic.sniff_interval must be positive")
+		}
+		if c.Elastic.AWSSigV4 {
+			errs = append(errs, "elastic.sniff is not supported by Amazon OpenSearch (aws_sigv4)")
+		}
+	}
+	if c.Elastic.BacklogInterval < 0 {
+		errs = append(errs, "elastic.backlog_interval must not be negative")
+	}
+	for name, side := range map[string]struct {
+		enabled bool
+		index   string
+	}{
+		"history":     {c.Elastic.History, c.Elastic.HistoryIndex},
+		"audit":       {c.Elastic.Audit, c.Elastic.AuditIndex},
+		"services":    {c.Elastic.Services, c.Elastic.ServicesIndex},
+		"teams":       {c.Elastic.Teams, c.Elastic.TeamsIndex},
+		"persons":     {c.Elastic.Persons, c.Elastic.PersonsIndex},
+		"slt":         {c.Elastic.SLT, c.Elastic.SLTIndex},
+		"work_orders": {c.Elastic.WorkOrders, c.Elastic.WorkOrdersIndex},
+		"rollups":     {c.Elastic.Rollups, c.Elastic.RollupsIndex},
+		"backlog":     {c.Elastic.Backlog, c.Elastic.BacklogIndex},
+	} {
+		if !side.enabled {
+			continue
+		}
+		if c.Output.Type != "elasticsearch" {
+			errs = append(errs, fmt.Sprintf("elastic.%s requires output.type elasticsearch", name))
+		}
+		if side.index == "" && strings.Contains(c.Elastic.Index, "{") {
+			errs = append(errs, fmt.Sprintf("elastic.%s_index must be set when elastic.index is templated", name))
+		}
+		if strings.ContainsAny(side.index, "{}*") {
+			errs = append(errs, fmt.Sprintf("elastic.%s_index must be a plain name", name))
+		}
+	}
+	if sec := c.ElasticSecondary; sec.URL != "" {
+		for _, node := range strings.Split(sec.URL, ",") {
+			node = strings.TrimSpace(node)
+			if u, err := url.Parse(node); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Sprintf("elastic_secondary.url: invalid node URL %q", node))
+			}
+		}
+		if (sec.CertFile == "") != (sec.KeyFile == "") {
+			errs = append(errs, "elastic_secondary.cert_file and elastic_secondary.key_file must be set together")
+		}
+		if sec.Index != "" && strings.ContainsAny(c.Elastic.Index+sec.Index, "{}") {
+			errs = append(errs, "elastic_secondary.index cannot be combined with a templated index")
+		}
+		if sec.QueueFile != "" && sec.QueueFile == c.Elastic.QueueFile {
+			errs = append(errs, "elastic_secondary.queue_file must differ from elastic.queue_file")
+		}
+		if sec.DeadLetterFile != "" && sec.DeadLetterFile == c.Elastic.DeadLetterFile {
+			errs = append(errs, "elastic_secondary.dead_letter_file must differ from elastic.dead_letter_file")
+		}
+	}
+	if c.Elastic.BulkSize <= 0 {
+		errs = append(errs, "elastic.bulk_size must be positive")
+	}
+	for _, m := range regexp.MustCompile(`\{([^{}]*)\}`).FindAllStringSubmatch(c.Elastic.Index, -1) {
+		if m[1] != "class" && !indexDateFormat.MatchString(m[1]) {
+			errs = append(errs, fmt.Sprintf("elastic.index: unknown placeholder {%s}, use {class} or a date like {yyyy.MM}", m[1]))
+		}
+	}
+	if strings.ContainsAny(c.Elastic.Alias, "{}*") {
+		errs = append(errs, "elastic.alias must be a plain name")
+	}
+	if c.Elastic.ExternalVersioning && c.Elastic.DataStream {
+		errs = append(errs, "elastic.external_versioning does not apply to data streams (snapshots are append-only)")
+	}
+	switch c.Elastic.WriteMode {
+	case "index":
+	case "update":
+		if c.Elastic.DataStream {
+			errs = append(errs, "elastic.write_mode update does not apply to data streams (snapshots are append-only)")
+		}
+		if c.Elastic.ExternalVersioning {
+			// _update only supports if_seq_no/if_primary_term concurrency control
+			errs = append(errs, "elastic.write_mode update cannot be combined with elastic.external_versioning")
+		}
+	default:
+		errs = append(errs, "elastic.write_mode must be index or update")
+	}
+	if c.Elastic.Flavor != "elasticsearch" && c.Elastic.Flavor != "opensearch" {
+		errs = append(errs, "elastic.flavor must be elasticsearch or opensearch")
+	}
+	if c.Elastic.AWSSigV4 && c.Elastic.AWSService != "es" && c.Elastic.AWSService != "aoss" {
+		errs = append(errs, "elastic.aws_service must be es or aoss")
+	}
+	if c.Elastic.DataStream {
+		for name, v := range map[string]string{
+			"ilm_rollover_max_age": c.Elastic.ILMRolloverMaxAge,
+			"ilm_warm_after":       c.Elastic.ILMWarmAfter,
+			"ilm_delete_after":     c.Elastic.ILMDeleteAfter,
+		} {
+			if v != "" && !esTimeUnit.MatchString(v) {
+				errs = append(errs, fmt.Sprintf("elastic.%s must be an ES time unit like 7d or 12h", name))
+			}
+		}
+		if c.Elastic.ILMRolloverMaxSize != "" && !esByteSize.MatchString(c.Elastic.ILMRolloverMaxSize) {
+			errs = append(errs, "elastic.ilm_rollover_max_size must be an ES byte size like 50gb")
+		}
+	}
+	if (c.Elastic.CertFile == "") != (c.Elastic.KeyFile == "") {
+		errs = append(errs, "elastic.cert_file and elastic.key_file must be set together")
+	}
+	if c.Elastic.MaxIdleConns < 0 {
+		errs = append(errs, "elastic.max_idle_conns must not be negative")
+	}
+	if c.Elastic.RequestTimeout < 0 {
+		errs = append(errs, "elastic.request_timeout must not be negative")
+	}
+	if c.Elastic.BreakerThreshold < 0 {
+		errs = append(errs, "elastic.breaker_threshold must not be negative")
+	}
+	if c.Elastic.BreakerThreshold > 0 && c.Elastic.BreakerProbeInterval <= 0 {
+		errs = append(errs, "elastic.breaker_probe_interval must be positive")
+	}
+	if c.Elastic.QueueFile != "" && c.Elastic.BreakerThreshold == 0 {
+		// Operations are only kept queued while the breaker reports ES down
+		errs = append(errs, "elastic.queue_file requires elastic.breaker_threshold")
+	}
+	if c.Sync.Interval <= 0 {
+		errs = append(errs, "sync.interval must be positive")
+	}
+	if c.ITop.TeamCacheTTL < 0 || c.ITop.TeamCacheSize < 0 {
+		errs = append(errs, "itop.team_cache_ttl and itop.team_cache_size must not be negative")
+	}
+	if c.ITop.SLTCacheTTL < 0 || c.ITop.SLTRefreshInterval < 0 {
+		errs = append(errs, "itop.slt_cache_ttl and itop.slt_refresh_interval must not be negative")
+	}
+	if c.Sync.Workers < 1 {
+		errs = append(errs, "sync.workers must be at least 1")
+	}
+	if c.Sync.FullInterval <= 0 {
+		errs = append(errs, "sync.full_interval must be positive")
+	}
+	if c.HTTP.WebhookEnabled {
+		if c.HTTP.ListenAddr == "" || c.HTTP.ListenAddr == "off" {
+			errs = append(errs, "http.webhook_enabled requires http.listen_addr")
+		}
+		if c.Sync.ReconcileInterval <= 0 {
+			errs = append(errs, "sync.reconcile_interval must be positive")
+		}
+	}
+	if c.Sync.ESReconcileInterval < 0 {
+		errs = append(errs, "sync.es_reconcile_interval must not be negative")
+	}
+	if c.Sync.PurgeAfterDays < 0 {
+		errs = append(errs, "sync.purge_after_days must not be negative")
+	}
+	if c.Sync.MaxDeleteRatio < 0 || c.Sync.MaxDeleteRatio > 1 {
+		errs = append(errs, "sync.max_delete_ratio must be between 0 and 1")
+	}
+	if c.Sync.Jitter < 0 {
+		errs = append(errs, "sync.jitter must not be negative")
+	}
+	if c.Sync.AgeRefreshInterval < 0 {
+		errs = append(errs, "sync.age_refresh_interval must not be negative")
+	}
+	if c.Sync.Throttle {
+		if c.Sync.ThrottleLatency <= 0 {
+			errs = append(errs, "sync.throttle_latency must be positive")
+		}
+		if c.Sync.ThrottleErrorRate <= 0 || c.Sync.ThrottleErrorRate > 1 {
+			errs = append(errs, "sync.throttle_error_rate must be above 0 and at most 1")
+		}
+		if c.Sync.ThrottleMaxFactor < 1 {
+			errs = append(errs, "sync.throttle_max_factor must be at least 1")
+		}
+	}
+	tiers, full := map[string]bool{}, 0
+	for i, t := range c.Sync.Tiers {
+		switch {
+		case t.Name == "":
+			errs = append(errs, fmt.Sprintf("sync.tiers[%d]: name is required", i))
+		case tiers[t.Name]:
+			errs = append(errs, fmt.Sprintf("sync.tiers[%d]: duplicate name %q", i, t.Name))
+		}
+		tiers[t.Name] = true
+		if t.Interval < time.Second {
+			errs = append(errs, fmt.Sprintf("sync.tiers[%s]: interval must be at least 1s", t.Name))
+		}
+		if t.UpdatedWithin < 0 {
+			errs = append(errs, fmt.Sprintf("sync.tiers[%s]: updated_within must not be negative", t.Name))
+		}
+		if t.Full() {
+			full++
+		}
+	}
+	if len(c.Sync.Tiers) > 0 && full != 1 {
+		errs = append(errs, "sync.tiers needs exactly one tier without where and updated_within, the full sync")
+	}
+	for i, o := range c.SLA.SLTOverrides {
+		switch {
+		case o.TTO < 0 || o.TTR < 0 || o.TTOBusinessDays < 0 || o.TTRBusinessDays < 0:
+			errs = append(errs, fmt.Sprintf("sla.slt_overrides[%d]: targets must not be negative", i))
+		case o.TTO > 0 && o.TTOBusinessDays > 0, o.TTR > 0 && o.TTRBusinessDays > 0:
+			errs = append(errs, fmt.Sprintf("sla.slt_overrides[%d]: a target is either a duration or business days", i))
+		case o.TTO == 0 && o.TTR == 0 && o.TTOBusinessDays == 0 && o.TTRBusinessDays == 0:
+			errs = append(errs, fmt.Sprintf("sla.slt_overrides[%d]: no target set", i))
+		}
+	}
+	if c.SLA.AtRiskThreshold < 0 || c.SLA.AtRiskThreshold > 1 {
+		errs = append(errs, "sla.at_risk_threshold must be between 0 and 1")
+	}
+	if _, err := time.Parse("15:04", c.BusinessHours.WorkStart); err != nil {
+		errs = append(errs, "business_hours.work_start must be HH:MM")
+	}
+	if _, err := time.Parse("15:04", c.BusinessHours.WorkEnd); err != nil {
+		errs = append(errs, "business_hours.work_end must be HH:MM")
+	}
+	if _, err := c.BusinessHours.Schedule(); err != nil {
+		errs = append(errs, fmt.Sprintf("business_hours: %v", err))
+	}
+	for name, specs := range c.BusinessHours.CoverageBreaks {
+		if _, err := parseBreaks(specs); err != nil {
+			errs = append(errs, fmt.Sprintf("business_hours.coverage_breaks[%s]: %v", name, err))
+		}
+	}
+	for name, zone := range c.BusinessHours.TeamTimezones {
+		if _, err := time.LoadLocation(zone); err != nil {
+			errs = append(errs, fmt.Sprintf("business_hours.team_timezones[%s]: unknown timezone %q", name, zone))
+		}
+	}
+	for name, zone := range c.BusinessHours.OrgTimezones {
+		if _, err := time.LoadLocation(zone); err != nil {
+			errs = append(errs, fmt.Sprintf("business_hours.org_timezones[%s]: unknown timezone %q", name, zone))
+		}
+	}
+	if c.Retry.MaxAttempts < 1 {
+		errs = append(errs, "retry.max_attempts must be at least 1")
+	}
+	if c.Retry.BaseDelay <= 0 || c.Retry.MaxDelay < c.Retry.BaseDelay {
+		errs = append(errs, "retry.base_delay must be positive and not above retry.max_delay")
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, "log.level must be debug, info, warn or error")
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, "log.format must be json or text")
+	}
+	if c.ReloadInterval < 0 {
+		errs = append(errs, "reload_interval must not be negative")
+	}
+	for i, ch := range c.Notify.Channels {
+		name := ch.Name
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+		switch ch.Type {
+		case "webhook", "slack", "teams":
+			if ch.URL == "" {
+				errs = append(errs, fmt.Sprintf("notify.channels[%s]: url is required", name))
+			}
+		case "email":
+			if ch.SMTPAddr == "" || ch.From == "" || len(ch.To) == 0 {
+				errs = append(errs, fmt.Sprintf("notify.channels[%s]: smtp_addr, from and to are required", name))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("notify.channels[%s]: type must be webhook, slack, teams or email", name))
+		}
+		for _, ev := range ch.Events {
+			if !isNotifyEvent(ev) {
+				errs = append(errs, fmt.Sprintf("notify.channels[%s]: unknown event %q (%s)", name, ev, strings.Join(NotifyEvents, ", ")))
+			}
+		}
+	}
+	if c.Notify.Breaches && len(c.Notify.Channels) == 0 {
+		errs = append(errs, "notify.breaches requires notify.channels")
+	}
+	if c.Leader.Enabled {
+		if c.Output.Type != "elasticsearch" {
+			errs = append(errs, "leader.enabled requires output.type elasticsearch")
+		}
+		if c.Leader.TTL < 3*time.Second {
+			errs = append(errs, "leader.ttl must be at least 3s")
+		}
+		if c.Leader.Index == "" && strings.Contains(c.Elastic.Index, "{") {
+			errs = append(errs, "leader.index must be set when elastic.index is templated")
+		}
+	}
+	names := map[string]bool{}
+	for i, p := range c.Pipelines {
+		switch {
+		case !pipelineName.MatchString(p.Name):
+			errs = append(errs, fmt.Sprintf("pipelines[%d]: name %q must be lowercase letters, digits, - or _", i, p.Name))
+		case names[p.Name]:
+			errs = append(errs, fmt.Sprintf("pipelines[%d]: duplicate name %q", i, p.Name))
+		}
+		names[p.Name] = true
+		if p.Timezone != "" {
+			if _, err := time.LoadLocation(p.Timezone); err != nil {
+				errs = append(errs, fmt.Sprintf("pipelines[%s]: unknown timezone %q", p.Name, p.Timezone))
+			}
+		}
+	}
+	if len(c.Pipelines) > 0 {
+		if c.Output.Type != "elasticsearch" {
+			errs = append(errs, "pipelines require output.type elasticsearch")
+		}
+		// The exported gauges have no pipeline label
+		if c.Sync.ExporterMode {
+			errs = append(errs, "sync.exporter_mode is not supported with pipelines")
+		}
+	}
+	if c.Shard.Total < 0 {
+		errs = append(errs, "shard.total must not be negative")
+	}
+	if c.Shard.Enabled() {
+		if c.Shard.Index < 0 || c.Shard.Index >= c.Shard.Total {
+			errs = append(errs, fmt.Sprintf("shard.index must be between 0 and %d", c.Shard.Total-1))
+		}
+		// Both summarize every ticket, a shard only sees its own
+		if c.Elastic.Rollups {
+			errs = append(errs, "elastic.rollups is not supported with shard.total > 1")
+		}
+		if c.Elastic.Backlog {
+			errs = append(errs, "elastic.backlog is not supported with shard.total > 1")
+		}
+	} else if c.Shard.Index != 0 {
+		errs = append(errs, "shard.index requires shard.total > 1")
+	}
+	if c.Notify.FailedCycles < 0 {
+		errs = append(errs, "notify.failed_cycles must not be negative")
+	}
+	if c.Notify.ErrorRate < 0 || c.Notify.ErrorRate > 1 {
+		errs = append(errs, "notify.error_rate must be between 0 and 1")
+	}
+	if (c.Notify.FailedCycles > 0 || c.Notify.ErrorRate > 0) && len(c.Notify.Channels) == 0 {
+		errs = append(errs, "notify.failed_cycles and notify.error_rate require notify.channels")
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf("unknown timezone %q", c.Timezone))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// SecondaryElasticConfig is the connection to the secondary cluster. Its
+// index defaults to elastic.index; every other setting is shared with elastic.
+type SecondaryElasticConfig struct {
+	URL                string `yaml:"url"`
+	User               string `yaml:"user"`
+	Password           string `yaml:"password"`
+	Index              string `yaml:"index"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	QueueFile          string `yaml:"queue_file"`
+	DeadLetterFile     string `yaml:"dead_letter_file"`
+}
+
+// Secondary returns the settings of the secondary cluster, or false when
+// elastic_secondary is not configured
+func (c *Config) Secondary() (ElasticConfig, bool) {
+	s := c.ElasticSecondary
+	if s.URL == "" {
+		return ElasticConfig{}, false
+	}
+	conf := c.Elastic
+	conf.URL, conf.User, conf.Password = s.URL, s.User, s.Password
+	if s.Index != "" {
+		conf.Index = s.Index
+	}
+	conf.CAFile, conf.CertFile, conf.KeyFile, conf.InsecureSkipVerify = s.CAFile, s.CertFile, s.KeyFile, s.InsecureSkipVerify
+	conf.QueueFile, conf.DeadLetterFile = s.QueueFile, s.DeadLetterFile
+	return conf, true
+}
+
+// History returns the settings of the history index writer, or false when
+// elastic.history is off
+func (c *Config) History() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.History, c.Elastic.HistoryIndex, "history")
+}
+
+// Audit returns the settings of the audit index writer, or false when
+// elastic.audit is off
+func (c *Config) Audit() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.Audit, c.Elastic.AuditIndex, "audit")
+}
+
+// Services returns the settings of the service catalog writer, or false
+// when elastic.services is off
+func (c *Config) Services() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.Services, c.Elastic.ServicesIndex, "services")
+}
+
+// Teams returns the settings of the team writer, or false when
+// elastic.teams is off
+func (c *Config) Teams() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.Teams, c.Elastic.TeamsIndex, "teams")
+}
+
+// Persons returns the settings of the person writer, or false when
+// elastic.persons is off
+func (c *Config) Persons() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.Persons, c.Elastic.PersonsIndex, "persons")
+}
+
+// SLT returns the settings of the SLT definition writer, or false when
+// elastic.slt is off
+func (c *Config) SLT() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.SLT, c.Elastic.SLTIndex, "slt")
+}
+
+// WorkOrders returns the settings of the work order writer, or false when
+// elastic.work_orders is off
+func (c *Config) WorkOrders() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.WorkOrders, c.Elastic.WorkOrdersIndex, "work_orders")
+}
+
+// Rollups returns the settings of the SLA rollup writer, or false when
+// elastic.rollups is off
+func (c *Config) Rollups() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.Rollups, c.Elastic.RollupsIndex, "rollups")
+}
+
+// Backlog returns the settings of the backlog snapshot writer, or false
+// when elastic.backlog is off
+func (c *Config) Backlog() (ElasticConfig, bool) {
+	return c.sideIndex(c.Elastic.Backlog, c.Elastic.BacklogIndex, "backlog")
+}
+
+// LeaderIndex is the index holding the leader election lease
+func (c *Config) LeaderIndex() string {
+	if c.Leader.Index != "" {
+		return c.Leader.Index
+	}
+	return c.Elastic.Index + "-leader"
+}
+
+// sideIndex derives the settings of an append-only index written next to
+// the tickets: plain index writes, with their own queue file
+func (c *Config) sideIndex(enabled bool, index, suffix string) (ElasticConfig, bool) {
+	if !enabled {
+		return ElasticConfig{}, false
+	}
+	conf := c.Elastic
+	conf.Index = index
+	if conf.Index == "" {
+		conf.Index = c.Elastic.Index + "-" + suffix
+	}
+	conf.Alias, conf.DataStream, conf.ExternalVersioning, conf.WriteMode = "", false, false, "index"
+	if conf.QueueFile != "" {
+		conf.QueueFile += "." + suffix
+	}
+	return conf, true
+}
+
+// Reload applies the sections of n that take effect without a restart:
+// business_hours, holidays, sla and sync (but sync.dry_run,
+// sync.dry_run_output and sync.exporter_mode, which select the writers). It
+// returns the other settings that differ, which need a restart.
+func (c *Config) Reload(n *Config) (restart []string) {
+	sync := n.Sync
+	sync.DryRun, sync.DryRunOutput, sync.ExporterMode = c.Sync.DryRun, c.Sync.DryRunOutput, c.Sync.ExporterMode
+	if !reflect.DeepEqual(sync, n.Sync) {
+		restart = append(restart, "sync.dry_run/dry_run_output/exporter_mode")
+	}
+	for name, same := range map[string]bool{
+		"itop":              reflect.DeepEqual(c.ITop, n.ITop),
+		"elastic":           reflect.DeepEqual(c.Elastic, n.Elastic),
+		"elastic_secondary": reflect.DeepEqual(c.ElasticSecondary, n.ElasticSecondary),
+		"output":            reflect.DeepEqual(c.Output, n.Output),
+		"http":              reflect.DeepEqual(c.HTTP, n.HTTP),
+		"log":               reflect.DeepEqual(c.Log, n.Log) && c.Debug == n.Debug,
+		"state":             reflect.DeepEqual(c.State, n.State),
+		"retry":             reflect.DeepEqual(c.Retry, n.Retry),
+		"timezone":          c.Timezone == n.Timezone,
+		"notify":            reflect.DeepEqual(c.Notify, n.Notify),
+		"leader":            c.Leader == n.Leader,
+		"shard":             c.Shard == n.Shard,
+		"source":            c.Source == n.Source,
+	} {
+		if !same {
+			restart = append(restart, name)
+		}
+	}
+	sort.Strings(restart)
+	c.BusinessHours, c.Holidays, c.SLA, c.Sync = n.BusinessHours, n.Holidays, n.SLA, sync
+	c.ReloadInterval = n.ReloadInterval
+	return restart
+}
+
+// Location returns the configured timezone, falling back to local time
+func (c *Config) Location() *time.Location {
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// OQLFor returns the query selecting a class's tickets: the itop.oql
+// override, or SELECT <class>
+func (c ITopConfig) OQLFor(class string) string {
+	if v, ok := c.OQL[strings.ToUpper(class)]; ok {
+		return strings.TrimSpace(v)
+	}
+	if v, ok := c.OQL[class]; ok {
+		return strings.TrimSpace(v)
+	}
+	return "SELECT " + class
+}
+
+// OutputFieldsFor returns the output_fields override for a class, or "" for the default
+func (c ITopConfig) OutputFieldsFor(class string) string {
+	if v, ok := c.OutputFields[strings.ToUpper(class)]; ok {
+		return v
+	}
+	return c.OutputFields[class]
+}
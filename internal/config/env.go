@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envReader applies environment overrides, collecting parse errors
+type envReader struct {
+	errs []string
+}
+
+func (e *envReader) fail(name, val string, err error) {
+	e.errs = append(e.errs, fmt.Sprintf("%s=%q: %v", name, val, err))
+}
+
+func (e *envReader) err() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid environment: %s", strings.Join(e.errs, "; "))
+}
+
+func (e *envReader) str(name string, dst *string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+func (e *envReader) boolean(name string, dst *bool) {
+	if v := os.Getenv(name); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.fail(name, v, err)
+			return
+		}
+		*dst = b
+	}
+}
+
+func (e *envReader) integer(name string, dst *int) {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.fail(name, v, err)
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) float(name string, dst *float64) {
+	if v := os.Getenv(name); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			e.fail(name, v, err)
+			return
+		}
+		*dst = f
+	}
+}
+
+func (e *envReader) duration(name string, dst *time.Duration) {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.fail(name, v, err)
+			return
+		}
+		*dst = d
+	}
+}
+
+// millis reads a plain number of milliseconds (e.g. ITOP_API_RATE_LIMIT_MS=200)
+func (e *envReader) millis(name string, dst *time.Duration) {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			e.fail(name, v, fmt.Errorf("must be a positive number of milliseconds"))
+			return
+		}
+		*dst = time.Duration(n) * time.Millisecond
+	}
+}
+
+// list reads a comma-separated list, ignoring empty items
+func (e *envReader) list(name string, dst *[]string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	if len(out) > 0 {
+		*dst = out
+	}
+}
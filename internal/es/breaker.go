@@ -0,0 +1,90 @@
+package es
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"itop-sla-exporter/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without contacting ES while the circuit breaker is open
+var ErrCircuitOpen = errors.New("elasticsearch unavailable: circuit breaker open")
+
+// breaker opens after threshold consecutive failed requests. While open,
+// requests fail fast; every probeInterval a probe is sent and the circuit
+// closes as soon as one succeeds.
+type breaker struct {
+	threshold     int
+	probeInterval time.Duration
+	target        string // metrics label
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	nextProbe time.Time
+}
+
+func newBreaker(threshold int, probeInterval time.Duration, target string) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, probeInterval: probeInterval, target: target}
+}
+
+// allow reports whether a request may be sent, probing ES when the circuit
+// is open and a probe is due
+func (b *breaker) allow(probe func() error) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if time.Now().Before(b.nextProbe) {
+		return ErrCircuitOpen
+	}
+	if err := probe(); err != nil {
+		b.nextProbe = time.Now().Add(b.probeInterval)
+		slog.Warn("Elasticsearch still unavailable", "err", err)
+		return ErrCircuitOpen
+	}
+	b.open = false
+	b.failures = 0
+	metrics.ESCircuitOpen.Set(0, b.target)
+	slog.Info("Elasticsearch reachable again, resuming writes")
+	return nil
+}
+
+// available reports whether a request would be attempted (circuit closed or probe due)
+func (b *breaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open || !time.Now().Before(b.nextProbe)
+}
+
+// record counts the outcome of a request
+func (b *breaker) record(ok bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if !b.open && b.failures >= b.threshold {
+		b.open = true
+		b.nextProbe = time.Now().Add(b.probeInterval)
+		metrics.ESCircuitOpen.Set(1, b.target)
+		slog.Warn("Elasticsearch circuit breaker open: pausing writes", "failures", b.failures, "probe_interval", b.probeInterval.String())
+	}
+}
@@ -0,0 +1,469 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"itop-sla-exporter/internal/metrics"
+	"itop-sla-exporter/internal/retry"
+)
+
+// BulkItemError describes a single operation rejected in a _bulk response
+type BulkItemError struct {
+	Item   int // position of the operation in the request
+	Action string
+	ID     string
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e BulkItemError) Error() string {
+	return fmt.Sprintf("%s %s: status %d: %s: %s", e.Action, e.ID, e.Status, e.Type, e.Reason)
+}
+
+// BulkResult summarises the outcome of one _bulk request
+type BulkResult struct {
+	Indexed int
+	Updated int
+	Deleted int
+	Stale   int // writes refused because ES holds a newer external version
+	Errors  []BulkItemError
+}
+
+// Versioned documents carry an external version (see elastic.external_versioning)
+type Versioned interface {
+	ExternalVersion() int64
+}
+
+// BulkWriter batches index and delete operations into _bulk requests.
+// A batch is sent when it reaches batchSize operations, when the flush
+// interval elapses, or when Flush is called explicitly. A batch ES did not
+// answer stays buffered from that failure on, and while the circuit breaker
+// is open nothing is sent; with a queue file buffered operations are also
+// staged on disk and replayed after a restart.
+type BulkWriter struct {
+	client        *Client
+	batchSize     int
+	flushInterval time.Duration
+
+	mu    sync.Mutex
+	ops   [][]byte   // NDJSON lines of each queued operation
+	queue *diskQueue // on-disk copy of ops, nil without a queue file
+
+	flushMu sync.Mutex // keeps batches in order across concurrent flushes
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBulkWriter creates a bulk writer configured by the client's bulk_size,
+// bulk_flush_interval, queue_file and dead_letter_file, and starts its
+// background flusher. Operations left in the queue file by a previous run
+// are sent first.
+func NewBulkWriter(client *Client) (*BulkWriter, error) {
+	batchSize := client.Config.BulkSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	w := &BulkWriter{
+		client:        client,
+		batchSize:     batchSize,
+		flushInterval: client.Config.BulkFlushInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if queueFile := client.Config.QueueFile; queueFile != "" {
+		q, ops, err := openQueue(queueFile)
+		if err != nil {
+			return nil, fmt.Errorf("open ES queue: %w", err)
+		}
+		if len(ops) > 0 {
+			slog.Info("Replaying queued ES operations", "file", queueFile, "operations", len(ops))
+		}
+		w.queue, w.ops = q, ops
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *BulkWriter) run() {
+	defer close(w.done)
+	if w.flushInterval <= 0 {
+		<-w.stop
+		return
+	}
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := w.Flush(); err != nil && !errors.Is(err, ErrCircuitOpen) {
+				slog.Error("ES bulk flush failed", "err", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Pending returns the number of operations queued and not yet sent
+func (w *BulkWriter) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.ops)
+}
+
+// Upsert queues a full document index operation, or appends a snapshot in
+// data stream mode. An empty index means elastic.index. With external
+// versioning, a Versioned document is only written if its version is not
+// older than the one in ES. In update write mode the document's fields are
+// merged into the existing one instead.
+func (w *BulkWriter) Upsert(index, id string, doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if w.client.Config.DataStream {
+		return w.add("create", index, id, 0, withTimestamp(data, time.Now()))
+	}
+	if w.client.Config.WriteMode == "update" {
+		merge, err := mergeDoc(doc, data)
+		if err != nil {
+			return err
+		}
+		return w.add("update", index, id, 0, merge)
+	}
+	var version int64
+	if v, ok := doc.(Versioned); ok && w.client.Config.ExternalVersioning {
+		version = v.ExternalVersion()
+	}
+	return w.add("index", index, id, version, data)
+}
+
+// Update queues a partial update that merges fields into an existing
+// document. Data streams are append-only: the fields are written as a new
+// (partial) snapshot instead.
+func (w *BulkWriter) Update(index, id string, partial interface{}) error {
+	if w.client.Config.DataStream {
+		return w.Upsert(index, id, partial)
+	}
+	data, err := json.Marshal(map[string]interface{}{"doc": partial})
+	if err != nil {
+		return err
+	}
+	return w.add("update", index, id, 0, data)
+}
+
+// Delete queues a delete operation
+func (w *BulkWriter) Delete(index, id string) error {
+	if w.client.Config.DataStream {
+		return fmt.Errorf("delete %s: data streams are append-only", id)
+	}
+	return w.add("delete", index, id, 0, nil)
+}
+
+// add queues an operation; a positive version is sent as an external_gte
+// version, which lets a ticket be rewritten at the same last_update (its SLA
+// figures change over time) but never with an older one
+func (w *BulkWriter) add(action, index, id string, version int64, source []byte) error {
+	if index == "" {
+		index = w.client.Config.Index
+	}
+	target := map[string]interface{}{"_index": index, "_id": id}
+	if action == "create" {
+		// Snapshots get generated ids, the ticket is identified by its fields
+		delete(target, "_id")
+	}
+	if version > 0 {
+		target["version"], target["version_type"] = version, "external_gte"
+	}
+	meta := map[string]map[string]interface{}{action: target}
+	metaLine, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	op := append(metaLine, '\n')
+	if source != nil {
+		op = append(append(op, source...), '\n')
+	}
+	w.mu.Lock()
+	if w.queue != nil {
+		if err := w.queue.append(op); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+	}
+	w.ops = append(w.ops, op)
+	full := len(w.ops) >= w.batchSize
+	w.mu.Unlock()
+
+	if full && w.client.Available() {
+		_, err := w.Flush()
+		return err
+	}
+	return nil
+}
+
+// Flush sends all queued operations in batches of batchSize. Per-item
+// failures are logged and returned in the result; the error is only set when
+// a request itself fails. A batch ES did not answer (unreachable, 429, 5xx,
+// circuit breaker open) is kept for the next flush.
+func (w *BulkWriter) Flush() (BulkResult, error) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.syncQueue()
+	res, sent, err := w.flush()
+	if sent {
+		w.compactQueue()
+	}
+	return res, err
+}
+
+// flush sends the queued operations, reporting whether any batch left the queue
+func (w *BulkWriter) flush() (total BulkResult, sent bool, err error) {
+	// Operations refused for load wait for the next flush
+	var again [][]byte
+	defer func() {
+		if len(again) == 0 {
+			return
+		}
+		w.mu.Lock()
+		for _, op := range again {
+			if w.queue != nil {
+				w.queue.append(op)
+			}
+		}
+		w.ops = append(w.ops, again...)
+		w.mu.Unlock()
+	}()
+	for {
+		w.mu.Lock()
+		if len(w.ops) == 0 {
+			w.mu.Unlock()
+			return total, sent, nil
+		}
+		if !w.client.Available() {
+			n := len(w.ops)
+			w.mu.Unlock()
+			return total, sent, fmt.Errorf("%w (%d operations buffered)", ErrCircuitOpen, n)
+		}
+		n := min(len(w.ops), w.batchSize)
+		batch := w.ops[:n:n]
+		w.ops = w.ops[n:]
+		w.mu.Unlock()
+
+		res, err := w.client.Bulk(bytes.Join(batch, nil))
+		again = append(again, w.handleItemErrors(batch, res.Errors)...)
+		total.Indexed += res.Indexed
+		total.Updated += res.Updated
+		total.Deleted += res.Deleted
+		total.Stale += res.Stale
+		if res.Stale > 0 {
+			metrics.StaleWrites.Add(float64(res.Stale), w.client.Target)
+		}
+		total.Errors = append(total.Errors, res.Errors...)
+		if err != nil && unanswered(err) {
+			// Kept, in order, for the next flush (and in the queue file)
+			w.mu.Lock()
+			w.ops = append(batch, w.ops...)
+			w.mu.Unlock()
+			return total, sent, err
+		}
+		sent = true
+		if err != nil {
+			return total, sent, err
+		}
+	}
+}
+
+// mergeDoc is the _update body of an upsert in update write mode: the
+// document's fields, with those it omits (omitempty) set to null so that a
+// cleared value, e.g. the resolution date of a reopened ticket, does not
+// linger. Fields the document does not own are left alone.
+func mergeDoc(doc interface{}, data []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(doc)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if _, ok := fields[name]; !ok {
+				fields[name] = json.RawMessage("null")
+			}
+		}
+	}
+	return json.Marshal(map[string]interface{}{"doc": fields, "doc_as_upsert": true})
+}
+
+// withTimestamp adds the @timestamp field data streams require to a JSON object
+func withTimestamp(data []byte, t time.Time) []byte {
+	ts, _ := json.Marshal(t.UTC())
+	out := append([]byte(`{"@timestamp":`), ts...)
+	if rest := bytes.TrimSpace(data[1:]); len(rest) > 1 {
+		out = append(out, ',')
+	}
+	return append(out, data[1:]...)
+}
+
+// handleItemErrors dead-letters the operations ES rejected, except those
+// refused for load (429) which are returned to be sent again
+func (w *BulkWriter) handleItemErrors(batch [][]byte, errs []BulkItemError) (again [][]byte) {
+	var letters []DeadLetter
+	for _, e := range errs {
+		slog.Warn("ES bulk item error", "action", e.Action, "id", e.ID, "status", e.Status, "type", e.Type, "reason", e.Reason)
+		metrics.Errors.Inc(w.client.Target)
+		if e.Item < 0 || e.Item >= len(batch) {
+			continue
+		}
+		if e.Status == http.StatusTooManyRequests {
+			again = append(again, batch[e.Item])
+			continue
+		}
+		letters = append(letters, newDeadLetter(batch[e.Item], e))
+	}
+	if err := w.deadLetters(letters); err != nil {
+		slog.Error("Failed to write dead letters", "file", w.client.Config.DeadLetterFile, "count", len(letters), "err", err)
+	}
+	return again
+}
+
+// syncQueue makes the queued operations durable before they are sent
+func (w *BulkWriter) syncQueue() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.queue == nil {
+		return
+	}
+	if err := w.queue.sync(); err != nil {
+		slog.Error("Failed to sync ES queue", "file", w.queue.path, "err", err)
+	}
+}
+
+// compactQueue drops sent operations from the queue file
+func (w *BulkWriter) compactQueue() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.queue == nil {
+		return
+	}
+	if err := w.queue.rewrite(w.ops); err != nil {
+		slog.Error("Failed to compact ES queue", "file", w.queue.path, "err", err)
+	}
+}
+
+// Close flushes remaining operations and stops the background flusher;
+// operations that could not be sent stay in the queue file
+func (w *BulkWriter) Close() error {
+	close(w.stop)
+	<-w.done
+	_, err := w.Flush()
+	if w.queue != nil {
+		if qerr := w.queue.close(); err == nil {
+			err = qerr
+		}
+	}
+	return err
+}
+
+// Bulk sends an NDJSON body to the _bulk endpoint and parses per-item results
+func (c *Client) Bulk(body []byte) (BulkResult, error) {
+	var res BulkResult
+	err := c.Retry.Do(c.Target+"_bulk", func() error {
+		resp, err := c.Do("POST", "/_bulk", "application/x-ndjson", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode >= 300 {
+			return retry.Status(resp, fmt.Errorf("bulk request failed: %w", &StatusError{Status: resp.StatusCode, Body: string(respBody)}))
+		}
+		if res, err = parseBulkResponse(respBody); err != nil {
+			return retry.Permanent(fmt.Errorf("%w: %v", errBulkResponse, err))
+		}
+		return nil
+	})
+	return res, err
+}
+
+// errBulkResponse is a _bulk response that could not be read: ES answered
+var errBulkResponse = errors.New("unreadable bulk response")
+
+// unanswered reports whether a failed _bulk request may not have been
+// applied (transport error, 429, 5xx), so its batch must be sent again;
+// other failures are answers ES would repeat
+func unanswered(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Status == http.StatusTooManyRequests || se.Status >= 500
+	}
+	return !errors.Is(err, errBulkResponse)
+}
+
+func parseBulkResponse(body []byte) (BulkResult, error) {
+	var parsed struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string `json:"_id"`
+			Status int    `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return BulkResult{}, err
+	}
+	var res BulkResult
+	for i, item := range parsed.Items {
+		for action, r := range item {
+			switch {
+			case r.Status < 300:
+				switch action {
+				case "delete":
+					res.Deleted++
+				case "update":
+					res.Updated++
+				default:
+					res.Indexed++
+				}
+			case action == "delete" && r.Status == 404:
+				// Already gone, nothing to do
+			case action == "index" && r.Status == 409 && r.Error != nil && r.Error.Type == "version_conflict_engine_exception":
+				// Only versioned writes conflict: ES already has newer data
+				res.Stale++
+			default:
+				e := BulkItemError{Item: i, Action: action, ID: r.ID, Status: r.Status}
+				if r.Error != nil {
+					e.Type = r.Error.Type
+					e.Reason = r.Error.Reason
+				}
+				res.Errors = append(res.Errors, e)
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,253 @@
+package es
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"itop-sla-exporter/internal/config"
+	"itop-sla-exporter/internal/metrics"
+	"itop-sla-exporter/internal/retry"
+)
+
+// Client is a thin wrapper around the elasticsearch REST API
+type Client struct {
+	Config config.ElasticConfig
+	HTTP   *http.Client
+	Retry  retry.Policy // applied to search, bulk and delete requests
+	Target string       // metrics label and retry op prefix: "es", or "es_secondary"
+
+	nodes   *nodePool
+	breaker *breaker     // nil when elastic.breaker_threshold is 0
+	signer  *sigV4Signer // nil unless elastic.aws_sigv4
+}
+
+// StatusError is an unexpected HTTP status from ES with the response body
+type StatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, e.Body)
+}
+
+// NewClient creates a client for the given config, with its own pooled
+// transport: max_idle_conns keep-alive connections to the cluster, each
+// request bounded by request_timeout
+func NewClient(conf config.ElasticConfig, retryConf config.RetryConfig) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = conf.MaxIdleConns
+	if conf.CAFile != "" || conf.CertFile != "" || conf.InsecureSkipVerify {
+		tlsConf, err := tlsConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConf
+	}
+	c := &Client{
+		Config: conf,
+		HTTP:   &http.Client{Transport: transport, Timeout: conf.RequestTimeout},
+		Retry:  retry.New(retryConf),
+		Target: "es",
+
+		nodes:   newNodePool(conf.URL),
+		breaker: newBreaker(conf.BreakerThreshold, conf.BreakerProbeInterval, "es"),
+	}
+	if conf.AWSSigV4 {
+		c.signer = newSigV4Signer(conf.AWSRegion, conf.AWSService)
+		if c.signer.region == "" {
+			return nil, fmt.Errorf("elastic.aws_sigv4 needs elastic.aws_region or AWS_REGION")
+		}
+	}
+	if conf.Sniff {
+		go c.sniffLoop(conf.SniffInterval)
+	}
+	return c, nil
+}
+
+// SetTarget names the cluster in metrics, e.g. "es_secondary"
+func (c *Client) SetTarget(target string) {
+	c.Target = target
+	if c.breaker != nil {
+		c.breaker.target = target
+	}
+}
+
+// tlsConfig builds the TLS settings: private CA, client certificate, skip verify
+func tlsConfig(conf config.ElasticConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.InsecureSkipVerify {
+		slog.Warn("Elasticsearch TLS certificate verification is disabled")
+	}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("elastic CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("elastic CA file %s: no PEM certificate found", conf.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("elastic client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// Do sends a request to path (relative to the cluster URL) with basic auth if
+// configured. While the circuit breaker is open it fails fast with ErrCircuitOpen.
+func (c *Client) Do(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	if err := c.breaker.allow(c.probe); err != nil {
+		return nil, retry.Permanent(err)
+	}
+	resp, err := c.send(method, path, contentType, body)
+	c.breaker.record(err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests)
+	return resp, err
+}
+
+// Available reports whether ES requests are being sent, i.e. the circuit
+// breaker is closed or due for a probe
+func (c *Client) Available() bool {
+	return c.breaker.available()
+}
+
+// Info returns the distribution ("elasticsearch" or "opensearch") and version of the cluster
+func (c *Client) Info() (distribution, version string, err error) {
+	resp, err := c.Do("GET", "/", "", nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return "", "", &StatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	var info struct {
+		Version struct {
+			Distribution string `json:"distribution"`
+			Number       string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", "", err
+	}
+	if info.Version.Distribution == "" {
+		info.Version.Distribution = "elasticsearch"
+	}
+	return info.Version.Distribution, info.Version.Number, nil
+}
+
+// probe checks the cluster answers, bypassing the circuit breaker
+func (c *Client) probe() error {
+	resp, err := c.send("GET", "/", "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// send tries the nodes in turn until one answers; HTTP errors are returned
+// as is, only unreachable nodes fail over
+func (c *Client) send(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	// The payload is kept to be sent again to another node, and SigV4 signs
+	// a hash of it (as sent)
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
+		if c.Config.Compression {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(payload)
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			payload = buf.Bytes()
+		}
+	}
+	var lastErr error
+	for _, node := range c.nodes.order() {
+		resp, err := c.sendTo(node, method, path, contentType, payload, body != nil)
+		if err == nil {
+			c.nodes.markAlive(node)
+			return resp, nil
+		}
+		c.nodes.markDead(node)
+		slog.Warn("Elasticsearch node unreachable", "node", node, "err", err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no Elasticsearch node configured")
+	}
+	return nil, lastErr
+}
+
+func (c *Client) sendTo(node, method, path, contentType string, payload []byte, hasBody bool) (*http.Response, error) {
+	var body io.Reader
+	if hasBody {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, node+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if hasBody && c.Config.Compression {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.signer != nil {
+		if err := c.signer.sign(req, payload, time.Now()); err != nil {
+			return nil, err
+		}
+	} else if c.Config.User != "" {
+		req.SetBasicAuth(c.Config.User, c.Config.Password)
+	}
+	start := time.Now()
+	resp, err := c.HTTP.Do(req)
+	metrics.APILatency.Observe(time.Since(start).Seconds(), c.Target)
+	if err != nil || (resp.StatusCode >= 300 && resp.StatusCode != 404) {
+		metrics.Errors.Inc(c.Target)
+	}
+	return resp, err
+}
+
+// Ping checks that the cluster is reachable and the credentials are accepted
+func (c *Client) Ping() error {
+	resp, err := c.Do("GET", "/", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package es
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"itop-sla-exporter/internal/metrics"
+)
+
+// DeadLetter is a bulk operation ES rejected (e.g. a mapping error), kept
+// with the error so it can be fixed and replayed
+type DeadLetter struct {
+	Time    time.Time       `json:"time"`
+	Action  string          `json:"action"`
+	Index   string          `json:"index"`
+	ID      string          `json:"id"`
+	Version int64           `json:"version,omitempty"` // external version, if any
+	Status  int             `json:"status"`
+	Type    string          `json:"type"`
+	Reason  string          `json:"reason"`
+	Source  json.RawMessage `json:"source,omitempty"`
+}
+
+// deadLetters appends the rejected operations to the dead-letter file. The
+// file is opened per call so it can be moved away by replay-dlq at any time.
+func (w *BulkWriter) deadLetters(letters []DeadLetter) error {
+	for _, dl := range letters {
+		metrics.DeadLetters.Inc(w.client.Target, dl.Type)
+	}
+	path := w.client.Config.DeadLetterFile
+	if path == "" || len(letters) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, dl := range letters {
+		enc.Encode(dl)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// newDeadLetter pairs a rejected operation (its NDJSON lines) with the item error
+func newDeadLetter(op []byte, e BulkItemError) DeadLetter {
+	dl := DeadLetter{Time: time.Now().UTC(), Action: e.Action, ID: e.ID, Status: e.Status, Type: e.Type, Reason: e.Reason}
+	lines := bytes.SplitN(bytes.TrimSuffix(op, []byte("\n")), []byte("\n"), 2)
+	var meta map[string]struct {
+		Index   string `json:"_index"`
+		Version int64  `json:"version"`
+	}
+	if json.Unmarshal(lines[0], &meta) == nil {
+		dl.Index, dl.Version = meta[e.Action].Index, meta[e.Action].Version
+	}
+	if len(lines) == 2 {
+		dl.Source = json.RawMessage(lines[1])
+	}
+	return dl
+}
+
+// ReadDeadLetters reads a dead-letter file
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []DeadLetter
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		out = append(out, dl)
+	}
+	return out, sc.Err()
+}
+
+// Replay queues a dead-lettered operation again, as it was first sent
+func (w *BulkWriter) Replay(dl DeadLetter) error {
+	var source []byte
+	if len(dl.Source) > 0 {
+		source = dl.Source
+	}
+	return w.add(dl.Action, dl.Index, dl.ID, dl.Version, source)
+}
@@ -0,0 +1,127 @@
+package es
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// LifecyclePolicyName is the ILM/ISM policy governing the data stream
+func (c *Client) LifecyclePolicyName() string {
+	if c.Config.ILMPolicy != "" {
+		return c.Config.ILMPolicy
+	}
+	return c.BaseName() + "-policy"
+}
+
+// EnsureLifecyclePolicy creates or updates the hot → warm → delete policy of
+// the data stream: an ILM policy on Elasticsearch, an ISM policy attached to
+// the backing indices on OpenSearch
+func (c *Client) EnsureLifecyclePolicy() error {
+	name := c.LifecyclePolicyName()
+	if c.Config.Flavor == "opensearch" {
+		return c.putISMPolicy(name)
+	}
+	hot := map[string]interface{}{}
+	rollover := map[string]interface{}{}
+	if c.Config.ILMRolloverMaxAge != "" {
+		rollover["max_age"] = c.Config.ILMRolloverMaxAge
+	}
+	if c.Config.ILMRolloverMaxSize != "" {
+		rollover["max_primary_shard_size"] = c.Config.ILMRolloverMaxSize
+	}
+	if len(rollover) > 0 {
+		hot["rollover"] = rollover
+	}
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{"actions": hot},
+	}
+	if c.Config.ILMWarmAfter != "" {
+		phases["warm"] = map[string]interface{}{
+			"min_age": c.Config.ILMWarmAfter,
+			"actions": map[string]interface{}{"forcemerge": map[string]interface{}{"max_num_segments": 1}},
+		}
+	}
+	if c.Config.ILMDeleteAfter != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": c.Config.ILMDeleteAfter,
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+	if err := c.putJSON("/_ilm/policy/"+name, map[string]interface{}{"policy": map[string]interface{}{"phases": phases}}); err != nil {
+		return fmt.Errorf("put ILM policy: %w", err)
+	}
+	return nil
+}
+
+// putISMPolicy creates or updates an OpenSearch ISM policy. Updates must
+// carry the sequence number of the current version.
+func (c *Client) putISMPolicy(name string) error {
+	type transition struct {
+		StateName  string            `json:"state_name"`
+		Conditions map[string]string `json:"conditions"`
+	}
+	type state struct {
+		Name        string                   `json:"name"`
+		Actions     []map[string]interface{} `json:"actions"`
+		Transitions []transition             `json:"transitions"`
+	}
+	hot := state{Name: "hot", Actions: []map[string]interface{}{}, Transitions: []transition{}}
+	rollover := map[string]string{}
+	if c.Config.ILMRolloverMaxAge != "" {
+		rollover["min_index_age"] = c.Config.ILMRolloverMaxAge
+	}
+	if c.Config.ILMRolloverMaxSize != "" {
+		rollover["min_primary_shard_size"] = c.Config.ILMRolloverMaxSize
+	}
+	if len(rollover) > 0 {
+		hot.Actions = append(hot.Actions, map[string]interface{}{"rollover": rollover})
+	}
+	states := []*state{&hot}
+	if c.Config.ILMWarmAfter != "" {
+		warm := &state{Name: "warm", Actions: []map[string]interface{}{{"force_merge": map[string]int{"max_num_segments": 1}}}, Transitions: []transition{}}
+		states[len(states)-1].Transitions = append(states[len(states)-1].Transitions, transition{"warm", map[string]string{"min_index_age": c.Config.ILMWarmAfter}})
+		states = append(states, warm)
+	}
+	if c.Config.ILMDeleteAfter != "" {
+		del := &state{Name: "delete", Actions: []map[string]interface{}{{"delete": map[string]interface{}{}}}, Transitions: []transition{}}
+		states[len(states)-1].Transitions = append(states[len(states)-1].Transitions, transition{"delete", map[string]string{"min_index_age": c.Config.ILMDeleteAfter}})
+		states = append(states, del)
+	}
+	policy := map[string]interface{}{"policy": map[string]interface{}{
+		"description":   "iTop ticket snapshots",
+		"default_state": "hot",
+		"states":        states,
+		"ism_template": []map[string]interface{}{
+			{"index_patterns": []string{".ds-" + c.IndexPattern() + "-*"}, "priority": 100},
+		},
+	}}
+	path := "/_plugins/_ism/policies/" + name
+	err := c.putJSON(path, policy)
+	var se *StatusError
+	if !errors.As(err, &se) || se.Status != 409 {
+		if err != nil {
+			return fmt.Errorf("put ISM policy: %w", err)
+		}
+		return nil
+	}
+	// The policy exists: update it at its current version
+	resp, err := c.Do("GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	var current struct {
+		SeqNo       int64 `json:"_seq_no"`
+		PrimaryTerm int64 `json:"_primary_term"`
+	}
+	if resp.StatusCode >= 300 || json.Unmarshal(body, &current) != nil {
+		return fmt.Errorf("get ISM policy: status %d: %s", resp.StatusCode, string(body))
+	}
+	if err := c.putJSON(fmt.Sprintf("%s?if_seq_no=%d&if_primary_term=%d", path, current.SeqNo, current.PrimaryTerm), policy); err != nil {
+		return fmt.Errorf("update ISM policy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package es
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+)
+
+// Lock is a lease kept in an Elasticsearch document, for leader election
+// between replicas: the holder renews it before it expires, any other
+// holder may take it over once it has. Updates are conditional on the
+// sequence number read, so two replicas can't both win a takeover. Expiry
+// is judged on local clocks, so the TTL must exceed the clock skew.
+type Lock struct {
+	client *Client
+	path   string // /<index>/_doc/<name>
+	create string // /<index>/_create/<name>
+	holder string
+	ttl    time.Duration
+}
+
+// lockDoc is the lease document
+type lockDoc struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RenewedAt time.Time `json:"renewed_at"`
+}
+
+// NewLock creates a lease named name in index, held as holder for ttl from
+// each successful TryAcquire
+func (c *Client) NewLock(index, name, holder string, ttl time.Duration) *Lock {
+	index, name = url.PathEscape(index), url.PathEscape(name)
+	return &Lock{client: c, path: "/" + index + "/_doc/" + name, create: "/" + index + "/_create/" + name, holder: holder, ttl: ttl}
+}
+
+// TryAcquire takes the lease when it is free or expired, or renews it when
+// already held; it reports whether the lease is held on return
+func (l *Lock) TryAcquire() (bool, error) {
+	return l.update(l.ttl)
+}
+
+// Release gives the lease up, if held, so a standby can take it at once
+func (l *Lock) Release() error {
+	_, err := l.update(0)
+	return err
+}
+
+// update writes the lease, held for ttl, unless another holder has it
+func (l *Lock) update(ttl time.Duration) (bool, error) {
+	resp, err := l.client.Do("GET", l.path, "", nil)
+	if err != nil {
+		return false, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	now := time.Now().UTC()
+	lease := lockDoc{Holder: l.holder, ExpiresAt: now.Add(ttl), RenewedAt: now}
+	switch {
+	case resp.StatusCode == 404:
+		if ttl == 0 {
+			return false, nil
+		}
+		return l.write(l.create, lease)
+	case resp.StatusCode >= 300:
+		return false, &StatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	var current struct {
+		SeqNo       int64   `json:"_seq_no"`
+		PrimaryTerm int64   `json:"_primary_term"`
+		Source      lockDoc `json:"_source"`
+	}
+	if err := json.Unmarshal(body, &current); err != nil {
+		return false, fmt.Errorf("decode lock: %w", err)
+	}
+	if current.Source.Holder != l.holder && (ttl == 0 || now.Before(current.Source.ExpiresAt)) {
+		return false, nil
+	}
+	return l.write(fmt.Sprintf("%s?if_seq_no=%d&if_primary_term=%d", l.path, current.SeqNo, current.PrimaryTerm), lease)
+}
+
+// write stores the lease; a conflict means another holder won the race
+func (l *Lock) write(path string, lease lockDoc) (bool, error) {
+	err := l.client.putJSON(path, lease)
+	var se *StatusError
+	if errors.As(err, &se) && se.Status == 409 {
+		return false, nil
+	}
+	return err == nil, err
+}
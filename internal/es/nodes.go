@@ -0,0 +1,153 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadNodeTimeout is how long an unreachable node is skipped
+const deadNodeTimeout = 30 * time.Second
+
+// nodePool spreads requests round-robin over the cluster nodes. A node that
+// cannot be reached is skipped for deadNodeTimeout; when every node is down
+// they are all tried anyway.
+type nodePool struct {
+	mu   sync.Mutex
+	urls []string
+	next int
+	dead map[string]time.Time
+}
+
+// newNodePool parses a comma-separated list of node URLs
+func newNodePool(list string) *nodePool {
+	p := &nodePool{dead: map[string]time.Time{}}
+	p.set(splitNodes(list))
+	return p
+}
+
+func splitNodes(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// set replaces the nodes, e.g. with the result of sniffing
+func (p *nodePool) set(urls []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.urls = urls
+	for u := range p.dead {
+		if !containsNode(urls, u) {
+			delete(p.dead, u)
+		}
+	}
+}
+
+func containsNode(urls []string, u string) bool {
+	for _, v := range urls {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// order returns the nodes to try for one request: the live ones starting
+// with the next in turn, then the dead ones as a last resort
+func (p *nodePool) order() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.urls)
+	var live, dead []string
+	for i := 0; i < n; i++ {
+		u := p.urls[(p.next+i)%n]
+		if until, ok := p.dead[u]; ok && time.Now().Before(until) {
+			dead = append(dead, u)
+		} else {
+			live = append(live, u)
+		}
+	}
+	if n > 0 {
+		p.next = (p.next + 1) % n
+	}
+	return append(live, dead...)
+}
+
+func (p *nodePool) markDead(u string) {
+	p.mu.Lock()
+	p.dead[u] = time.Now().Add(deadNodeTimeout)
+	p.mu.Unlock()
+}
+
+func (p *nodePool) markAlive(u string) {
+	p.mu.Lock()
+	delete(p.dead, u)
+	p.mu.Unlock()
+}
+
+// sniff replaces the configured nodes with the HTTP addresses the cluster
+// publishes, keeping the scheme of the configured URLs
+func (c *Client) sniff() error {
+	resp, err := c.send("GET", "/_nodes/http", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return &StatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	var parsed struct {
+		Nodes map[string]struct {
+			HTTP struct {
+				PublishAddress string `json:"publish_address"`
+			} `json:"http"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return err
+	}
+	scheme := "http"
+	if seed, err := url.Parse(splitNodes(c.Config.URL)[0]); err == nil && seed.Scheme != "" {
+		scheme = seed.Scheme
+	}
+	var urls []string
+	for _, n := range parsed.Nodes {
+		addr := n.HTTP.PublishAddress
+		if addr == "" {
+			continue
+		}
+		// "hostname/ip:port" when the node has a hostname: prefer the
+		// hostname, which TLS certificates are issued for
+		if host, rest, ok := strings.Cut(addr, "/"); ok {
+			addr = host + rest[strings.LastIndex(rest, ":"):]
+		}
+		urls = append(urls, scheme+"://"+addr)
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("no node publishes an HTTP address")
+	}
+	c.nodes.set(urls)
+	slog.Debug("Sniffed Elasticsearch nodes", "nodes", urls)
+	return nil
+}
+
+// sniffLoop refreshes the node list every interval
+func (c *Client) sniffLoop(interval time.Duration) {
+	for {
+		if err := c.sniff(); err != nil {
+			slog.Warn("Elasticsearch node sniffing failed, keeping the current nodes", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
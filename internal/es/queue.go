@@ -0,0 +1,111 @@
+package es
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+)
+
+// diskQueue is an append-only file mirroring the operations buffered by a
+// BulkWriter, so they survive a restart while ES is unreachable. Each line
+// holds one operation as a JSON array of its NDJSON lines (action metadata,
+// then the source when there is one).
+type diskQueue struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+// openQueue opens (or creates) the queue file and returns the operations it holds
+func openQueue(path string) (*diskQueue, [][]byte, error) {
+	var ops [][]byte
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	torn := false
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var parts []json.RawMessage
+		if err := json.Unmarshal(line, &parts); err != nil || len(parts) == 0 {
+			// Torn write after a crash: keep the operations before it
+			slog.Warn("Ignoring invalid queued ES operation", "file", path, "line", i+1)
+			torn = true
+			break
+		}
+		var op []byte
+		for _, p := range parts {
+			op = append(append(op, p...), '\n')
+		}
+		ops = append(ops, op)
+	}
+	q := &diskQueue{path: path}
+	if err := q.open(os.O_APPEND); err != nil {
+		return nil, nil, err
+	}
+	if torn {
+		if err := q.rewrite(ops); err != nil {
+			return nil, nil, err
+		}
+	}
+	return q, ops, nil
+}
+
+func (q *diskQueue) open(flag int) error {
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return err
+	}
+	q.f = f
+	q.w = bufio.NewWriter(f)
+	return nil
+}
+
+// append queues one operation (its NDJSON lines)
+func (q *diskQueue) append(op []byte) error {
+	lines := bytes.Split(bytes.TrimSuffix(op, []byte("\n")), []byte("\n"))
+	q.w.WriteByte('[')
+	q.w.Write(bytes.Join(lines, []byte(",")))
+	_, err := q.w.WriteString("]\n")
+	return err
+}
+
+// sync makes the queued operations durable
+func (q *diskQueue) sync() error {
+	if err := q.w.Flush(); err != nil {
+		return err
+	}
+	return q.f.Sync()
+}
+
+// rewrite replaces the file content with ops (the operations not yet sent)
+func (q *diskQueue) rewrite(ops [][]byte) error {
+	tmp := &diskQueue{path: q.path + ".tmp"}
+	if err := tmp.open(os.O_TRUNC); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		tmp.append(op)
+	}
+	if err := tmp.close(); err != nil {
+		return err
+	}
+	q.f.Close()
+	if err := os.Rename(tmp.path, q.path); err != nil {
+		q.open(os.O_APPEND)
+		return err
+	}
+	return q.open(os.O_APPEND)
+}
+
+func (q *diskQueue) close() error {
+	if err := q.sync(); err != nil {
+		q.f.Close()
+		return err
+	}
+	return q.f.Close()
+}
@@ -0,0 +1,143 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// ResolveAlias returns the indices behind name when it is an alias; ok is
+// false when name is not an alias (a concrete index, or nothing yet)
+func (c *Client) ResolveAlias(name string) (indices []string, ok bool, err error) {
+	resp, err := c.Do("GET", "/_alias/"+name, "", nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == 404 {
+		return nil, false, nil
+	}
+	if resp.StatusCode >= 300 {
+		return nil, false, &StatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, false, err
+	}
+	for index := range parsed {
+		indices = append(indices, index)
+	}
+	return indices, true, nil
+}
+
+// CreateIndex creates an index with the given field mappings
+func (c *Client) CreateIndex(name string, properties map[string]interface{}) error {
+	return c.putJSON("/"+name, map[string]interface{}{
+		"mappings": map[string]interface{}{"properties": properties},
+	})
+}
+
+// DeleteIndex deletes an index
+func (c *Client) DeleteIndex(name string) error {
+	resp, err := c.Do("DELETE", "/"+name, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// Reindex copies the documents of src matching query (all when nil) into
+// dst server-side, polling the reindex task until it finishes, and returns
+// how many documents were written
+func (c *Client) Reindex(src, dst string, query map[string]interface{}) (int, error) {
+	source := map[string]interface{}{"index": src}
+	if query != nil {
+		source["query"] = query
+	}
+	dest := map[string]interface{}{"index": dst, "op_type": "index"}
+	req := map[string]interface{}{"source": source, "dest": dest}
+	if c.Config.ExternalVersioning {
+		// Keep the last_update versions instead of restarting at 1; documents
+		// already copied at the same version are skipped
+		dest["version_type"] = "external"
+		req["conflicts"] = "proceed"
+	}
+	data, _ := json.Marshal(req)
+	resp, err := c.Do("POST", "/_reindex?wait_for_completion=false", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, &StatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	var started struct {
+		Task string `json:"task"`
+	}
+	if err := json.Unmarshal(body, &started); err != nil || started.Task == "" {
+		return 0, fmt.Errorf("unexpected reindex response: %s", string(body))
+	}
+	for {
+		time.Sleep(2 * time.Second)
+		resp, err := c.Do("GET", "/_tasks/"+started.Task, "", nil)
+		if err != nil {
+			return 0, err
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return 0, &StatusError{Status: resp.StatusCode, Body: string(body)}
+		}
+		var task struct {
+			Completed bool `json:"completed"`
+			Error     *struct {
+				Reason string `json:"reason"`
+			} `json:"error"`
+			Response struct {
+				Created  int               `json:"created"`
+				Updated  int               `json:"updated"`
+				Failures []json.RawMessage `json:"failures"`
+			} `json:"response"`
+		}
+		if err := json.Unmarshal(body, &task); err != nil {
+			return 0, err
+		}
+		if !task.Completed {
+			continue
+		}
+		written := task.Response.Created + task.Response.Updated
+		if task.Error != nil {
+			return written, errors.New(task.Error.Reason)
+		}
+		if len(task.Response.Failures) > 0 {
+			return written, fmt.Errorf("%d documents failed, first: %s", len(task.Response.Failures), string(task.Response.Failures[0]))
+		}
+		return written, nil
+	}
+}
+
+// SwapAlias atomically points alias at index (as its write index). The
+// indices in from lose the alias; when replaceIndex is set, alias is the name
+// of a concrete index which is deleted in the same request.
+func (c *Client) SwapAlias(alias, index string, from []string, replaceIndex bool) error {
+	actions := []map[string]interface{}{
+		{"add": map[string]interface{}{"index": index, "alias": alias, "is_write_index": true}},
+	}
+	for _, old := range from {
+		actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": old, "alias": alias}})
+	}
+	if replaceIndex {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]string{"index": alias}})
+	}
+	return c.postJSON("/_aliases", map[string]interface{}{"actions": actions})
+}
@@ -0,0 +1,58 @@
+package es
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// indexPlaceholder matches the {...} parts of a templated elastic.index
+var indexPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// IndexFor resolves the index (or data stream) a ticket is written to.
+// elastic.index may contain {class} (lower-cased ticket class) and date
+// placeholders formatted from the ticket's start date with yyyy, MM and dd,
+// e.g. itop-{class}-write or itop-tickets-{yyyy.MM}. Routing on the start
+// date keeps every ticket in one index for its whole life.
+func (c *Client) IndexFor(class string, start time.Time) string {
+	if !c.Templated() {
+		return c.Config.Index
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+	return indexPlaceholder.ReplaceAllStringFunc(c.Config.Index, func(m string) string {
+		name := m[1 : len(m)-1]
+		if name == "class" {
+			return strings.ToLower(class)
+		}
+		layout := strings.NewReplacer("yyyy", "2006", "MM", "01", "dd", "02").Replace(name)
+		return start.UTC().Format(layout)
+	})
+}
+
+// Templated reports whether elastic.index contains placeholders
+func (c *Client) Templated() bool {
+	return indexPlaceholder.MatchString(c.Config.Index)
+}
+
+// IndexPattern is elastic.index with its placeholders as wildcards, matching
+// every index it can resolve to
+func (c *Client) IndexPattern() string {
+	return indexPlaceholder.ReplaceAllString(c.Config.Index, "*")
+}
+
+// ReadTarget is what searches and delete-by-query run against: the alias
+// when one is configured, else the index pattern
+func (c *Client) ReadTarget() string {
+	if c.Config.Alias != "" {
+		return c.Config.Alias
+	}
+	return c.IndexPattern()
+}
+
+// BaseName is elastic.index without placeholder braces, used to name the
+// index template and lifecycle policy
+func (c *Client) BaseName() string {
+	return strings.ToLower(indexPlaceholder.ReplaceAllString(c.Config.Index, "$1"))
+}
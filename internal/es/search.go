@@ -0,0 +1,119 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"itop-sla-exporter/internal/retry"
+)
+
+// Hit is a single document returned by a search
+type Hit struct {
+	ID     string          `json:"_id"`
+	Index  string          `json:"_index"`
+	Source json.RawMessage `json:"_source"`
+}
+
+type searchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []Hit `json:"hits"`
+	} `json:"hits"`
+}
+
+// scrollKeepAlive is how long ES keeps the scroll context between pages
+const scrollKeepAlive = "1m"
+
+// ScrollAll reads every document of the index using the scroll API, pageSize
+// docs per request (by @timestamp for data streams); when fields are given
+// only those are returned in _source
+func (c *Client) ScrollAll(pageSize int, fields ...string) ([]Hit, error) {
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	path := fmt.Sprintf("/%s/_search?scroll=%s&size=%d", c.ReadTarget(), scrollKeepAlive, pageSize)
+	body := map[string]interface{}{"sort": []string{"_doc"}}
+	if c.Config.DataStream {
+		// Oldest snapshots first, so the latest one of each ticket is read last
+		body["sort"] = []string{"@timestamp"}
+	}
+	if len(fields) > 0 {
+		body["_source"] = fields
+	}
+	query, _ := json.Marshal(body)
+	page, err := c.search(path, query)
+	if err != nil {
+		return nil, err
+	}
+	var out []Hit
+	scrollID := page.ScrollID
+	defer func() {
+		if scrollID != "" {
+			c.clearScroll(scrollID)
+		}
+	}()
+	for len(page.Hits.Hits) > 0 {
+		out = append(out, page.Hits.Hits...)
+		if scrollID == "" {
+			break
+		}
+		next, _ := json.Marshal(map[string]string{"scroll": scrollKeepAlive, "scroll_id": scrollID})
+		page, err = c.search("/_search/scroll", next)
+		if err != nil {
+			return nil, err
+		}
+		if page.ScrollID != "" {
+			scrollID = page.ScrollID
+		}
+	}
+	return out, nil
+}
+
+func (c *Client) search(path string, query []byte) (searchResponse, error) {
+	var result searchResponse
+	err := c.Retry.Do(c.Target+"_search", func() error {
+		resp, err := c.Do("POST", path, "application/json", bytes.NewReader(query))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode >= 300 {
+			return retry.Status(resp, fmt.Errorf("search failed: %w", &StatusError{Status: resp.StatusCode, Body: string(body)}))
+		}
+		return retry.Permanent(json.Unmarshal(body, &result))
+	})
+	return result, err
+}
+
+func (c *Client) clearScroll(scrollID string) {
+	body, _ := json.Marshal(map[string][]string{"scroll_id": {scrollID}})
+	resp, err := c.Do("DELETE", "/_search/scroll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// DeleteByQuery deletes all documents of the index matching query and returns how many were removed
+func (c *Client) DeleteByQuery(query map[string]interface{}) (int, error) {
+	body, _ := json.Marshal(map[string]interface{}{"query": query})
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	err := c.Retry.Do(c.Target+"_delete", func() error {
+		resp, err := c.Do("POST", "/"+c.ReadTarget()+"/_delete_by_query?conflicts=proceed", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode >= 300 {
+			return retry.Status(resp, fmt.Errorf("delete_by_query failed: %w", &StatusError{Status: resp.StatusCode, Body: string(respBody)}))
+		}
+		return retry.Permanent(json.Unmarshal(respBody, &result))
+	})
+	return result.Deleted, err
+}
@@ -0,0 +1,219 @@
+package es
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sigV4Signer signs requests with AWS Signature Version 4, as required by
+// Amazon OpenSearch Service (service "es") and OpenSearch Serverless ("aoss")
+type sigV4Signer struct {
+	region  string
+	service string
+	creds   *awsCredentialProvider
+}
+
+func newSigV4Signer(region, service string) *sigV4Signer {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if service == "" {
+		service = "es"
+	}
+	return &sigV4Signer{region: region, service: service, creds: &awsCredentialProvider{region: region}}
+}
+
+// sign adds the x-amz-* and Authorization headers for payload sent at now
+func (s *sigV4Signer) sign(req *http.Request, payload []byte, now time.Time) error {
+	creds, err := s.creds.get()
+	if err != nil {
+		return err
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.EscapedPath(), false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	for _, part := range []string{s.region, s.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// canonicalQuery sorts and escapes query parameters
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters (and '/'
+// unless escapeSlash), as SigV4 requires
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsCredentials are the keys requests are signed with
+type awsCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	SessionToken    string `xml:"SessionToken"`
+	Expiration      time.Time
+}
+
+// awsCredentialProvider reads credentials from AWS_ACCESS_KEY_ID /
+// AWS_SECRET_ACCESS_KEY (/ AWS_SESSION_TOKEN), or exchanges the web identity
+// token of IRSA (AWS_ROLE_ARN, AWS_WEB_IDENTITY_TOKEN_FILE) with STS, caching
+// the temporary credentials until shortly before they expire
+type awsCredentialProvider struct {
+	region string
+
+	mu     sync.Mutex
+	cached awsCredentials
+}
+
+func (p *awsCredentialProvider) get() (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" || tokenFile == "" {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials: set AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or AWS_ROLE_ARN/AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Until(p.cached.Expiration) > 5*time.Minute {
+		return p.cached, nil
+	}
+	creds, err := p.assumeRoleWithWebIdentity(roleARN, tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("STS AssumeRoleWithWebIdentity: %w", err)
+	}
+	p.cached = creds
+	return creds, nil
+}
+
+func (p *awsCredentialProvider) assumeRoleWithWebIdentity(roleARN, tokenFile string) (awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "itop-sla-exporter"
+	}
+	endpoint := "https://sts.amazonaws.com/"
+	if p.region != "" {
+		endpoint = "https://sts." + p.region + ".amazonaws.com/"
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	var parsed struct {
+		Credentials awsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &parsed); err != nil {
+		return awsCredentials{}, err
+	}
+	return parsed.Credentials, nil
+}
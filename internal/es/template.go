@@ -0,0 +1,176 @@
+package es
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// MappingProperties derives ES field mappings from a struct's json tags:
+// time.Time → date, string → keyword, numbers → long/double, bool → boolean.
+// An `es:"<type>"` tag overrides the derived type; `es:"text"` maps to text
+// with a keyword sub-field.
+func MappingProperties(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if override := f.Tag.Get("es"); override != "" {
+			props[name] = typeMapping(override)
+			continue
+		}
+		if m := fieldMapping(f.Type); m != nil {
+			props[name] = m
+		}
+	}
+	return props
+}
+
+func typeMapping(esType string) map[string]interface{} {
+	if esType == "text" {
+		return map[string]interface{}{
+			"type": "text",
+			"fields": map[string]interface{}{
+				"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+			},
+		}
+	}
+	return map[string]interface{}{"type": esType}
+}
+
+func fieldMapping(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return typeMapping("date")
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return typeMapping("keyword")
+	case reflect.Bool:
+		return typeMapping("boolean")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return typeMapping("long")
+	case reflect.Float32, reflect.Float64:
+		return typeMapping("double")
+	case reflect.Slice, reflect.Array:
+		return fieldMapping(t.Elem())
+	case reflect.Struct:
+		return map[string]interface{}{"properties": MappingProperties(t)}
+	case reflect.Map, reflect.Interface:
+		return map[string]interface{}{"type": "object"}
+	}
+	return nil
+}
+
+// EnsureIndexTemplate creates or updates an index template for the configured
+// index (or data stream), and pushes the same mappings to it if it already exists.
+func (c *Client) EnsureIndexTemplate(name string, properties map[string]interface{}) error {
+	body := map[string]interface{}{
+		"mappings": map[string]interface{}{"properties": properties},
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{c.IndexPattern()},
+		"template":       body,
+	}
+	if c.Config.Alias != "" && !c.Config.DataStream {
+		// Every index created from the template joins the read alias
+		body["aliases"] = map[string]interface{}{c.Config.Alias: map[string]interface{}{}}
+	}
+	if c.Config.DataStream {
+		properties["@timestamp"] = typeMapping("date")
+		template["data_stream"] = map[string]interface{}{}
+		if c.Config.Flavor != "opensearch" {
+			// OpenSearch attaches ISM policies through their ism_template
+			body["settings"] = map[string]interface{}{"index.lifecycle.name": c.LifecyclePolicyName()}
+		}
+	}
+	err := c.putJSON("/_index_template/"+name, template)
+	var se *StatusError
+	if errors.As(err, &se) && (se.Status == 404 || se.Status == 405 || se.Status == 400 && strings.Contains(se.Body, "no handler")) {
+		// Composable templates are missing before Elasticsearch 7.8 and on
+		// Open Distro / older Amazon OpenSearch Service domains
+		err = c.putJSON("/_template/"+name, map[string]interface{}{
+			"index_patterns": []string{c.IndexPattern()},
+			"mappings":       map[string]interface{}{"properties": properties},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("put index template: %w", err)
+	}
+	// Templates only apply to new indices; add new fields to existing ones
+	// (no index yet is not an error)
+	err = c.putJSON("/"+c.IndexPattern()+"/_mapping", map[string]interface{}{"properties": properties})
+	if errors.As(err, &se) && se.Status == 404 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("update index mapping: %w", err)
+	}
+	if c.Config.Alias != "" && !c.Config.DataStream {
+		if err := c.ensureAlias(); err != nil {
+			return fmt.Errorf("update alias: %w", err)
+		}
+	}
+	return nil
+}
+
+// ensureAlias adds the existing indices matching the index pattern to the read alias
+func (c *Client) ensureAlias() error {
+	err := c.postJSON("/_aliases", map[string]interface{}{
+		"actions": []map[string]interface{}{
+			{"add": map[string]string{"index": c.IndexPattern(), "alias": c.Config.Alias}},
+		},
+	})
+	var se *StatusError
+	if errors.As(err, &se) && se.Status == 404 {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) putJSON(path string, body interface{}) error {
+	return c.sendJSON("PUT", path, body)
+}
+
+func (c *Client) postJSON(path string, body interface{}) error {
+	return c.sendJSON("POST", path, body)
+}
+
+func (c *Client) sendJSON(method, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(method, path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return &StatusError{Status: resp.StatusCode, Body: string(respBody)}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package itop
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CatalogItem is a Service or ServiceSubcategory of the service catalog
+type CatalogItem struct {
+	ID            string
+	Class         string // Service or ServiceSubcategory
+	Name          string
+	Description   string
+	Status        string // implementation, production or obsolete
+	OrgID         string
+	OrgName       string
+	ServiceFamily string // services only
+	ServiceID     string // subcategories: the parent service
+	ServiceName   string
+	RequestType   string // subcategories only: incident or service_request
+}
+
+// FetchCatalog fetches the services (within itop.organizations) and their
+// subcategories, which take the organization of their service
+func (c *ITopClient) FetchCatalog() ([]CatalogItem, error) {
+	oql := "SELECT Service"
+	if org := c.orgCondition("org_id", "organization_name"); org != "" {
+		oql += " WHERE " + org
+	}
+	var services struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID            string `json:"id"`
+				Name          string `json:"name"`
+				Description   string `json:"description"`
+				Status        string `json:"status"`
+				OrgID         string `json:"org_id"`
+				OrgName       string `json:"organization_name"`
+				ServiceFamily string `json:"servicefamily_name"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := c.getObjects("Service", oql, "id,name,description,status,org_id,organization_name,servicefamily_name", &services); err != nil {
+		return nil, err
+	}
+	var items []CatalogItem
+	byID := map[string]CatalogItem{}
+	for _, obj := range services.Objects {
+		f := obj.Fields
+		item := CatalogItem{ID: f.ID, Class: "Service", Name: f.Name, Description: f.Description, Status: f.Status,
+			OrgID: f.OrgID, OrgName: f.OrgName, ServiceFamily: f.ServiceFamily}
+		byID[f.ID] = item
+		items = append(items, item)
+	}
+
+	var subcategories struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID          string `json:"id"`
+				Name        string `json:"name"`
+				Description string `json:"description"`
+				Status      string `json:"status"`
+				ServiceID   string `json:"service_id"`
+				ServiceName string `json:"service_name"`
+				RequestType string `json:"request_type"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := c.getObjects("ServiceSubcategory", "SELECT ServiceSubcategory", "id,name,description,status,service_id,service_name,request_type", &subcategories); err != nil {
+		return nil, err
+	}
+	for _, obj := range subcategories.Objects {
+		f := obj.Fields
+		service, ok := byID[f.ServiceID]
+		if !ok {
+			continue // service outside itop.organizations
+		}
+		items = append(items, CatalogItem{ID: f.ID, Class: "ServiceSubcategory", Name: f.Name, Description: f.Description, Status: f.Status,
+			OrgID: service.OrgID, OrgName: service.OrgName, ServiceID: f.ServiceID, ServiceName: f.ServiceName, RequestType: f.RequestType})
+	}
+	return items, nil
+}
+
+// getObjects runs a core/get query and decodes the response into result;
+// an iTop error code is returned as an error
+func (c *ITopClient) getObjects(class, oql, fields string, result interface{}) error {
+	c.rateLimiter.Wait()
+	body, err := c.Post("core/get", map[string]interface{}{
+		"class":         class,
+		"key":           oql,
+		"output_fields": fields,
+	})
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	if status.Code != 0 {
+		return iTopError(class, status.Code, status.Message)
+	}
+	return json.Unmarshal(body, result)
+}
+
+func iTopError(class string, code int, message string) error {
+	return fmt.Errorf("iTop error %d on %s: %s", code, class, message)
+}
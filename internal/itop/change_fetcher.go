@@ -0,0 +1,115 @@
+package itop
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// changeBaseFields are the default fields requested for the Change classes,
+// which have none of the SLA fields of incidents and requests; start_date
+// and end_date hold the planned window
+const changeBaseFields = "id,ref,title,org_id,org_name,status,agent_id,agent_id_friendlyname,team_id,team_id_friendlyname,caller_id,caller_id_friendlyname,creation_date,start_date,end_date,close_date,last_update,outage"
+
+// changeOutputFields returns the default output_fields of a Change class,
+// "" for other classes. Only normal and emergency changes are approved, and
+// only normal changes accepted.
+func changeOutputFields(class string) string {
+	switch class {
+	case "NormalChange":
+		return changeBaseFields + ",approval_date,acceptance_date"
+	case "EmergencyChange":
+		return changeBaseFields + ",approval_date"
+	case "RoutineChange", "Change":
+		return changeBaseFields
+	}
+	return ""
+}
+
+// ChangeDetails are the change management fields of a Change
+type ChangeDetails struct {
+	CreationDate   time.Time
+	PlannedStart   time.Time // start_date
+	PlannedEnd     time.Time // end_date
+	ActualStart    time.Time // when the change went past approval (status history)
+	ActualEnd      time.Time // close_date, else when the change was implemented
+	ApprovalDate   time.Time
+	AcceptanceDate time.Time
+	Outage         bool
+}
+
+// changeNotStarted are the statuses of a change whose implementation has not
+// begun yet
+var changeNotStarted = map[string]bool{"new": true, "assigned": true, "planned": true, "approved": true, "rejected": true, "notapproved": true}
+
+// parseChangeFields fills the ChangeDetails of the parsed tickets from a
+// core/get response on a Change class
+func parseChangeFields(data []byte, tickets []Ticket, loc *time.Location) error {
+	var resp struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID             string `json:"id"`
+				CreationDate   string `json:"creation_date"`
+				EndDate        string `json:"end_date"`
+				CloseDate      string `json:"close_date"`
+				ApprovalDate   string `json:"approval_date"`
+				AcceptanceDate string `json:"acceptance_date"`
+				Outage         string `json:"outage"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	byID := make(map[string]*ChangeDetails, len(resp.Objects))
+	for _, obj := range resp.Objects {
+		f := obj.Fields
+		d := &ChangeDetails{Outage: f.Outage == "yes"}
+		d.CreationDate, _ = parseDateFlexible(f.CreationDate, loc)
+		d.PlannedEnd, _ = parseDateFlexible(f.EndDate, loc)
+		d.ActualEnd, _ = parseDateFlexible(f.CloseDate, loc)
+		d.ApprovalDate, _ = parseDateFlexible(f.ApprovalDate, loc)
+		d.AcceptanceDate, _ = parseDateFlexible(f.AcceptanceDate, loc)
+		byID[f.ID] = d
+	}
+	for i := range tickets {
+		if d, ok := byID[tickets[i].ID]; ok {
+			d.PlannedStart = tickets[i].StartDate
+			tickets[i].Change = d
+		}
+	}
+	return nil
+}
+
+// fetchChangeActuals derives the actual start, and the actual end of
+// changes not closed yet, from their status history
+func (c *ITopClient) fetchChangeActuals(class string, changes []Ticket) {
+	var ids []string
+	for _, t := range changes {
+		if t.Change != nil {
+			ids = append(ids, t.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	history, err := c.FetchStatusHistory(class, ids)
+	if err != nil {
+		slog.Warn("Failed to fetch the status history of changes", "class", class, "changes", len(ids), "err", err)
+		return
+	}
+	for _, t := range changes {
+		d := t.Change
+		if d == nil {
+			continue
+		}
+		for _, sc := range history[t.ID] {
+			if d.ActualStart.IsZero() && !changeNotStarted[sc.To] {
+				d.ActualStart = sc.Date
+			}
+			if d.ActualEnd.IsZero() && sc.To == "implemented" {
+				d.ActualEnd = sc.Date
+			}
+		}
+	}
+}
@@ -2,56 +2,210 @@ package itop
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
+
+	"itop-sla-exporter/internal/config"
+	"itop-sla-exporter/internal/metrics"
+	"itop-sla-exporter/internal/retry"
 )
 
 type ITopClient struct {
 	BaseURL  string
 	Username string
 	Password string
+	Token    string // auth_token, replaces Username/Password when set
 	Version  string
+	Location *time.Location // timezone iTop dates are expressed in
+
+	conf        config.ITopConfig
+	http        *http.Client
+	retry       retry.Policy
+	rateLimiter *rateLimiter // shared by concurrent person lookups
+	ticketLimit *rateLimiter // ticket fetches, nil when unlimited
+	sltLimit    *rateLimiter // SLT and coverage window lookups, nil when unlimited
+	teams       *teamCache   // person friendlyname -> teams
+	stats       apiStats     // requests since the last TakeStats
+
+	// SLT lookups and coverage windows, fetched again after itop.slt_cache_ttl
+	sltCache        map[string]sltCacheEntry
+	sltCacheMu      sync.RWMutex
+	coverageCache   map[string]coverageCacheEntry
+	coverageCacheMu sync.RWMutex
 }
 
+// NewClient creates an iTop client from config; loc is the timezone of iTop dates
+func NewClient(conf config.ITopConfig, retryConf config.RetryConfig, loc *time.Location) (*ITopClient, error) {
+	rateLimit := conf.RateLimit
+	if rateLimit <= 0 {
+		rateLimit = 200 * time.Millisecond
+	}
+	// Proxy from the environment unless itop.proxy is set
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConf, err := tlsConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConf
+	// The transport sends Accept-Encoding: gzip and decodes the response itself
+	transport.DisableCompression = !conf.Compression
+	transport.DialContext = (&net.Dialer{Timeout: conf.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	if conf.Proxy != "" {
+		if proxy, err := url.Parse(conf.Proxy); err == nil {
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+	}
+	return &ITopClient{
+		BaseURL:     conf.URL,
+		Username:    conf.User,
+		Password:    conf.Password,
+		Token:       conf.Token,
+		Version:     conf.Version,
+		Location:    loc,
+		conf:        conf,
+		http:        &http.Client{Transport: transport, Timeout: conf.RequestTimeout},
+		retry:       retry.New(retryConf),
+		rateLimiter: newRateLimiter(rateLimit, conf.RateBurst),
+		ticketLimit: newRateLimiterPerSecond(conf.TicketRate, conf.TicketBurst),
+		sltLimit:    newRateLimiterPerSecond(conf.SLTRate, conf.SLTBurst),
+		teams:       newTeamCache(conf.TeamCacheTTL, conf.TeamCacheSize),
+
+		sltCache:      make(map[string]sltCacheEntry),
+		coverageCache: make(map[string]coverageCacheEntry),
+	}, nil
+}
+
+// tlsConfig builds the TLS settings: private CA, client certificate, skip verify
+func tlsConfig(conf config.ITopConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.InsecureSkipVerify && strings.HasPrefix(conf.URL, "https:") {
+		slog.Warn("iTop TLS certificate verification is disabled")
+	}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("itop CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("itop CA file %s: no PEM certificate found", conf.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("itop client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// Post calls a REST operation, retrying transient failures
 func (c *ITopClient) Post(operation string, params map[string]interface{}) ([]byte, error) {
 	params["operation"] = operation
 	jsonData, _ := json.Marshal(params)
 
 	form := url.Values{}
 	form.Set("version", c.Version)
-	form.Set("auth_user", c.Username)
-	form.Set("auth_pwd", c.Password)
+	if c.Token != "" {
+		form.Set("auth_token", c.Token)
+	} else {
+		form.Set("auth_user", c.Username)
+		form.Set("auth_pwd", c.Password)
+	}
 	form.Set("json_data", string(jsonData))
+	payload := form.Encode()
 
-	req, err := http.NewRequest("POST", c.BaseURL, strings.NewReader(form.Encode()))
+	var body []byte
+	err := c.retry.Do("itop", func() error {
+		var err error
+		body, err = c.post(operation, payload)
+		return err
+	})
+	return body, err
+}
+
+func (c *ITopClient) post(operation, payload string) ([]byte, error) {
+	req, err := http.NewRequest("POST", c.BaseURL, strings.NewReader(payload))
 	if err != nil {
-		return nil, err
+		return nil, retry.Permanent(err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	// Add a timeout to prevent hanging requests
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   10 * time.Second,
-	}
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	metrics.APILatency.Observe(time.Since(start).Seconds(), "itop")
+	c.stats.record(time.Since(start), err != nil || resp.StatusCode != 200)
 	if err != nil {
+		metrics.Errors.Inc("itop")
 		return nil, err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		log.Printf("iTop API response status: %d", resp.StatusCode)
-		log.Printf("iTop API response body: %s", string(body))
-		return nil, err
+		metrics.Errors.Inc("itop")
+		slog.Error("iTop API error response", "operation", operation, "status", resp.StatusCode, "body", string(body))
+		return nil, retry.Status(resp, fmt.Errorf("iTop API returned status %d", resp.StatusCode))
 	}
 	return body, err
 }
+
+// CheckCredentials verifies the API is reachable and the configured user (or
+// token) is authorized
+func (c *ITopClient) CheckCredentials() error {
+	if c.Token != "" {
+		// check_credentials takes a password: any authenticated call proves the token
+		body, err := c.Post("list_operations", map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return fmt.Errorf("unexpected response: %v", err)
+		}
+		if result.Code != 0 {
+			return fmt.Errorf("iTop error %d: %s", result.Code, result.Message)
+		}
+		return nil
+	}
+	body, err := c.Post("core/check_credentials", map[string]interface{}{
+		"user":     c.Username,
+		"password": c.Password,
+	})
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Code       int    `json:"code"`
+		Message    string `json:"message"`
+		Authorized bool   `json:"authorized"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("unexpected response: %v", err)
+	}
+	if result.Code != 0 {
+		return fmt.Errorf("iTop error %d: %s", result.Code, result.Message)
+	}
+	if !result.Authorized {
+		return fmt.Errorf("user %s is not authorized", c.Username)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package itop
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"itop-sla-exporter/internal/utils"
+)
+
+type coverageCacheEntry struct {
+	window  *CoverageWindow
+	fetched time.Time
+}
+
+// CoverageWindow is an iTop CoverageWindow with its weekly open intervals
+type CoverageWindow struct {
+	ID       string
+	Name     string
+	Schedule utils.WeeklySchedule
+}
+
+// Calendar returns the business calendar of the window, with breaks taken
+// out of its open intervals
+func (w *CoverageWindow) Calendar(breaks []utils.Interval, holidays utils.Holidays) utils.BusinessCalendar {
+	return utils.NewCalendar(w.Schedule.WithBreaks(breaks), holidays)
+}
+
+// GetCoverageWindowCached returns a CoverageWindow, fetching it again once
+// itop.slt_cache_ttl has passed
+func (c *ITopClient) GetCoverageWindowCached(id string) (*CoverageWindow, error) {
+	c.coverageCacheMu.RLock()
+	if e, ok := c.coverageCache[id]; ok && (c.conf.SLTCacheTTL <= 0 || time.Since(e.fetched) < c.conf.SLTCacheTTL) {
+		c.coverageCacheMu.RUnlock()
+		return e.window, nil
+	}
+	c.coverageCacheMu.RUnlock()
+	window, err := c.FetchCoverageWindow(id)
+	if err == nil {
+		c.coverageCacheMu.Lock()
+		c.coverageCache[id] = coverageCacheEntry{window: window, fetched: time.Now()}
+		c.coverageCacheMu.Unlock()
+	}
+	return window, err
+}
+
+func (c *ITopClient) flushCoverageCache() {
+	c.coverageCacheMu.Lock()
+	c.coverageCache = make(map[string]coverageCacheEntry)
+	c.coverageCacheMu.Unlock()
+}
+
+// FetchCoverageWindow fetches a CoverageWindow and its per-weekday intervals.
+// Returns nil when the window does not exist or has no interval.
+func (c *ITopClient) FetchCoverageWindow(id string) (*CoverageWindow, error) {
+	c.sltLimit.Wait()
+	body, err := c.Post("core/get", map[string]interface{}{
+		"class":         "CoverageWindow",
+		"key":           "SELECT CoverageWindow WHERE id = " + id,
+		"output_fields": "name,interval_list",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Objects map[string]struct {
+			Fields struct {
+				Name         string `json:"name"`
+				IntervalList []struct {
+					Weekday   string `json:"weekday"`
+					StartTime string `json:"start_time"`
+					EndTime   string `json:"end_time"`
+				} `json:"interval_list"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	window := &CoverageWindow{ID: id}
+	schedule := &window.Schedule
+	for _, obj := range result.Objects {
+		window.Name = obj.Fields.Name
+		for _, iv := range obj.Fields.IntervalList {
+			day, ok := utils.ParseWeekday(iv.Weekday)
+			if !ok {
+				return nil, fmt.Errorf("coverage window %s: unknown weekday %q", id, iv.Weekday)
+			}
+			start, err := utils.ParseClock(iv.StartTime)
+			if err != nil {
+				return nil, fmt.Errorf("coverage window %s: %v", id, err)
+			}
+			end, err := utils.ParseClock(iv.EndTime)
+			if err != nil {
+				return nil, fmt.Errorf("coverage window %s: %v", id, err)
+			}
+			schedule.Add(day, utils.Interval{Start: start, End: end})
+		}
+	}
+	if schedule.IsEmpty() {
+		return nil, nil
+	}
+	return window, nil
+}
@@ -0,0 +1,145 @@
+package itop
+
+import "encoding/json"
+
+// TeamMember is a person of a team
+type TeamMember struct {
+	ID   string
+	Name string
+}
+
+// TeamInfo is a Team with its members
+type TeamInfo struct {
+	ID      string
+	Name    string
+	Email   string
+	Status  string // active or inactive
+	OrgID   string
+	OrgName string
+	Members []TeamMember
+}
+
+// PersonInfo is a Person with the teams they belong to
+type PersonInfo struct {
+	ID        string
+	Name      string // friendlyname
+	FirstName string
+	LastName  string
+	Email     string
+	Function  string
+	Status    string // active or inactive
+	OrgID     string
+	OrgName   string
+	Teams     []string
+}
+
+// FetchTeams fetches the teams (within itop.organizations) and their members
+func (c *ITopClient) FetchTeams() ([]TeamInfo, error) {
+	var result struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID          string `json:"id"`
+				Name        string `json:"name"`
+				Email       string `json:"email"`
+				Status      string `json:"status"`
+				OrgID       string `json:"org_id"`
+				OrgName     string `json:"org_name"`
+				PersonsList []struct {
+					PersonID   string `json:"person_id"`
+					PersonName string `json:"person_name"`
+				} `json:"persons_list"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := c.getObjects("Team", c.orgOQL("Team"), "id,name,email,status,org_id,org_name,persons_list", &result); err != nil {
+		return nil, err
+	}
+	teams := make([]TeamInfo, 0, len(result.Objects))
+	for _, obj := range result.Objects {
+		f := obj.Fields
+		t := TeamInfo{ID: f.ID, Name: f.Name, Email: f.Email, Status: f.Status, OrgID: f.OrgID, OrgName: f.OrgName}
+		for _, m := range f.PersonsList {
+			t.Members = append(t.Members, TeamMember{ID: m.PersonID, Name: m.PersonName})
+		}
+		teams = append(teams, t)
+	}
+	return teams, nil
+}
+
+// FetchPersons fetches the persons (within itop.organizations) and their
+// teams, in pages of itop.page_size
+func (c *ITopClient) FetchPersons() ([]PersonInfo, error) {
+	var persons []PersonInfo
+	seen := map[string]bool{}
+	for page := 1; ; page++ {
+		params := map[string]interface{}{
+			"class":         "Person",
+			"key":           c.orgOQL("Person"),
+			"output_fields": "id,friendlyname,first_name,name,email,function,status,org_id,org_name,team_list",
+		}
+		if c.conf.PageSize > 0 {
+			params["limit"] = c.conf.PageSize
+			params["page"] = page
+		}
+		c.rateLimiter.Wait()
+		body, err := c.Post("core/get", params)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Objects map[string]struct {
+				Fields struct {
+					ID           string `json:"id"`
+					FriendlyName string `json:"friendlyname"`
+					FirstName    string `json:"first_name"`
+					LastName     string `json:"name"`
+					Email        string `json:"email"`
+					Function     string `json:"function"`
+					Status       string `json:"status"`
+					OrgID        string `json:"org_id"`
+					OrgName      string `json:"org_name"`
+					TeamList     []struct {
+						TeamName string `json:"team_name"`
+					} `json:"team_list"`
+				} `json:"fields"`
+			} `json:"objects"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		if result.Code != 0 {
+			return nil, iTopError("Person", result.Code, result.Message)
+		}
+		fresh := 0
+		for _, obj := range result.Objects {
+			f := obj.Fields
+			if seen[f.ID] {
+				continue
+			}
+			seen[f.ID] = true
+			fresh++
+			p := PersonInfo{ID: f.ID, Name: f.FriendlyName, FirstName: f.FirstName, LastName: f.LastName, Email: f.Email,
+				Function: f.Function, Status: f.Status, OrgID: f.OrgID, OrgName: f.OrgName}
+			for _, t := range f.TeamList {
+				p.Teams = append(p.Teams, t.TeamName)
+			}
+			persons = append(persons, p)
+		}
+		// As for tickets: a short page is the last, and a server ignoring
+		// limit/page returns everything at once or the same page again
+		if c.conf.PageSize <= 0 || len(result.Objects) != c.conf.PageSize || fresh < len(result.Objects) {
+			return persons, nil
+		}
+	}
+}
+
+// orgOQL selects the objects of a class with an org_id (contacts, teams)
+// within itop.organizations
+func (c *ITopClient) orgOQL(class string) string {
+	if org := c.orgCondition("org_id", "org_name"); org != "" {
+		return "SELECT " + class + " WHERE " + org
+	}
+	return "SELECT " + class
+}
@@ -2,197 +2,485 @@ package itop
 
 import (
 	"encoding/json"
-	"log"
-	"os"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-// FetchTicketsByClass fetches tickets for a single class only
-func FetchTicketsByClass(class string) ([]Ticket, error) {
-	baseURL := os.Getenv("ITOP_API_URL")
-	username := os.Getenv("ITOP_API_USER")
-	password := os.Getenv("ITOP_API_PWD")
-	if baseURL == "" || username == "" || password == "" {
-		log.Println("Missing iTop API environment variables")
-		return nil, nil
-	}
-	client := ITopClient{
-		BaseURL:  baseURL,
-		Username: username,
-		Password: password,
-		Version:  "1.3",
+// ticketOutputFields are the fields requested for every ticket class
+const ticketOutputFields = "id,ref,title,org_id,org_name,origin,status,priority,urgency,impact,service_id,service_name,servicesubcategory_name,agent_id,agent_id_friendlyname,team_id,team_id_friendlyname,caller_id,caller_id_friendlyname,start_date,assignment_date,resolution_date,last_pending_date,last_update,close_date,resolution_code,solution,user_satisfaction,tto_deadline,ttr_deadline,sla_tto_passed,sla_tto_over,sla_ttr_passed,sla_ttr_over"
+
+// OutputFieldsForClass returns output_fields for a class (Problem and the
+// Change classes have their own defaults), overridable per
+// class (itop.output_fields / ITOP_OUTPUT_FIELDS_<CLASS>) for classes that
+// lack some of the default ticket fields,
+// and functionalcis_list (itop.impacted_cis), public_log (itop.public_log),
+// the escalation fields (itop.escalation), the links to other tickets
+// (itop.ticket_links) and itop.extra_fields appended
+func (c *ITopClient) OutputFieldsForClass(class string) string {
+	fields := ticketOutputFields
+	if class == "Problem" {
+		fields = problemOutputFields
+	} else if val := changeOutputFields(class); val != "" {
+		fields = val
 	}
-	params := map[string]interface{}{
-		"class":         class,
-		"key":           "SELECT " + class,
-		"output_fields": "id,ref,title,origin,status,priority,urgency,impact,service_id,service_name,servicesubcategory_name,agent_id,agent_id_friendlyname,team_id,team_id_friendlyname,caller_id_friendlyname,start_date,assignment_date,resolution_date,last_pending_date,last_update,sla_tto_passed,sla_ttr_passed",
+	if val := c.conf.OutputFieldsFor(class); val != "" {
+		fields = val
 	}
-	resp, err := client.Post("core/get", params)
-	if err != nil {
-		log.Printf("Error from iTop API (%s): %v", class, err)
-		return nil, err
+	extras := c.conf.ExtraFields
+	if c.conf.ImpactedCIs {
+		extras = append([]string{"functionalcis_list"}, extras...)
+	}
+	if c.conf.PublicLog && IsSupportTicket(class) {
+		extras = append([]string{"public_log"}, extras...)
+	}
+	if c.conf.Escalation && IsSupportTicket(class) {
+		extras = append(strings.Split(escalationFields, ","), extras...)
+	}
+	if class == "UserRequest" {
+		// the request type selects the SLT
+		extras = append([]string{"request_type"}, extras...)
 	}
-	tickets, err := ParseTickets(resp)
-	for i := range tickets {
-		tickets[i].Class = class
+	if c.conf.TicketLinks {
+		if links := linkFields[class]; links != "" {
+			extras = append(strings.Split(links, ","), extras...)
+		}
+	}
+	for _, extra := range extras {
+		if !strings.Contains(","+fields+",", ","+extra+",") {
+			fields += "," + extra
+		}
 	}
-	return tickets, err
+	return fields
 }
 
-// FetchTickets fetches tickets from iTop REST API
-func FetchTickets() ([]Ticket, error) {
-	baseURL := os.Getenv("ITOP_API_URL")
-	username := os.Getenv("ITOP_API_USER")
-	password := os.Getenv("ITOP_API_PWD")
-	if baseURL == "" || username == "" || password == "" {
-		log.Println("Missing iTop API environment variables")
-		return nil, nil
+// whereClause finds the WHERE keyword of an OQL query
+var whereClause = regexp.MustCompile(`(?i)\sWHERE\s`)
+
+// classOQL is the query selecting a class's tickets (itop.oql), narrowed by
+// cond when set and by itop.organizations
+func (c *ITopClient) classOQL(class, cond string) string {
+	oql := c.conf.OQLFor(class)
+	if org := c.orgCondition("org_id", "org_name"); org != "" {
+		if cond == "" {
+			cond = org
+		} else {
+			cond = org + " AND " + cond
+		}
 	}
-	client := ITopClient{
-		BaseURL:  baseURL,
-		Username: username,
-		Password: password,
-		Version:  "1.3",
+	if cond == "" {
+		return oql
 	}
-	classes := []string{"Incident", "UserRequest"}
-	var allTickets []Ticket
-	for _, class := range classes {
+	if loc := whereClause.FindStringIndex(oql); loc != nil {
+		return oql[:loc[0]] + " WHERE (" + strings.TrimSpace(oql[loc[1]:]) + ") AND " + cond
+	}
+	return oql + " WHERE " + cond
+}
+
+// orgCondition restricts objects to itop.organizations, numeric entries
+// matching idAttr and the others nameAttr; "" when unrestricted
+func (c *ITopClient) orgCondition(idAttr, nameAttr string) string {
+	var ids, names []string
+	for _, org := range c.conf.Organizations {
+		org = strings.TrimSpace(org)
+		if _, err := strconv.Atoi(org); err == nil {
+			ids = append(ids, org)
+		} else {
+			names = append(names, quoteOQL(org))
+		}
+	}
+	var conds []string
+	if len(ids) > 0 {
+		conds = append(conds, idAttr+" IN ("+strings.Join(ids, ",")+")")
+	}
+	if len(names) > 0 {
+		conds = append(conds, nameAttr+" IN ("+strings.Join(names, ",")+")")
+	}
+	switch len(conds) {
+	case 0:
+		return ""
+	case 1:
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+// FetchTicketsByClass fetches tickets for a single class only
+func (c *ITopClient) FetchTicketsByClass(class string) ([]Ticket, error) {
+	return c.FetchTicketsByClassPages(class, nil)
+}
+
+// FetchTicketsByClassPages fetches tickets of a class page by page
+// (itop.page_size), handing each page to each as it arrives
+func (c *ITopClient) FetchTicketsByClassPages(class string, each func([]Ticket)) ([]Ticket, error) {
+	return c.fetchTicketsByOQL(class, c.classOQL(class, ""), each)
+}
+
+// FetchTicketsByClassSince fetches tickets of a class updated at or after since
+func (c *ITopClient) FetchTicketsByClassSince(class string, since time.Time) ([]Ticket, error) {
+	oql := c.classOQL(class, "last_update >= '"+since.In(c.Location).Format("2006-01-02 15:04:05")+"'")
+	return c.fetchTicketsByOQL(class, oql, nil)
+}
+
+// FetchTicketsByClassWhere fetches tickets of a class matching the OQL
+// condition cond (when set) and updated at or after since (when not zero)
+func (c *ITopClient) FetchTicketsByClassWhere(class, cond string, since time.Time) ([]Ticket, error) {
+	if cond != "" {
+		cond = "(" + cond + ")"
+	}
+	if !since.IsZero() {
+		if cond != "" {
+			cond += " AND "
+		}
+		cond += "last_update >= '" + since.In(c.Location).Format("2006-01-02 15:04:05") + "'"
+	}
+	return c.fetchTicketsByOQL(class, c.classOQL(class, cond), nil)
+}
+
+// FetchTicketsByClassBetween fetches tickets of a class with start_date in [from, to)
+func (c *ITopClient) FetchTicketsByClassBetween(class string, from, to time.Time) ([]Ticket, error) {
+	const layout = "2006-01-02 15:04:05"
+	oql := c.classOQL(class, "start_date >= '"+from.In(c.Location).Format(layout)+"' AND start_date < '"+to.In(c.Location).Format(layout)+"'")
+	return c.fetchTicketsByOQL(class, oql, nil)
+}
+
+// FetchResolvedTicketsByClassBetween fetches tickets of a class with
+// resolution_date in [from, to)
+func (c *ITopClient) FetchResolvedTicketsByClassBetween(class string, from, to time.Time) ([]Ticket, error) {
+	const layout = "2006-01-02 15:04:05"
+	oql := c.classOQL(class, "resolution_date >= '"+from.In(c.Location).Format(layout)+"' AND resolution_date < '"+to.In(c.Location).Format(layout)+"'")
+	return c.fetchTicketsByOQL(class, oql, nil)
+}
+
+// FetchTicket fetches a single ticket by numeric id or by ref, nil if not
+// found (or outside itop.oql)
+func (c *ITopClient) FetchTicket(class, key string) (*Ticket, error) {
+	cond := "ref = \"" + strings.ReplaceAll(key, "\"", "\\\"") + "\""
+	if _, err := strconv.Atoi(key); err == nil {
+		cond = "id = " + key
+	}
+	tickets, err := c.fetchTicketsByOQL(class, c.classOQL(class, cond), nil)
+	if err != nil || len(tickets) == 0 {
+		return nil, err
+	}
+	return &tickets[0], nil
+}
+
+// fetchTicketsByOQL runs a ticket query, in pages of itop.page_size when
+// set; each, if not nil, receives every page as it arrives
+func (c *ITopClient) fetchTicketsByOQL(class, oql string, each func([]Ticket)) ([]Ticket, error) {
+	pageSize := c.conf.PageSize
+	var all []Ticket
+	seen := map[string]struct{}{}
+	for page := 1; ; page++ {
 		params := map[string]interface{}{
 			"class":         class,
-			"key":           "SELECT " + class,
-			"output_fields": "id,ref,title,origin,status,priority,urgency,impact,service_id,service_name,servicesubcategory_name,agent_id,agent_id_friendlyname,team_id,team_id_friendlyname,caller_id_friendlyname,start_date,assignment_date,resolution_date,last_pending_date,last_update,sla_tto_passed,sla_ttr_passed",
+			"key":           oql,
+			"output_fields": c.OutputFieldsForClass(class),
+		}
+		if pageSize > 0 {
+			params["limit"] = pageSize
+			params["page"] = page
 		}
-		resp, err := client.Post("core/get", params)
+		c.ticketLimit.Wait()
+		resp, err := c.Post("core/get", params)
 		if err != nil {
-			// log.Printf("Error from iTop API (%s): %v", class, err)
-			continue
+			slog.Error("Error from iTop API", "class", class, "page", page, "err", err)
+			return nil, err
+		}
+		tickets, err := ParseTickets(resp, c.Location)
+		if err != nil {
+			return all, err
+		}
+		if len(c.conf.ExtraFields) > 0 {
+			if err := parseExtraFields(resp, tickets, c.conf.ExtraFields); err != nil {
+				return all, err
+			}
+		}
+		if c.conf.ImpactedCIs {
+			if err := parseImpactedCIs(resp, tickets); err != nil {
+				return all, err
+			}
+		}
+		if c.conf.PublicLog && IsSupportTicket(class) {
+			if err := parsePublicLog(resp, tickets, c.Location); err != nil {
+				return all, err
+			}
+		}
+		if c.conf.Escalation && IsSupportTicket(class) {
+			if err := parseEscalation(resp, tickets, c.Location); err != nil {
+				return all, err
+			}
+		}
+		if c.conf.TicketLinks && linkFields[class] != "" {
+			if err := parseTicketLinks(resp, tickets); err != nil {
+				return all, err
+			}
 		}
-		// log.Printf("Raw iTop API response (%s): %s", class, string(resp))
-		tickets, err := ParseTickets(resp)
-		log.Printf("Parsed %d tickets from iTop (%s)", len(tickets), class)
-		// Set class for each ticket
-		for i := range tickets {
-			tickets[i].Class = class
+		if class == "Problem" {
+			if err := parseProblemFields(resp, tickets); err != nil {
+				return all, err
+			}
+			c.fetchProblemIncidents(tickets)
+		}
+		if changeOutputFields(class) != "" {
+			if err := parseChangeFields(resp, tickets, c.Location); err != nil {
+				return all, err
+			}
+			c.fetchChangeActuals(class, tickets)
+		}
+		fresh := tickets[:0]
+		for _, t := range tickets {
+			if _, dup := seen[t.ID]; !dup {
+				seen[t.ID] = struct{}{}
+				t.Class = class
+				fresh = append(fresh, t)
+			}
+		}
+		if len(fresh) > 0 && each != nil {
+			each(fresh)
+		}
+		all = append(all, fresh...)
+		// A short page is the last; a server ignoring limit/page returns
+		// everything at once, or the same page again
+		if pageSize <= 0 || len(tickets) != pageSize || len(fresh) < len(tickets) {
+			return all, nil
+		}
+	}
+}
+
+// FetchTickets fetches tickets of all configured classes from iTop REST API
+func (c *ITopClient) FetchTickets() ([]Ticket, error) {
+	var allTickets []Ticket
+	for _, class := range c.conf.Classes {
+		tickets, err := c.FetchTicketsByClass(class)
+		if err != nil {
+			continue
 		}
+		slog.Info("Parsed tickets from iTop", "class", class, "tickets", len(tickets))
 		allTickets = append(allTickets, tickets...)
 	}
 	return allTickets, nil
 }
 
-// personTeamCache caches person team information to avoid redundant API calls
-var personTeamCache = make(map[string]string)
-var personTeamCacheMutex sync.RWMutex
-
-// rateLimiter helps control the frequency of API calls
-var rateLimiter *time.Ticker
-
-// init initializes the rate limiter
-func init() {
-	// Default rate limit: 200ms between requests (5 requests per second)
-	rateLimit := 200 * time.Millisecond
+// PersonRef identifies a person by id, with the friendlyname as fallback for
+// classes or OQL overrides that don't return caller_id
+type PersonRef struct {
+	ID   string
+	Name string
+}
 
-	// Allow configuration via environment variable
-	if val := os.Getenv("ITOP_API_RATE_LIMIT_MS"); val != "" {
-		if ms, err := time.ParseDuration(val + "ms"); err == nil && ms > 0 {
-			rateLimit = ms
-			log.Printf("Using custom API rate limit: %v", rateLimit)
-		}
+// cacheKey keys the team cache by id when known; friendly names are not
+// unique and change on renames
+func (p PersonRef) cacheKey() string {
+	if p.ID != "" && p.ID != "0" {
+		return "id:" + p.ID
 	}
+	return "name:" + p.Name
+}
 
-	rateLimiter = time.NewTicker(rateLimit)
+func (p PersonRef) isZero() bool {
+	return (p.ID == "" || p.ID == "0") && p.Name == ""
 }
 
-// FetchPersonTeams fetches team information for a person by their friendly name
-func FetchPersonTeams(personName string) (string, error) {
-	// Check cache first
-	personTeamCacheMutex.RLock()
-	if team, found := personTeamCache[personName]; found {
-		personTeamCacheMutex.RUnlock()
-		return team, nil
+// FetchPersonTeams fetches team information for a person, by id or else by friendly name
+func (c *ITopClient) FetchPersonTeams(person PersonRef) (string, error) {
+	if person.isZero() {
+		return "-", nil
 	}
-	personTeamCacheMutex.RUnlock()
 
-	// Handle empty name
-	if personName == "" {
-		personTeamCacheMutex.Lock()
-		personTeamCache[personName] = "-"
-		personTeamCacheMutex.Unlock()
-		return "-", nil
+	// Check cache first
+	key := person.cacheKey()
+	if team, found := c.teams.Get(key); found {
+		return team, nil
 	}
 
 	// Rate limit API calls
-	<-rateLimiter.C
-
-	// Escape special characters in the person name for the query
-	escapedName := strings.ReplaceAll(personName, "\"", "\\\"")
+	c.rateLimiter.Wait()
 
-	baseURL := os.Getenv("ITOP_API_URL")
-	username := os.Getenv("ITOP_API_USER")
-	password := os.Getenv("ITOP_API_PWD")
-	if baseURL == "" || username == "" || password == "" {
-		log.Println("Missing iTop API environment variables")
-		return "-", nil
-	}
-	client := ITopClient{
-		BaseURL:  baseURL,
-		Username: username,
-		Password: password,
-		Version:  "1.3",
+	oql := "SELECT Person WHERE friendlyname=" + quoteOQL(person.Name)
+	if strings.HasPrefix(key, "id:") {
+		oql = "SELECT Person WHERE id=" + quoteOQL(person.ID)
 	}
 	params := map[string]interface{}{
 		"class":         "Person",
-		"key":           "SELECT Person WHERE friendlyname=\"" + escapedName + "\"",
-		"output_fields": "friendlyname,team_list",
+		"key":           oql,
+		"output_fields": "id,friendlyname,team_list",
 	}
-	resp, err := client.Post("core/get", params)
+	resp, err := c.Post("core/get", params)
 	if err != nil {
-		log.Printf("Error fetching person teams: %v", err)
+		slog.Warn("Error fetching person teams", "person", person.Name, "person_id", person.ID, "err", err)
 		return "-", err
 	}
 
-	var result struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-		Objects map[string]struct {
-			Fields struct {
-				TeamList []struct {
-					TeamName string `json:"team_name"`
-				} `json:"team_list"`
-			} `json:"fields"`
-		} `json:"objects"`
-	}
-
+	var result personTeamsResponse
 	if err := json.Unmarshal(resp, &result); err != nil {
-		log.Printf("Error parsing person teams response: %v", err)
+		slog.Warn("Error parsing person teams response", "person", person.Name, "person_id", person.ID, "err", err)
 		return "-", err
 	}
 
 	if result.Code != 0 || len(result.Objects) == 0 {
-		personTeamCacheMutex.Lock()
-		personTeamCache[personName] = "-" // Cache negative result
-		personTeamCacheMutex.Unlock()
+		c.teams.Set(key, "-") // Cache negative result
 		return "-", nil
 	}
 
 	var teamNames []string
 	for _, obj := range result.Objects {
-		for _, team := range obj.Fields.TeamList {
-			teamNames = append(teamNames, team.TeamName)
+		teamNames = append(teamNames, obj.Fields.teamNames()...)
+	}
+
+	teamList := joinTeams(teamNames)
+	c.teams.Set(key, teamList) // Cache the result ("-" when empty)
+	return teamList, nil
+}
+
+// personTeamsResponse is the core/get answer for Person with team_list
+type personTeamsResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Objects map[string]struct {
+		Fields personTeamsFields `json:"fields"`
+	} `json:"objects"`
+}
+
+type personTeamsFields struct {
+	ID           string `json:"id"`
+	FriendlyName string `json:"friendlyname"`
+	TeamList     []struct {
+		TeamName string `json:"team_name"`
+	} `json:"team_list"`
+}
+
+func (f personTeamsFields) teamNames() []string {
+	names := make([]string, 0, len(f.TeamList))
+	for _, team := range f.TeamList {
+		names = append(names, team.TeamName)
+	}
+	return names
+}
+
+func joinTeams(names []string) string {
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ", ")
+}
+
+// quoteOQL quotes a value as an OQL string literal
+func quoteOQL(v string) string {
+	return "\"" + strings.ReplaceAll(v, "\"", "\\\"") + "\""
+}
+
+// WarmPersonTeams seeds the team cache with every Person, fetched in pages of
+// pageSize (core/get limit/page), and returns the number of persons cached
+func (c *ITopClient) WarmPersonTeams(pageSize int) (int, error) {
+	total := 0
+	for page := 1; ; page++ {
+		c.rateLimiter.Wait()
+		resp, err := c.Post("core/get", map[string]interface{}{
+			"class":         "Person",
+			"key":           "SELECT Person",
+			"output_fields": "id,friendlyname,team_list",
+			"limit":         pageSize,
+			"page":          page,
+		})
+		if err != nil {
+			return total, err
+		}
+		var result personTeamsResponse
+		if err := json.Unmarshal(resp, &result); err != nil {
+			return total, err
+		}
+		if result.Code != 0 {
+			return total, fmt.Errorf("iTop error %d: %s", result.Code, result.Message)
+		}
+		for _, obj := range result.Objects {
+			teams := joinTeams(obj.Fields.teamNames())
+			c.teams.Set(PersonRef{ID: obj.Fields.ID}.cacheKey(), teams)
+			c.teams.Set(PersonRef{Name: obj.Fields.FriendlyName}.cacheKey(), teams)
+		}
+		total += len(result.Objects)
+		// A short page is the last one; older iTop versions ignore limit and
+		// return everything at once
+		if len(result.Objects) != pageSize {
+			return total, nil
 		}
 	}
+}
 
-	if len(teamNames) == 0 {
-		personTeamCacheMutex.Lock()
-		personTeamCache[personName] = "-" // Cache empty result
-		personTeamCacheMutex.Unlock()
-		return "-", nil
+// PrefetchPersonTeams resolves the teams of every uncached person with
+// id IN (...) / friendlyname IN (...) queries of up to 100 values, filling
+// the cache in bulk
+func (c *ITopClient) PrefetchPersonTeams(persons []PersonRef) error {
+	var ids, names []string
+	seen := map[string]bool{}
+	for _, p := range persons {
+		key := p.cacheKey()
+		if p.isZero() || seen[key] || c.teams.Has(key) {
+			continue
+		}
+		seen[key] = true
+		if strings.HasPrefix(key, "id:") {
+			ids = append(ids, p.ID)
+		} else {
+			names = append(names, p.Name)
+		}
+	}
+	if err := c.prefetchPersonTeams("id", ids); err != nil {
+		return err
 	}
+	return c.prefetchPersonTeams("friendlyname", names)
+}
 
-	teamList := strings.Join(teamNames, ", ")
-	personTeamCacheMutex.Lock()
-	personTeamCache[personName] = teamList // Cache the result
-	personTeamCacheMutex.Unlock()
-	return teamList, nil
+// prefetchPersonTeams caches the teams of persons whose attr (id or
+// friendlyname) is in values; values not found are cached as "-"
+func (c *ITopClient) prefetchPersonTeams(attr string, values []string) error {
+	ref := func(v string) PersonRef {
+		if attr == "id" {
+			return PersonRef{ID: v}
+		}
+		return PersonRef{Name: v}
+	}
+	for start := 0; start < len(values); start += 100 {
+		end := start + 100
+		if end > len(values) {
+			end = len(values)
+		}
+		chunk := values[start:end]
+		quoted := make([]string, len(chunk))
+		for i, v := range chunk {
+			quoted[i] = quoteOQL(v)
+		}
+		c.rateLimiter.Wait()
+		resp, err := c.Post("core/get", map[string]interface{}{
+			"class":         "Person",
+			"key":           "SELECT Person WHERE " + attr + " IN (" + strings.Join(quoted, ",") + ")",
+			"output_fields": "id,friendlyname,team_list",
+		})
+		if err != nil {
+			return err
+		}
+		var result personTeamsResponse
+		if err := json.Unmarshal(resp, &result); err != nil {
+			return err
+		}
+		if result.Code != 0 {
+			return fmt.Errorf("iTop error %d: %s", result.Code, result.Message)
+		}
+		teams := map[string][]string{}
+		for _, obj := range result.Objects {
+			v := obj.Fields.FriendlyName
+			if attr == "id" {
+				v = obj.Fields.ID
+			}
+			teams[v] = append(teams[v], obj.Fields.teamNames()...)
+		}
+		for _, v := range chunk {
+			c.teams.Set(ref(v).cacheKey(), joinTeams(teams[v])) // persons not found are cached as "-"
+		}
+	}
+	return nil
 }
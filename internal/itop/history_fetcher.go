@@ -0,0 +1,116 @@
+package itop
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StatusChange is one status transition recorded in the ticket history
+type StatusChange struct {
+	Date time.Time
+	From string
+	To   string
+}
+
+// historyChunkSize bounds the number of ids per "objkey IN (...)" query
+const historyChunkSize = 100
+
+// FetchStatusHistory returns the status transitions of the given tickets of a
+// class, keyed by ticket id and ordered by date
+func (c *ITopClient) FetchStatusHistory(class string, ids []string) (map[string][]StatusChange, error) {
+	history, err := c.fetchAttributeHistory(class, []string{"status"}, ids)
+	return history["status"], err
+}
+
+// FetchAssignmentHistory returns the agent_id and team_id changes of the
+// given tickets of a class, keyed by ticket id and ordered by date; From and
+// To hold the ids of the agents and teams
+func (c *ITopClient) FetchAssignmentHistory(class string, ids []string) (agents, teams map[string][]StatusChange, err error) {
+	history, err := c.fetchAttributeHistory(class, []string{"agent_id", "team_id"}, ids)
+	return history["agent_id"], history["team_id"], err
+}
+
+// fetchAttributeHistory returns the changes of the given attributes, keyed
+// by attribute code then ticket id and ordered by date
+func (c *ITopClient) fetchAttributeHistory(class string, attcodes []string, ids []string) (map[string]map[string][]StatusChange, error) {
+	out := make(map[string]map[string][]StatusChange, len(attcodes))
+	for _, code := range attcodes {
+		out[code] = make(map[string][]StatusChange)
+	}
+	for start := 0; start < len(ids); start += historyChunkSize {
+		end := start + historyChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		oql := "SELECT CMDBChangeOpSetAttributeScalar WHERE objclass = '" + class + "' AND attcode IN ('" + strings.Join(attcodes, "','") + "') AND objkey IN (" + strings.Join(ids[start:end], ",") + ")"
+		body, err := c.Post("core/get", map[string]interface{}{
+			"class":         "CMDBChangeOpSetAttributeScalar",
+			"key":           oql,
+			"output_fields": "objkey,attcode,date,oldvalue,newvalue",
+		})
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Objects map[string]struct {
+				Fields struct {
+					ObjKey   string `json:"objkey"`
+					AttCode  string `json:"attcode"`
+					Date     string `json:"date"`
+					OldValue string `json:"oldvalue"`
+					NewValue string `json:"newvalue"`
+				} `json:"fields"`
+			} `json:"objects"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Objects {
+			date, err := parseDateFlexible(obj.Fields.Date, c.Location)
+			if err != nil || date.IsZero() {
+				continue
+			}
+			byID, ok := out[obj.Fields.AttCode]
+			if !ok {
+				continue
+			}
+			byID[obj.Fields.ObjKey] = append(byID[obj.Fields.ObjKey], StatusChange{
+				Date: date,
+				From: obj.Fields.OldValue,
+				To:   obj.Fields.NewValue,
+			})
+		}
+	}
+	for _, byID := range out {
+		for id := range byID {
+			changes := byID[id]
+			sort.Slice(changes, func(i, j int) bool { return changes[i].Date.Before(changes[j].Date) })
+		}
+	}
+	return out, nil
+}
+
+// FetchTeamNames returns the names of the given teams, keyed by id
+func (c *ITopClient) FetchTeamNames(ids []string) (map[string]string, error) {
+	names := make(map[string]string, len(ids))
+	for start := 0; start < len(ids); start += historyChunkSize {
+		end := min(start+historyChunkSize, len(ids))
+		var result struct {
+			Objects map[string]struct {
+				Fields struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"fields"`
+			} `json:"objects"`
+		}
+		if err := c.getObjects("Team", "SELECT Team WHERE id IN ("+strings.Join(ids[start:end], ",")+")", "id,name", &result); err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Objects {
+			names[obj.Fields.ID] = obj.Fields.Name
+		}
+	}
+	return names, nil
+}
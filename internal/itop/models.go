@@ -22,6 +22,8 @@ type Ticket struct {
 	TTRDeadline        time.Time
 	SLATTOPassed       string
 	SLATTRPassed       string
+	SLATTOOver         time.Duration // sla_tto_over: how far iTop says TTO was exceeded
+	SLATTROver         time.Duration // sla_ttr_over
 	Agent              string
 	Team               string
 	Priority           string
@@ -30,9 +32,69 @@ type Ticket struct {
 	ServiceID          string
 	AgentID            string
 	TeamID             string
-	TicketType         string     // for future multi-class
-	LastPendingDate    *time.Time // last_pending_date dari iTop, bisa kosong
-	LastUpdate         *time.Time // last_update dari iTop, bisa kosong
-	Caller             string     // caller_id_friendlyname
-	Origin             string     // origin
+	TicketType         string         // for future multi-class
+	LastPendingDate    *time.Time     // last_pending_date dari iTop, bisa kosong
+	LastUpdate         *time.Time     // last_update dari iTop, bisa kosong
+	CallerID           string         // caller_id
+	Caller             string         // caller_id_friendlyname
+	Origin             string         // origin
+	StatusHistory      []StatusChange // status transitions, only loaded for SLA pause and reopen tracking
+	AgentHistory       []StatusChange // agent id changes, only loaded for reassignment tracking
+	TeamHistory        []StatusChange // team changes by name, only loaded for reassignment tracking
+
+	Extra map[string]interface{} // itop.extra_fields values, as returned
+
+	Problem *ProblemDetails // class Problem only
+	Change  *ChangeDetails  // Change classes only
+
+	OrgID   string // org_id
+	OrgName string // org_name
+
+	CIs []CIRef // impacted functional CIs, nil unless itop.impacted_cis is set
+
+	PublicLog *CaseLogSummary // nil unless itop.public_log is set
+
+	CloseDate        time.Time // close_date
+	ResolutionCode   string    // resolution_code
+	Solution         string    // solution, as returned (may be HTML)
+	UserSatisfaction string    // user_satisfaction: 1 (very satisfied) to 4
+
+	// itop.escalation only
+	TTOEscalationDeadline time.Time // tto_escalation_deadline
+	TTREscalationDeadline time.Time // ttr_escalation_deadline
+	EscalationFlag        bool      // escalation_flag
+	EscalationReason      string    // escalation_reason
+
+	Links *TicketLinks // itop.ticket_links only
+
+	RequestType string // request_type, UserRequest only: incident or service_request
+}
+
+// TicketLinks are the refs of the tickets a ticket is linked to
+type TicketLinks struct {
+	ParentRequest  string
+	ParentIncident string
+	ParentProblem  string
+	ParentChange   string
+	Children       []string // child incidents and attached user requests
+}
+
+// CaseLogSummary summarizes the entries of a case log; zero times when
+// there is no such entry
+type CaseLogSummary struct {
+	Entries            int
+	LastCustomerUpdate time.Time // last entry by the caller
+	LastAgentUpdate    time.Time // last entry by anyone else
+	FirstResponse      time.Time // first entry by anyone else
+}
+
+// CIRef identifies a functional CI linked to a ticket
+type CIRef struct {
+	ID   string
+	Name string
+}
+
+// CallerRef identifies the caller for team lookups
+func (t Ticket) CallerRef() PersonRef {
+	return PersonRef{ID: t.CallerID, Name: t.Caller}
 }
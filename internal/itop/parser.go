@@ -2,12 +2,13 @@ package itop
 
 import (
 	"encoding/json"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // parseDateFlexible mencoba beberapa format waktu umum
-func parseDateFlexible(s string) (time.Time, error) {
+func parseDateFlexible(s string, loc *time.Location) (time.Time, error) {
 	if s == "" {
 		return time.Time{}, nil
 	}
@@ -21,12 +22,7 @@ func parseDateFlexible(s string) (time.Time, error) {
 	}
 	var t time.Time
 	var err error
-	tz := os.Getenv("TIMEZONE")
-	if tz == "" {
-		tz = "Asia/Jakarta"
-	}
-	loc, locErr := time.LoadLocation(tz)
-	if locErr != nil {
+	if loc == nil {
 		loc = time.Local
 	}
 	for _, layout := range layouts {
@@ -38,6 +34,15 @@ func parseDateFlexible(s string) (time.Time, error) {
 	return time.Time{}, err
 }
 
+// parseSeconds parses a duration field iTop returns as a number of seconds
+func parseSeconds(s string) time.Duration {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(f * float64(time.Second))
+}
+
 type TicketResponse struct {
 	Objects map[string]struct {
 		Fields struct {
@@ -55,6 +60,7 @@ type TicketResponse struct {
 			Agent                  string `json:"agent_id_friendlyname"`
 			TeamID                 string `json:"team_id"`
 			Team                   string `json:"team_id_friendlyname"`
+			CallerID               string `json:"caller_id"`
 			Caller                 string `json:"caller_id_friendlyname"`
 			Origin                 string `json:"origin"`
 			StartDate              string `json:"start_date"`
@@ -66,11 +72,21 @@ type TicketResponse struct {
 			TTRDeadline            string `json:"ttr_deadline"`
 			SLATTOPassed           string `json:"sla_tto_passed"`
 			SLATTRPassed           string `json:"sla_ttr_passed"`
+			SLATTOOver             string `json:"sla_tto_over"`
+			SLATTROver             string `json:"sla_ttr_over"`
+			OrgID                  string `json:"org_id"`
+			OrgName                string `json:"org_name"`
+			CloseDate              string `json:"close_date"`
+			ResolutionCode         string `json:"resolution_code"`
+			Solution               string `json:"solution"`
+			UserSatisfaction       string `json:"user_satisfaction"`
+			RequestType            string `json:"request_type"`
 		} `json:"fields"`
 	} `json:"objects"`
 }
 
-func ParseTickets(data []byte) ([]Ticket, error) {
+// ParseTickets parses a core/get response; dates are interpreted in loc
+func ParseTickets(data []byte, loc *time.Location) ([]Ticket, error) {
 	var resp TicketResponse
 	if err := json.Unmarshal(data, &resp); err != nil {
 		return nil, err
@@ -78,13 +94,14 @@ func ParseTickets(data []byte) ([]Ticket, error) {
 	var tickets []Ticket
 	for _, obj := range resp.Objects {
 		fields := obj.Fields
-		startDate, _ := parseDateFlexible(fields.StartDate)
-		assignmentDate, _ := parseDateFlexible(fields.AssignmentDate)
-		resolutionDate, _ := parseDateFlexible(fields.ResolutionDate)
-		ttoDeadline, _ := parseDateFlexible(fields.TTODeadline)
-		ttrDeadline, _ := parseDateFlexible(fields.TTRDeadline)
-		lastPendingDate, _ := parseDateFlexible(fields.LastPendingDate)
-		lastUpdate, _ := parseDateFlexible(fields.LastUpdate)
+		startDate, _ := parseDateFlexible(fields.StartDate, loc)
+		assignmentDate, _ := parseDateFlexible(fields.AssignmentDate, loc)
+		resolutionDate, _ := parseDateFlexible(fields.ResolutionDate, loc)
+		ttoDeadline, _ := parseDateFlexible(fields.TTODeadline, loc)
+		ttrDeadline, _ := parseDateFlexible(fields.TTRDeadline, loc)
+		lastPendingDate, _ := parseDateFlexible(fields.LastPendingDate, loc)
+		lastUpdate, _ := parseDateFlexible(fields.LastUpdate, loc)
+		closeDate, _ := parseDateFlexible(fields.CloseDate, loc)
 
 		ticket := Ticket{
 			ID:                 fields.ID,
@@ -101,6 +118,8 @@ func ParseTickets(data []byte) ([]Ticket, error) {
 			TTRDeadline:        ttrDeadline,
 			SLATTOPassed:       fields.SLATTOPassed,
 			SLATTRPassed:       fields.SLATTRPassed,
+			SLATTOOver:         parseSeconds(fields.SLATTOOver),
+			SLATTROver:         parseSeconds(fields.SLATTROver),
 			Agent:              fields.Agent,
 			AgentID:            fields.AgentID,
 			Team:               fields.Team,
@@ -109,10 +128,18 @@ func ParseTickets(data []byte) ([]Ticket, error) {
 			Urgency:            fields.Urgency,
 			Impact:             fields.Impact,
 			ServiceID:          fields.ServiceID,
+			CallerID:           fields.CallerID,
 			Caller:             fields.Caller,
 			Origin:             fields.Origin,
 			LastPendingDate:    nil,
 			LastUpdate:         nil,
+			OrgID:              fields.OrgID,
+			OrgName:            fields.OrgName,
+			CloseDate:          closeDate,
+			ResolutionCode:     fields.ResolutionCode,
+			Solution:           fields.Solution,
+			UserSatisfaction:   fields.UserSatisfaction,
+			RequestType:        fields.RequestType,
 		}
 		if !lastPendingDate.IsZero() {
 			ticket.LastPendingDate = &lastPendingDate
@@ -131,3 +158,213 @@ func ParseTickets(data []byte) ([]Ticket, error) {
 	}
 	return tickets, nil
 }
+
+// parseExtraFields copies the itop.extra_fields values of a core/get
+// response into the parsed tickets
+func parseExtraFields(data []byte, tickets []Ticket, names []string) error {
+	var resp struct {
+		Objects map[string]struct {
+			Fields map[string]interface{} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	byID := make(map[string]map[string]interface{}, len(resp.Objects))
+	for _, obj := range resp.Objects {
+		if id, ok := obj.Fields["id"].(string); ok {
+			byID[id] = obj.Fields
+		}
+	}
+	for i := range tickets {
+		fields := byID[tickets[i].ID]
+		extra := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			if v, ok := fields[name]; ok {
+				extra[name] = v
+			}
+		}
+		tickets[i].Extra = extra
+	}
+	return nil
+}
+
+// parseImpactedCIs copies the functionalcis_list of a core/get response
+// into the parsed tickets, leaving out the CIs marked as not impacted
+func parseImpactedCIs(data []byte, tickets []Ticket) error {
+	var resp struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID      string `json:"id"`
+				CIsList []struct {
+					ID         string `json:"functionalci_id"`
+					Name       string `json:"functionalci_name"`
+					ImpactCode string `json:"impact_code"`
+				} `json:"functionalcis_list"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	byID := make(map[string][]CIRef, len(resp.Objects))
+	for _, obj := range resp.Objects {
+		cis := []CIRef{}
+		for _, ci := range obj.Fields.CIsList {
+			if ci.ImpactCode != "not_impacted" {
+				cis = append(cis, CIRef{ID: ci.ID, Name: ci.Name})
+			}
+		}
+		byID[obj.Fields.ID] = cis
+	}
+	for i := range tickets {
+		tickets[i].CIs = byID[tickets[i].ID]
+	}
+	return nil
+}
+
+// IsSupportTicket tells whether a class is an incident or user request
+// class (with a public_log and SLA stopwatches), not a problem or change
+func IsSupportTicket(class string) bool {
+	return class != "Problem" && changeOutputFields(class) == ""
+}
+
+// parsePublicLog summarizes the public_log of a core/get response into the
+// parsed tickets. Entries written under the caller's name are the
+// customer's, the others the agents'.
+func parsePublicLog(data []byte, tickets []Ticket, loc *time.Location) error {
+	var resp struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID        string `json:"id"`
+				PublicLog struct {
+					Entries []struct {
+						Date      string `json:"date"`
+						UserLogin string `json:"user_login"`
+					} `json:"entries"`
+				} `json:"public_log"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	byID := make(map[string]int, len(tickets))
+	for i := range tickets {
+		byID[tickets[i].ID] = i
+	}
+	for _, obj := range resp.Objects {
+		i, ok := byID[obj.Fields.ID]
+		if !ok {
+			continue
+		}
+		t := &tickets[i]
+		summary := &CaseLogSummary{Entries: len(obj.Fields.PublicLog.Entries)}
+		for _, e := range obj.Fields.PublicLog.Entries {
+			date, err := parseDateFlexible(e.Date, loc)
+			if err != nil || date.IsZero() {
+				continue
+			}
+			if t.Caller != "" && strings.EqualFold(strings.TrimSpace(e.UserLogin), strings.TrimSpace(t.Caller)) {
+				if date.After(summary.LastCustomerUpdate) {
+					summary.LastCustomerUpdate = date
+				}
+				continue
+			}
+			if date.After(summary.LastAgentUpdate) {
+				summary.LastAgentUpdate = date
+			}
+			if summary.FirstResponse.IsZero() || date.Before(summary.FirstResponse) {
+				summary.FirstResponse = date
+			}
+		}
+		t.PublicLog = summary
+	}
+	return nil
+}
+
+// escalationFields are the escalation thresholds of the TTO and TTR
+// stopwatches (75% of the SLT) and the manual escalation of a ticket
+const escalationFields = "tto_escalation_deadline,ttr_escalation_deadline,escalation_flag,escalation_reason"
+
+// parseEscalation copies the escalationFields of a core/get response into
+// the parsed tickets
+func parseEscalation(data []byte, tickets []Ticket, loc *time.Location) error {
+	var resp struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID                    string `json:"id"`
+				TTOEscalationDeadline string `json:"tto_escalation_deadline"`
+				TTREscalationDeadline string `json:"ttr_escalation_deadline"`
+				EscalationFlag        string `json:"escalation_flag"`
+				EscalationReason      string `json:"escalation_reason"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	byID := make(map[string]int, len(tickets))
+	for i := range tickets {
+		byID[tickets[i].ID] = i
+	}
+	for _, obj := range resp.Objects {
+		i, ok := byID[obj.Fields.ID]
+		if !ok {
+			continue
+		}
+		t := &tickets[i]
+		t.TTOEscalationDeadline, _ = parseDateFlexible(obj.Fields.TTOEscalationDeadline, loc)
+		t.TTREscalationDeadline, _ = parseDateFlexible(obj.Fields.TTREscalationDeadline, loc)
+		t.EscalationFlag = obj.Fields.EscalationFlag == "yes"
+		t.EscalationReason = obj.Fields.EscalationReason
+	}
+	return nil
+}
+
+// linkFields are the fields linking incidents and user requests to other
+// tickets: their parents and the tickets attached to them
+var linkFields = map[string]string{
+	"Incident":    "parent_incident_ref,parent_problem_ref,parent_change_ref,child_incidents_list,related_request_list",
+	"UserRequest": "parent_request_ref,parent_incident_ref,parent_problem_ref,parent_change_ref,related_request_list",
+}
+
+// parseTicketLinks copies the linkFields of a core/get response into the
+// parsed tickets
+func parseTicketLinks(data []byte, tickets []Ticket) error {
+	type refList []struct {
+		Ref string `json:"ref"`
+	}
+	var resp struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID                 string  `json:"id"`
+				ParentRequestRef   string  `json:"parent_request_ref"`
+				ParentIncidentRef  string  `json:"parent_incident_ref"`
+				ParentProblemRef   string  `json:"parent_problem_ref"`
+				ParentChangeRef    string  `json:"parent_change_ref"`
+				ChildIncidentsList refList `json:"child_incidents_list"`
+				RelatedRequestList refList `json:"related_request_list"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	byID := make(map[string]*TicketLinks, len(resp.Objects))
+	for _, obj := range resp.Objects {
+		f := obj.Fields
+		l := &TicketLinks{ParentRequest: f.ParentRequestRef, ParentIncident: f.ParentIncidentRef,
+			ParentProblem: f.ParentProblemRef, ParentChange: f.ParentChangeRef, Children: []string{}}
+		for _, list := range []refList{f.ChildIncidentsList, f.RelatedRequestList} {
+			for _, r := range list {
+				l.Children = append(l.Children, r.Ref)
+			}
+		}
+		byID[f.ID] = l
+	}
+	for i := range tickets {
+		tickets[i].Links = byID[tickets[i].ID]
+	}
+	return nil
+}
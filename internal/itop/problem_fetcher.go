@@ -0,0 +1,130 @@
+package itop
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// problemOutputFields are the default fields requested for the Problem
+// class, which has none of the SLA fields of incidents and requests
+const problemOutputFields = "id,ref,title,org_id,org_name,status,priority,urgency,impact,service_id,service_name,servicesubcategory_name,agent_id,agent_id_friendlyname,team_id,team_id_friendlyname,caller_id,caller_id_friendlyname,start_date,assignment_date,resolution_date,last_update,close_date,related_change_id_friendlyname,related_request_list,knownerrors_list"
+
+// ProblemDetails are the problem management fields of a Problem
+type ProblemDetails struct {
+	RelatedRequests  []string // refs of the user requests attached to the problem
+	RelatedIncidents []string // refs of the incidents whose parent problem it is
+	RelatedChange    string   // related_change_id_friendlyname
+	KnownErrors      int
+	Workaround       string // workarounds of the known errors, one per line
+	RootCause        string // root causes of the known errors, one per line
+}
+
+// parseProblemFields fills the ProblemDetails of the parsed tickets from a
+// core/get response on Problem
+func parseProblemFields(data []byte, tickets []Ticket) error {
+	var resp struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID                 string `json:"id"`
+				RelatedChange      string `json:"related_change_id_friendlyname"`
+				RelatedRequestList []struct {
+					Ref string `json:"ref"`
+				} `json:"related_request_list"`
+				KnownErrorsList []struct {
+					Workaround string `json:"workaround"`
+					RootCause  string `json:"root_cause"`
+				} `json:"knownerrors_list"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	byID := make(map[string]*ProblemDetails, len(resp.Objects))
+	for _, obj := range resp.Objects {
+		f := obj.Fields
+		p := &ProblemDetails{RelatedChange: f.RelatedChange, KnownErrors: len(f.KnownErrorsList)}
+		for _, r := range f.RelatedRequestList {
+			p.RelatedRequests = append(p.RelatedRequests, r.Ref)
+		}
+		var workarounds, causes []string
+		for _, ke := range f.KnownErrorsList {
+			if s := strings.TrimSpace(ke.Workaround); s != "" {
+				workarounds = append(workarounds, s)
+			}
+			if s := strings.TrimSpace(ke.RootCause); s != "" {
+				causes = append(causes, s)
+			}
+		}
+		p.Workaround = strings.Join(workarounds, "\n")
+		p.RootCause = strings.Join(causes, "\n")
+		byID[f.ID] = p
+	}
+	for i := range tickets {
+		if p, ok := byID[tickets[i].ID]; ok {
+			tickets[i].Problem = p
+		}
+	}
+	return nil
+}
+
+// fetchProblemIncidents sets the refs of the incidents attached
+// (parent_problem_id) to the given problems. Without the Incident class or
+// that attribute, the problems keep no related incidents.
+func (c *ITopClient) fetchProblemIncidents(problems []Ticket) {
+	var ids []string
+	byID := map[string]*ProblemDetails{}
+	for i := range problems {
+		if p := problems[i].Problem; p != nil {
+			ids = append(ids, problems[i].ID)
+			byID[problems[i].ID] = p
+		}
+	}
+	for start := 0; start < len(ids); start += historyChunkSize {
+		end := min(start+historyChunkSize, len(ids))
+		refs, err := c.problemIncidents(ids[start:end])
+		if err != nil {
+			slog.Warn("Failed to fetch the incidents of problems", "problems", end-start, "err", err)
+			return
+		}
+		for id, r := range refs {
+			sort.Strings(r)
+			byID[id].RelatedIncidents = r
+		}
+	}
+}
+
+func (c *ITopClient) problemIncidents(ids []string) (map[string][]string, error) {
+	body, err := c.Post("core/get", map[string]interface{}{
+		"class":         "Incident",
+		"key":           "SELECT Incident WHERE parent_problem_id IN (" + strings.Join(ids, ",") + ")",
+		"output_fields": "ref,parent_problem_id",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Objects map[string]struct {
+			Fields struct {
+				Ref       string `json:"ref"`
+				ProblemID string `json:"parent_problem_id"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if result.Code != 0 {
+		return nil, fmt.Errorf("iTop error %d: %s", result.Code, result.Message)
+	}
+	out := map[string][]string{}
+	for _, obj := range result.Objects {
+		out[obj.Fields.ProblemID] = append(out[obj.Fields.ProblemID], obj.Fields.Ref)
+	}
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package itop
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by concurrent callers: one token is
+// added every interval (times the slowdown factor), up to burst tokens
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	factor   float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{interval: interval, factor: 1, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// newRateLimiterPerSecond limits to rate requests per second, nil (no
+// limit) when rate is 0
+func newRateLimiterPerSecond(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return newRateLimiter(time.Duration(float64(time.Second)/rate), burst)
+}
+
+// slowDown stretches the interval between tokens by factor (1 restores it)
+func (r *rateLimiter) slowDown(factor float64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.factor = factor
+	r.mu.Unlock()
+}
+
+// Wait blocks until a token is available; a nil limiter never blocks.
+// Tokens are reserved under the lock, so waiting callers are served in
+// order without busy looping.
+func (r *rateLimiter) Wait() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	interval := float64(r.interval) * r.factor
+	r.tokens += float64(now.Sub(r.last)) / interval
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens--
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens * interval)
+	}
+	r.mu.Unlock()
+	time.Sleep(wait)
+}
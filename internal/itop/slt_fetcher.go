@@ -1,134 +1,184 @@
 package itop
 
 import (
-	"bytes"
-	"crypto/tls"
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
-	"os"
+	"log/slog"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-var (
-	sltCache   = make(map[string]SLTDeadline)
-	sltCacheMu sync.RWMutex
-)
+// sltCacheEntry is a cached SLT lookup, keyed by its arguments joined by "|"
+type sltCacheEntry struct {
+	slt     SLTDeadline
+	fetched time.Time
+}
+
+func sltCacheKey(class, priority, serviceName, subcategory, requestType string) string {
+	return class + "|" + priority + "|" + serviceName + "|" + subcategory + "|" + requestType
+}
 
-// GetSLTDeadlineCached returns SLTDeadline from cache or fetches from iTop if not cached
-func GetSLTDeadlineCached(class, priority, serviceName string) (SLTDeadline, error) {
-	key := class + "|" + priority + "|" + serviceName
-	sltCacheMu.RLock()
-	if val, ok := sltCache[key]; ok {
-		sltCacheMu.RUnlock()
-		return val, nil
-	}
-	sltCacheMu.RUnlock()
-	slt, err := GetTicketSLT(class, "", priority, serviceName)
+// GetSLTDeadlineCached returns SLTDeadline from cache or fetches from iTop
+// if not cached, or cached more than itop.slt_cache_ttl ago
+func (c *ITopClient) GetSLTDeadlineCached(class, priority, serviceName, subcategory, requestType string) (SLTDeadline, error) {
+	key := sltCacheKey(class, priority, serviceName, subcategory, requestType)
+	c.sltCacheMu.RLock()
+	if e, ok := c.sltCache[key]; ok && (c.conf.SLTCacheTTL <= 0 || time.Since(e.fetched) < c.conf.SLTCacheTTL) {
+		c.sltCacheMu.RUnlock()
+		return e.slt, nil
+	}
+	c.sltCacheMu.RUnlock()
+	slt, err := c.GetTicketSLT(class, priority, serviceName, subcategory, requestType)
 	if err == nil {
-		sltCacheMu.Lock()
-		sltCache[key] = slt
-		sltCacheMu.Unlock()
+		c.sltCacheMu.Lock()
+		c.sltCache[key] = sltCacheEntry{slt: slt, fetched: time.Now()}
+		c.sltCacheMu.Unlock()
 	}
 	return slt, err
 }
 
+// RefreshSLTCache fetches every cached SLT lookup again, along with the
+// coverage windows; a lookup that fails keeps its cached value
+func (c *ITopClient) RefreshSLTCache() (int, error) {
+	c.sltCacheMu.RLock()
+	keys := make([]string, 0, len(c.sltCache))
+	for key := range c.sltCache {
+		keys = append(keys, key)
+	}
+	c.sltCacheMu.RUnlock()
+	c.flushCoverageCache()
+	var firstErr error
+	n := 0
+	for _, key := range keys {
+		args := strings.Split(key, "|")
+		slt, err := c.GetTicketSLT(args[0], args[1], args[2], args[3], args[4])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		c.sltCacheMu.Lock()
+		c.sltCache[key] = sltCacheEntry{slt: slt, fetched: time.Now()}
+		c.sltCacheMu.Unlock()
+		n++
+	}
+	return n, firstErr
+}
+
+// FlushSLTCache empties the SLT and coverage window caches, so the next
+// lookups read iTop; it returns the number of SLT lookups dropped
+func (c *ITopClient) FlushSLTCache() int {
+	c.sltCacheMu.Lock()
+	n := len(c.sltCache)
+	c.sltCache = make(map[string]sltCacheEntry)
+	c.sltCacheMu.Unlock()
+	c.flushCoverageCache()
+	return n
+}
+
+// SLTCacheEntries returns a copy of the SLT cache for persistence
+func (c *ITopClient) SLTCacheEntries() map[string]SLTDeadline {
+	c.sltCacheMu.RLock()
+	defer c.sltCacheMu.RUnlock()
+	out := make(map[string]SLTDeadline, len(c.sltCache))
+	for k, e := range c.sltCache {
+		out[k] = e.slt
+	}
+	return out
+}
+
+// RestoreSLTCache seeds the SLT cache with persisted entries, which count
+// as fetched now; entries of an older key format are dropped
+func (c *ITopClient) RestoreSLTCache(entries map[string]SLTDeadline) {
+	c.sltCacheMu.Lock()
+	defer c.sltCacheMu.Unlock()
+	now := time.Now()
+	for k, v := range entries {
+		if strings.Count(k, "|") == 4 {
+			c.sltCache[k] = sltCacheEntry{slt: v, fetched: now}
+		}
+	}
+}
+
 type SLTDeadline struct {
 	TTO time.Duration
 	TTR time.Duration
+	// TTODays and TTRDays are targets in business days (SLT unit
+	// business_days), evaluated against the business calendar; TTO and TTR
+	// are then 0
+	TTODays int
+	TTRDays int
+	// Coverage is the coverage window linked to the service in the customer
+	// contract, nil when there is none
+	Coverage *CoverageWindow
 }
 
-// GetTicketSLT fetches TTO/TTR for a ticket from iTop (by priority, service_name, class)
-func GetTicketSLT(class, ref, priority, serviceName string) (SLTDeadline, error) {
-	baseURL := os.Getenv("ITOP_API_URL")
-	username := os.Getenv("ITOP_API_USER")
-	password := os.Getenv("ITOP_API_PWD")
-	if baseURL == "" || username == "" || password == "" {
-		return SLTDeadline{}, nil
-	}
+// GetTicketSLT fetches TTO/TTR for a ticket from iTop (by priority,
+// service_name, class). Contracts that set an SLA per service subcategory
+// (a servicesubcategory_name on their services_list, where iTop is extended
+// that way) take precedence for tickets of that subcategory. requestType,
+// when set, selects the SLTs instead of the class.
+func (c *ITopClient) GetTicketSLT(class, priority, serviceName, subcategory, requestType string) (SLTDeadline, error) {
 	// 1. Get SLA_NAME for service_name
-	payload1 := map[string]interface{}{
-		"operation":     "core/get",
+	c.sltLimit.Wait()
+	body1, err := c.Post("core/get", map[string]interface{}{
 		"class":         "CustomerContract",
 		"key":           "SELECT CustomerContract",
 		"output_fields": "services_list",
-	}
-	jsonData1, _ := json.Marshal(payload1)
-	form1 := map[string]string{
-		"version":   "1.3",
-		"auth_user": username,
-		"auth_pwd":  password,
-		"json_data": string(jsonData1),
-	}
-	formData1 := encodeForm(form1)
-	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
-	req1, _ := http.NewRequest("POST", baseURL, bytes.NewReader(formData1))
-	req1.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	// log debug dimatikan
-	resp1, err := client.Do(req1)
+	})
 	if err != nil {
 		return SLTDeadline{}, err
 	}
-	defer resp1.Body.Close()
-	body1, _ := ioutil.ReadAll(resp1.Body)
-	// log debug dimatikan
 	var cc struct {
 		Objects map[string]struct {
 			Fields struct {
 				ServicesList []struct {
-					ServiceName string `json:"service_name"`
-					SLAName     string `json:"sla_name"`
+					ServiceName      string `json:"service_name"`
+					SubcategoryName  string `json:"servicesubcategory_name"`
+					SLAName          string `json:"sla_name"`
+					CoverageWindowID string `json:"coveragewindow_id"`
 				} `json:"services_list"`
 			} `json:"fields"`
 		} `json:"objects"`
 	}
 	_ = json.Unmarshal(body1, &cc)
-	var slaName string
+	var slaName, coverageID string
+	bySubcategory := false
 	for _, obj := range cc.Objects {
 		for _, svc := range obj.Fields.ServicesList {
-			if strings.EqualFold(svc.ServiceName, serviceName) {
-				slaName = svc.SLAName
-				break
+			if !strings.EqualFold(svc.ServiceName, serviceName) {
+				continue
+			}
+			switch {
+			case svc.SubcategoryName != "" && subcategory != "" && strings.EqualFold(svc.SubcategoryName, subcategory):
+				slaName, coverageID, bySubcategory = svc.SLAName, svc.CoverageWindowID, true
+			case svc.SubcategoryName == "" && slaName == "" && !bySubcategory:
+				slaName, coverageID = svc.SLAName, svc.CoverageWindowID
 			}
 		}
 	}
 	if slaName == "" {
 		return SLTDeadline{}, nil
 	}
-	// 2. Get SLT for priority, class, sla_name
-	requestType := ""
-	if class == "Incident" {
-		requestType = "incident"
-	} else if class == "UserRequest" {
-		requestType = "service_request"
+	// 2. Get SLT for priority, request type (by default from the class), sla_name
+	if requestType == "" {
+		if class == "Incident" {
+			requestType = "incident"
+		} else if class == "UserRequest" {
+			requestType = "service_request"
+		}
 	}
-	payload2 := map[string]interface{}{
-		"operation":     "core/get",
+	c.sltLimit.Wait()
+	body2, err := c.Post("core/get", map[string]interface{}{
 		"class":         "SLT",
 		"key":           "SELECT SLT WHERE priority = " + priority + " AND request_type = \"" + requestType + "\"",
 		"output_fields": "*",
-	}
-	jsonData2, _ := json.Marshal(payload2)
-	form2 := map[string]string{
-		"version":   "1.3",
-		"auth_user": username,
-		"auth_pwd":  password,
-		"json_data": string(jsonData2),
-	}
-	formData2 := encodeForm(form2)
-	req2, _ := http.NewRequest("POST", baseURL, bytes.NewReader(formData2))
-	req2.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	// log debug dimatikan
-	resp2, err := client.Do(req2)
+	})
 	if err != nil {
 		return SLTDeadline{}, err
 	}
-	defer resp2.Body.Close()
-	body2, _ := ioutil.ReadAll(resp2.Body)
-	// log debug dimatikan
 	var sltResp struct {
 		Objects map[string]struct {
 			Fields struct {
@@ -143,6 +193,7 @@ func GetTicketSLT(class, ref, priority, serviceName string) (SLTDeadline, error)
 	}
 	_ = json.Unmarshal(body2, &sltResp)
 	var tto, ttr time.Duration
+	var ttoDays, ttrDays int
 	for _, obj := range sltResp.Objects {
 		for _, sla := range obj.Fields.SLAsList {
 			if sla.SLAName == slaName {
@@ -152,27 +203,37 @@ func GetTicketSLT(class, ref, priority, serviceName string) (SLTDeadline, error)
 						valInt = v
 					}
 				}
+				days := 0
+				if IsBusinessDayUnit(obj.Fields.Unit) {
+					days = valInt
+				}
 				if obj.Fields.Metric == "tto" {
-					tto = parseSLTDuration(valInt, obj.Fields.Unit)
+					tto, ttoDays = parseSLTDuration(valInt, obj.Fields.Unit), days
 				} else if obj.Fields.Metric == "ttr" {
-					ttr = parseSLTDuration(valInt, obj.Fields.Unit)
+					ttr, ttrDays = parseSLTDuration(valInt, obj.Fields.Unit), days
 				}
 			}
 		}
 	}
-	return SLTDeadline{TTO: tto, TTR: ttr}, nil
+	slt := SLTDeadline{TTO: tto, TTR: ttr, TTODays: ttoDays, TTRDays: ttrDays}
+	if c.conf.CoverageWindows && coverageID != "" && coverageID != "0" {
+		coverage, err := c.GetCoverageWindowCached(coverageID)
+		if err != nil {
+			slog.Warn("Failed to fetch coverage window, using global work hours", "coverage_window", coverageID, "err", err)
+		}
+		slt.Coverage = coverage
+	}
+	return slt, nil
 }
 
-func encodeForm(form map[string]string) []byte {
-	var buf bytes.Buffer
-	for k, v := range form {
-		buf.WriteString(k + "=" + v + "&")
-	}
-	b := buf.Bytes()
-	if len(b) > 0 {
-		b = b[:len(b)-1]
+// IsBusinessDayUnit reports whether an SLT unit counts business days,
+// which have no fixed duration
+func IsBusinessDayUnit(unit string) bool {
+	switch strings.ToLower(unit) {
+	case "business_days", "business_day", "businessdays", "business days", "bd":
+		return true
 	}
-	return b
+	return false
 }
 
 func parseSLTDuration(val int, unit string) time.Duration {
@@ -188,3 +249,88 @@ func parseSLTDuration(val int, unit string) time.Duration {
 	}
 	return 0
 }
+
+// SLTDefinition is an SLT as linked to one SLA, with the services whose
+// customer contracts use that SLA
+type SLTDefinition struct {
+	SLTID       string
+	SLTName     string
+	SLAID       string
+	SLAName     string
+	Priority    string
+	RequestType string // incident or service_request
+	Metric      string // tto or ttr
+	Value       int
+	Unit        string
+	Target      time.Duration
+	Services    []string
+}
+
+// FetchSLTDefinitions fetches every SLT with the SLAs it belongs to; SLTs
+// outside any SLA are returned once with no SLA
+func (c *ITopClient) FetchSLTDefinitions() ([]SLTDefinition, error) {
+	var contracts struct {
+		Objects map[string]struct {
+			Fields struct {
+				ServicesList []struct {
+					ServiceName string `json:"service_name"`
+					SLAName     string `json:"sla_name"`
+				} `json:"services_list"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := c.getObjects("CustomerContract", "SELECT CustomerContract", "services_list", &contracts); err != nil {
+		return nil, err
+	}
+	services := map[string][]string{}
+	seen := map[string]bool{}
+	for _, obj := range contracts.Objects {
+		for _, svc := range obj.Fields.ServicesList {
+			if svc.SLAName == "" || seen[svc.SLAName+"|"+svc.ServiceName] {
+				continue
+			}
+			seen[svc.SLAName+"|"+svc.ServiceName] = true
+			services[svc.SLAName] = append(services[svc.SLAName], svc.ServiceName)
+		}
+	}
+	for _, names := range services {
+		sort.Strings(names)
+	}
+
+	var slts struct {
+		Objects map[string]struct {
+			Fields struct {
+				ID          string `json:"id"`
+				Name        string `json:"name"`
+				Priority    string `json:"priority"`
+				RequestType string `json:"request_type"`
+				Metric      string `json:"metric"`
+				Value       string `json:"value"`
+				Unit        string `json:"unit"`
+				SLAsList    []struct {
+					SLAID   string `json:"sla_id"`
+					SLAName string `json:"sla_name"`
+				} `json:"slas_list"`
+			} `json:"fields"`
+		} `json:"objects"`
+	}
+	if err := c.getObjects("SLT", "SELECT SLT", "id,name,priority,request_type,metric,value,unit,slas_list", &slts); err != nil {
+		return nil, err
+	}
+	var defs []SLTDefinition
+	for _, obj := range slts.Objects {
+		f := obj.Fields
+		value, _ := strconv.Atoi(f.Value)
+		def := SLTDefinition{SLTID: f.ID, SLTName: f.Name, Priority: f.Priority, RequestType: f.RequestType,
+			Metric: f.Metric, Value: value, Unit: f.Unit, Target: parseSLTDuration(value, f.Unit)}
+		if len(f.SLAsList) == 0 {
+			defs = append(defs, def)
+		}
+		for _, sla := range f.SLAsList {
+			d := def
+			d.SLAID, d.SLAName, d.Services = sla.SLAID, sla.SLAName, services[sla.SLAName]
+			defs = append(defs, d)
+		}
+	}
+	return defs, nil
+}
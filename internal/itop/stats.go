@@ -0,0 +1,59 @@
+package itop
+
+import (
+	"sync"
+	"time"
+)
+
+// APIStats describes the iTop requests made over a period
+type APIStats struct {
+	Requests int
+	Errors   int           // network errors and non-200 responses
+	Latency  time.Duration // mean
+}
+
+// ErrorRate is the share of failed requests, 0 without requests
+func (s APIStats) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// apiStats accumulates the requests of a client
+type apiStats struct {
+	mu       sync.Mutex
+	requests int
+	errors   int
+	total    time.Duration
+}
+
+func (s *apiStats) record(d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.total += d
+	if failed {
+		s.errors++
+	}
+}
+
+// TakeStats returns the requests made since the previous call
+func (c *ITopClient) TakeStats() APIStats {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	st := APIStats{Requests: c.stats.requests, Errors: c.stats.errors}
+	if st.Requests > 0 {
+		st.Latency = c.stats.total / time.Duration(st.Requests)
+	}
+	c.stats.requests, c.stats.errors, c.stats.total = 0, 0, 0
+	return st
+}
+
+// SlowDown stretches the interval between requests of every rate limit by
+// factor, 1 restoring the configured rates; unlimited requests stay so
+func (c *ITopClient) SlowDown(factor float64) {
+	c.rateLimiter.slowDown(factor)
+	c.ticketLimit.slowDown(factor)
+	c.sltLimit.slowDown(factor)
+}
@@ -0,0 +1,127 @@
+package itop
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	metrics "itop-sla-exporter/internal/metrics"
+)
+
+// teamCache is the person -> teams LRU cache. Entries expire after ttl so team
+// changes in iTop show up; the least recently used are evicted beyond max.
+type teamCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type teamCacheEntry struct {
+	key     string
+	teams   string
+	expires time.Time
+}
+
+func newTeamCache(ttl time.Duration, max int) *teamCache {
+	return &teamCache{ttl: ttl, max: max, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns the cached teams of a person, recording a hit or miss
+func (c *teamCache) Get(key string) (string, bool) {
+	teams, ok := c.lookup(key)
+	if ok {
+		metrics.CacheLookups.Inc("person_team", "hit")
+	} else {
+		metrics.CacheLookups.Inc("person_team", "miss")
+	}
+	return teams, ok
+}
+
+// Has reports whether a live entry exists, without touching the metrics
+func (c *teamCache) Has(key string) bool {
+	_, ok := c.lookup(key)
+	return ok
+}
+
+func (c *teamCache) lookup(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	e := el.Value.(*teamCacheEntry)
+	if c.ttl > 0 && time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return "", false
+	}
+	c.ll.MoveToFront(el)
+	return e.teams, true
+}
+
+func (c *teamCache) Set(key, teams string) {
+	c.set(key, teams, time.Now().Add(c.ttl))
+}
+
+func (c *teamCache) set(key, teams string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*teamCacheEntry)
+		e.teams, e.expires = teams, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&teamCacheEntry{key, teams, expires})
+	for c.max > 0 && c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*teamCacheEntry).key)
+	}
+}
+
+// CachedTeams is a team cache entry as persisted in the state store
+type CachedTeams struct {
+	Teams   string    `json:"teams"`
+	Expires time.Time `json:"expires"`
+}
+
+// TeamCacheEntries returns the live entries of the person-team cache
+func (c *ITopClient) TeamCacheEntries() map[string]CachedTeams {
+	c.teams.mu.Lock()
+	defer c.teams.mu.Unlock()
+	out := make(map[string]CachedTeams, len(c.teams.items))
+	now := time.Now()
+	for key, el := range c.teams.items {
+		e := el.Value.(*teamCacheEntry)
+		if c.teams.ttl <= 0 || now.Before(e.expires) {
+			out[key] = CachedTeams{e.teams, e.expires}
+		}
+	}
+	return out
+}
+
+// FlushTeamCache empties the person-team cache and returns the number of
+// entries dropped
+func (c *ITopClient) FlushTeamCache() int {
+	c.teams.mu.Lock()
+	defer c.teams.mu.Unlock()
+	n := len(c.teams.items)
+	c.teams.ll.Init()
+	c.teams.items = map[string]*list.Element{}
+	return n
+}
+
+// RestoreTeamCache seeds the person-team cache, skipping expired entries
+func (c *ITopClient) RestoreTeamCache(entries map[string]CachedTeams) {
+	now := time.Now()
+	for key, e := range entries {
+		if c.teams.ttl > 0 && !now.Before(e.Expires) {
+			continue
+		}
+		c.teams.set(key, e.Teams, e.Expires)
+	}
+}
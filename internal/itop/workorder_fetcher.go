@@ -0,0 +1,92 @@
+package itop
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WorkOrder is a work order logged against a ticket
+type WorkOrder struct {
+	ID          string
+	Name        string
+	Status      string // open or closed
+	TicketID    string
+	TicketRef   string
+	TeamID      string
+	Team        string
+	AgentID     string
+	Agent       string
+	StartDate   time.Time
+	EndDate     time.Time
+	Description string
+}
+
+// FetchWorkOrders fetches the work orders (of tickets within
+// itop.organizations), in pages of itop.page_size
+func (c *ITopClient) FetchWorkOrders() ([]WorkOrder, error) {
+	oql := "SELECT WorkOrder"
+	if org := c.orgCondition("t.org_id", "t.org_name"); org != "" {
+		oql = "SELECT w FROM WorkOrder AS w JOIN Ticket AS t ON w.ticket_id = t.id WHERE " + org
+	}
+	var orders []WorkOrder
+	seen := map[string]bool{}
+	for page := 1; ; page++ {
+		params := map[string]interface{}{
+			"class":         "WorkOrder",
+			"key":           oql,
+			"output_fields": "id,name,status,ticket_id,ticket_ref,team_id,team_id_friendlyname,agent_id,agent_id_friendlyname,start_date,end_date,description",
+		}
+		if c.conf.PageSize > 0 {
+			params["limit"] = c.conf.PageSize
+			params["page"] = page
+		}
+		c.rateLimiter.Wait()
+		body, err := c.Post("core/get", params)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Objects map[string]struct {
+				Fields struct {
+					ID          string `json:"id"`
+					Name        string `json:"name"`
+					Status      string `json:"status"`
+					TicketID    string `json:"ticket_id"`
+					TicketRef   string `json:"ticket_ref"`
+					TeamID      string `json:"team_id"`
+					Team        string `json:"team_id_friendlyname"`
+					AgentID     string `json:"agent_id"`
+					Agent       string `json:"agent_id_friendlyname"`
+					StartDate   string `json:"start_date"`
+					EndDate     string `json:"end_date"`
+					Description string `json:"description"`
+				} `json:"fields"`
+			} `json:"objects"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		if result.Code != 0 {
+			return nil, iTopError("WorkOrder", result.Code, result.Message)
+		}
+		fresh := 0
+		for _, obj := range result.Objects {
+			f := obj.Fields
+			if seen[f.ID] {
+				continue
+			}
+			seen[f.ID] = true
+			fresh++
+			w := WorkOrder{ID: f.ID, Name: f.Name, Status: f.Status, TicketID: f.TicketID, TicketRef: f.TicketRef,
+				TeamID: f.TeamID, Team: f.Team, AgentID: f.AgentID, Agent: f.Agent, Description: f.Description}
+			w.StartDate, _ = parseDateFlexible(f.StartDate, c.Location)
+			w.EndDate, _ = parseDateFlexible(f.EndDate, c.Location)
+			orders = append(orders, w)
+		}
+		if c.conf.PageSize <= 0 || len(result.Objects) != c.conf.PageSize || fresh < len(result.Objects) {
+			return orders, nil
+		}
+	}
+}
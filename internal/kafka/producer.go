@@ -0,0 +1,368 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"itop-sla-exporter/internal/config"
+	"itop-sla-exporter/internal/metrics"
+	"itop-sla-exporter/internal/retry"
+)
+
+// maxBatch bounds the messages sent in one produce request
+const maxBatch = 500
+
+// Producer publishes messages to one topic. It speaks just enough of the
+// Kafka protocol for the synchronizer (metadata and produce v3, i.e. brokers
+// 0.11+, optional TLS and SASL/PLAIN); records are sent uncompressed.
+type Producer struct {
+	conf  config.KafkaConfig
+	tls   *tls.Config // nil without output.kafka.tls
+	retry retry.Policy
+
+	mu      sync.Mutex
+	brokers map[int32]string // node id → host:port
+	leaders []int32          // partition → leader node id, nil when stale
+	conns   map[string]*conn // by address
+}
+
+// NewProducer creates a producer; brokers are contacted on the first Produce
+func NewProducer(conf config.KafkaConfig, retryConf config.RetryConfig) (*Producer, error) {
+	p := &Producer{conf: conf, retry: retry.New(retryConf), conns: map[string]*conn{}}
+	if conf.TLS {
+		p.tls = &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+		if conf.CAFile != "" {
+			pem, err := os.ReadFile(conf.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("kafka CA file: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("kafka CA file %s: no PEM certificate found", conf.CAFile)
+			}
+			p.tls.RootCAs = pool
+		}
+	}
+	return p, nil
+}
+
+// Produce publishes messages, partitioned by key. Partitions whose leader
+// moved or was unreachable are retried with fresh metadata.
+func (p *Producer) Produce(msgs []Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(msgs) > 0 {
+		n := min(len(msgs), maxBatch)
+		pending := msgs[:n]
+		err := p.retry.Do("kafka_produce", func() error {
+			var err error
+			pending, err = p.produce(pending)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// produce sends msgs to the partition leaders and returns those to send again
+func (p *Producer) produce(msgs []Message) ([]Message, error) {
+	if p.leaders == nil {
+		if err := p.refreshMetadata(); err != nil {
+			return msgs, err
+		}
+	}
+	byLeader := map[int32]map[int32][]Message{}
+	for _, m := range msgs {
+		partition := int32(partitionFor(m.Key, len(p.leaders)))
+		leader := p.leaders[partition]
+		if byLeader[leader] == nil {
+			byLeader[leader] = map[int32][]Message{}
+		}
+		byLeader[leader][partition] = append(byLeader[leader][partition], m)
+	}
+	var failed []Message
+	var lastErr error
+	for leader, partitions := range byLeader {
+		err := p.produceTo(leader, partitions)
+		var perPartition partitionErrors
+		switch {
+		case err == nil:
+			continue
+		case errors.As(err, &perPartition):
+			for partition, perr := range perPartition {
+				failed = append(failed, partitions[partition]...)
+				lastErr = perr
+			}
+		default:
+			for _, ms := range partitions {
+				failed = append(failed, ms...)
+			}
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		return nil, nil
+	}
+	var kerr kafkaError
+	if errors.As(lastErr, &kerr) && !kerr.retriable() {
+		return failed, retry.Permanent(lastErr)
+	}
+	p.leaders = nil // leadership may have moved
+	return failed, lastErr
+}
+
+// partitionErrors are the partitions a broker refused, by partition
+type partitionErrors map[int32]error
+
+func (e partitionErrors) Error() string {
+	for partition, err := range e {
+		return fmt.Sprintf("partition %d: %v (%d partitions failed)", partition, err, len(e))
+	}
+	return "no partition failed"
+}
+
+// produceTo sends one produce request (v3) to a leader
+func (p *Producer) produceTo(leader int32, partitions map[int32][]Message) error {
+	addr, ok := p.brokers[leader]
+	if !ok {
+		return fmt.Errorf("kafka: no broker %d in metadata", leader)
+	}
+	var e encoder
+	e.nullableString(nil) // transactional id
+	e.int16(int16(p.conf.Acks))
+	e.int32(int32(p.conf.Timeout.Milliseconds()))
+	e.int32(1)
+	e.string(p.conf.Topic)
+	e.int32(int32(len(partitions)))
+	for partition, msgs := range partitions {
+		e.int32(partition)
+		e.bytes(recordBatch(msgs))
+	}
+	resp, err := p.request(addr, apiProduce, 3, e.buf)
+	if err != nil {
+		return err
+	}
+	d := decoder{buf: resp}
+	failed := partitionErrors{}
+	for i, topics := 0, d.arrayLen(); i < topics; i++ {
+		d.string()
+		for j, n := 0, d.arrayLen(); j < n; j++ {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if code != 0 {
+				failed[partition] = kafkaError(code)
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// refreshMetadata reads the brokers and partition leaders of the topic from
+// the first bootstrap broker that answers (metadata v1)
+func (p *Producer) refreshMetadata() error {
+	var e encoder
+	e.int32(1)
+	e.string(p.conf.Topic)
+	var lastErr error
+	for _, addr := range p.conf.Brokers {
+		resp, err := p.request(addr, apiMetadata, 1, e.buf)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		d := decoder{buf: resp}
+		brokers := map[int32]string{}
+		for i, n := 0, d.arrayLen(); i < n; i++ {
+			id := d.int32()
+			host := d.string()
+			port := d.int32()
+			d.string() // rack
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		d.int32() // controller id
+		var leaders []int32
+		var topicErr error
+		for i, n := 0, d.arrayLen(); i < n; i++ {
+			code := d.int16()
+			name := d.string()
+			d.int8() // is internal
+			parts := d.arrayLen()
+			partLeaders := make([]int32, parts)
+			for j := 0; j < parts; j++ {
+				d.int16() // partition error, e.g. a replica down
+				partition := d.int32()
+				leader := d.int32()
+				for k, r := 0, d.arrayLen(); k < r; k++ {
+					d.int32() // replicas
+				}
+				for k, r := 0, d.arrayLen(); k < r; k++ {
+					d.int32() // in-sync replicas
+				}
+				if partition >= 0 && int(partition) < parts {
+					partLeaders[partition] = leader
+				}
+				if leader < 0 {
+					topicErr = kafkaError(5) // LEADER_NOT_AVAILABLE
+				}
+			}
+			if name != p.conf.Topic {
+				continue
+			}
+			if code != 0 {
+				topicErr = kafkaError(code)
+			}
+			leaders = partLeaders
+		}
+		if d.err != nil {
+			return d.err
+		}
+		if topicErr != nil {
+			return topicErr
+		}
+		if len(leaders) == 0 {
+			return fmt.Errorf("kafka: topic %s has no partitions", p.conf.Topic)
+		}
+		p.brokers, p.leaders = brokers, leaders
+		return nil
+	}
+	return lastErr
+}
+
+// request sends one request to a broker, dialing it if needed; a broken
+// connection is dropped so the next attempt dials again
+func (p *Producer) request(addr string, apiKey, version int16, body []byte) ([]byte, error) {
+	c, ok := p.conns[addr]
+	if !ok {
+		var err error
+		if c, err = p.dial(addr); err != nil {
+			metrics.Errors.Inc("kafka")
+			return nil, err
+		}
+		p.conns[addr] = c
+	}
+	start := time.Now()
+	resp, err := c.roundTrip(apiKey, version, p.conf.ClientID, body, p.conf.Timeout)
+	metrics.APILatency.Observe(time.Since(start).Seconds(), "kafka")
+	if err != nil {
+		metrics.Errors.Inc("kafka")
+		c.Close()
+		delete(p.conns, addr)
+	}
+	return resp, err
+}
+
+func (p *Producer) dial(addr string) (*conn, error) {
+	dialer := &net.Dialer{Timeout: p.conf.Timeout}
+	var nc net.Conn
+	var err error
+	if p.tls != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", addr, p.tls)
+	} else {
+		nc, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	c := &conn{Conn: nc}
+	if p.conf.SASLUser != "" {
+		if err := c.saslPlain(p.conf, p.conf.Timeout); err != nil {
+			c.Close()
+			return nil, retry.Permanent(err)
+		}
+	}
+	return c, nil
+}
+
+// Close closes the broker connections
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, c := range p.conns {
+		c.Close()
+		delete(p.conns, addr)
+	}
+	return nil
+}
+
+// conn is a connection to one broker
+type conn struct {
+	net.Conn
+	correlation int32
+}
+
+// roundTrip sends a request (header v1) and returns the response body
+func (c *conn) roundTrip(apiKey, version int16, clientID string, body []byte, timeout time.Duration) ([]byte, error) {
+	c.correlation++
+	var e encoder
+	e.int32(0) // size, set below
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(c.correlation)
+	e.string(clientID)
+	e.buf = append(e.buf, body...)
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(e.buf); err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	if len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != c.correlation {
+		return nil, errors.New("kafka: response out of sequence")
+	}
+	return resp[4:], nil
+}
+
+// saslPlain authenticates with SASL/PLAIN (handshake v1, authenticate v0)
+func (c *conn) saslPlain(conf config.KafkaConfig, timeout time.Duration) error {
+	var e encoder
+	e.string("PLAIN")
+	resp, err := c.roundTrip(apiSaslHandshake, 1, conf.ClientID, e.buf, timeout)
+	if err != nil {
+		return err
+	}
+	d := decoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("SASL handshake: %w", kafkaError(code))
+	}
+	e = encoder{}
+	e.bytes([]byte("\x00" + conf.SASLUser + "\x00" + conf.SASLPassword))
+	if resp, err = c.roundTrip(apiSaslAuthenticate, 0, conf.ClientID, e.buf, timeout); err != nil {
+		return err
+	}
+	d = decoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("SASL authentication: %w: %s", kafkaError(code), d.string())
+	}
+	return d.err
+}
@@ -0,0 +1,259 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Kafka API keys and the versions spoken (brokers 0.11+)
+const (
+	apiProduce          = 0
+	apiMetadata         = 3
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encoder builds a request body in the Kafka wire format (big endian)
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8)   { e.buf = append(e.buf, byte(v)) }
+func (e *encoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+func (e *encoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+func (e *encoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v) // zig-zag, as Kafka records use
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) nullableString(s *string) {
+	if s == nil {
+		e.int16(-1)
+		return
+	}
+	e.string(*s)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// varbytes writes a record key or value: varint length, -1 for null
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder reads a response body; the first error sticks and later reads
+// return zero values
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShortResponse = errors.New("kafka: truncated response")
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errShortResponse
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// arrayLen reads an array length, treating null as empty
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || int(n) > len(d.buf) {
+		if n > 0 {
+			d.err = errShortResponse
+		}
+		return 0
+	}
+	return int(n)
+}
+
+// Message is a record to publish; a nil Value is a tombstone
+type Message struct {
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+	Time    time.Time
+}
+
+// recordBatch encodes messages as a v2 record batch (no compression, no
+// idempotence)
+func recordBatch(msgs []Message) []byte {
+	first := msgs[0].Time
+	maxTime := first
+	var records encoder
+	for i, m := range msgs {
+		if m.Time.After(maxTime) {
+			maxTime = m.Time
+		}
+		var r encoder
+		r.int8(0) // attributes
+		r.varint(m.Time.Sub(first).Milliseconds())
+		r.varint(int64(i))
+		r.varbytes(m.Key)
+		r.varbytes(m.Value)
+		r.varint(int64(len(m.Headers)))
+		for k, v := range m.Headers {
+			r.varbytes([]byte(k))
+			r.varbytes([]byte(v))
+		}
+		records.varint(int64(len(r.buf)))
+		records.buf = append(records.buf, r.buf...)
+	}
+
+	// The CRC covers everything from the attributes on
+	var body encoder
+	body.int16(0) // attributes: no compression
+	body.int32(int32(len(msgs) - 1))
+	body.int64(first.UnixMilli())
+	body.int64(maxTime.UnixMilli())
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(msgs)))
+	body.buf = append(body.buf, records.buf...)
+
+	var batch encoder
+	batch.int64(0)                                // base offset
+	batch.int32(int32(4 + 1 + 4 + len(body.buf))) // length after this field
+	batch.int32(-1)                               // partition leader epoch
+	batch.int8(2)                                 // magic
+	batch.int32(int32(crc32.Checksum(body.buf, castagnoli)))
+	batch.buf = append(batch.buf, body.buf...)
+	return batch.buf
+}
+
+// kafkaError is a non-zero error code returned by a broker
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	if name, ok := errorNames[int16(e)]; ok {
+		return fmt.Sprintf("kafka: %s (%d)", name, int16(e))
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// retriable reports whether new metadata may fix the error (leadership moved)
+func (e kafkaError) retriable() bool {
+	switch e {
+	case 3, 5, 6, 7, 8, 9, 19, 20:
+		return true
+	}
+	return false
+}
+
+var errorNames = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_FOR_PARTITION",
+	7:  "REQUEST_TIMED_OUT",
+	8:  "BROKER_NOT_AVAILABLE",
+	9:  "REPLICA_NOT_AVAILABLE",
+	10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	35: "UNSUPPORTED_VERSION",
+	58: "SASL_AUTHENTICATION_FAILED",
+}
+
+// partitionFor picks the partition of a key like the Java client's default
+// partitioner (murmur2), so keyed consumers see the usual layout
+func partitionFor(key []byte, partitions int) int {
+	return int(murmur2(key)&0x7fffffff) % partitions
+}
+
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	const r = 24
+	length := len(data)
+	h := uint32(0x9747b28c) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is anything that can render itself in the Prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds registered metrics
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry served by Handler
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the default registry at /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Default.WriteText(w)
+	})
+}
+
+// vec keeps one value per label combination
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+}
+
+func (v *vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, splitKey(k, len(v.labels)), "", ""), formatFloat(v.values[k]))
+	}
+}
+
+// CounterVec is a monotonically increasing counter partitioned by labels
+type CounterVec struct{ *vec }
+
+// NewCounterVec creates and registers a counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	Default.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values by 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by delta
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	k := c.key(labelValues)
+	c.mu.Lock()
+	c.values[k] += delta
+	c.mu.Unlock()
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels
+type GaugeVec struct{ *vec }
+
+// NewGaugeVec creates and registers a gauge
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels)}
+	Default.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] = value
+	g.mu.Unlock()
+}
+
+// Reset removes all label combinations
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	g.values = make(map[string]float64)
+	g.mu.Unlock()
+}
+
+// DefaultBuckets are histogram buckets in seconds suited to API calls and sync cycles
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec tracks the distribution of observations, partitioned by labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+// NewHistogramVec creates and registers a histogram; nil buckets means DefaultBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	Default.register(h)
+	return h
+}
+
+// Observe records a value for the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+	k := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, b := range h.buckets {
+		if value <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		values := splitKey(k, len(h.labels))
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values, "", ""), s.count)
+	}
+}
+
+func splitKey(k string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(k, "\xff")
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+"=\""+escapeLabel(values[i])+"\"")
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+"=\""+extraValue+"\"")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+	return strings.ReplaceAll(s, "\n", "\\n")
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
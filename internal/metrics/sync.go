@@ -0,0 +1,23 @@
+package metrics
+
+// Sync health metrics shared by the itop, es and sync layers
+var (
+	TicketsFetched = NewCounterVec("itop_sync_tickets_fetched_total", "Tickets fetched from iTop per class.", "class")
+	Upserts        = NewCounterVec("itop_sync_upserts_total", "Documents queued for upsert in Elasticsearch.")
+	Deletes        = NewCounterVec("itop_sync_deletes_total", "Documents queued for deletion in Elasticsearch.")
+	Skips          = NewCounterVec("itop_sync_skips_total", "Tickets skipped because the ES document is unchanged.")
+	DeletesBlocked = NewCounterVec("itop_sync_deletes_blocked_total", "Delete phases aborted by the max delete ratio guard.")
+	Errors         = NewCounterVec("itop_sync_errors_total", "Errors talking to iTop or Elasticsearch.", "target")
+	Retries        = NewCounterVec("itop_sync_retries_total", "Retries of transient iTop and Elasticsearch failures by operation.", "op")
+	Webhooks       = NewCounterVec("itop_sync_webhooks_total", "Webhook requests received from iTop by result.", "result")
+	DeadLetters    = NewCounterVec("itop_sync_dead_letters_total", "Bulk operations rejected by Elasticsearch, by target and error type.", "target", "type")
+	StaleWrites    = NewCounterVec("itop_sync_stale_writes_total", "Upserts refused by Elasticsearch because it holds a newer version of the ticket.", "target")
+	ESCircuitOpen  = NewGaugeVec("itop_sync_es_circuit_open", "1 while the Elasticsearch circuit breaker pauses writes, by target.", "target")
+	Notifications  = NewCounterVec("itop_sync_notifications_total", "Notifications by event and result (sent/error/dropped).", "event", "result")
+	Leader         = NewGaugeVec("itop_sync_leader", "1 while this replica holds the leader lease (leader.enabled).")
+	CacheLookups   = NewCounterVec("itop_sync_cache_lookups_total", "Cache lookups by cache and result (hit/miss).", "cache", "result")
+	CyclesSkipped  = NewCounterVec("itop_sync_cycles_skipped_total", "Scheduled sync cycles skipped because the previous cycle overran the interval.")
+	Throttle       = NewGaugeVec("itop_sync_throttle_factor", "Slowdown applied while iTop struggles (sync.throttle), 1 at full speed.")
+	CycleDuration  = NewHistogramVec("itop_sync_cycle_duration_seconds", "Wall time of a sync cycle.", nil, "mode")
+	APILatency     = NewHistogramVec("itop_sync_api_request_duration_seconds", "Latency of iTop and Elasticsearch API requests.", nil, "target")
+)
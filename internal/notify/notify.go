@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"itop-sla-exporter/internal/config"
+	"itop-sla-exporter/internal/metrics"
+	"itop-sla-exporter/internal/retry"
+)
+
+// queueSize bounds the notifications waiting to be sent; more are dropped
+const queueSize = 1000
+
+// Message is a notification. Webhook channels receive it as JSON; the other
+// channels receive Subject, Text and Fields as text.
+type Message struct {
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"` // one of config.NotifyEvents
+	Subject string            `json:"subject"`
+	Text    string            `json:"text"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Notifier sends messages to the configured channels from a background
+// goroutine, so a slow channel never holds up a sync cycle
+type Notifier struct {
+	channels []config.NotifyChannel
+	dryRun   bool
+	retry    retry.Policy
+	http     *http.Client
+	queue    chan Message
+	done     chan struct{} // closed once the queue is drained after Close
+}
+
+// New creates a notifier and starts its sender; nil (a valid notifier that
+// drops everything) without channels. Dry runs log messages instead.
+func New(conf config.NotifyConfig, retryConf config.RetryConfig, dryRun bool) *Notifier {
+	if len(conf.Channels) == 0 {
+		return nil
+	}
+	n := &Notifier{channels: conf.Channels, dryRun: dryRun, retry: retry.New(retryConf),
+		http: &http.Client{Timeout: 30 * time.Second}, queue: make(chan Message, queueSize), done: make(chan struct{})}
+	go n.run()
+	return n
+}
+
+// Send queues a message for the channels accepting its event
+func (n *Notifier) Send(m Message) {
+	if n == nil {
+		return
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now().UTC()
+	}
+	select {
+	case n.queue <- m:
+	default:
+		slog.Warn("Notification queue full, dropping notification", "event", m.Event, "subject", m.Subject)
+		metrics.Notifications.Inc(m.Event, "dropped")
+	}
+}
+
+// Close sends the queued messages and stops the sender
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	close(n.queue)
+	<-n.done
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for m := range n.queue {
+		for _, ch := range n.channels {
+			if !accepts(ch, m.Event) {
+				continue
+			}
+			if n.dryRun {
+				slog.Info("[dry-run] would notify", "channel", ch.Name, "type", ch.Type, "event", m.Event, "subject", m.Subject)
+				continue
+			}
+			err := n.retry.Do("notify_"+ch.Type, func() error { return n.deliver(ch, m) })
+			if err != nil {
+				slog.Error("Failed to send notification", "channel", ch.Name, "type", ch.Type, "event", m.Event, "err", err)
+				metrics.Notifications.Inc(m.Event, "error")
+				continue
+			}
+			metrics.Notifications.Inc(m.Event, "sent")
+		}
+	}
+}
+
+// accepts reports whether a channel takes an event
+func accepts(ch config.NotifyChannel, event string) bool {
+	if len(ch.Events) == 0 {
+		return true
+	}
+	for _, ev := range ch.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) deliver(ch config.NotifyChannel, m Message) error {
+	switch ch.Type {
+	case "webhook":
+		return n.post(ch, m)
+	case "slack", "teams":
+		// Both incoming webhooks accept a plain text payload
+		return n.post(ch, map[string]string{"text": "*" + m.Subject + "*\n" + m.body("\n")})
+	case "email":
+		return sendMail(ch, m)
+	}
+	return retry.Permanent(fmt.Errorf("unknown channel type %q", ch.Type))
+}
+
+// post sends a JSON payload to the channel URL
+func (n *Notifier) post(ch config.NotifyChannel, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, ch.URL, bytes.NewReader(body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range ch.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return retry.Status(resp, fmt.Errorf("HTTP %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// sendMail sends a plain text email through the channel's SMTP server
+func sendMail(ch config.NotifyChannel, m Message) error {
+	var auth smtp.Auth
+	if ch.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(ch.SMTPAddr)
+		auth = smtp.PlainAuth("", ch.SMTPUser, ch.SMTPPassword, host)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", ch.From, strings.Join(ch.To, ", "), m.Subject)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(m.body("\r\n"))
+	return smtp.SendMail(ch.SMTPAddr, auth, ch.From, ch.To, []byte(b.String()))
+}
+
+// body is the text of a message followed by its non-empty fields, one per
+// line
+func (m Message) body(nl string) string {
+	lines := []string{m.Text}
+	keys := make([]string, 0, len(m.Fields))
+	for k, v := range m.Fields {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, k+": "+m.Fields[k])
+	}
+	return strings.Join(lines, nl)
+}
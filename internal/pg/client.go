@@ -0,0 +1,190 @@
+package pg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"itop-sla-exporter/internal/config"
+	"itop-sla-exporter/internal/metrics"
+	"itop-sla-exporter/internal/retry"
+)
+
+// Client runs statements on PostgreSQL over one connection, reconnecting
+// after failures. Transient failures (lost connection, deadlock, server
+// shutting down) are retried.
+type Client struct {
+	Config config.PostgresConfig
+	Retry  retry.Policy
+
+	mu   sync.Mutex
+	conn *conn // nil until connected, or after a connection failure
+}
+
+// NewClient creates a client; the server is contacted on the first query
+func NewClient(conf config.PostgresConfig, retryConf config.RetryConfig) *Client {
+	return &Client{Config: conf, Retry: retry.New(retryConf)}
+}
+
+// Query runs SQL and returns the rows of its last result as text
+func (c *Client) Query(sql string) ([][]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var rows [][]string
+	err := c.Retry.Do("postgres_query", func() error {
+		if c.conn == nil {
+			conn, err := dial(c.Config)
+			if err != nil {
+				metrics.Errors.Inc("postgres")
+				return err
+			}
+			c.conn = conn
+		}
+		start := time.Now()
+		var err error
+		rows, err = c.conn.query(sql, c.Config.Timeout)
+		metrics.APILatency.Observe(time.Since(start).Seconds(), "postgres")
+		if err == nil {
+			return nil
+		}
+		metrics.Errors.Inc("postgres")
+		var pgErr *Error
+		if !errors.As(err, &pgErr) {
+			// The session is in an unknown state: start a new one
+			c.conn.nc.Close()
+			c.conn = nil
+			return err
+		}
+		if transient(pgErr.Code) {
+			return err
+		}
+		return retry.Permanent(err)
+	})
+	return rows, err
+}
+
+// transient reports whether a SQLSTATE is worth retrying: connection
+// exceptions, serialization failures and deadlocks, insufficient resources
+// and operator intervention (e.g. server shutting down)
+func transient(code string) bool {
+	for _, class := range []string{"08", "40", "53", "57"} {
+		if strings.HasPrefix(code, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close ends the session
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.close()
+	c.conn = nil
+	return err
+}
+
+// Column is a table column derived from a struct field
+type Column struct {
+	Name string
+	Type string
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Columns derives table columns from a struct's json tags: time.Time →
+// timestamptz, string → text, numbers → bigint/double precision, bool →
+// boolean, anything else → jsonb
+func Columns(t reflect.Type) []Column {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var cols []Column
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		typ := "jsonb"
+		switch {
+		case ft == timeType:
+			typ = "timestamptz"
+		case ft.Kind() == reflect.String:
+			typ = "text"
+		case ft.Kind() == reflect.Bool:
+			typ = "boolean"
+		case ft.Kind() >= reflect.Int && ft.Kind() <= reflect.Uint64:
+			typ = "bigint"
+		case ft.Kind() == reflect.Float32 || ft.Kind() == reflect.Float64:
+			typ = "double precision"
+		}
+		cols = append(cols, Column{Name: name, Type: typ})
+	}
+	return cols
+}
+
+// Migrate creates the table keyed by doc_id if needed and adds the columns
+// it lacks; existing columns are left as they are
+func (c *Client) Migrate(table string, cols []Column) error {
+	stmts := []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (doc_id text PRIMARY KEY)", Ident(table))}
+	for _, col := range cols {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", Ident(table), Ident(col.Name), col.Type))
+	}
+	_, err := c.Query(strings.Join(stmts, ";\n"))
+	return err
+}
+
+// Ident quotes an identifier, keeping a schema prefix apart
+func Ident(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// Quote renders a JSON-decoded value as a SQL literal. Strings are left
+// untyped so they convert to the column type (text, timestamptz, ...);
+// objects and arrays become jsonb.
+func Quote(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "'" + strconv.FormatFloat(v, 'g', -1, 64) + "'"
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return quoteString(v)
+	default:
+		data, _ := json.Marshal(v)
+		return quoteString(string(data)) + "::jsonb"
+	}
+}
+
+// quoteString relies on standard_conforming_strings (backslashes are
+// literal); NUL bytes cannot be stored in text and are dropped
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, "\x00", "")
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,277 @@
+package pg
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"itop-sla-exporter/internal/config"
+)
+
+// Error is an ErrorResponse from the server
+type Error struct {
+	Severity string
+	Code     string // SQLSTATE
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("postgres: %s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+}
+
+// conn is one session speaking the simple query protocol (v3). Statements
+// are sent as text: values are inlined with Quote, which relies on
+// standard_conforming_strings, checked at startup.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// dial connects and authenticates (trust, cleartext, MD5 or SCRAM-SHA-256)
+func dial(conf config.PostgresConfig) (*conn, error) {
+	addr := net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+	nc, err := net.DialTimeout("tcp", addr, conf.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: %w", err)
+	}
+	nc.SetDeadline(time.Now().Add(conf.Timeout))
+	if conf.SSLMode != "disable" {
+		if nc, err = startTLS(nc, conf); err != nil {
+			return nil, err
+		}
+	}
+	c := &conn{nc: nc, r: bufio.NewReader(nc)}
+	if err := c.startup(conf); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startTLS asks the server for TLS (SSLRequest); with sslmode prefer a
+// server without TLS is used in clear
+func startTLS(nc net.Conn, conf config.PostgresConfig) (net.Conn, error) {
+	var req [8]byte
+	binary.BigEndian.PutUint32(req[0:], 8)
+	binary.BigEndian.PutUint32(req[4:], 80877103)
+	if _, err := nc.Write(req[:]); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("postgres: %w", err)
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(nc, answer[:]); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("postgres: %w", err)
+	}
+	if answer[0] != 'S' {
+		if conf.SSLMode == "prefer" {
+			return nc, nil
+		}
+		nc.Close()
+		return nil, errors.New("postgres: server does not support TLS")
+	}
+	tc := tls.Client(nc, &tls.Config{ServerName: conf.Host, InsecureSkipVerify: conf.SSLMode != "verify-full"})
+	if err := tc.Handshake(); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("postgres: TLS: %w", err)
+	}
+	return tc, nil
+}
+
+func (c *conn) startup(conf config.PostgresConfig) error {
+	var msg []byte
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint32(msg, 196608) // protocol 3.0
+	for _, kv := range [][2]string{{"user", conf.User}, {"database", conf.Database}, {"application_name", "itop-sync"}} {
+		msg = append(append(append(append(msg, kv[0]...), 0), kv[1]...), 0)
+	}
+	msg = append(msg, 0)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+	if _, err := c.nc.Write(msg); err != nil {
+		return fmt.Errorf("postgres: %w", err)
+	}
+	var scram *scramClient
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(body) < 4 {
+				return errors.New("postgres: malformed authentication request")
+			}
+			code, data := binary.BigEndian.Uint32(body), body[4:]
+			switch code {
+			case 0: // authenticated
+			case 3:
+				err = c.send('p', append([]byte(conf.Password), 0))
+			case 5:
+				if len(data) < 4 {
+					return errors.New("postgres: malformed MD5 request")
+				}
+				err = c.send('p', append([]byte(md5Password(conf.User, conf.Password, data[:4])), 0))
+			case 10:
+				if !strings.Contains(string(data), "SCRAM-SHA-256\x00") {
+					return fmt.Errorf("postgres: unsupported SASL mechanisms %q", data)
+				}
+				scram = newScramClient(conf.Password)
+				first := scram.clientFirst()
+				out := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+				err = c.send('p', append(out, first...))
+			case 11:
+				if scram == nil {
+					return errors.New("postgres: unexpected SASL continue")
+				}
+				var final []byte
+				if final, err = scram.clientFinal(data); err == nil {
+					err = c.send('p', final)
+				}
+			case 12:
+				if scram == nil {
+					return errors.New("postgres: unexpected SASL final")
+				}
+				err = scram.verifyServer(data)
+			default:
+				return fmt.Errorf("postgres: unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'S':
+			if name, value := parameterStatus(body); name == "standard_conforming_strings" && value != "on" {
+				return errors.New("postgres: standard_conforming_strings must be on")
+			}
+		case 'E':
+			return parseError(body)
+		case 'Z':
+			return nil
+		}
+	}
+}
+
+// query runs SQL (possibly several statements) and returns the text values
+// of the rows of the last result; NULL reads as ""
+func (c *conn) query(sql string, timeout time.Duration) ([][]string, error) {
+	c.nc.SetDeadline(time.Now().Add(timeout))
+	if err := c.send('Q', append([]byte(sql), 0)); err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	var qerr error
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'T':
+			rows = nil
+		case 'D':
+			row, err := dataRow(body)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		case 'E':
+			qerr = parseError(body)
+		case 'Z':
+			return rows, qerr
+		}
+	}
+}
+
+func (c *conn) close() error {
+	c.send('X', nil)
+	return c.nc.Close()
+}
+
+func (c *conn) send(typ byte, body []byte) error {
+	msg := append([]byte{typ}, binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	if _, err := c.nc.Write(append(msg, body...)); err != nil {
+		return fmt.Errorf("postgres: %w", err)
+	}
+	return nil
+}
+
+func (c *conn) receive() (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, fmt.Errorf("postgres: %w", err)
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n < 4 {
+		return 0, nil, errors.New("postgres: malformed message")
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, fmt.Errorf("postgres: %w", err)
+	}
+	return head[0], body, nil
+}
+
+func dataRow(body []byte) ([]string, error) {
+	if len(body) < 2 {
+		return nil, errors.New("postgres: malformed data row")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	row := make([]string, n)
+	for i := range row {
+		if len(body) < 4 {
+			return nil, errors.New("postgres: malformed data row")
+		}
+		size := int32(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if size < 0 {
+			continue
+		}
+		if int(size) > len(body) {
+			return nil, errors.New("postgres: malformed data row")
+		}
+		row[i], body = string(body[:size]), body[size:]
+	}
+	return row, nil
+}
+
+func parseError(body []byte) error {
+	e := &Error{}
+	for _, field := range strings.Split(string(body), "\x00") {
+		if field == "" {
+			continue
+		}
+		switch field[0] {
+		case 'S':
+			e.Severity = field[1:]
+		case 'C':
+			e.Code = field[1:]
+		case 'M':
+			e.Message = field[1:]
+		}
+	}
+	return e
+}
+
+func parameterStatus(body []byte) (name, value string) {
+	parts := strings.SplitN(string(body), "\x00", 3)
+	if len(parts) < 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// md5Password is "md5" + md5(md5(password + user) + salt)
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
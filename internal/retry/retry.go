@@ -0,0 +1,122 @@
+package retry
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"itop-sla-exporter/internal/config"
+	"itop-sla-exporter/internal/metrics"
+)
+
+// Policy retries transient failures with exponential backoff and full jitter
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// New creates a policy from config
+func New(conf config.RetryConfig) Policy {
+	return Policy{MaxAttempts: conf.MaxAttempts, BaseDelay: conf.BaseDelay, MaxDelay: conf.MaxDelay}
+}
+
+// Do calls fn until it succeeds, returns a Permanent error or MaxAttempts is
+// reached; op names the call in logs and metrics
+func (p Policy) Do(op string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if attempt >= p.MaxAttempts {
+			return err
+		}
+		delay := p.backoff(attempt)
+		var after *afterError
+		if errors.As(err, &after) && after.delay > delay {
+			if after.delay > p.MaxDelay {
+				// The server asks for a longer pause than we are willing to wait
+				return err
+			}
+			delay = after.delay
+		}
+		slog.Warn("Retrying after transient error", "op", op, "attempt", attempt, "delay_ms", delay.Milliseconds(), "err", err)
+		metrics.Retries.Inc(op)
+		time.Sleep(delay)
+	}
+}
+
+// backoff returns a random delay up to BaseDelay*2^(attempt-1), capped at MaxDelay
+func (p Policy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+type afterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *afterError) Error() string { return e.err.Error() }
+func (e *afterError) Unwrap() error { return e.err }
+
+// Status classifies a failed HTTP response: 408, 429 and 5xx except 501 are
+// retried (no sooner than the Retry-After header asks), anything else is
+// permanent. err describes the failure to the caller.
+func Status(resp *http.Response, err error) error {
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+	default:
+		if resp.StatusCode < 500 || resp.StatusCode == http.StatusNotImplemented {
+			return Permanent(err)
+		}
+	}
+	if d := retryAfter(resp.Header.Get("Retry-After")); d > 0 {
+		return &afterError{err: err, delay: d}
+	}
+	return err
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
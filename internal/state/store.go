@@ -0,0 +1,82 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store is a small embedded key/value store persisted as one JSON file.
+// Each section (checkpoints, hashes, caches, ...) is stored as raw JSON and
+// decoded by its owner; Save replaces the file atomically.
+type Store struct {
+	path     string
+	mu       sync.Mutex
+	sections map[string]json.RawMessage
+}
+
+// Open loads the store at path; a missing file yields an empty store
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, sections: map[string]json.RawMessage{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.sections); err != nil {
+		return nil, fmt.Errorf("corrupt state file %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Get decodes a section into v and reports whether it existed
+func (s *Store) Get(section string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	raw, ok := s.sections[section]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Put replaces a section; it is written to disk on the next Save
+func (s *Store) Put(section string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sections[section] = raw
+	s.mu.Unlock()
+	return nil
+}
+
+// Save writes the store to a temporary file and renames it over the old one
+func (s *Store) Save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.sections)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
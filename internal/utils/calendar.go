@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"time"
+)
+
+// BusinessCalendar tells working time apart from closed time
+type BusinessCalendar interface {
+	// IsWorkingTime reports whether t falls within an open interval
+	IsWorkingTime(t time.Time) bool
+	// DurationBetween returns the working time between start and end
+	DurationBetween(start, end time.Time) time.Duration
+	// IsWorkingDay reports whether the day of t has any open interval
+	IsWorkingDay(t time.Time) bool
+}
+
+// AddBusinessDays returns the same time of day n working days after start
+func AddBusinessDays(c BusinessCalendar, start time.Time, n int) time.Time {
+	t := start
+	for i := 0; i < n; {
+		t = t.AddDate(0, 0, 1)
+		if c.IsWorkingDay(t) {
+			i++
+		}
+		if t.Sub(start) > 366*24*time.Hour {
+			break // no working day at all
+		}
+	}
+	return t
+}
+
+// HolidayProvider supplies the current holidays
+type HolidayProvider interface {
+	Holidays() Holidays
+}
+
+// Calendar is a BusinessCalendar open along a weekly schedule, except for
+// holiday closures. Times are read in their own location.
+type Calendar struct {
+	Schedule WeeklySchedule
+	Holidays Holidays
+}
+
+// NewCalendar returns the calendar of a weekly schedule and holidays
+func NewCalendar(schedule WeeklySchedule, holidays Holidays) Calendar {
+	return Calendar{Schedule: schedule, Holidays: holidays}
+}
+
+// Calendar24 is open all day (00:00–23:59) Monday to Friday, except on
+// holidays: the calendar of the *_24bh durations
+func Calendar24(holidays Holidays) Calendar {
+	schedule, _ := NewWorkweekSchedule("00:00", "23:59")
+	return NewCalendar(schedule, holidays)
+}
+
+// IsWorkingTime reports whether t falls within an open interval
+func (c Calendar) IsWorkingTime(t time.Time) bool {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(day)
+	for _, iv := range c.Holidays.open(day, c.Schedule[day.Weekday()]) {
+		if offset >= iv.Start && offset < iv.End {
+			return true
+		}
+	}
+	return false
+}
+
+// IsWorkingDay reports whether the day of t has any open interval
+func (c Calendar) IsWorkingDay(t time.Time) bool {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return len(c.Holidays.open(day, c.Schedule[day.Weekday()])) > 0
+}
+
+// DurationBetween returns the open time between start and end
+func (c Calendar) DurationBetween(start, end time.Time) time.Duration {
+	return c.Schedule.Duration(start, end, c.Holidays)
+}
+
+// InLocation returns c reading every time in loc: the business hours of a
+// team working in another timezone
+func InLocation(c BusinessCalendar, loc *time.Location) BusinessCalendar {
+	return locatedCalendar{c, loc}
+}
+
+type locatedCalendar struct {
+	BusinessCalendar
+	loc *time.Location
+}
+
+func (c locatedCalendar) IsWorkingTime(t time.Time) bool {
+	return c.BusinessCalendar.IsWorkingTime(t.In(c.loc))
+}
+
+func (c locatedCalendar) IsWorkingDay(t time.Time) bool {
+	return c.BusinessCalendar.IsWorkingDay(t.In(c.loc))
+}
+
+func (c locatedCalendar) DurationBetween(start, end time.Time) time.Duration {
+	return c.BusinessCalendar.DurationBetween(start.In(c.loc), end.In(c.loc))
+}
+
+// HolidayFile is a HolidayProvider reading a holiday file (see
+// ParseHolidays) on each call; a missing file means no holidays
+type HolidayFile string
+
+// Holidays parses the file, skipping invalid lines
+func (f HolidayFile) Holidays() Holidays {
+	lines, _ := ReadHolidayFile(string(f))
+	holidays, _ := ParseHolidays(lines)
+	return holidays
+}
+
+// ReadHolidayFile reads the lines of a holiday file (one date, range or
+// half day per line)
+func ReadHolidayFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Holidays maps a date ("2006-01-02") to the intervals closed on that day;
+// an empty list means the whole day is closed
+type Holidays map[string][]Interval
+
+// ParseHolidays parses holiday lines in one of these forms:
+//
+//	2025-05-01                          full day
+//	2025-12-24..2025-12-26              date range, inclusive
+//	2025-12-31 12:00-17:00              half day (closed 12:00–17:00)
+//	2025-12-24..2025-12-26 13:00-17:00  partial closure on each day of a range
+//	!2025-05-01                         cancels the holidays of a date or range
+//
+// Cancellations apply after every other line, whatever their order. Blank
+// lines and lines starting with # are ignored. Invalid lines are skipped;
+// the first error is returned along with the remaining holidays.
+func ParseHolidays(lines []string) (Holidays, error) {
+	h := make(Holidays)
+	var firstErr error
+	var cancels []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "!") {
+			cancels = append(cancels, line)
+			continue
+		}
+		if err := h.addLine(line); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, line := range cancels {
+		from, to, err := parseDateRange(strings.TrimPrefix(line, "!"))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("holiday %q: %v", line, err)
+			}
+			continue
+		}
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			delete(h, d.Format("2006-01-02"))
+		}
+	}
+	return h, firstErr
+}
+
+// parseDateRange parses "2006-01-02" or "2006-01-02..2006-01-02"
+func parseDateRange(s string) (from, to time.Time, err error) {
+	dates := strings.SplitN(strings.TrimSpace(s), "..", 2)
+	if from, err = time.Parse("2006-01-02", dates[0]); err != nil {
+		return
+	}
+	to = from
+	if len(dates) == 2 {
+		if to, err = time.Parse("2006-01-02", dates[1]); err != nil {
+			return
+		}
+		if to.Before(from) {
+			err = fmt.Errorf("range end before start")
+		}
+	}
+	return
+}
+
+func (h Holidays) addLine(line string) error {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	fields := strings.Fields(line)
+	from, to, err := parseDateRange(fields[0])
+	if err != nil {
+		return fmt.Errorf("holiday %q: %v", line, err)
+	}
+	var closed []Interval
+	if len(fields) > 1 {
+		if closed, err = ParseIntervals(strings.Join(fields[1:], "")); err != nil {
+			return fmt.Errorf("holiday %q: %v", line, err)
+		}
+	}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		key := d.Format("2006-01-02")
+		existing, seen := h[key]
+		switch {
+		case seen && len(existing) == 0:
+			// already closed all day
+		case len(closed) == 0:
+			h[key] = nil
+		default:
+			h[key] = append(existing, closed...)
+		}
+	}
+	return nil
+}
+
+// FormatHoliday renders a holiday in the ParseHolidays line format; end may
+// be empty for a single day, startTime/endTime empty for a full-day closure
+func FormatHoliday(date, end, startTime, endTime string) string {
+	line := date
+	if end != "" && end != date {
+		line += ".." + end
+	}
+	if startTime != "" && endTime != "" {
+		line += " " + startTime + "-" + endTime
+	}
+	return line
+}
+
+// open returns the open intervals of a day once holiday closures are applied
+func (h Holidays) open(day time.Time, intervals []Interval) []Interval {
+	closed, isHoliday := h[day.Format("2006-01-02")]
+	if !isHoliday {
+		return intervals
+	}
+	if len(closed) == 0 {
+		return nil
+	}
+	var out []Interval
+	for _, iv := range intervals {
+		out = append(out, subtractBreaks(iv, closed)...)
+	}
+	return out
+}
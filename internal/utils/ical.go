@@ -0,0 +1,506 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icalEvent is the part of a VEVENT that makes a holiday
+type icalEvent struct {
+	uid          string
+	start, end   time.Time
+	allDay       bool
+	rrule        string
+	exdates      []time.Time
+	recurrenceID time.Time // set on the override of one occurrence
+	cancelled    bool
+}
+
+// ParseICal reads the events of an iCal (.ics) calendar as holiday lines
+// (see ParseHolidays) for the occurrences between from and to. All-day
+// events close whole days, timed events the hours they cover in loc.
+// Recurring events (RRULE with FREQ, INTERVAL, COUNT, UNTIL, BYDAY,
+// BYMONTHDAY and BYMONTH), EXDATE and overridden occurrences are expanded;
+// cancelled events are skipped. Invalid events are skipped and the first
+// error is returned along with the other lines.
+func ParseICal(r io.Reader, loc *time.Location, from, to time.Time) ([]string, error) {
+	events, firstErr := readICalEvents(r, loc)
+	overridden := map[string][]time.Time{}
+	for _, ev := range events {
+		if !ev.recurrenceID.IsZero() {
+			overridden[ev.uid] = append(overridden[ev.uid], ev.recurrenceID)
+		}
+	}
+	var lines []string
+	for _, ev := range events {
+		if ev.cancelled {
+			continue
+		}
+		starts := []time.Time{ev.start}
+		if ev.rrule != "" && ev.recurrenceID.IsZero() {
+			var err error
+			if starts, err = expandRRule(ev.rrule, ev.start, to); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("event %s: %v", ev.uid, err)
+				}
+				continue
+			}
+		}
+		skip := append(append([]time.Time(nil), ev.exdates...), overridden[ev.uid]...)
+		if !ev.recurrenceID.IsZero() {
+			skip = nil
+		}
+	occurrences:
+		for _, start := range starts {
+			for _, ex := range skip {
+				if ex.Equal(start) {
+					continue occurrences
+				}
+			}
+			end := start.Add(ev.end.Sub(ev.start))
+			if ev.allDay {
+				end = start.AddDate(0, 0, dayCount(ev.start, ev.end))
+			}
+			if !end.After(from) || start.After(to) {
+				continue
+			}
+			lines = append(lines, icalLines(start.In(loc), end.In(loc), ev.allDay)...)
+		}
+	}
+	return lines, firstErr
+}
+
+// readICalEvents unfolds the calendar lines and collects its VEVENTs
+func readICalEvents(r io.Reader, loc *time.Location) ([]icalEvent, error) {
+	var unfolded []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(unfolded) > 0 {
+			unfolded[len(unfolded)-1] += line[1:]
+			continue
+		}
+		unfolded = append(unfolded, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []icalEvent
+	var firstErr error
+	var ev *icalEvent
+	var hasEnd bool
+	var duration string
+	for _, line := range unfolded {
+		name, params, value := splitICalLine(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			ev, hasEnd, duration = &icalEvent{}, false, ""
+			continue
+		case ev == nil:
+			continue
+		case name == "END" && value == "VEVENT":
+			err := ev.finish(hasEnd, duration)
+			if err == nil {
+				events = append(events, *ev)
+			} else if firstErr == nil {
+				firstErr = fmt.Errorf("event %s: %v", ev.uid, err)
+			}
+			ev = nil
+			continue
+		}
+		var err error
+		switch name {
+		case "UID":
+			ev.uid = value
+		case "DTSTART":
+			ev.start, ev.allDay, err = parseICalTime(value, params, loc)
+		case "DTEND":
+			ev.end, _, err = parseICalTime(value, params, loc)
+			hasEnd = true
+		case "DURATION":
+			duration = value
+		case "RRULE":
+			ev.rrule = value
+		case "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				t, _, e := parseICalTime(v, params, loc)
+				if e != nil {
+					err = e
+					break
+				}
+				ev.exdates = append(ev.exdates, t)
+			}
+		case "RECURRENCE-ID":
+			ev.recurrenceID, _, err = parseICalTime(value, params, loc)
+		case "STATUS":
+			ev.cancelled = strings.EqualFold(value, "CANCELLED")
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", line, err)
+		}
+	}
+	return events, firstErr
+}
+
+// finish sets the end of an event from DTEND, DURATION or its start
+func (ev *icalEvent) finish(hasEnd bool, duration string) error {
+	if ev.start.IsZero() {
+		return fmt.Errorf("no DTSTART")
+	}
+	switch {
+	case hasEnd:
+	case duration != "":
+		d, err := parseICalDuration(duration)
+		if err != nil {
+			return err
+		}
+		ev.end = ev.start.Add(d)
+		if ev.allDay {
+			ev.end = ev.start.AddDate(0, 0, int(d/(24*time.Hour)))
+		}
+	case ev.allDay:
+		ev.end = ev.start.AddDate(0, 0, 1)
+	default:
+		ev.end = ev.start
+	}
+	if !ev.end.After(ev.start) {
+		return fmt.Errorf("event ends before it starts")
+	}
+	return nil
+}
+
+// splitICalLine splits "NAME;PARAM=x;PARAM2=y:value"; colons within quoted
+// parameter values are not separators
+func splitICalLine(line string) (name string, params map[string]string, value string) {
+	quoted := false
+	sep := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 {
+		return strings.ToUpper(line), nil, ""
+	}
+	parts := strings.Split(line[:sep], ";")
+	params = map[string]string{}
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, strings.TrimSpace(line[sep+1:])
+}
+
+// parseICalTime parses a DATE ("20250101") or DATE-TIME value: UTC
+// ("20250101T090000Z"), in the TZID parameter's zone, or floating (loc)
+func parseICalTime(value string, params map[string]string, loc *time.Location) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	zone := loc
+	if tzid := params["TZID"]; tzid != "" {
+		if z, err := time.LoadLocation(tzid); err == nil {
+			zone = z
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, zone)
+	return t, false, err
+}
+
+// parseICalDuration parses a DURATION value such as "P1D", "PT2H30M" or
+// "P1W"
+func parseICalDuration(s string) (time.Duration, error) {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(s, "+"), "P")
+	if !ok {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+	var d time.Duration
+	num := ""
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case c == 'T':
+		case c >= '0' && c <= '9':
+			num += string(c)
+		default:
+			n, err := strconv.Atoi(num)
+			unit, ok := units[c]
+			if err != nil || !ok {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			d += time.Duration(n) * unit
+			num = ""
+		}
+	}
+	return d, nil
+}
+
+// dayCount is the number of days of an all-day event (DTEND is exclusive)
+func dayCount(start, end time.Time) int {
+	n := 0
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		n++
+	}
+	return n
+}
+
+// icalLines renders one occurrence as holiday lines: a date range for an
+// all-day event, the closed hours of each day for a timed one
+func icalLines(start, end time.Time, allDay bool) []string {
+	if allDay {
+		last := end.AddDate(0, 0, -1)
+		return []string{FormatHoliday(start.Format("2006-01-02"), last.Format("2006-01-02"), "", "")}
+	}
+	var lines []string
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location()); day.Before(end); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		from, to := "00:00", "24:00"
+		if start.After(day) {
+			from = start.Format("15:04")
+		}
+		if end.Before(next) {
+			to = end.Format("15:04")
+		}
+		if from == "00:00" && to == "24:00" {
+			lines = append(lines, day.Format("2006-01-02"))
+		} else if from < to || to == "24:00" {
+			lines = append(lines, FormatHoliday(day.Format("2006-01-02"), "", from, to))
+		}
+	}
+	return lines
+}
+
+// maxRRulePeriods bounds the expansion of rules without COUNT or UNTIL
+// whose occurrences never reach the end of the window (e.g. BYMONTHDAY=31
+// with FREQ=MONTHLY and BYMONTH=2)
+const maxRRulePeriods = 10000
+
+// expandRRule returns the occurrence starts of a recurring event up to to
+func expandRRule(rule string, start, to time.Time) ([]time.Time, error) {
+	parts := map[string]string{}
+	for _, p := range strings.Split(rule, ";") {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			parts[strings.ToUpper(k)] = strings.ToUpper(v)
+		}
+	}
+	for k := range parts {
+		switch k {
+		case "FREQ", "INTERVAL", "COUNT", "UNTIL", "BYDAY", "BYMONTHDAY", "BYMONTH", "WKST":
+		default:
+			return nil, fmt.Errorf("unsupported RRULE part %s", k)
+		}
+	}
+	interval := 1
+	if v, ok := parts["INTERVAL"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid RRULE INTERVAL %q", v)
+		}
+		interval = n
+	}
+	count := -1
+	if v, ok := parts["COUNT"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid RRULE COUNT %q", v)
+		}
+		count = n
+	}
+	if v, ok := parts["UNTIL"]; ok {
+		until, _, err := parseICalTime(v, nil, start.Location())
+		if err != nil {
+			return nil, fmt.Errorf("invalid RRULE UNTIL %q", v)
+		}
+		if len(v) == 8 {
+			until = until.AddDate(0, 0, 1).Add(-time.Second) // the whole last day
+		}
+		if until.Before(to) {
+			to = until
+		}
+	}
+	days, err := parseByDay(parts["BYDAY"])
+	if err != nil {
+		return nil, err
+	}
+	monthDays, err := parseIntList(parts["BYMONTHDAY"], -31, 31)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RRULE BYMONTHDAY: %v", err)
+	}
+	months, err := parseIntList(parts["BYMONTH"], 1, 12)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RRULE BYMONTH: %v", err)
+	}
+
+	var out []time.Time
+	for period := 0; period < maxRRulePeriods; period++ {
+		var candidates []time.Time
+		switch parts["FREQ"] {
+		case "DAILY":
+			candidates = []time.Time{start.AddDate(0, 0, period*interval)}
+		case "WEEKLY":
+			week := start.AddDate(0, 0, period*interval*7)
+			if len(days) == 0 {
+				candidates = []time.Time{week}
+				break
+			}
+			monday := week.AddDate(0, 0, -(int(week.Weekday())+6)%7)
+			for _, d := range days {
+				candidates = append(candidates, monday.AddDate(0, 0, (int(d.day)+6)%7))
+			}
+		case "MONTHLY":
+			first := time.Date(start.Year(), start.Month()+time.Month(period*interval), 1,
+				start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+			candidates = monthCandidates(first, start.Day(), days, monthDays)
+		case "YEARLY":
+			year := start.Year() + period*interval
+			for _, m := range orDefault(months, int(start.Month())) {
+				first := time.Date(year, time.Month(m), 1, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+				candidates = append(candidates, monthCandidates(first, start.Day(), days, monthDays)...)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported RRULE FREQ %q", parts["FREQ"])
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+		for _, c := range candidates {
+			if c.Before(start) {
+				continue
+			}
+			if c.After(to) {
+				return out, nil
+			}
+			if len(months) > 0 && parts["FREQ"] != "YEARLY" && !containsInt(months, int(c.Month())) {
+				continue
+			}
+			out = append(out, c)
+			if count > 0 && len(out) == count {
+				return out, nil
+			}
+		}
+	}
+	return out, nil
+}
+
+// weekdayRule is a BYDAY entry: a weekday with an optional ordinal within
+// the month ("2MO", "-1FR")
+type weekdayRule struct {
+	n   int
+	day time.Weekday
+}
+
+func parseByDay(s string) ([]weekdayRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	codes := map[string]time.Weekday{"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday,
+		"WE": time.Wednesday, "TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday}
+	var out []weekdayRule
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) < 2 {
+			return nil, fmt.Errorf("invalid RRULE BYDAY %q", s)
+		}
+		day, ok := codes[p[len(p)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("invalid RRULE BYDAY %q", s)
+		}
+		n := 0
+		if num := p[:len(p)-2]; num != "" {
+			var err error
+			if n, err = strconv.Atoi(num); err != nil || n == 0 || n < -5 || n > 5 {
+				return nil, fmt.Errorf("invalid RRULE BYDAY %q", s)
+			}
+		}
+		out = append(out, weekdayRule{n: n, day: day})
+	}
+	return out, nil
+}
+
+func parseIntList(s string, lo, hi int) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var out []int
+	for _, p := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < lo || n > hi || n == 0 {
+			return nil, fmt.Errorf("%q", s)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// monthCandidates lists the days of a month (first is its first day, at
+// the time of the event) matching BYDAY and BYMONTHDAY, or day when neither
+// is set; days that do not exist in the month are skipped
+func monthCandidates(first time.Time, day int, days []weekdayRule, monthDays []int) []time.Time {
+	last := first.AddDate(0, 1, -1).Day()
+	var out []time.Time
+	byMonthDay := map[int]bool{}
+	for _, d := range monthDays {
+		if d < 0 {
+			d = last + 1 + d
+		}
+		if d >= 1 && d <= last {
+			byMonthDay[d] = true
+			if len(days) == 0 {
+				out = append(out, first.AddDate(0, 0, d-1))
+			}
+		}
+	}
+	for _, w := range days {
+		var matches []time.Time
+		for d := 1; d <= last; d++ {
+			// with both BYDAY and BYMONTHDAY, a day must match both
+			if c := first.AddDate(0, 0, d-1); c.Weekday() == w.day && (len(monthDays) == 0 || byMonthDay[d]) {
+				matches = append(matches, c)
+			}
+		}
+		switch {
+		case w.n == 0:
+			out = append(out, matches...)
+		case w.n > 0 && w.n <= len(matches):
+			out = append(out, matches[w.n-1])
+		case w.n < 0 && -w.n <= len(matches):
+			out = append(out, matches[len(matches)+w.n])
+		}
+	}
+	if len(days) == 0 && len(monthDays) == 0 && day <= last {
+		out = append(out, first.AddDate(0, 0, day-1))
+	}
+	return out
+}
+
+func orDefault(list []int, def int) []int {
+	if len(list) == 0 {
+		return []int{def}
+	}
+	return list
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval is an open period within a day, as offsets from midnight
+type Interval struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// WeeklySchedule lists the open intervals for each weekday (indexed by time.Weekday)
+type WeeklySchedule [7][]Interval
+
+// NewWorkweekSchedule returns a Monday–Friday schedule open from workStart to workEnd ("15:04")
+func NewWorkweekSchedule(workStart, workEnd string) (WeeklySchedule, error) {
+	var s WeeklySchedule
+	start, err := ParseClock(workStart)
+	if err != nil {
+		return s, err
+	}
+	end, err := ParseClock(workEnd)
+	if err != nil {
+		return s, err
+	}
+	for d := time.Monday; d <= time.Friday; d++ {
+		s[d] = []Interval{{Start: start, End: end}}
+	}
+	return s, nil
+}
+
+// ParseClock parses a time of day as "15:04" or as decimal hours ("8.5" = 08:30)
+func ParseClock(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			if s == "24:00" {
+				return 24 * time.Hour, nil
+			}
+			return 0, err
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+	h, err := strconv.ParseFloat(s, 64)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(h * float64(time.Hour)), nil
+}
+
+// ParseIntervals parses a day spec such as "08:00-12:00" or
+// "08:00-12:00,13:00-17:00"; "closed" (or "-") means no open interval
+func ParseIntervals(spec string) ([]Interval, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "closed" || spec == "-" {
+		return nil, nil
+	}
+	var out []Interval
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid interval %q, expected HH:MM-HH:MM", part)
+		}
+		start, err := ParseClock(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := ParseClock(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if end <= start {
+			return nil, fmt.Errorf("invalid interval %q, end must be after start", part)
+		}
+		out = append(out, Interval{Start: start, End: end})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	return out, nil
+}
+
+// ParseWeekday parses an English weekday name ("monday", "Mon")
+func ParseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		full := strings.ToLower(d.String())
+		if name == full || name == full[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// Add appends an open interval to a weekday, keeping intervals ordered
+func (w *WeeklySchedule) Add(day time.Weekday, iv Interval) {
+	w[day] = append(w[day], iv)
+	sort.Slice(w[day], func(i, j int) bool { return w[day][i].Start < w[day][j].Start })
+}
+
+// WithBreaks returns a copy of the schedule with the break intervals
+// (e.g. a 12:00-13:00 lunch) removed from every day
+func (w WeeklySchedule) WithBreaks(breaks []Interval) WeeklySchedule {
+	if len(breaks) == 0 {
+		return w
+	}
+	var out WeeklySchedule
+	for day, intervals := range w {
+		for _, iv := range intervals {
+			out[day] = append(out[day], subtractBreaks(iv, breaks)...)
+		}
+	}
+	return out
+}
+
+func subtractBreaks(iv Interval, breaks []Interval) []Interval {
+	parts := []Interval{iv}
+	for _, b := range breaks {
+		var next []Interval
+		for _, p := range parts {
+			if b.End <= p.Start || b.Start >= p.End {
+				next = append(next, p)
+				continue
+			}
+			if b.Start > p.Start {
+				next = append(next, Interval{Start: p.Start, End: b.Start})
+			}
+			if b.End < p.End {
+				next = append(next, Interval{Start: b.End, End: p.End})
+			}
+		}
+		parts = next
+	}
+	return parts
+}
+
+// IsEmpty reports whether the schedule has no open interval at all
+func (w WeeklySchedule) IsEmpty() bool {
+	for _, day := range w {
+		if len(day) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Duration returns the open time between start and end, skipping holiday closures
+func (w WeeklySchedule) Duration(start, end time.Time, holidays Holidays) time.Duration {
+	if !end.After(start) {
+		return 0
+	}
+	loc := start.Location()
+	end = end.In(loc)
+	var total time.Duration
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	for day.Before(end) {
+		next := time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, loc)
+		for _, iv := range holidays.open(day, w[day.Weekday()]) {
+			from := day.Add(iv.Start)
+			to := day.Add(iv.End)
+			if from.Before(start) {
+				from = start
+			}
+			if to.After(end) {
+				to = end
+			}
+			if to.After(from) {
+				total += to.Sub(from)
+			}
+		}
+		day = next
+	}
+	return total
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	es "itop-sla-exporter/internal/es"
+	kafka "itop-sla-exporter/internal/kafka"
+)
+
+// kafkaSink publishes ticket events to a Kafka topic, keyed by document id:
+// upserts carry the full document, updates (soft deletes) only the changed
+// fields and deletes are tombstones, so a compacted topic holds the current
+// tickets. The "action" and "index" headers tell them apart. Kafka cannot be
+// listed: change detection relies on the shadow kept in the state file.
+type kafkaSink struct {
+	producer *kafka.Producer
+
+	mu      sync.Mutex
+	pending []kafka.Message // published on Flush
+}
+
+func (s *kafkaSink) Upsert(index, id string, doc interface{}) error {
+	return s.add("upsert", index, id, doc)
+}
+
+func (s *kafkaSink) Update(index, id string, partial interface{}) error {
+	return s.add("update", index, id, partial)
+}
+
+func (s *kafkaSink) Delete(index, id string) error {
+	return s.add("delete", index, id, nil)
+}
+
+func (s *kafkaSink) add(action, index, id string, doc interface{}) error {
+	msg := kafka.Message{
+		Key:     []byte(id),
+		Headers: map[string]string{"action": action, "index": index},
+		Time:    time.Now(),
+	}
+	if doc != nil {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		msg.Value = data
+	}
+	s.mu.Lock()
+	s.pending = append(s.pending, msg)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *kafkaSink) List() ([]ESTicket, error) {
+	return nil, errNotListable
+}
+
+// Flush publishes the pending events; on failure they are kept for the next flush
+func (s *kafkaSink) Flush() (es.BulkResult, error) {
+	s.mu.Lock()
+	msgs := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	var res es.BulkResult
+	if len(msgs) == 0 {
+		return res, nil
+	}
+	if err := s.producer.Produce(msgs); err != nil {
+		s.mu.Lock()
+		s.pending = append(msgs, s.pending...)
+		s.mu.Unlock()
+		return res, err
+	}
+	for _, m := range msgs {
+		switch m.Headers["action"] {
+		case "upsert":
+			res.Indexed++
+		case "update":
+			res.Updated++
+		case "delete":
+			res.Deleted++
+		}
+	}
+	return res, nil
+}
+
+func (s *kafkaSink) Close() error {
+	_, err := s.Flush()
+	s.producer.Close()
+	return err
+}
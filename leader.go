@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
+	metrics "itop-sla-exporter/internal/metrics"
+)
+
+// leaderLockName is the id of the lease document in leader.index
+const leaderLockName = "itop-sla-exporter"
+
+var errStandby = errors.New("standby replica: another replica holds the leader lease")
+
+// leaderElection takes and keeps the leader lease (leader.enabled); the
+// run loop only syncs while it is held
+type leaderElection struct {
+	lock *es.Lock
+	id   string
+	ttl  time.Duration
+	held atomic.Bool
+}
+
+func newLeaderElection(cfg *config.Config, client *es.Client) (*leaderElection, error) {
+	id := cfg.Leader.ID
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("leader.id: %w", err)
+		}
+		id = host
+	}
+	name := leaderLockName
+	if cfg.Shard.Enabled() {
+		// One leader per shard
+		name = fmt.Sprintf("%s-shard-%d", leaderLockName, cfg.Shard.Index)
+	}
+	return &leaderElection{lock: client.NewLock(cfg.LeaderIndex(), name, id, cfg.Leader.TTL), id: id, ttl: cfg.Leader.TTL}, nil
+}
+
+// campaign tries to take the lease, then renews it, every ttl/3. A lease
+// that could not be renewed for 2/3 of the ttl is given up before it
+// expires, as a standby may take it over then.
+func (l *leaderElection) campaign() {
+	var renewed time.Time
+	for {
+		held, err := l.lock.TryAcquire()
+		switch {
+		case err != nil:
+			if l.held.Load() && time.Since(renewed) >= l.ttl*2/3 {
+				l.held.Store(false)
+				slog.Error("Standing by: failed to renew the leader lease", "id", l.id, "err", err)
+			} else {
+				slog.Warn("Failed to reach the leader lease", "id", l.id, "err", err)
+			}
+		case held:
+			renewed = time.Now()
+			if !l.held.Swap(true) {
+				slog.Info("Elected leader, syncing", "id", l.id)
+			}
+		default:
+			if l.held.Swap(false) {
+				slog.Warn("Standing by: another replica took the leader lease", "id", l.id)
+			}
+		}
+		if l.held.Load() {
+			metrics.Leader.Set(1)
+		} else {
+			metrics.Leader.Set(0)
+		}
+		time.Sleep(l.ttl / 3)
+	}
+}
+
+// isLeader reports whether this replica may write: always without leader
+// election
+func (s *syncer) isLeader() bool {
+	return s.leader == nil || s.leader.held.Load()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+)
+
+// setupLogging installs the leveled structured logger as slog's default; the
+// standard log package is routed through it as well
+func setupLogging(conf config.LogConfig, debug bool) {
+	var level slog.Level
+	switch strings.ToLower(conf.Level) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	if debug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if conf.Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(&errorRecorder{Handler: handler, log: recentErrors}))
+}
+
+// maxRecentErrors bounds the errors kept for the status page
+const maxRecentErrors = 20
+
+// recentErrors holds the last errors logged, shown by the status page
+var recentErrors = &errorLog{}
+
+// loggedError is an error-level log record
+type loggedError struct {
+	Time    time.Time
+	Message string
+	Attrs   string // key=value pairs
+}
+
+// errorLog keeps the last maxRecentErrors errors logged
+type errorLog struct {
+	mu     sync.Mutex
+	errors []loggedError
+}
+
+func (l *errorLog) add(e loggedError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, e)
+	if len(l.errors) > maxRecentErrors {
+		l.errors = l.errors[len(l.errors)-maxRecentErrors:]
+	}
+}
+
+// list returns the errors kept, the most recent first
+func (l *errorLog) list() []loggedError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]loggedError, len(l.errors))
+	for i, e := range l.errors {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
+
+// pipelineLogger is the default logger, tagged with the pipeline of cfg if any
+func pipelineLogger(cfg *config.Config) *slog.Logger {
+	if cfg.Pipeline == "" {
+		return slog.Default()
+	}
+	return slog.With("pipeline", cfg.Pipeline)
+}
+
+// errorRecorder passes records on to Handler and keeps the errors in log
+type errorRecorder struct {
+	slog.Handler
+	log   *errorLog
+	attrs []slog.Attr // from WithAttrs, e.g. cycle_id
+}
+
+func (h *errorRecorder) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		var parts []string
+		for _, a := range h.attrs {
+			parts = append(parts, a.String())
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			parts = append(parts, a.String())
+			return true
+		})
+		h.log.add(loggedError{Time: r.Time, Message: r.Message, Attrs: strings.Join(parts, " ")})
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *errorRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &errorRecorder{Handler: h.Handler.WithAttrs(attrs), log: h.log, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *errorRecorder) WithGroup(name string) slog.Handler {
+	return &errorRecorder{Handler: h.Handler.WithGroup(name), log: h.log, attrs: h.attrs}
+}
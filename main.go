@@ -1,36 +1,32 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"fmt"
+	"html"
+	"log/slog"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"time"
 
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
 	itop "itop-sla-exporter/internal/itop"
 	utils "itop-sla-exporter/internal/utils"
 
 	"github.com/joho/godotenv"
 )
 
-// ESConfig holds elasticsearch connection info
-type ESConfig struct {
-	URL      string
-	Username string
-	Password string
-	Index    string
-}
-
 // ESTicket is the model for elasticsearch
 type ESTicket struct {
 	ID                                string     `json:"id"`
 	Ref                               string     `json:"ref"`
 	Class                             string     `json:"class"`
-	Title                             string     `json:"title"`
+	Title                             string     `json:"title" es:"text"`
 	Status                            string     `json:"status"`
 	Priority                          string     `json:"priority"`
 	Urgency                           string     `json:"urgency"`
@@ -38,10 +34,12 @@ type ESTicket struct {
 	ServiceID                         string     `json:"service_id"`
 	ServiceName                       string     `json:"service_name"`
 	ServiceSubcategoryName            string     `json:"servicesubcategory_name"`
+	RequestType                       string     `json:"request_type,omitempty"` // UserRequest only
 	AgentID                           string     `json:"agent_id"`
 	Agent                             string     `json:"agent_id_friendlyname"`
 	TeamID                            string     `json:"team_id"`
 	Team                              string     `json:"team_id_friendlyname"`
+	CallerID                          string     `json:"caller_id"`
 	Caller                            string     `json:"caller_id_friendlyname"`
 	CallerTeam                        string     `json:"caller_team"` // Team(s) of the caller, comma-separated if multiple teams
 	Origin                            string     `json:"origin"`
@@ -63,99 +61,192 @@ type ESTicket struct {
 	TimeToResolve24BH         float64 `json:"time_to_resolve_24bh"`
 	SLAComplianceResponse24BH string  `json:"sla_compliance_response_24bh"`
 	SLAComplianceResolve24BH  string  `json:"sla_compliance_resolve_24bh"`
+
+	// Time the TTR clock was paused (SLA pause), already subtracted from TTR
+	TimePausedRaw        float64 `json:"time_paused_raw"`
+	TimePausedBusinessHr float64 `json:"time_paused_business_hour"`
+	TimePaused24BH       float64 `json:"time_paused_24bh"`
+
+	// Elapsed time so far for unresolved tickets, refreshed every sync.age_refresh_interval (0 once resolved)
+	AgeRaw        float64 `json:"age_raw"`
+	AgeBusinessHr float64 `json:"age_business_hour"`
+	Age24BH       float64 `json:"age_24bh"`
+
+	// Business-hour time left before the SLT deadline for open tickets, negative once breached
+	TTORemainingSeconds *float64 `json:"tto_remaining_seconds,omitempty"`
+	TTRRemainingSeconds *float64 `json:"ttr_remaining_seconds,omitempty"`
+
+	// SLA as computed by iTop itself, to compare with the values above
+	ITopTTODeadline           *time.Time `json:"itop_tto_deadline,omitempty"`
+	ITopTTRDeadline           *time.Time `json:"itop_ttr_deadline,omitempty"`
+	ITopSLATTOPassed          bool       `json:"itop_sla_tto_passed"`
+	ITopSLATTRPassed          bool       `json:"itop_sla_ttr_passed"`
+	ITopSLATTOOver            float64    `json:"itop_sla_tto_over"`
+	ITopSLATTROver            float64    `json:"itop_sla_ttr_over"`
+	SLAComplianceResponseITop string     `json:"sla_compliance_response_itop"`
+	SLAComplianceResolveITop  string     `json:"sla_compliance_resolve_itop"`
+
+	// ContentHash identifies the document content for change detection
+	ContentHash string `json:"content_hash"`
+
+	// Soft-delete mode: set when the ticket no longer exists in iTop
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// Extra holds the itop.extra_fields values, written next to the fields
+	// above under their own names
+	Extra map[string]interface{} `json:"-"`
+
+	// Problem management fields, class Problem only
+	Problem *ESProblem `json:"problem,omitempty"`
+
+	// Change management fields, Change classes only
+	Change *ESChange `json:"change,omitempty"`
+
+	// Organization (customer) of the ticket
+	OrgID   string `json:"org_id"`
+	OrgName string `json:"org_name"`
+
+	// Impacted functional CIs (itop.impacted_cis)
+	CIIDs   []string `json:"ci_ids,omitempty"`
+	CINames []string `json:"ci_names,omitempty"`
+	CICount *int     `json:"ci_count,omitempty"`
+
+	// Public log summary (itop.public_log): the first agent entry is the
+	// true first response, timed the same three ways as TTO
+	PublicLogCount              *int       `json:"public_log_count,omitempty"`
+	LastCustomerUpdate          *time.Time `json:"last_customer_update,omitempty"`
+	LastAgentUpdate             *time.Time `json:"last_agent_update,omitempty"`
+	FirstResponseDate           *time.Time `json:"first_response_date,omitempty"`
+	TimeToFirstResponseRaw      *float64   `json:"time_to_first_response_raw,omitempty"`
+	TimeToFirstResponseBusiness *float64   `json:"time_to_first_response_business_hour,omitempty"`
+	TimeToFirstResponse24BH     *float64   `json:"time_to_first_response_24bh,omitempty"`
+
+	// Resolution and closure; time to close runs from start_date to
+	// close_date, computed the same three ways as TTR
+	CloseDate             *time.Time `json:"close_date,omitempty"`
+	ResolutionCode        string     `json:"resolution_code,omitempty"`
+	Solution              string     `json:"solution,omitempty" es:"text"`
+	UserSatisfaction      string     `json:"user_satisfaction,omitempty"`
+	TimeToCloseRaw        float64    `json:"time_to_close_raw"`
+	TimeToCloseBusinessHr float64    `json:"time_to_close_business_hour"`
+	TimeToClose24BH       float64    `json:"time_to_close_24bh"`
+
+	// Reopens (sla.track_reopens): resolved or closed tickets set back to
+	// an open status
+	ReopenCount    *int       `json:"reopen_count,omitempty"`
+	LastReopenDate *time.Time `json:"last_reopen_date,omitempty"`
+
+	// Reassignments (sla.track_reassignments): agent and team changes, and
+	// the teams the ticket went through in order
+	ReassignmentCount *int     `json:"reassignment_count,omitempty"`
+	AgentChangeCount  *int     `json:"agent_change_count,omitempty"`
+	TeamChangeCount   *int     `json:"team_change_count,omitempty"`
+	TeamPath          []string `json:"team_path,omitempty"`
+	TeamHops          *int     `json:"team_hops,omitempty"`
+
+	// Resolved tickets only: resolved by the first agent and team assigned,
+	// and resolved by the first team without (itop.escalation) escalation
+	FirstAssignmentResolution *bool `json:"first_assignment_resolution,omitempty"`
+	ResolvedWithoutEscalation *bool `json:"resolved_without_escalation,omitempty"`
+
+	// Escalation (itop.escalation): a metric is escalated once its
+	// escalation deadline passed before it stopped; escalated also covers
+	// the manual escalation flag
+	TTOEscalationDeadline *time.Time `json:"tto_escalation_deadline,omitempty"`
+	TTREscalationDeadline *time.Time `json:"ttr_escalation_deadline,omitempty"`
+	TTOEscalated          *bool      `json:"tto_escalated,omitempty"`
+	TTREscalated          *bool      `json:"ttr_escalated,omitempty"`
+	Escalated             *bool      `json:"escalated,omitempty"`
+	EscalationReason      string     `json:"escalation_reason,omitempty"`
+
+	// Links to other tickets (itop.ticket_links), by ref
+	ParentRequestRef  string   `json:"parent_request_ref,omitempty"`
+	ParentIncidentRef string   `json:"parent_incident_ref,omitempty"`
+	ParentProblemRef  string   `json:"parent_problem_ref,omitempty"`
+	ParentChangeRef   string   `json:"parent_change_ref,omitempty"`
+	RelatedTicketRefs []string `json:"related_ticket_refs,omitempty"` // child incidents and attached requests
+	ChildCount        *int     `json:"child_count,omitempty"`
+
+	// Timezone business hours were counted in (business_hours.team_timezones,
+	// org_timezones or timezone)
+	Timezone string `json:"timezone"`
+
+	// Source is the iTop instance the ticket comes from (source, or the
+	// pipeline name)
+	Source string `json:"source,omitempty"`
+
+	index string // concrete index the document was read from
 }
 
-func main() {
-	// Load .env if exists, ignore error if not found
-	_ = godotenv.Load()
+// esTicketFields are the names of the regular document fields
+var esTicketFields = es.MappingProperties(reflect.TypeOf(ESTicket{}))
 
-	esConf := ESConfig{
-		URL:      os.Getenv("ELASTIC_URL"),
-		Username: os.Getenv("ELASTIC_USER"),
-		Password: os.Getenv("ELASTIC_PWD"),
-		Index:    os.Getenv("ELASTIC_INDEX"),
+// MarshalJSON adds the extra fields to the document; a name the document
+// already uses is left out
+func (t ESTicket) MarshalJSON() ([]byte, error) {
+	type plain ESTicket
+	data, err := json.Marshal(plain(t))
+	if err != nil || len(t.Extra) == 0 {
+		return data, err
 	}
-
-	if esConf.URL == "" || esConf.Index == "" {
-		log.Fatal("Missing ELASTIC_URL or ELASTIC_INDEX env var")
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
 	}
-
-	// Debug mode
-	debug := os.Getenv("DEBUG") == "true"
-
-	// Sync holidays from iTop to file in background (periodic, setiap 10 detik)
-	go itop.SyncHolidaysToFile("holidays.txt", 10*time.Second)
-
-	go syncLoop(esConf, debug)
-	select {} // block forever
-}
-
-func syncLoop(esConf ESConfig, debug bool) {
-	interval := 3 * time.Second
-	if s := os.Getenv("SYNC_INTERVAL"); s != "" {
-		if d, err := time.ParseDuration(s); err == nil {
-			interval = d
+	for name, v := range t.Extra {
+		if _, taken := esTicketFields[name]; !taken {
+			fields[name] = v
 		}
 	}
-	for {
-		// Load holidays
-		holidays, _ := itop.LoadHolidaysFromFile("holidays.txt")
-		holidayMap := make(map[string]struct{})
-		for _, h := range holidays {
-			holidayMap[h] = struct{}{}
-		}
+	return json.Marshal(fields)
+}
 
-		// Fetch Incident & UserRequest tickets concurrently
-		type result struct {
-			class   string
-			tickets []itop.Ticket
-			err     error
-		}
-		classes := []string{"Incident", "UserRequest"}
-		ch := make(chan result, len(classes))
-		for _, class := range classes {
-			go func(class string) {
-				tickets, err := itop.FetchTicketsByClass(class)
-				ch <- result{class, tickets, err}
-			}(class)
-		}
-		var allTickets []itop.Ticket
-		countByClass := map[string]int{}
-		for i := 0; i < len(classes); i++ {
-			r := <-ch
-			if r.err != nil {
-				log.Printf("Failed to fetch tickets from iTop (%s): %v", r.class, r.err)
-				continue
-			}
-			countByClass[r.class] = len(r.tickets)
-			allTickets = append(allTickets, r.tickets...)
-		}
-		log.Printf("Parsed %d tickets (Incident) and %d tickets (UserRequest)", countByClass["Incident"], countByClass["UserRequest"])
+// ExternalVersion is the ES external version of the document: its iTop
+// last_update in epoch milliseconds
+func (t ESTicket) ExternalVersion() int64 {
+	if t.LastUpdate == nil {
+		return 0
+	}
+	return t.LastUpdate.UnixMilli()
+}
 
-		// Fetch all tickets from Elasticsearch (by scroll or search all)
-		esTickets := fetchAllESTickets(esConf)
-		esTicketMap := make(map[string]ESTicket)
-		for _, t := range esTickets {
-			esTicketMap[hashTicketKey(t.ID, t.Ref, t.Class)] = t
-		}
+func main() {
+	// Load .env if exists, ignore error if not found
+	_ = godotenv.Load()
 
-		// Sync tickets
-		for _, t := range allTickets {
-			key := hashTicketKey(t.ID, t.Ref, t.Class)
-			est := mapTicketToES(t, holidayMap, debug)
-			// Compare, if not exist or different, upsert
-			if old, ok := esTicketMap[key]; !ok || !compareESTicket(est, old) {
-				upsertESTicket(esConf, est)
-			}
-			// Remove from map to track which to delete
-			delete(esTicketMap, key)
-		}
-		// Delete tickets in ES that no longer exist in iTop
-		for _, t := range esTicketMap {
-			deleteESTicket(esConf, t)
-		}
-		// log.Println("Sync complete at", time.Now().Format(time.RFC3339))
-		time.Sleep(interval)
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	var err error
+	switch cmd {
+	case "run":
+		err = runCmd(args)
+	case "once":
+		err = onceCmd(args)
+	case "backfill":
+		err = backfillCmd(args)
+	case "recalculate":
+		err = recalculateCmd(args)
+	case "validate":
+		err = validateCmd(args)
+	case "replay-dlq":
+		err = replayDLQCmd(args)
+	case "reindex":
+		err = reindexCmd(args)
+	case "flush-slt-cache":
+		err = flushSLTCacheCmd(args)
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
 }
 
@@ -165,53 +256,124 @@ func hashTicketKey(id, ref, class string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTicket {
-	workStart := os.Getenv("WORK_START")
-	workEnd := os.Getenv("WORK_END")
-	if workStart == "" {
-		workStart = "08:00"
+// sltFor returns the SLT targets of a ticket: those of sla.slt_overrides,
+// completed from iTop unless the override sets both TTO and TTR
+func (s *syncer) sltFor(t itop.Ticket) itop.SLTDeadline {
+	o, ok := s.cfg.SLA.SLTOverrideFor(config.SLTKey{Class: t.Class, Priority: t.Priority, PriorityLabel: priorityLabel(t.Priority),
+		Service: t.Service, Subcategory: t.ServiceSubcategory, RequestType: t.RequestType})
+	var slt itop.SLTDeadline
+	if !ok || (o.TTO == 0 && o.TTOBusinessDays == 0) || (o.TTR == 0 && o.TTRBusinessDays == 0) {
+		// Ambil SLT dari iTop (cache)
+		slt, _ = s.itop.GetSLTDeadlineCached(t.Class, t.Priority, t.Service, t.ServiceSubcategory, t.RequestType)
+	}
+	if !ok {
+		return slt
+	}
+	if o.TTO > 0 || o.TTOBusinessDays > 0 {
+		slt.TTO, slt.TTODays = o.TTO, o.TTOBusinessDays
+	}
+	if o.TTR > 0 || o.TTRBusinessDays > 0 {
+		slt.TTR, slt.TTRDays = o.TTR, o.TTRBusinessDays
 	}
-	if workEnd == "" {
-		workEnd = "17:00"
+	return slt
+}
+
+func (s *syncer) mapTicketToES(t itop.Ticket, holidays utils.Holidays) ESTicket {
+	slt := s.sltFor(t)
+
+	// Business hours follow the SLT's coverage window when iTop defines one,
+	// otherwise the configured (per-weekday) working hours
+	var business utils.BusinessCalendar = utils.NewCalendar(s.schedule, holidays)
+	if slt.Coverage != nil {
+		business = slt.Coverage.Calendar(s.cfg.BusinessHours.BreaksFor(slt.Coverage.Name), holidays)
 	}
+	// in the timezone of the ticket's team or organization
+	ticketLoc := s.cfg.BusinessHours.LocationFor(t.Team, t.OrgName, s.loc)
+	business = utils.InLocation(business, ticketLoc)
+	businessDuration := business.DurationBetween
+
 	ttrRaw := t.TimeToResolve.Seconds()
 	ttoRaw := t.TimeToResponse.Seconds()
-	ttrBH := utils.CalculateBusinessHourDuration(t.StartDate, t.ResolutionDate, workStart, workEnd, holidays)
-	ttoBH := utils.CalculateBusinessHourDuration(t.StartDate, t.AssignmentDate, workStart, workEnd, holidays)
+	ttrBH := businessDuration(t.StartDate, t.ResolutionDate)
+	ttoBH := businessDuration(t.StartDate, t.AssignmentDate)
 
 	// 24-hour business hour calculation (00:00-23:59)
-	ttr24BH := utils.CalculateBusinessHourDuration(t.StartDate, t.ResolutionDate, "00:00", "23:59", holidays)
-	tto24BH := utils.CalculateBusinessHourDuration(t.StartDate, t.AssignmentDate, "00:00", "23:59", holidays)
+	duration24BH := utils.InLocation(utils.Calendar24(holidays), ticketLoc).DurationBetween
+	ttr24BH := duration24BH(t.StartDate, t.ResolutionDate)
+	tto24BH := duration24BH(t.StartDate, t.AssignmentDate)
+
+	// SLA pause: time spent in pause statuses does not count towards TTR
+	now := time.Now().UTC()
+	var pauses []period
+	var pausedRaw, pausedBH, paused24BH time.Duration
+	if s.cfg.SLA.PauseEnabled && !t.StartDate.IsZero() {
+		until := now
+		if !t.ResolutionDate.IsZero() {
+			until = t.ResolutionDate
+		}
+		pauses = pausePeriods(t.StatusHistory, s.cfg.SLA.PauseStatuses, until)
+		rawDuration := func(a, b time.Time) time.Duration { return b.Sub(a) }
+		pausedRaw = pausedDuration(pauses, t.StartDate, until, rawDuration)
+		pausedBH = pausedDuration(pauses, t.StartDate, until, businessDuration)
+		paused24BH = pausedDuration(pauses, t.StartDate, until, duration24BH)
+		if !t.ResolutionDate.IsZero() {
+			ttrRaw -= pausedRaw.Seconds()
+			ttrBH -= pausedBH
+			ttr24BH -= paused24BH
+		}
+	}
+
+	// Aging of open tickets
+	var ageRaw, ageBH, age24BH time.Duration
+	if t.ResolutionDate.IsZero() && !t.StartDate.IsZero() && now.After(t.StartDate) {
+		ageRaw = now.Sub(t.StartDate)
+		ageBH = businessDuration(t.StartDate, now)
+		age24BH = duration24BH(t.StartDate, now)
+	}
+
+	// SLT targets on each clock. A target in business days ends at the same
+	// time of the Nth working day after the start, which each clock measures
+	// differently.
+	targets := func(d time.Duration, days int) (raw, bh, bh24 time.Duration) {
+		if days <= 0 || t.StartDate.IsZero() {
+			return d, d, d
+		}
+		deadline := utils.AddBusinessDays(business, t.StartDate.In(ticketLoc), days)
+		return deadline.Sub(t.StartDate), businessDuration(t.StartDate, deadline), duration24BH(t.StartDate, deadline)
+	}
+	ttoRawTarget, ttoBHTarget, tto24BHTarget := targets(slt.TTO, slt.TTODays)
+	ttrRawTarget, ttrBHTarget, ttr24BHTarget := targets(slt.TTR, slt.TTRDays)
+
+	// SLA countdown: unassigned tickets count down TTO, unresolved ones TTR
+	var ttoRemaining, ttrRemaining *float64
+	if !t.StartDate.IsZero() && t.ResolutionDate.IsZero() {
+		if ttoBHTarget > 0 && t.AssignmentDate.IsZero() {
+			v := (ttoBHTarget - ageBH).Seconds()
+			ttoRemaining = &v
+		}
+		if ttrBHTarget > 0 {
+			v := (ttrBHTarget - (ageBH - pausedBH)).Seconds()
+			ttrRemaining = &v
+		}
+	}
 
 	// Fetch caller team information
 	callerTeam := "-"
-	if t.Caller != "" {
-		teams, err := itop.FetchPersonTeams(t.Caller)
+	if t.Caller != "" || t.CallerID != "" {
+		teams, err := s.itop.FetchPersonTeams(t.CallerRef())
 		if err != nil {
-			log.Printf("Error fetching teams for caller %s: %v", t.Caller, err)
+			s.log.Warn("Error fetching teams for caller", "caller", t.Caller, "ticket_ref", t.Ref, "err", err)
 			callerTeam = "-"
 		} else if teams != "" && teams != "-" {
 			callerTeam = teams
-			if debug {
-				log.Printf("Found teams for caller %s: %s", t.Caller, callerTeam)
-			}
+			s.log.Debug("Found teams for caller", "caller", t.Caller, "teams", callerTeam)
 		} else {
 			callerTeam = "-"
 		}
 	}
 
-	// Ambil SLT dari iTop (cache)
-	slt, _ := itop.GetSLTDeadlineCached(t.Class, t.Priority, t.Service)
-
 	// Timezone
-	tz := os.Getenv("TIMEZONE")
-	if tz == "" {
-		tz = "Asia/Jakarta"
-	}
-	loc, err := time.LoadLocation(tz)
-	if err != nil {
-		loc = time.Local
-	}
+	loc := s.loc
 
 	var startDatePtr, assignmentDatePtr, resolutionDatePtr, lastPendingDatePtr, lastUpdatePtr *time.Time
 	if !t.StartDate.IsZero() {
@@ -237,12 +399,19 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 		lastUpdatePtr = &v
 	}
 
+	// Open tickets past sla.at_risk_threshold of their TTR budget are flagged "at_risk"
+	riskState := func(consumed, target time.Duration) string {
+		if s.cfg.SLA.AtRiskThreshold > 0 && consumed.Seconds() >= s.cfg.SLA.AtRiskThreshold*target.Seconds() {
+			return "at_risk"
+		}
+		return ""
+	}
+
 	// Compliance logic (RAW)
 	var slaComplianceResponseRaw, slaComplianceResolveRaw string
-	now := time.Now().UTC()
 	// Response compliance (TTO)
-	if slt.TTO > 0 && ttoRaw > 0 {
-		if ttoRaw <= slt.TTO.Seconds() {
+	if ttoRawTarget > 0 && ttoRaw > 0 {
+		if ttoRaw <= ttoRawTarget.Seconds() {
 			slaComplianceResponseRaw = "comply"
 		} else {
 			slaComplianceResponseRaw = "overdue"
@@ -259,8 +428,8 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 			slaComplianceResolveRaw = ""
 		}
 	} else if t.Status == "resolved" || t.Status == "closed" {
-		if slt.TTR > 0 && ttrRaw > 0 {
-			if ttrRaw <= slt.TTR.Seconds() {
+		if ttrRawTarget > 0 && ttrRaw > 0 {
+			if ttrRaw <= ttrRawTarget.Seconds() {
 				slaComplianceResolveRaw = "comply"
 			} else {
 				slaComplianceResolveRaw = "overdue"
@@ -270,12 +439,12 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 		}
 	} else if t.Status != "pending" && t.Status != "resolved" && t.Status != "closed" {
 		// In progress (e.g. new, assigned, etc): overdue if now > SLT deadline
-		if slt.TTR > 0 && t.StartDate != (time.Time{}) {
-			deadline := t.StartDate.Add(slt.TTR)
+		if ttrRawTarget > 0 && t.StartDate != (time.Time{}) {
+			deadline := t.StartDate.Add(ttrRawTarget + pausedRaw)
 			if now.After(deadline) {
 				slaComplianceResolveRaw = "overdue"
 			} else {
-				slaComplianceResolveRaw = ""
+				slaComplianceResolveRaw = riskState(now.Sub(t.StartDate)-pausedRaw, ttrRawTarget)
 			}
 		} else {
 			slaComplianceResolveRaw = ""
@@ -287,8 +456,8 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 	// Compliance logic (Business Hour)
 	var slaComplianceResponseBH, slaComplianceResolveBH string
 	// Response compliance (TTO)
-	if slt.TTO > 0 {
-		if (ttoBH > 0 && ttoBH.Seconds() <= slt.TTO.Seconds()) || (ttoBH.Seconds() == 0 && ttoRaw > 0 && ttoRaw <= slt.TTO.Seconds()) {
+	if ttoBHTarget > 0 {
+		if (ttoBH > 0 && ttoBH.Seconds() <= ttoBHTarget.Seconds()) || (ttoBH.Seconds() == 0 && ttoRaw > 0 && ttoRaw <= ttoBHTarget.Seconds()) {
 			slaComplianceResponseBH = "comply"
 		} else if ttoBH.Seconds() > 0 {
 			slaComplianceResponseBH = "overdue"
@@ -301,15 +470,15 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 	// Resolve compliance (TTR)
 	if t.Status == "pending" && lastPendingDatePtr != nil {
 		// Calculate business hours between lastPendingDate and now
-		bhPending := utils.CalculateBusinessHourDuration(*lastPendingDatePtr, now, workStart, workEnd, holidays)
+		bhPending := businessDuration(*lastPendingDatePtr, now)
 		if bhPending.Hours() > 48 {
 			slaComplianceResolveBH = "overdue"
 		} else {
 			slaComplianceResolveBH = ""
 		}
 	} else if t.Status == "resolved" || t.Status == "closed" {
-		if slt.TTR > 0 {
-			if (ttrBH > 0 && ttrBH.Seconds() <= slt.TTR.Seconds()) || (ttrBH.Seconds() == 0 && ttrRaw > 0 && ttrRaw <= slt.TTR.Seconds()) {
+		if ttrBHTarget > 0 {
+			if (ttrBH > 0 && ttrBH.Seconds() <= ttrBHTarget.Seconds()) || (ttrBH.Seconds() == 0 && ttrRaw > 0 && ttrRaw <= ttrBHTarget.Seconds()) {
 				slaComplianceResolveBH = "comply"
 			} else if ttrBH.Seconds() > 0 {
 				slaComplianceResolveBH = "overdue"
@@ -321,12 +490,12 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 		}
 	} else if t.Status != "pending" && t.Status != "resolved" && t.Status != "closed" {
 		// In progress (e.g. new, assigned, etc): overdue if business hour since start > SLT
-		if slt.TTR > 0 && t.StartDate != (time.Time{}) {
-			bhInProgress := utils.CalculateBusinessHourDuration(t.StartDate, now, workStart, workEnd, holidays)
-			if bhInProgress.Seconds() > slt.TTR.Seconds() {
+		if ttrBHTarget > 0 && t.StartDate != (time.Time{}) {
+			bhInProgress := businessDuration(t.StartDate, now) - pausedBH
+			if bhInProgress.Seconds() > ttrBHTarget.Seconds() {
 				slaComplianceResolveBH = "overdue"
 			} else {
-				slaComplianceResolveBH = ""
+				slaComplianceResolveBH = riskState(bhInProgress, ttrBHTarget)
 			}
 		} else {
 			slaComplianceResolveBH = ""
@@ -338,8 +507,8 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 	// Compliance logic (24-hour business hour)
 	var slaComplianceResponse24BH, slaComplianceResolve24BH string
 	// Response compliance (TTO)
-	if slt.TTO > 0 {
-		if (tto24BH > 0 && tto24BH.Seconds() <= slt.TTO.Seconds()) || (tto24BH.Seconds() == 0 && ttoRaw > 0 && ttoRaw <= slt.TTO.Seconds()) {
+	if tto24BHTarget > 0 {
+		if (tto24BH > 0 && tto24BH.Seconds() <= tto24BHTarget.Seconds()) || (tto24BH.Seconds() == 0 && ttoRaw > 0 && ttoRaw <= tto24BHTarget.Seconds()) {
 			slaComplianceResponse24BH = "comply"
 		} else if tto24BH.Seconds() > 0 {
 			slaComplianceResponse24BH = "overdue"
@@ -352,15 +521,15 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 	// Resolve compliance (TTR)
 	if t.Status == "pending" && lastPendingDatePtr != nil {
 		// Calculate 24-hour business hours between lastPendingDate and now
-		bh24Pending := utils.CalculateBusinessHourDuration(*lastPendingDatePtr, now, "00:00", "23:59", holidays)
+		bh24Pending := duration24BH(*lastPendingDatePtr, now)
 		if bh24Pending.Hours() > 48 {
 			slaComplianceResolve24BH = "overdue"
 		} else {
 			slaComplianceResolve24BH = ""
 		}
 	} else if t.Status == "resolved" || t.Status == "closed" {
-		if slt.TTR > 0 {
-			if (ttr24BH > 0 && ttr24BH.Seconds() <= slt.TTR.Seconds()) || (ttr24BH.Seconds() == 0 && ttrRaw > 0 && ttrRaw <= slt.TTR.Seconds()) {
+		if ttr24BHTarget > 0 {
+			if (ttr24BH > 0 && ttr24BH.Seconds() <= ttr24BHTarget.Seconds()) || (ttr24BH.Seconds() == 0 && ttrRaw > 0 && ttrRaw <= ttr24BHTarget.Seconds()) {
 				slaComplianceResolve24BH = "comply"
 			} else if ttr24BH.Seconds() > 0 {
 				slaComplianceResolve24BH = "overdue"
@@ -372,12 +541,12 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 		}
 	} else if t.Status != "pending" && t.Status != "resolved" && t.Status != "closed" {
 		// In progress (e.g. new, assigned, etc): overdue if 24bh since start > SLT
-		if slt.TTR > 0 && t.StartDate != (time.Time{}) {
-			bh24InProgress := utils.CalculateBusinessHourDuration(t.StartDate, now, "00:00", "23:59", holidays)
-			if bh24InProgress.Seconds() > slt.TTR.Seconds() {
+		if ttr24BHTarget > 0 && t.StartDate != (time.Time{}) {
+			bh24InProgress := duration24BH(t.StartDate, now) - paused24BH
+			if bh24InProgress.Seconds() > ttr24BHTarget.Seconds() {
 				slaComplianceResolve24BH = "overdue"
 			} else {
-				slaComplianceResolve24BH = ""
+				slaComplianceResolve24BH = riskState(bh24InProgress, ttr24BHTarget)
 			}
 		} else {
 			slaComplianceResolve24BH = ""
@@ -386,7 +555,7 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 		slaComplianceResolve24BH = ""
 	}
 
-	return ESTicket{
+	doc := ESTicket{
 		ID:                                t.ID,
 		Ref:                               t.Ref,
 		Class:                             t.Class,
@@ -402,6 +571,7 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 		Agent:                             t.Agent,
 		TeamID:                            t.TeamID,
 		Team:                              t.Team,
+		CallerID:                          t.CallerID,
 		Caller:                            t.Caller,
 		CallerTeam:                        callerTeam,
 		Origin:                            t.Origin,
@@ -422,7 +592,226 @@ func mapTicketToES(t itop.Ticket, holidays map[string]struct{}, debug bool) ESTi
 		TimeToResolve24BH:                 ttr24BH.Seconds(),
 		SLAComplianceResponse24BH:         slaComplianceResponse24BH,
 		SLAComplianceResolve24BH:          slaComplianceResolve24BH,
+		TimePausedRaw:                     pausedRaw.Seconds(),
+		TimePausedBusinessHr:              pausedBH.Seconds(),
+		TimePaused24BH:                    paused24BH.Seconds(),
+		AgeRaw:                            ageRaw.Seconds(),
+		AgeBusinessHr:                     ageBH.Seconds(),
+		Age24BH:                           age24BH.Seconds(),
+		TTORemainingSeconds:               ttoRemaining,
+		TTRRemainingSeconds:               ttrRemaining,
+		ITopTTODeadline:                   toESDate(t.TTODeadline, loc),
+		ITopTTRDeadline:                   toESDate(t.TTRDeadline, loc),
+		ITopSLATTOPassed:                  itopFlag(t.SLATTOPassed),
+		ITopSLATTRPassed:                  itopFlag(t.SLATTRPassed),
+		ITopSLATTOOver:                    t.SLATTOOver.Seconds(),
+		ITopSLATTROver:                    t.SLATTROver.Seconds(),
+		SLAComplianceResponseITop:         itopCompliance(t.SLATTOPassed, !t.AssignmentDate.IsZero()),
+		SLAComplianceResolveITop:          itopCompliance(t.SLATTRPassed, !t.ResolutionDate.IsZero()),
+		Extra:                             t.Extra,
+		Problem:                           mapProblem(t.Problem),
+		Change:                            mapChange(t.Change, loc),
+		OrgID:                             t.OrgID,
+		OrgName:                           t.OrgName,
+		Timezone:                          ticketLoc.String(),
+		Source:                            s.cfg.Source,
+		CloseDate:                         toESDate(t.CloseDate, loc),
+		ResolutionCode:                    t.ResolutionCode,
+		Solution:                          s.solutionText(t.Solution),
+		UserSatisfaction:                  t.UserSatisfaction,
+		RequestType:                       t.RequestType,
+	}
+	if t.CIs != nil {
+		n := len(t.CIs)
+		doc.CICount = &n
+		for _, ci := range t.CIs {
+			doc.CIIDs = append(doc.CIIDs, ci.ID)
+			doc.CINames = append(doc.CINames, ci.Name)
+		}
+	}
+	if s.cfg.SLA.TrackReopens {
+		n, last := reopens(t.StatusHistory)
+		doc.ReopenCount = &n
+		doc.LastReopenDate = toESDate(last, loc)
+	}
+	if s.cfg.SLA.TrackReassignments {
+		agents, teams, total, path := reassignments(t.AgentHistory, t.TeamHistory, t.Team)
+		hops := max(len(path)-1, 0)
+		doc.AgentChangeCount, doc.TeamChangeCount, doc.ReassignmentCount = &agents, &teams, &total
+		doc.TeamPath, doc.TeamHops = path, &hops
+		if !t.ResolutionDate.IsZero() {
+			first, unescalated := agents == 0 && teams == 0, teams == 0
+			doc.FirstAssignmentResolution, doc.ResolvedWithoutEscalation = &first, &unescalated
+		}
+	}
+	if s.cfg.ITop.Escalation && itop.IsSupportTicket(t.Class) {
+		tto := escalated(t.TTOEscalationDeadline, t.AssignmentDate, now)
+		ttr := escalated(t.TTREscalationDeadline, t.ResolutionDate, now)
+		flagged := t.EscalationFlag || tto || ttr
+		doc.TTOEscalationDeadline = toESDate(t.TTOEscalationDeadline, loc)
+		doc.TTREscalationDeadline = toESDate(t.TTREscalationDeadline, loc)
+		doc.TTOEscalated, doc.TTREscalated, doc.Escalated = &tto, &ttr, &flagged
+		doc.EscalationReason = t.EscalationReason
+		if doc.ResolvedWithoutEscalation != nil && flagged {
+			*doc.ResolvedWithoutEscalation = false
+		}
+	}
+	if l := t.Links; l != nil {
+		n := len(l.Children)
+		doc.ParentRequestRef, doc.ParentIncidentRef = l.ParentRequest, l.ParentIncident
+		doc.ParentProblemRef, doc.ParentChangeRef = l.ParentProblem, l.ParentChange
+		doc.RelatedTicketRefs, doc.ChildCount = l.Children, &n
+	}
+	if !t.CloseDate.IsZero() && !t.StartDate.IsZero() {
+		doc.TimeToCloseRaw = t.CloseDate.Sub(t.StartDate).Seconds()
+		doc.TimeToCloseBusinessHr = businessDuration(t.StartDate, t.CloseDate).Seconds()
+		doc.TimeToClose24BH = duration24BH(t.StartDate, t.CloseDate).Seconds()
+	}
+	if pl := t.PublicLog; pl != nil {
+		n := pl.Entries
+		doc.PublicLogCount = &n
+		doc.LastCustomerUpdate = toESDate(pl.LastCustomerUpdate, loc)
+		doc.LastAgentUpdate = toESDate(pl.LastAgentUpdate, loc)
+		doc.FirstResponseDate = toESDate(pl.FirstResponse, loc)
+		if !pl.FirstResponse.IsZero() && !t.StartDate.IsZero() {
+			raw := pl.FirstResponse.Sub(t.StartDate).Seconds()
+			bh := businessDuration(t.StartDate, pl.FirstResponse).Seconds()
+			bh24 := duration24BH(t.StartDate, pl.FirstResponse).Seconds()
+			doc.TimeToFirstResponseRaw, doc.TimeToFirstResponseBusiness, doc.TimeToFirstResponse24BH = &raw, &bh, &bh24
+		}
+	}
+	doc.ContentHash = contentHash(doc)
+	return doc
+}
+
+// ESProblem are the problem management fields of a Problem document
+type ESProblem struct {
+	RelatedIncidents     []string `json:"related_incidents"`
+	RelatedIncidentCount int      `json:"related_incident_count"`
+	RelatedRequests      []string `json:"related_requests"`
+	RelatedRequestCount  int      `json:"related_request_count"`
+	RelatedChange        string   `json:"related_change,omitempty"`
+	KnownErrorCount      int      `json:"known_error_count"`
+	Workaround           string   `json:"workaround,omitempty" es:"text"`
+	RootCause            string   `json:"root_cause,omitempty" es:"text"`
+	HasWorkaround        bool     `json:"has_workaround"`
+}
+
+func mapProblem(p *itop.ProblemDetails) *ESProblem {
+	if p == nil {
+		return nil
+	}
+	return &ESProblem{
+		RelatedIncidents:     p.RelatedIncidents,
+		RelatedIncidentCount: len(p.RelatedIncidents),
+		RelatedRequests:      p.RelatedRequests,
+		RelatedRequestCount:  len(p.RelatedRequests),
+		RelatedChange:        p.RelatedChange,
+		KnownErrorCount:      p.KnownErrors,
+		Workaround:           p.Workaround,
+		RootCause:            p.RootCause,
+		HasWorkaround:        p.Workaround != "",
+	}
+}
+
+// ESChange are the change management fields of a Change document
+type ESChange struct {
+	CreationDate   *time.Time `json:"creation_date,omitempty"`
+	PlannedStart   *time.Time `json:"planned_start_date,omitempty"`
+	PlannedEnd     *time.Time `json:"planned_end_date,omitempty"`
+	ActualStart    *time.Time `json:"actual_start_date,omitempty"`
+	ActualEnd      *time.Time `json:"actual_end_date,omitempty"`
+	ApprovalDate   *time.Time `json:"approval_date,omitempty"`
+	AcceptanceDate *time.Time `json:"acceptance_date,omitempty"`
+	Outage         bool       `json:"outage"`
+}
+
+func mapChange(c *itop.ChangeDetails, loc *time.Location) *ESChange {
+	if c == nil {
+		return nil
+	}
+	return &ESChange{
+		CreationDate:   toESDate(c.CreationDate, loc),
+		PlannedStart:   toESDate(c.PlannedStart, loc),
+		PlannedEnd:     toESDate(c.PlannedEnd, loc),
+		ActualStart:    toESDate(c.ActualStart, loc),
+		ActualEnd:      toESDate(c.ActualEnd, loc),
+		ApprovalDate:   toESDate(c.ApprovalDate, loc),
+		AcceptanceDate: toESDate(c.AcceptanceDate, loc),
+		Outage:         c.Outage,
+	}
+}
+
+// solutionText applies itop.solution_strip_html and
+// itop.solution_max_length to a ticket's solution
+func (s *syncer) solutionText(solution string) string {
+	if s.cfg.ITop.SolutionStripHTML {
+		solution = stripHTML(solution)
+	}
+	if limit := s.cfg.ITop.SolutionMaxLength; limit > 0 {
+		if r := []rune(solution); len(r) > limit {
+			solution = string(r[:limit])
+		}
+	}
+	return solution
+}
+
+var (
+	htmlBreak = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|tr|h[1-6])>`)
+	htmlTag   = regexp.MustCompile(`<[^>]*>`)
+	blankRuns = regexp.MustCompile(`[ \t]+`)
+	blankLine = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// stripHTML turns the HTML of iTop rich text fields into plain text, one
+// line per paragraph
+func stripHTML(s string) string {
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+	s = blankRuns.ReplaceAllString(strings.ReplaceAll(s, "\u00a0", " "), " ")
+	return strings.TrimSpace(blankLine.ReplaceAllString(s, "\n"))
+}
+
+// escalated tells whether a metric passed its escalation deadline: before
+// it stopped, or by now while it runs
+func escalated(deadline, stopped, now time.Time) bool {
+	if deadline.IsZero() {
+		return false
 	}
+	if stopped.IsZero() {
+		return now.After(deadline)
+	}
+	return stopped.After(deadline)
+}
+
+// toESDate applies the same timezone shift as start_date & co, nil for zero times
+func toESDate(t time.Time, loc *time.Location) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	v := t.In(loc).Add(-7 * time.Hour)
+	return &v
+}
+
+// itopFlag interprets iTop boolean attributes ("1"/"yes"/"true")
+func itopFlag(v string) bool {
+	switch strings.ToLower(v) {
+	case "1", "yes", "true":
+		return true
+	}
+	return false
+}
+
+// itopCompliance derives comply/overdue from iTop's sla_*_passed flag; a
+// metric still running and not yet passed has no verdict
+func itopCompliance(passed string, stopped bool) string {
+	if itopFlag(passed) {
+		return "overdue"
+	}
+	if stopped {
+		return "comply"
+	}
+	return ""
 }
 
 func priorityLabel(id string) string {
@@ -468,79 +857,67 @@ func impactLabel(id string) string {
 	}
 }
 
-func compareESTicket(a, b ESTicket) bool {
-	aj, _ := json.Marshal(a)
-	bj, _ := json.Marshal(b)
-	return bytes.Equal(aj, bj)
-}
-
-func fetchAllESTickets(conf ESConfig) []ESTicket {
-	// Simple: fetch all (assume <10k)
-	url := conf.URL + "/" + conf.Index + "/_search?size=10000"
-	req, _ := http.NewRequest("GET", url, nil)
-	if conf.Username != "" {
-		req.SetBasicAuth(conf.Username, conf.Password)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("Failed to fetch from ES: %v", err)
-		return nil
+// clockFields are the fields of an open ticket that change with time alone;
+// they are refreshed by ageFields updates rather than through content_hash
+var clockFields = []string{"age_raw", "age_business_hour", "age_24bh", "tto_remaining_seconds", "ttr_remaining_seconds"}
+
+// riskFields may turn "at_risk" with time alone
+var riskFields = []string{"sla_compliance_resolve_raw", "sla_compliance_resolve_bussiness_hour", "sla_compliance_resolve_24bh"}
+
+// contentHash is a sha1 of the document as canonical JSON (sorted keys,
+// content_hash, clockFields and at_risk flags left out), stable across field
+// order and mapping changes
+func contentHash(doc ESTicket) string {
+	doc.ContentHash = ""
+	data, _ := json.Marshal(doc)
+	var canonical map[string]interface{}
+	json.Unmarshal(data, &canonical)
+	for _, f := range clockFields {
+		delete(canonical, f)
+	}
+	for _, f := range riskFields {
+		if canonical[f] == "at_risk" {
+			canonical[f] = ""
+		}
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	var result struct {
-		Hits struct {
-			Hits []struct {
-				Source ESTicket `json:"_source"`
-			} `json:"hits"`
-		} `json:"hits"`
-	}
-	_ = json.Unmarshal(body, &result)
-	var out []ESTicket
-	for _, h := range result.Hits.Hits {
-		out = append(out, h.Source)
-	}
-	return out
+	data, _ = json.Marshal(canonical)
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
 }
 
-func upsertESTicket(conf ESConfig, t ESTicket) {
-	// Use hash as _id
-	id := hashTicketKey(t.ID, t.Ref, t.Class)
-	url := conf.URL + "/" + conf.Index + "/_doc/" + id
-	data, _ := json.Marshal(t)
-	req, _ := http.NewRequest("PUT", url, bytes.NewReader(data))
-	if conf.Username != "" {
-		req.SetBasicAuth(conf.Username, conf.Password)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("Failed to upsert ES: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Printf("ES upsert error: %s", string(body))
+// ageFields is the partial update refreshing the clockFields and at_risk
+// flags of an open ticket
+func ageFields(doc ESTicket) map[string]interface{} {
+	return map[string]interface{}{
+		"age_raw":                               doc.AgeRaw,
+		"age_business_hour":                     doc.AgeBusinessHr,
+		"age_24bh":                              doc.Age24BH,
+		"tto_remaining_seconds":                 doc.TTORemainingSeconds,
+		"ttr_remaining_seconds":                 doc.TTRRemainingSeconds,
+		"sla_compliance_resolve_raw":            doc.SLAComplianceResolveRaw,
+		"sla_compliance_resolve_bussiness_hour": doc.SLAComplianceResolveBusinessHour,
+		"sla_compliance_resolve_24bh":           doc.SLAComplianceResolve24BH,
 	}
 }
 
-func deleteESTicket(conf ESConfig, t ESTicket) {
-	id := hashTicketKey(t.ID, t.Ref, t.Class)
-	url := conf.URL + "/" + conf.Index + "/_doc/" + id
-	req, _ := http.NewRequest("DELETE", url, nil)
-	if conf.Username != "" {
-		req.SetBasicAuth(conf.Username, conf.Password)
-	}
-	resp, err := http.DefaultClient.Do(req)
+// fetchAllESTickets reads the identity, routing fields, soft-delete flag and
+// content hash of every document; the rest of _source is not needed to detect changes
+func fetchAllESTickets(client *es.Client) ([]ESTicket, error) {
+	// Read the whole index page by page (scroll), not just the first 10k hits
+	hits, err := client.ScrollAll(1000, "id", "ref", "class", "start_date", "deleted", "content_hash",
+		"status", "agent_id_friendlyname", "team_id_friendlyname")
 	if err != nil {
-		log.Printf("Failed to delete ES: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 && resp.StatusCode != 404 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Printf("ES delete error: %s", string(body))
+		return nil, err
+	}
+	out := make([]ESTicket, 0, len(hits))
+	for _, h := range hits {
+		var t ESTicket
+		if err := json.Unmarshal(h.Source, &t); err != nil {
+			slog.Warn("Failed to decode ES document", "id", h.ID, "err", err)
+			continue
+		}
+		t.index = h.Index
+		out = append(out, t)
 	}
+	return out, nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
+)
+
+// mirrorWriter writes to the primary sink and mirrors every operation to a
+// secondary one: the secondary cluster (elastic_secondary) or PostgreSQL
+// (output.postgres.alongside). Only the primary's errors are returned: a
+// failing secondary is logged and catches up through its own retries (and,
+// for Elasticsearch, circuit breaker and queue), with metrics under its own
+// target. Change detection follows the primary, so a new secondary must be
+// seeded first (e.g. with a _reindex from remote).
+type mirrorWriter struct {
+	primary   sink
+	secondary sink
+	name      string // of the secondary, in logs
+
+	primaryIndex   string // elastic.index
+	secondaryIndex string // elastic_secondary.index, empty to keep indices
+}
+
+// newMirrorWriter wraps the primary writer with the configured secondaries:
+// the secondary cluster, whose template is bootstrapped, then PostgreSQL
+func newMirrorWriter(cfg *config.Config, primary sink) (sink, error) {
+	w := primary
+	if conf, ok := cfg.Secondary(); ok {
+		client, err := es.NewClient(conf, cfg.Retry)
+		if err != nil {
+			return nil, err
+		}
+		client.SetTarget("es_secondary")
+		bootstrapTemplate(cfg, client)
+		bw, err := es.NewBulkWriter(client)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Mirroring writes to the secondary Elasticsearch cluster", "url", conf.URL, "index", conf.Index)
+		w = &mirrorWriter{primary: w, secondary: &esSink{BulkWriter: bw, client: client}, name: "Secondary Elasticsearch",
+			primaryIndex: cfg.Elastic.Index, secondaryIndex: conf.Index}
+	}
+	if cfg.Output.Postgres.Alongside {
+		ps, err := newPostgresSink(cfg.Output.Postgres, cfg.Retry)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Mirroring writes to PostgreSQL", "host", cfg.Output.Postgres.Host, "table", cfg.Output.Postgres.Table)
+		w = &mirrorWriter{primary: w, secondary: ps, name: "PostgreSQL"}
+	}
+	return w, nil
+}
+
+// index maps a primary index to the secondary's
+func (w *mirrorWriter) index(index string) string {
+	if w.secondaryIndex != "" && (index == "" || index == w.primaryIndex) {
+		return w.secondaryIndex
+	}
+	return index
+}
+
+func (w *mirrorWriter) Upsert(index, id string, doc interface{}) error {
+	w.failed("upsert", w.secondary.Upsert(w.index(index), id, doc))
+	return w.primary.Upsert(index, id, doc)
+}
+
+func (w *mirrorWriter) Update(index, id string, partial interface{}) error {
+	w.failed("update", w.secondary.Update(w.index(index), id, partial))
+	return w.primary.Update(index, id, partial)
+}
+
+func (w *mirrorWriter) Delete(index, id string) error {
+	w.failed("delete", w.secondary.Delete(w.index(index), id))
+	return w.primary.Delete(index, id)
+}
+
+// List reads the primary cluster
+func (w *mirrorWriter) List() ([]ESTicket, error) {
+	return w.primary.List()
+}
+
+// Flush flushes both sinks concurrently and returns the primary's result
+func (w *mirrorWriter) Flush() (es.BulkResult, error) {
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.secondary.Flush()
+		done <- err
+	}()
+	res, err := w.primary.Flush()
+	w.failed("flush", <-done)
+	return res, err
+}
+
+func (w *mirrorWriter) Close() error {
+	w.failed("close", w.secondary.Close())
+	return w.primary.Close()
+}
+
+// failed logs an error of the secondary
+func (w *mirrorWriter) failed(op string, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, es.ErrCircuitOpen):
+		slog.Warn(w.name+" unavailable, writes buffered until it recovers", "op", op, "err", err)
+	default:
+		slog.Error(w.name+" write failed", "op", op, "err", err)
+	}
+}
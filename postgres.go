@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
+	pg "itop-sla-exporter/internal/pg"
+)
+
+// maxStatements bounds the statements sent in one round trip
+const maxStatements = 500
+
+// postgresSink upserts tickets into a PostgreSQL table keyed by document id,
+// one column per ESTicket field; soft deletes update the deleted columns and
+// deletes remove the row. The table is created, and missing columns added,
+// at startup. Statements are buffered and sent on Flush, each batch in one
+// implicit transaction.
+type postgresSink struct {
+	client  *pg.Client
+	table   string // quoted
+	columns []pg.Column
+
+	mu      sync.Mutex
+	pending []pgStatement // sent on Flush
+}
+
+type pgStatement struct {
+	action string
+	sql    string
+}
+
+func newPostgresSink(conf config.PostgresConfig, retryConf config.RetryConfig) (*postgresSink, error) {
+	s := openPostgresSink(conf, retryConf)
+	if err := s.client.Migrate(conf.Table, s.columns); err != nil {
+		s.client.Close()
+		return nil, fmt.Errorf("migrate table %s: %w", conf.Table, err)
+	}
+	return s, nil
+}
+
+// openPostgresSink creates the sink without touching the schema
+func openPostgresSink(conf config.PostgresConfig, retryConf config.RetryConfig) *postgresSink {
+	return &postgresSink{
+		client:  pg.NewClient(conf, retryConf),
+		table:   pg.Ident(conf.Table),
+		columns: pg.Columns(reflect.TypeOf(ESTicket{})),
+	}
+}
+
+// Upsert writes every column, so fields the document omits are cleared
+func (s *postgresSink) Upsert(index, id string, doc interface{}) error {
+	fields, err := jsonFields(doc)
+	if err != nil {
+		return err
+	}
+	names := []string{`"doc_id"`}
+	values := []string{pg.Quote(id)}
+	var set []string
+	for _, col := range s.columns {
+		name := pg.Ident(col.Name)
+		names = append(names, name)
+		values = append(values, pg.Quote(fields[col.Name]))
+		set = append(set, name+" = EXCLUDED."+name)
+	}
+	s.add("upsert", fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (\"doc_id\") DO UPDATE SET %s",
+		s.table, strings.Join(names, ", "), strings.Join(values, ", "), strings.Join(set, ", ")))
+	return nil
+}
+
+// Update sets the known columns present in partial
+func (s *postgresSink) Update(index, id string, partial interface{}) error {
+	fields, err := jsonFields(partial)
+	if err != nil {
+		return err
+	}
+	var set []string
+	for _, col := range s.columns {
+		if v, ok := fields[col.Name]; ok {
+			set = append(set, pg.Ident(col.Name)+" = "+pg.Quote(v))
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	s.add("update", fmt.Sprintf("UPDATE %s SET %s WHERE \"doc_id\" = %s", s.table, strings.Join(set, ", "), pg.Quote(id)))
+	return nil
+}
+
+func (s *postgresSink) Delete(index, id string) error {
+	s.add("delete", fmt.Sprintf("DELETE FROM %s WHERE \"doc_id\" = %s", s.table, pg.Quote(id)))
+	return nil
+}
+
+func (s *postgresSink) add(action, sql string) {
+	s.mu.Lock()
+	s.pending = append(s.pending, pgStatement{action: action, sql: sql})
+	s.mu.Unlock()
+}
+
+// List reads the fields change detection needs from the table; a table
+// not created yet holds nothing
+func (s *postgresSink) List() ([]ESTicket, error) {
+	rows, err := s.client.Query(fmt.Sprintf(`SELECT json_build_object('id', "id", 'ref', "ref", 'class', "class", `+
+		`'start_date', "start_date", 'deleted', "deleted", 'content_hash', "content_hash", 'status', "status", `+
+		`'agent_id_friendlyname', "agent_id_friendlyname", 'team_id_friendlyname', "team_id_friendlyname") FROM %s`, s.table))
+	var pgErr *pg.Error
+	if errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ESTicket, 0, len(rows))
+	for _, row := range rows {
+		var t ESTicket
+		if err := json.Unmarshal([]byte(row[0]), &t); err != nil {
+			return nil, fmt.Errorf("decode row: %w", err)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// Flush sends the pending statements. After a connection failure they are
+// kept for the next flush; a batch the server rejects is dropped.
+func (s *postgresSink) Flush() (es.BulkResult, error) {
+	s.mu.Lock()
+	stmts := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	var res es.BulkResult
+	for len(stmts) > 0 {
+		batch := stmts[:min(len(stmts), maxStatements)]
+		sqls := make([]string, len(batch))
+		for i, st := range batch {
+			sqls[i] = st.sql
+		}
+		if _, err := s.client.Query(strings.Join(sqls, ";\n")); err != nil {
+			var pgErr *pg.Error
+			if errors.As(err, &pgErr) {
+				stmts = stmts[len(batch):]
+			}
+			s.mu.Lock()
+			s.pending = append(stmts, s.pending...)
+			s.mu.Unlock()
+			return res, err
+		}
+		for _, st := range batch {
+			switch st.action {
+			case "upsert":
+				res.Indexed++
+			case "update":
+				res.Updated++
+			case "delete":
+				res.Deleted++
+			}
+		}
+		stmts = stmts[len(batch):]
+	}
+	return res, nil
+}
+
+func (s *postgresSink) Close() error {
+	_, err := s.Flush()
+	if cerr := s.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// jsonFields decodes a document as its JSON fields
+func jsonFields(doc interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+)
+
+// watchConfig reloads the config file on SIGHUP, and when its modification
+// time changes if reload_interval is set, and hands the result to the run
+// loop. override re-applies the command line flags to each reloaded config.
+func (s *syncer) watchConfig(path string, override func(*config.Config)) {
+	path = config.Path(path)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	modTime := fileModTime(path)
+	interval, pipeline := s.cfg.ReloadInterval, s.cfg.Pipeline // s.cfg belongs to the run loop from now on
+	for {
+		var poll <-chan time.Time
+		if interval > 0 && path != "" {
+			poll = time.After(interval)
+		}
+		select {
+		case <-hup:
+			slog.Info("SIGHUP received, reloading the configuration", "file", path)
+		case <-poll:
+			if fileModTime(path).Equal(modTime) {
+				continue
+			}
+			slog.Info("Configuration file changed, reloading", "file", path)
+		}
+		modTime = fileModTime(path)
+		cfg, err := config.LoadPipeline(path, pipeline)
+		if err != nil {
+			slog.Error("Invalid configuration, keeping the current one", "file", path, "err", err)
+			continue
+		}
+		override(cfg)
+		interval = cfg.ReloadInterval
+		s.reloads <- cfg
+	}
+}
+
+func fileModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reload applies a reloaded configuration between cycles. The next cycle is
+// a full sync, so every ticket is re-evaluated against the new business
+// hours, holidays and SLA settings.
+func (s *syncer) reload(cfg *config.Config) {
+	schedule, err := cfg.BusinessHours.Schedule()
+	if err != nil {
+		s.log.Error("Invalid business hours, keeping the current configuration", "err", err)
+		return
+	}
+	restart := s.cfg.Reload(cfg)
+	s.schedule = schedule
+	s.calendar.reconfigure(s.cfg.Holidays)
+	if err := s.calendar.refresh(); err != nil {
+		s.log.Error("Failed to fetch holidays", "err", err)
+	}
+	s.lastFull = time.Time{}
+	s.log.Info("Configuration reloaded, the next cycle re-evaluates every ticket")
+	if len(restart) > 0 {
+		s.log.Warn("Changed settings need a restart to take effect", "sections", strings.Join(restart, ","))
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	itop "itop-sla-exporter/internal/itop"
+)
+
+// rollupDoc is a document of the SLA rollup index (elastic.rollups): the
+// tickets started in a day, week (from Monday) or month, overall or for one
+// team, service or priority. Compliance and means use business hours, like
+// the sla_compliance_*_bussiness_hour fields of the tickets.
+type rollupDoc struct {
+	SyncedAt    time.Time  `json:"synced_at"`
+	Period      string     `json:"period"` // day, week or month
+	PeriodStart *time.Time `json:"period_start"`
+	Dimension   string     `json:"dimension"` // all, team, service or priority
+	Value       string     `json:"value"`     // team, service or priority, empty for all
+
+	Tickets  int `json:"tickets"`
+	Resolved int `json:"resolved"`
+	Open     int `json:"open"`
+
+	TTOComply        int      `json:"tto_comply"`
+	TTOOverdue       int      `json:"tto_overdue"`
+	TTOCompliancePct *float64 `json:"tto_compliance_pct,omitempty"` // unset without measured tickets
+	TTRComply        int      `json:"ttr_comply"`
+	TTROverdue       int      `json:"ttr_overdue"`
+	TTRCompliancePct *float64 `json:"ttr_compliance_pct,omitempty"`
+
+	// Mean time to assign and to resolve, in seconds
+	MTTABusinessHr *float64 `json:"mtta_business_hour,omitempty"`
+	MTTRBusinessHr *float64 `json:"mttr_business_hour,omitempty"`
+	MTTARaw        *float64 `json:"mtta_raw,omitempty"`
+	MTTRRaw        *float64 `json:"mttr_raw,omitempty"`
+}
+
+// newRollupsSink creates the writer of the SLA rollup index, nil when
+// elastic.rollups is off
+func newRollupsSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.Rollups()
+	if !ok {
+		return nil, nil
+	}
+	if cfg.Shard.Enabled() {
+		return nil, fmt.Errorf("elastic.rollups: %w", errShardSummary)
+	}
+	return newSideSink(cfg, conf, "es_rollups", reflect.TypeOf(rollupDoc{}), writer)
+}
+
+// rollupKey identifies a rollup: a period, its first day and a dimension value
+type rollupKey struct {
+	period    string
+	start     time.Time
+	dimension string
+	value     string
+}
+
+// rollupTotals accumulates the tickets of a rollup
+type rollupTotals struct {
+	tickets, resolved                            int
+	ttoComply, ttoOverdue, ttrComply, ttrOverdue int
+	assigned                                     int
+	ttaBH, ttaRaw                                float64
+	ttrBH, ttrRaw                                float64
+}
+
+// rollupSet accumulates the rollups of a full sync, ticket by ticket
+type rollupSet struct {
+	loc    *time.Location
+	totals map[rollupKey]*rollupTotals
+}
+
+func newRollupSet(loc *time.Location) *rollupSet {
+	return &rollupSet{loc: loc, totals: make(map[rollupKey]*rollupTotals)}
+}
+
+// add counts a ticket in the rollups of its start_date; tickets without one
+// are left out
+func (r *rollupSet) add(t itop.Ticket, doc ESTicket) {
+	if t.StartDate.IsZero() {
+		return
+	}
+	y, m, d := t.StartDate.In(r.loc).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, r.loc)
+	starts := map[string]time.Time{
+		"day":   day,
+		"week":  day.AddDate(0, 0, -(int(day.Weekday())+6)%7),
+		"month": time.Date(y, m, 1, 0, 0, 0, 0, r.loc),
+	}
+	dimensions := map[string]string{"all": "", "team": doc.Team, "service": doc.ServiceName, "priority": doc.Priority}
+	for period, start := range starts {
+		for dimension, value := range dimensions {
+			if dimension != "all" && value == "" {
+				continue
+			}
+			k := rollupKey{period, start, dimension, value}
+			tot := r.totals[k]
+			if tot == nil {
+				tot = &rollupTotals{}
+				r.totals[k] = tot
+			}
+			tot.count(doc)
+		}
+	}
+}
+
+func (tot *rollupTotals) count(doc ESTicket) {
+	tot.tickets++
+	switch doc.SLAComplianceResponseBusinessHour {
+	case "comply":
+		tot.ttoComply++
+	case "overdue":
+		tot.ttoOverdue++
+	}
+	switch doc.SLAComplianceResolveBusinessHour {
+	case "comply":
+		tot.ttrComply++
+	case "overdue":
+		tot.ttrOverdue++
+	}
+	if doc.TimeToResponseRaw > 0 {
+		tot.assigned++
+		tot.ttaBH += doc.TimeToResponseBusinessHr
+		tot.ttaRaw += doc.TimeToResponseRaw
+	}
+	if doc.ResolutionDate != nil {
+		tot.resolved++
+		tot.ttrBH += doc.TimeToResolveBusinessHr
+		tot.ttrRaw += doc.TimeToResolveRaw
+	}
+}
+
+// doc renders the totals of a rollup
+func (tot *rollupTotals) doc(k rollupKey, now time.Time, loc *time.Location) rollupDoc {
+	return rollupDoc{
+		SyncedAt: now, Period: k.period, PeriodStart: toESDate(k.start, loc), Dimension: k.dimension, Value: k.value,
+		Tickets: tot.tickets, Resolved: tot.resolved, Open: tot.tickets - tot.resolved,
+		TTOComply: tot.ttoComply, TTOOverdue: tot.ttoOverdue, TTRComply: tot.ttrComply, TTROverdue: tot.ttrOverdue,
+		TTOCompliancePct: percent(tot.ttoComply, tot.ttoComply+tot.ttoOverdue),
+		TTRCompliancePct: percent(tot.ttrComply, tot.ttrComply+tot.ttrOverdue),
+		MTTABusinessHr:   mean(tot.ttaBH, tot.assigned),
+		MTTARaw:          mean(tot.ttaRaw, tot.assigned),
+		MTTRBusinessHr:   mean(tot.ttrBH, tot.resolved),
+		MTTRRaw:          mean(tot.ttrRaw, tot.resolved),
+	}
+}
+
+// percent is n/total in percent, nil when total is 0
+func percent(n, total int) *float64 {
+	if total == 0 {
+		return nil
+	}
+	v := float64(n) * 100 / float64(total)
+	return &v
+}
+
+// mean is sum/n, nil when n is 0
+func mean(sum float64, n int) *float64 {
+	if n == 0 {
+		return nil
+	}
+	v := sum / float64(n)
+	return &v
+}
+
+// writeRollups writes the rollups of a full sync, then removes those no
+// longer produced (periods without tickets left, renamed teams)
+func (s *syncer) writeRollups(r *rollupSet) {
+	now := time.Now().UTC()
+	for k, tot := range r.totals {
+		sum := sha1.Sum([]byte(k.value))
+		id := k.period + "-" + k.start.Format("2006-01-02") + "-" + k.dimension + "-" + hex.EncodeToString(sum[:6])
+		if err := s.rollups.Upsert("", id, tot.doc(k, now, s.loc)); err != nil {
+			s.log.Error("Failed to queue SLA rollup", "id", id, "err", err)
+			return
+		}
+	}
+	n, err := replaceSideDocs(s.rollups, now)
+	if err != nil {
+		s.log.Error("Failed to write SLA rollups", "err", err)
+		return
+	}
+	s.log.Info("Wrote SLA rollups", "rollups", len(r.totals), "removed", n)
+}
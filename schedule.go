@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	metrics "itop-sla-exporter/internal/metrics"
+)
+
+// nextWait is the time until the next cycle of a schedule running every
+// interval from start, plus up to sync.jitter. Cycles never overlap: the
+// runs a cycle longer than interval overran are skipped, not run back to
+// back.
+func (s *syncer) nextWait(start time.Time, interval time.Duration) time.Duration {
+	elapsed := time.Since(start)
+	wait := interval - elapsed
+	if wait < 0 {
+		missed := int(elapsed / interval)
+		metrics.CyclesSkipped.Add(float64(missed))
+		s.log.Warn("Sync cycle overran the interval, skipping the missed runs", "duration_ms", elapsed.Milliseconds(), "interval", interval.String(), "skipped", missed)
+		wait = interval - elapsed%interval
+	}
+	return wait + jitter(s.cfg.Sync.Jitter)
+}
+
+// jitter is a random duration in [0, max)
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	config "itop-sla-exporter/internal/config"
+	metrics "itop-sla-exporter/internal/metrics"
+)
+
+// routes are the endpoints of a syncer served next to the operational ones
+func (s *syncer) routes() map[string]http.Handler {
+	routes := map[string]http.Handler{
+		"/readyz":       s.readyHandler(),
+		"/sync/summary": s.summaryHandler(),
+		"/status":       s.statusHandler(),
+		"/ui":           s.uiHandler(),
+	}
+	// The admin endpoints change state: without a token they are not served
+	if s.cfg.HTTP.AdminToken != "" {
+		routes["/sync/full"] = s.fullSyncHandler()
+		routes["/sync/caches"] = s.cachesHandler()
+		routes["/sync/ticket/"] = s.adminHandler()
+		routes["/sync/slt-cache"] = s.sltCacheHandler()
+	}
+	if s.cfg.HTTP.WebhookEnabled {
+		routes["/hooks/itop"] = s.webhookHandler()
+	}
+	return routes
+}
+
+// startHTTPServer serves operational endpoints (metrics, health, ...) on
+// http.listen_addr, plus the given routes (admin, probes, webhook receiver)
+func startHTTPServer(conf config.HTTPConfig, routes map[string]http.Handler) {
+	addr := conf.ListenAddr
+	if addr == "" || addr == "off" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", healthHandler())
+	for pattern, h := range routes {
+		mux.Handle(pattern, h)
+	}
+	go func() {
+		slog.Info("HTTP server listening", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("HTTP server stopped", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// shadowDoc is what the syncer knows about a document in the ES index
+type shadowDoc struct {
+	Hash    string `json:"hash"`
+	ID      string `json:"id,omitempty"`
+	Ref     string `json:"ref,omitempty"`
+	Class   string `json:"class"`
+	Index   string `json:"index,omitempty"` // where the document lives (elastic.index may be templated)
+	Deleted bool   `json:"deleted,omitempty"`
+
+	// State compared by the history index (elastic.history)
+	Status string `json:"status,omitempty"`
+	Agent  string `json:"agent,omitempty"`
+	Team   string `json:"team,omitempty"`
+}
+
+// refreshShadow re-reads the ES index into the shadow state when it was never
+// read or sync.es_reconcile_interval has elapsed. A failed read keeps the
+// current shadow and is retried on the next full sync.
+func (s *syncer) refreshShadow() {
+	if !s.lastESRead.IsZero() && time.Since(s.lastESRead) < s.cfg.Sync.ESReconcileInterval {
+		s.summary.ESDocs = len(s.shadow)
+		return
+	}
+	defer s.summary.track("es_read", time.Now())
+	esTickets, err := s.writer.List()
+	if errors.Is(err, errNotListable) {
+		// Nothing to read back: the shadow only comes from this run (and the state file)
+		s.lastESRead = time.Now()
+		s.summary.ESDocs = len(s.shadow)
+		return
+	}
+	if err != nil {
+		s.log.Error("Failed to fetch from ES", "err", err)
+		s.summary.Errors++
+		s.summary.ESDocs = len(s.shadow)
+		return
+	}
+	shadow := make(map[string]shadowDoc, len(esTickets))
+	for _, t := range esTickets {
+		if !s.inShard(t.ID) {
+			// Kept up to date, and deleted, by the replica of its shard
+			continue
+		}
+		index := t.index
+		if s.cfg.Elastic.DataStream {
+			// Hits come from backing indices, snapshots are written to the stream
+			index = s.indexFor(t)
+		}
+		shadow[hashTicketKey(t.ID, t.Ref, t.Class)] = shadowDoc{Hash: t.ContentHash, ID: t.ID, Ref: t.Ref, Class: t.Class, Index: index, Deleted: t.Deleted,
+			Status: t.Status, Agent: t.Agent, Team: t.Team}
+	}
+	s.shadow = shadow
+	s.lastESRead = time.Now()
+	s.summary.ESDocs = len(shadow)
+}
+
+// remember records the hash of a document written to ES, and its change
+// in the history index
+func (s *syncer) remember(key string, doc ESTicket) {
+	old, known := s.shadow[key]
+	s.shadow[key] = shadowDoc{Hash: doc.ContentHash, ID: doc.ID, Ref: doc.Ref, Class: doc.Class, Index: s.indexFor(doc),
+		Status: doc.Status, Agent: doc.Agent, Team: doc.Team}
+	s.recordChange(key, old, known, doc)
+}
+
+// indexFor is the index (or data stream) a ticket is routed to
+func (s *syncer) indexFor(doc ESTicket) string {
+	var start time.Time
+	if doc.StartDate != nil {
+		start = *doc.StartDate
+	}
+	return s.es.IndexFor(doc.Class, start)
+}
+
+// forget records the deletion (or soft deletion) of a document
+func (s *syncer) forget(key string) {
+	s.recordDeletion(key, s.shadow[key])
+	if d, ok := s.shadow[key]; ok && s.softDeletes() {
+		d.Deleted = true
+		s.shadow[key] = d
+		return
+	}
+	delete(s.shadow, key)
+}
+
+// unchanged reports whether doc matches the last version written to ES
+func (s *syncer) unchanged(key string, doc ESTicket) bool {
+	d, ok := s.shadow[key]
+	return ok && !d.Deleted && d.Hash == doc.ContentHash
+}
+
+// activeDocs counts shadowed documents that are not soft-deleted
+func (s *syncer) activeDocs() int {
+	n := 0
+	for _, d := range s.shadow {
+		if !d.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// softDeletes reports whether orphans are marked deleted rather than removed;
+// always the case for append-only data streams (as tombstone snapshots)
+func (s *syncer) softDeletes() bool {
+	return s.cfg.Sync.SoftDelete || s.cfg.Elastic.DataStream
+}
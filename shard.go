@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+
+	itop "itop-sla-exporter/internal/itop"
+)
+
+var errOtherShard = errors.New("ticket belongs to another shard")
+
+// errShardSummary refuses the indexes summarizing every ticket when a
+// replica only sees its shard: shards would overwrite each other's documents
+// and remove them as stale
+var errShardSummary = errors.New("not supported with shard.total > 1")
+
+// inShard reports whether a ticket id belongs to this replica's shard
+// (shard.index), always true when the tickets are not split
+func (s *syncer) inShard(id string) bool {
+	if !s.cfg.Shard.Enabled() {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32()%uint32(s.cfg.Shard.Total)) == s.cfg.Shard.Index
+}
+
+// ownTickets keeps the tickets of this replica's shard, in place
+func (s *syncer) ownTickets(tickets []itop.Ticket) []itop.Ticket {
+	if !s.cfg.Shard.Enabled() {
+		return tickets
+	}
+	own := tickets[:0]
+	for _, t := range tickets {
+		if s.inShard(t.ID) {
+			own = append(own, t)
+		}
+	}
+	return own
+}
+
+// primaryShard reports whether this replica writes what isn't split by
+// ticket: the catalog and directory indexes, the soft-delete purge
+func (s *syncer) primaryShard() bool {
+	return s.cfg.Shard.Index == 0
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
+	kafka "itop-sla-exporter/internal/kafka"
+)
+
+// errNotListable is returned by List when a sink cannot read its documents
+// back (NDJSON on stdout, Kafka)
+var errNotListable = errors.New("sink cannot list its documents")
+
+// sink receives the upserts and deletes computed by a sync cycle
+type sink interface {
+	Upsert(index, id string, doc interface{}) error
+	Update(index, id string, partial interface{}) error
+	Delete(index, id string) error
+	// List returns the documents held by the sink, for change detection
+	// and orphan deletion
+	List() ([]ESTicket, error)
+	Flush() (es.BulkResult, error)
+	Close() error
+}
+
+// newSink creates the sink selected by output.type, or the dry-run writer
+func newSink(cfg *config.Config, esClient *es.Client) (sink, error) {
+	if cfg.Sync.DryRun {
+		w, err := newDryRunWriter(cfg.Sync.DryRunOutput, listerFor(cfg, esClient))
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	switch cfg.Output.Type {
+	case "ndjson":
+		s, err := newNDJSONSink(cfg.Output.File)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "kafka":
+		p, err := kafka.NewProducer(cfg.Output.Kafka, cfg.Retry)
+		if err != nil {
+			return nil, err
+		}
+		return &kafkaSink{producer: p}, nil
+	case "postgres":
+		s, err := newPostgresSink(cfg.Output.Postgres, cfg.Retry)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	// Bulk writer batches upserts/deletes into _bulk requests
+	w, err := es.NewBulkWriter(esClient)
+	if err != nil {
+		return nil, err
+	}
+	return newMirrorWriter(cfg, &esSink{BulkWriter: w, client: esClient})
+}
+
+// listerFor reads back the documents of the configured output
+func listerFor(cfg *config.Config, esClient *es.Client) func() ([]ESTicket, error) {
+	switch cfg.Output.Type {
+	case "ndjson":
+		return func() ([]ESTicket, error) { return readNDJSON(cfg.Output.File) }
+	case "kafka":
+		return func() ([]ESTicket, error) { return nil, errNotListable }
+	case "postgres":
+		return func() ([]ESTicket, error) {
+			s := openPostgresSink(cfg.Output.Postgres, cfg.Retry)
+			defer s.client.Close()
+			return s.List()
+		}
+	}
+	return func() ([]ESTicket, error) { return fetchAllESTickets(esClient) }
+}
+
+// esSink writes to Elasticsearch through the bulk writer
+type esSink struct {
+	*es.BulkWriter
+	client *es.Client
+}
+
+func (s *esSink) List() ([]ESTicket, error) {
+	return fetchAllESTickets(s.client)
+}
+
+// ndjsonOp is one line of the NDJSON output (and of the dry-run output)
+type ndjsonOp struct {
+	Action string          `json:"action"` // upsert, update or delete
+	Index  string          `json:"index"`
+	ID     string          `json:"id"`
+	Doc    json.RawMessage `json:"doc,omitempty"`
+}
+
+// ndjsonSink appends every operation as an NDJSON line to a file or stdout
+type ndjsonSink struct {
+	path string // empty for stdout
+
+	mu     sync.Mutex
+	out    io.WriteCloser
+	buf    *bufio.Writer
+	result es.BulkResult // operations since the last flush
+}
+
+func newNDJSONSink(path string) (*ndjsonSink, error) {
+	s := &ndjsonSink{path: path, out: os.Stdout}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open output file: %w", err)
+		}
+		s.out = f
+	}
+	s.buf = bufio.NewWriter(s.out)
+	return s, nil
+}
+
+func (s *ndjsonSink) Upsert(index, id string, doc interface{}) error {
+	return s.write("upsert", index, id, doc)
+}
+
+func (s *ndjsonSink) Update(index, id string, partial interface{}) error {
+	return s.write("update", index, id, partial)
+}
+
+func (s *ndjsonSink) Delete(index, id string) error {
+	return s.write("delete", index, id, nil)
+}
+
+func (s *ndjsonSink) write(action, index, id string, doc interface{}) error {
+	op := ndjsonOp{Action: action, Index: index, ID: id}
+	if doc != nil {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		op.Doc = data
+	}
+	line, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.buf.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	switch action {
+	case "upsert":
+		s.result.Indexed++
+	case "update":
+		s.result.Updated++
+	case "delete":
+		s.result.Deleted++
+	}
+	return nil
+}
+
+// List replays the output file: the last operation of each document wins
+func (s *ndjsonSink) List() ([]ESTicket, error) {
+	if err := s.flushBuffer(); err != nil {
+		return nil, err
+	}
+	return readNDJSON(s.path)
+}
+
+// Flush writes the buffered lines out
+func (s *ndjsonSink) Flush() (es.BulkResult, error) {
+	s.mu.Lock()
+	res := s.result
+	s.result = es.BulkResult{}
+	s.mu.Unlock()
+	return res, s.flushBuffer()
+}
+
+func (s *ndjsonSink) flushBuffer() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+func (s *ndjsonSink) Close() error {
+	if err := s.flushBuffer(); err != nil {
+		return err
+	}
+	if s.path == "" {
+		return nil
+	}
+	return s.out.Close()
+}
+
+// readNDJSON rebuilds the documents held by an NDJSON output file
+func readNDJSON(path string) ([]ESTicket, error) {
+	if path == "" {
+		return nil, errNotListable
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	docs := make(map[string]ESTicket)
+	var order []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var op ndjsonOp
+		if err := json.Unmarshal(sc.Bytes(), &op); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		switch op.Action {
+		case "delete":
+			delete(docs, op.ID)
+			continue
+		case "upsert":
+			docs[op.ID] = ESTicket{}
+			order = append(order, op.ID)
+		}
+		// Updates merge their fields into the document
+		t, ok := docs[op.ID]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(op.Doc, &t); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		t.index = op.Index
+		docs[op.ID] = t
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]ESTicket, 0, len(docs))
+	for _, id := range order {
+		if t, ok := docs[id]; ok {
+			out = append(out, t)
+			delete(docs, id) // once, however often it was upserted
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"time"
+
+	itop "itop-sla-exporter/internal/itop"
+)
+
+// period is a closed-open time range
+type period struct {
+	start, end time.Time
+}
+
+// historyEntry caches a ticket's status history until its last_update changes
+type historyEntry struct {
+	lastUpdate time.Time
+	changes    []itop.StatusChange
+	agents     []itop.StatusChange // agent ids (sla.track_reassignments)
+	teams      []itop.StatusChange // team names (sla.track_reassignments)
+}
+
+// loadStatusHistory fills StatusHistory on tickets when SLA pause or reopen
+// tracking is enabled, and AgentHistory and TeamHistory when reassignments
+// are tracked, only querying iTop for tickets changed since their history
+// was cached
+func (s *syncer) loadStatusHistory(tickets []itop.Ticket) {
+	status := s.cfg.SLA.PauseEnabled || s.cfg.SLA.TrackReopens
+	assignments := s.cfg.SLA.TrackReassignments
+	if !status && !assignments {
+		return
+	}
+	defer s.summary.track("fetch", time.Now())
+	stale := map[string][]string{}
+	for _, t := range tickets {
+		key := hashTicketKey(t.ID, t.Ref, t.Class)
+		entry, ok := s.historyCache[key]
+		if !ok || t.LastUpdate == nil || !entry.lastUpdate.Equal(*t.LastUpdate) {
+			stale[t.Class] = append(stale[t.Class], t.ID)
+		}
+	}
+	type classHistory struct {
+		status, agents, teams map[string][]itop.StatusChange
+	}
+	fetched := map[string]classHistory{}
+	for class, ids := range stale {
+		var h classHistory
+		var err error
+		if status {
+			h.status, err = s.itop.FetchStatusHistory(class, ids)
+		}
+		if err == nil && assignments {
+			h.agents, h.teams, err = s.itop.FetchAssignmentHistory(class, ids)
+			if err == nil {
+				err = s.nameTeams(h.teams)
+			}
+		}
+		if err != nil {
+			s.log.Error("Failed to fetch status history", "class", class, "err", err)
+			s.summary.Errors++
+			continue
+		}
+		fetched[class] = h
+	}
+	for i := range tickets {
+		t := &tickets[i]
+		key := hashTicketKey(t.ID, t.Ref, t.Class)
+		if h, ok := fetched[t.Class]; ok {
+			entry := historyEntry{changes: h.status[t.ID], agents: h.agents[t.ID], teams: h.teams[t.ID]}
+			if t.LastUpdate != nil {
+				entry.lastUpdate = *t.LastUpdate
+			}
+			s.historyCache[key] = entry
+		}
+		entry := s.historyCache[key]
+		t.StatusHistory, t.AgentHistory, t.TeamHistory = entry.changes, entry.agents, entry.teams
+	}
+}
+
+// nameTeams replaces the team ids of team_id changes with the team names
+func (s *syncer) nameTeams(history map[string][]itop.StatusChange) error {
+	seen := map[string]bool{}
+	var ids []string
+	for _, changes := range history {
+		for _, ch := range changes {
+			for _, id := range []string{ch.From, ch.To} {
+				if id != "" && id != "0" && !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	names, err := s.itop.FetchTeamNames(ids)
+	if err != nil {
+		return err
+	}
+	name := func(id string) string {
+		if id == "" || id == "0" {
+			return ""
+		}
+		if n, ok := names[id]; ok {
+			return n
+		}
+		return id // team deleted since
+	}
+	for _, changes := range history {
+		for i := range changes {
+			changes[i].From, changes[i].To = name(changes[i].From), name(changes[i].To)
+		}
+	}
+	return nil
+}
+
+// reassignments counts the changes from one agent, or team, to another
+// (first assignments excluded), the reassignments changing both counting
+// once in total, and lists the teams a ticket went through, ending with team
+func reassignments(agents, teams []itop.StatusChange, team string) (agentChanges, teamChanges, total int, path []string) {
+	at := map[time.Time]bool{}
+	for _, ch := range agents {
+		if ch.From != "" && ch.From != "0" && ch.From != ch.To {
+			agentChanges++
+			at[ch.Date] = true
+		}
+	}
+	add := func(name string) {
+		if name != "" && (len(path) == 0 || path[len(path)-1] != name) {
+			path = append(path, name)
+		}
+	}
+	for _, ch := range teams {
+		if ch.From != "" && ch.From != ch.To {
+			teamChanges++
+			at[ch.Date] = true
+		}
+		add(ch.From)
+		add(ch.To)
+	}
+	if len(teams) == 0 {
+		add(team)
+	}
+	if path == nil {
+		path = []string{}
+	}
+	return agentChanges, teamChanges, len(at), path
+}
+
+// pruneStatusHistory drops the cached history of tickets not seen in a
+// complete full fetch
+func (s *syncer) pruneStatusHistory(seen map[string]bool) {
+	for key := range s.historyCache {
+		if !seen[key] {
+			delete(s.historyCache, key)
+		}
+	}
+}
+
+// reopens counts the transitions from resolved or closed back to another
+// status, and returns the date of the last one
+func reopens(history []itop.StatusChange) (int, time.Time) {
+	var count int
+	var last time.Time
+	for _, ch := range history {
+		if (ch.From == "resolved" || ch.From == "closed") && ch.To != "resolved" && ch.To != "closed" {
+			count++
+			last = ch.Date
+		}
+	}
+	return count, last
+}
+
+// pausePeriods returns the periods during which the ticket sat in one of the
+// pause statuses, the last one ending at until if still paused
+func pausePeriods(history []itop.StatusChange, statuses []string, until time.Time) []period {
+	paused := make(map[string]bool, len(statuses))
+	for _, st := range statuses {
+		paused[st] = true
+	}
+	var out []period
+	var pauseStart time.Time
+	for _, ch := range history {
+		switch {
+		case paused[ch.To] && pauseStart.IsZero():
+			pauseStart = ch.Date
+		case !paused[ch.To] && !pauseStart.IsZero():
+			out = append(out, period{pauseStart, ch.Date})
+			pauseStart = time.Time{}
+		}
+	}
+	if !pauseStart.IsZero() && until.After(pauseStart) {
+		out = append(out, period{pauseStart, until})
+	}
+	return out
+}
+
+// pausedDuration sums the part of the pauses inside [from, to) measured with durationFn
+func pausedDuration(pauses []period, from, to time.Time, durationFn func(a, b time.Time) time.Duration) time.Duration {
+	var total time.Duration
+	for _, p := range pauses {
+		a, b := p.start, p.end
+		if a.Before(from) {
+			a = from
+		}
+		if b.After(to) {
+			b = to
+		}
+		if b.After(a) {
+			total += durationFn(a, b)
+		}
+	}
+	return total
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+
+	itop "itop-sla-exporter/internal/itop"
+	state "itop-sla-exporter/internal/state"
+)
+
+// Sections of the state file (state.file)
+const (
+	stateCheckpoints = "checkpoints"
+	stateLastFull    = "last_full"
+	stateShadow      = "shadow"
+	stateESRead      = "es_read"
+	statePersonTeams = "person_teams"
+	stateSLT         = "slt"
+	stateBreaches    = "breaches"
+)
+
+// restoreState loads checkpoints, document hashes and the iTop caches saved
+// by a previous run, so a restart resumes incrementally with warm caches
+func (s *syncer) restoreState() error {
+	store, err := state.Open(s.cfg.State.File)
+	if err != nil {
+		return err
+	}
+	s.store = store
+	if _, err := store.Get(stateCheckpoints, &s.checkpoints); err != nil {
+		return err
+	}
+	if _, err := store.Get(stateLastFull, &s.lastFull); err != nil {
+		return err
+	}
+	if _, err := store.Get(stateShadow, &s.shadow); err != nil {
+		return err
+	}
+	if s.shadow == nil {
+		s.shadow = make(map[string]shadowDoc)
+	}
+	for key, d := range s.shadow {
+		// Saved before shard.total changed: left to the replica of its shard
+		if !s.inShard(d.ID) {
+			delete(s.shadow, key)
+		}
+	}
+	if _, err := store.Get(stateESRead, &s.lastESRead); err != nil {
+		return err
+	}
+	var teams map[string]itop.CachedTeams
+	if _, err := store.Get(statePersonTeams, &teams); err != nil {
+		return err
+	}
+	s.itop.RestoreTeamCache(teams)
+	var slt map[string]itop.SLTDeadline
+	if _, err := store.Get(stateSLT, &slt); err != nil {
+		return err
+	}
+	s.itop.RestoreSLTCache(slt)
+	found, err := store.Get(stateBreaches, &s.breaches)
+	if err != nil {
+		return err
+	}
+	if s.breaches == nil {
+		s.breaches = make(map[string][]string)
+	}
+	s.breachesReady = found
+	s.log.Info("Restored sync state", "file", s.cfg.State.File, "checkpoints", len(s.checkpoints), "documents", len(s.shadow), "person_teams", len(teams), "slt", len(slt))
+	return nil
+}
+
+// saveState persists the state after a cycle (never in dry-run); caches only
+// change meaningfully on full syncs so they are written then
+func (s *syncer) saveState(full bool) {
+	if s.store == nil || s.cfg.Sync.DryRun {
+		return
+	}
+	defer s.summary.track("write", time.Now())
+	puts := map[string]interface{}{
+		stateCheckpoints: s.checkpoints,
+		stateLastFull:    s.lastFull,
+		stateShadow:      s.shadow,
+		stateESRead:      s.lastESRead,
+		stateBreaches:    s.breaches,
+	}
+	if full {
+		puts[statePersonTeams] = s.itop.TeamCacheEntries()
+		puts[stateSLT] = s.itop.SLTCacheEntries()
+	}
+	for section, v := range puts {
+		if err := s.store.Put(section, v); err != nil {
+			s.log.Error("Failed to encode sync state", "section", section, "err", err)
+		}
+	}
+	if err := s.store.Save(); err != nil {
+		s.log.Error("Failed to save sync state", "file", s.cfg.State.File, "err", err)
+	}
+}
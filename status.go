@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// syncStatus is the state of the synchronizer served by GET /status,
+// published by the run loop after each cycle; PendingWrites and
+// QueuedResyncs are read when served
+type syncStatus struct {
+	UpdatedAt           time.Time            `json:"updated_at"`
+	LastSuccess         *time.Time           `json:"last_success"` // null until a cycle succeeds
+	LastFullSync        *time.Time           `json:"last_full_sync"`
+	ConsecutiveFailures int                  `json:"consecutive_failures"`
+	Tickets             map[string]int       `json:"tickets"` // documents per class, soft-deleted ones excluded
+	OpenTickets         int                  `json:"open_tickets"`
+	Checkpoints         map[string]time.Time `json:"checkpoints"` // last_update reached per class (incremental mode)
+	ErrorsTotal         int                  `json:"errors_total"`
+	PendingWrites       int                  `json:"pending_writes"` // operations queued for the output, not yet sent
+	QueuedResyncs       int                  `json:"queued_resyncs"` // webhook and admin re-syncs waiting for the run loop
+	LastCycle           *cycleSummary        `json:"last_cycle"`
+	Caches              map[string]int       `json:"caches"`          // entries per cache
+	ThrottleFactor      float64              `json:"throttle_factor"` // slowdown while iTop struggles, 1 at full speed
+}
+
+// publishStatus snapshots the state of the run loop for /status
+func (s *syncer) publishStatus() {
+	sum := s.lastSummary.Load()
+	st := &syncStatus{
+		UpdatedAt:           time.Now().UTC(),
+		ConsecutiveFailures: s.failedCycles,
+		Tickets:             map[string]int{},
+		OpenTickets:         len(s.openTickets),
+		Checkpoints:         make(map[string]time.Time, len(s.checkpoints)),
+		LastCycle:           sum,
+		ThrottleFactor:      s.throttle,
+		Caches: map[string]int{
+			"person_teams":   len(s.itop.TeamCacheEntries()),
+			"slt":            len(s.itop.SLTCacheEntries()),
+			"status_history": len(s.historyCache),
+		},
+	}
+	if prev := s.status.Load(); prev != nil {
+		st.ErrorsTotal = prev.ErrorsTotal
+	}
+	if sum != nil {
+		st.ErrorsTotal += sum.Errors
+	}
+	if ns := s.lastSuccess.Load(); ns != 0 {
+		t := time.Unix(0, ns).UTC()
+		st.LastSuccess = &t
+	}
+	if !s.lastFull.IsZero() {
+		t := s.lastFull.UTC()
+		st.LastFullSync = &t
+	}
+	for _, d := range s.shadow {
+		if !d.Deleted {
+			st.Tickets[d.Class]++
+		}
+	}
+	for class, t := range s.checkpoints {
+		st.Checkpoints[class] = t
+	}
+	s.status.Store(st)
+}
+
+// statusHandler serves GET /status with the state of the last cycle, for
+// dashboards and humans
+func (s *syncer) statusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		prev := s.status.Load()
+		if prev == nil {
+			http.Error(w, "no sync cycle finished yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.liveStatus(*prev))
+	})
+}
+
+// liveStatus completes a published status with the queue depths
+func (s *syncer) liveStatus(st syncStatus) syncStatus {
+	if p, ok := s.writer.(interface{ Pending() int }); ok {
+		st.PendingWrites = p.Pending()
+	}
+	st.QueuedResyncs = len(s.hooks)
+	return st
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	metrics "itop-sla-exporter/internal/metrics"
+)
+
+// cycleSummary collects the statistics of one sync cycle; the last finished
+// one is logged and served on /sync/summary
+type cycleSummary struct {
+	CycleID    int              `json:"cycle_id"`
+	Mode       string           `json:"mode"`
+	StartedAt  time.Time        `json:"started_at"`
+	DurationMS int64            `json:"duration_ms"`
+	Fetched    map[string]int   `json:"fetched"` // tickets per class
+	ESDocs     int              `json:"es_docs"` // documents read from ES (full sync)
+	Upserts    int              `json:"upserts"`
+	Skips      int              `json:"skips"`
+	Deletes    int              `json:"deletes"`
+	Errors     int              `json:"errors"`
+	PhasesMS   map[string]int64 `json:"phases_ms"` // fetch, es_read, map, write
+
+	phases map[string]time.Duration
+}
+
+func newCycleSummary(id int) *cycleSummary {
+	return &cycleSummary{
+		CycleID:   id,
+		StartedAt: time.Now(),
+		Fetched:   map[string]int{},
+		phases:    map[string]time.Duration{},
+	}
+}
+
+// track adds the time elapsed since start to a phase
+func (c *cycleSummary) track(phase string, start time.Time) {
+	c.phases[phase] += time.Since(start)
+}
+
+func (c *cycleSummary) finish() {
+	c.DurationMS = time.Since(c.StartedAt).Milliseconds()
+	c.PhasesMS = make(map[string]int64, len(c.phases))
+	for phase, d := range c.phases {
+		c.PhasesMS[phase] = d.Milliseconds()
+	}
+}
+
+// upsert queues a document and accounts for it in the cycle summary
+func (s *syncer) upsert(key string, doc ESTicket) {
+	defer s.summary.track("write", time.Now())
+	index := s.indexFor(doc)
+	if old, ok := s.shadow[key]; ok && old.Index != "" && old.Index != index && !s.cfg.Elastic.DataStream {
+		// The ticket now routes to another index: drop the stale copy
+		if err := s.writer.Delete(old.Index, key); err != nil {
+			s.log.Error("Failed to delete ES", "index", old.Index, "id", key, "err", err)
+		} else {
+			s.auditRemoval("delete", "relocated", key, old, fmt.Sprintf("index: %s → %s", old.Index, index))
+		}
+	}
+	if err := s.writer.Upsert(index, key, doc); err != nil {
+		s.log.Error("Failed to upsert ES", "id", key, "ticket_ref", doc.Ref, "err", err)
+		s.summary.Errors++
+		return
+	}
+	s.auditUpsert("sync", key, index, doc)
+	s.remember(key, doc)
+	s.summary.Upserts++
+	metrics.Upserts.Inc()
+}
+
+// upsertIfChanged skips documents identical to the last version written,
+// as known from the shadow state
+func (s *syncer) upsertIfChanged(key string, doc ESTicket) {
+	s.checkBreaches(key, doc)
+	if s.unchanged(key, doc) {
+		if s.refreshAges && doc.ResolutionDate == nil {
+			s.refreshAge(key, doc)
+		}
+		s.summary.Skips++
+		metrics.Skips.Inc()
+		return
+	}
+	s.upsert(key, doc)
+}
+
+// refreshAge writes the age fields of an unchanged open ticket. Only an ES
+// index merges a partial update into the document: data stream snapshots and
+// the other outputs (a compacted Kafka topic, NDJSON) must hold whole
+// documents, so there the document is sent again.
+func (s *syncer) refreshAge(key string, doc ESTicket) {
+	defer s.summary.track("write", time.Now())
+	var err error
+	if s.cfg.Output.Type == "elasticsearch" && !s.cfg.Elastic.DataStream {
+		err = s.writer.Update(s.indexFor(doc), key, ageFields(doc))
+	} else {
+		err = s.writer.Upsert(s.indexFor(doc), key, doc)
+	}
+	if err != nil {
+		s.log.Error("Failed to refresh ticket age", "id", key, "ticket_ref", doc.Ref, "err", err)
+		s.summary.Errors++
+	}
+}
+
+// remove deletes (or soft-deletes) a document and accounts for it in the cycle summary
+func (s *syncer) remove(key string, now time.Time) {
+	defer s.summary.track("write", time.Now())
+	d := s.shadow[key]
+	var err error
+	action := "delete"
+	if s.softDeletes() {
+		action = "soft_delete"
+		fields := map[string]interface{}{"deleted": true, "deleted_at": now}
+		if s.cfg.Elastic.DataStream {
+			// A tombstone snapshot must identify its ticket
+			fields["id"], fields["ref"], fields["class"] = d.ID, d.Ref, d.Class
+		}
+		err = s.writer.Update(d.Index, key, fields)
+	} else {
+		err = s.writer.Delete(d.Index, key)
+	}
+	if err != nil {
+		s.log.Error("Failed to delete ES", "id", key, "err", err)
+		s.summary.Errors++
+		return
+	}
+	s.auditRemoval(action, "orphan", key, d, "")
+	s.forget(key)
+	s.summary.Deletes++
+	metrics.Deletes.Inc()
+}
+
+// summaryHandler serves GET /sync/summary with the last finished cycle
+func (s *syncer) summaryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sum := s.lastSummary.Load()
+		if sum == nil {
+			http.Error(w, "no sync cycle finished yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sum)
+	})
+}
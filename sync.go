@@ -0,0 +1,646 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	es "itop-sla-exporter/internal/es"
+	itop "itop-sla-exporter/internal/itop"
+	metrics "itop-sla-exporter/internal/metrics"
+	notify "itop-sla-exporter/internal/notify"
+	state "itop-sla-exporter/internal/state"
+	utils "itop-sla-exporter/internal/utils"
+)
+
+// syncer holds the state carried between sync cycles
+type syncer struct {
+	cfg      *config.Config
+	loc      *time.Location
+	schedule utils.WeeklySchedule // global business hours
+	itop     *itop.ITopClient
+	es       *es.Client
+	writer   sink
+	events   sink // history index writer (elastic.history), nil when off
+	audit    sink // audit index writer (elastic.audit), nil when off
+	services sink // service catalog writer (elastic.services), nil when off
+	teams    sink // team writer (elastic.teams), nil when off
+	persons  sink // person writer (elastic.persons), nil when off
+	slts     sink // SLT definition writer (elastic.slt), nil when off
+
+	workOrders sink // work order writer (elastic.work_orders), nil when off
+	rollups    sink // SLA rollup writer (elastic.rollups), nil when off
+	backlog    sink // backlog snapshot writer (elastic.backlog), nil when off
+
+	lastBacklog time.Time // last backlog snapshot
+
+	// Incremental mode: only tickets with last_update >= checkpoint are fetched,
+	// with a full reconciliation (including deletes) every sync.full_interval
+	lastFull    time.Time
+	checkpoints map[string]time.Time
+	lastPurge   time.Time
+	tierRuns    map[string]time.Time // last run of each sync.tiers tier but the full one (lastFull)
+
+	// Open tickets' age fields are refreshed every sync.age_refresh_interval
+	lastAgeRefresh time.Time
+	refreshAges    bool // set during cycles due a refresh
+
+	historyCache map[string]historyEntry // SLA pause status history by ticket key
+	openTickets  map[string]itop.Ticket  // unresolved tickets, re-mapped by incremental cycles for age_* fields
+	hooks        chan syncRequest        // single-ticket re-syncs (webhook, admin endpoint)
+	fullSyncs    chan struct{}           // full syncs requested through POST /sync/full
+
+	cycleID     int
+	log         *slog.Logger                 // tagged with the current cycle_id
+	summary     *cycleSummary                // statistics of the running cycle
+	lastSummary atomic.Pointer[cycleSummary] // last finished cycle, read by /sync/summary
+
+	lastSuccess atomic.Int64 // unix nanos of the last cycle without fetch or write errors, read by /readyz
+
+	status atomic.Pointer[syncStatus] // published after each cycle, read by /status
+
+	// Shadow of the ES index (content hash of each document), kept up to date
+	// on write and re-read from ES every sync.es_reconcile_interval
+	shadow     map[string]shadowDoc
+	lastESRead time.Time
+
+	store *state.Store // persistent state (state.file), nil when disabled
+
+	calendar *holidayCalendar
+	holidays utils.Holidays // as of the last cycle, to notice changes
+
+	reloads chan *config.Config // reloaded configurations, applied by the run loop
+
+	// Breach notifications (notify.breaches): notifier is nil outside the
+	// run and once commands; breaches lists the compliances notified per
+	// ticket key, recorded without notifying until breachesReady
+	notifier      *notify.Notifier
+	breaches      map[string][]string
+	breachesReady bool
+
+	// Sync failure notifications (notify.failed_cycles, notify.error_rate)
+	failedCycles      int  // consecutive failed cycles, also reported by /status
+	failureNotified   bool // failed_cycles reached, until a cycle succeeds
+	errorRateNotified bool
+
+	// Leader election (leader.enabled), nil when off; leading is whether
+	// the last cycle ran as leader, so a takeover starts with a full sync
+	leader  *leaderElection
+	leading bool
+
+	throttle float64 // slowdown factor while iTop struggles (sync.throttle), 1 at full speed
+}
+
+func newSyncer(cfg *config.Config, itopClient *itop.ITopClient, esClient *es.Client) (*syncer, error) {
+	writer, err := newSink(cfg, esClient)
+	if err != nil {
+		return nil, err
+	}
+	events, err := newEventSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := newAuditSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	services, err := newServicesSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	teams, err := newTeamsSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	persons, err := newPersonsSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	slts, err := newSLTSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	workOrders, err := newWorkOrdersSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	rollups, err := newRollupsSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	backlog, err := newBacklogSink(cfg, writer)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := cfg.BusinessHours.Schedule()
+	if err != nil {
+		return nil, err
+	}
+	s := &syncer{
+		cfg:         cfg,
+		loc:         cfg.Location(),
+		schedule:    schedule,
+		itop:        itopClient,
+		es:          esClient,
+		writer:      writer,
+		events:      events,
+		audit:       audit,
+		services:    services,
+		teams:       teams,
+		persons:     persons,
+		slts:        slts,
+		workOrders:  workOrders,
+		rollups:     rollups,
+		backlog:     backlog,
+		checkpoints: make(map[string]time.Time),
+		tierRuns:    make(map[string]time.Time),
+		throttle:    1,
+		shadow:      make(map[string]shadowDoc),
+
+		historyCache: make(map[string]historyEntry),
+		openTickets:  make(map[string]itop.Ticket),
+		hooks:        make(chan syncRequest, 100),
+		fullSyncs:    make(chan struct{}, 1),
+		log:          pipelineLogger(cfg),
+		summary:      newCycleSummary(0),
+		calendar:     newHolidayCalendar(cfg.Holidays, itopClient, cfg.Location()),
+		reloads:      make(chan *config.Config, 1),
+		breaches:     make(map[string][]string),
+	}
+	if err := s.calendar.refresh(); err != nil {
+		slog.Error("Failed to fetch holidays", "err", err)
+	}
+	if cfg.State.File != "" {
+		if err := s.restoreState(); err != nil {
+			return nil, fmt.Errorf("state file: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// close flushes and closes the side sinks, then the ticket writer; history
+// and audit entries queued outside a cycle (backfill, recalculate) are only
+// written here, so a side sink failing to is logged
+func (s *syncer) close() error {
+	for _, side := range []struct {
+		name string
+		w    sink
+	}{
+		{"history", s.events}, {"audit", s.audit}, {"services", s.services}, {"teams", s.teams}, {"persons", s.persons},
+		{"slt", s.slts}, {"work_orders", s.workOrders}, {"rollups", s.rollups}, {"backlog", s.backlog},
+	} {
+		if side.w == nil || side.w == s.writer {
+			continue
+		}
+		if err := side.w.Close(); err != nil {
+			s.log.Error("Failed to write the last documents of a side index", "index", side.name, "err", err)
+		}
+	}
+	return s.writer.Close()
+}
+
+func (s *syncer) run() {
+	defer s.close()
+	for {
+		start := time.Now()
+		switch {
+		case s.isLeader():
+			if s.leader != nil && !s.leading {
+				// The previous leader may have written since our last cycle
+				s.leading, s.lastFull, s.lastESRead = true, time.Time{}, time.Time{}
+			}
+			s.cycle()
+		case s.leading:
+			s.leading = false
+			s.log.Info("Standing by, sync paused")
+		}
+		// log.Println("Sync complete at", time.Now().Format(time.RFC3339))
+		interval := s.cfg.Sync.Interval
+		if s.cfg.HTTP.WebhookEnabled {
+			// Webhooks deliver changes as they happen, polling only reconciles
+			interval = s.cfg.Sync.ReconcileInterval
+		}
+		wait := s.nextWait(start, s.throttled(interval))
+		if len(s.cfg.Sync.Tiers) > 0 {
+			wait = s.nextTier(time.Now()) + jitter(s.cfg.Sync.Jitter)
+		}
+		timer := time.NewTimer(wait)
+	wait:
+		for {
+			select {
+			case req := <-s.hooks:
+				s.handleSyncRequest(req)
+			case cfg := <-s.reloads:
+				s.reload(cfg)
+			case <-s.fullSyncs:
+				timer.Stop()
+				s.lastFull = time.Time{}
+				break wait
+			case <-timer.C:
+				break wait
+			}
+		}
+	}
+}
+
+// loadHolidays returns the current holidays (dates, ranges and half days)
+func (s *syncer) loadHolidays() utils.Holidays {
+	return s.calendar.Holidays()
+}
+
+func (s *syncer) cycle() {
+	s.cycleID++
+	s.log = pipelineLogger(s.cfg).With("cycle_id", s.cycleID)
+	sum := newCycleSummary(s.cycleID)
+	s.summary = sum
+	holidayMap := s.loadHolidays()
+	if s.holidays != nil && !reflect.DeepEqual(holidayMap, s.holidays) {
+		// Closed tickets are only re-mapped by a full sync
+		s.log.Info("Holidays changed, re-evaluating every ticket")
+		s.lastFull = time.Time{}
+	}
+	s.holidays = holidayMap
+
+	sum.Mode = "incremental"
+	defer func() {
+		sum.finish()
+		metrics.CycleDuration.Observe(float64(sum.DurationMS)/1000, sum.Mode)
+		s.log.Info("Sync cycle summary", "mode", sum.Mode, "duration_ms", sum.DurationMS, "fetched", sum.Fetched, "es_docs", sum.ESDocs,
+			"upserts", sum.Upserts, "skips", sum.Skips, "deletes", sum.Deletes, "errors", sum.Errors, "phases_ms", sum.PhasesMS)
+		s.lastSummary.Store(sum)
+		s.publishStatus()
+		// Writes outside a cycle (webhook, admin) must not touch the published summary
+		s.summary = newCycleSummary(s.cycleID)
+		s.refreshAges = false
+	}()
+	s.refreshAges = time.Since(s.lastAgeRefresh) >= s.cfg.Sync.AgeRefreshInterval
+	if s.refreshAges {
+		s.lastAgeRefresh = time.Now()
+	}
+	full := !s.cfg.Sync.Incremental || s.lastFull.IsZero() || time.Since(s.lastFull) >= s.cfg.Sync.FullInterval
+	var tiers []config.SyncTier
+	if len(s.cfg.Sync.Tiers) > 0 {
+		tiers, full = s.dueTiers(time.Now())
+	}
+	checkpoints := maps.Clone(s.checkpoints)
+	var ok bool
+	if full {
+		sum.Mode = "full"
+		ok = s.fullSync(holidayMap)
+		// A failed full sync is retried on the next cycle
+		if ok {
+			s.lastFull = time.Now()
+			// A full sync covers the other due tiers too
+			s.markTiers(tiers, s.lastFull)
+		}
+		if s.primaryShard() {
+			s.syncServices()
+			s.syncTeams()
+			s.syncPersons()
+			s.syncSLTs()
+			s.syncWorkOrders()
+		}
+	} else if len(s.cfg.Sync.Tiers) > 0 {
+		sum.Mode = "tier:" + tierNames(tiers)
+		ok = true
+		var done []config.SyncTier
+		for _, t := range tiers {
+			if s.syncTier(t, holidayMap) {
+				done = append(done, t)
+			} else {
+				ok = false
+			}
+		}
+		// Failed tiers stay due
+		s.markTiers(done, time.Now())
+	} else {
+		ok = s.incrementalSync(holidayMap)
+	}
+	s.breachesReady = true
+	s.snapshotBacklog()
+
+	flushStart := time.Now()
+	res, err := s.writer.Flush()
+	s.flushEvents()
+	s.flushAudit()
+	sum.track("write", flushStart)
+	sum.Errors += len(res.Errors)
+	if err == nil && ok {
+		s.lastSuccess.Store(time.Now().UnixNano())
+	}
+	s.checkSyncHealth(err == nil && ok, err, res)
+	s.adaptThrottle()
+	if err != nil || sum.Errors > 0 || res.Stale > 0 {
+		// Failed or refused writes leave the shadow out of step with ES: re-read it
+		s.lastESRead = time.Time{}
+		// and tickets that did not make it must be fetched again
+		s.checkpoints = checkpoints
+	}
+	s.saveState(full)
+	if errors.Is(err, es.ErrCircuitOpen) {
+		sum.Errors++
+		s.log.Warn("Elasticsearch unavailable, writes buffered until it recovers", "err", err)
+	} else if err != nil {
+		sum.Errors++
+		s.log.Error("ES bulk flush failed", "err", err)
+	} else if res.Indexed > 0 || res.Updated > 0 || res.Deleted > 0 || res.Stale > 0 {
+		s.log.Debug("ES bulk", "indexed", res.Indexed, "updated", res.Updated, "deleted", res.Deleted, "stale", res.Stale, "errors", len(res.Errors))
+	}
+}
+
+// fullSync compares every iTop ticket with the ES index, upserting changes and deleting orphans.
+// It reports whether every class was fetched successfully.
+func (s *syncer) fullSync(holidayMap utils.Holidays) bool {
+	// Compare with the shadow of the ES index, re-read every es_reconcile_interval
+	s.refreshShadow()
+	seen := make(map[string]bool, len(s.shadow))
+
+	// Sync tickets page by page as they arrive from iTop
+	var mapped []ESTicket
+	var rollups *rollupSet
+	if s.rollups != nil {
+		rollups = newRollupSet(s.loc)
+	}
+	_, failed := s.fetchTickets(false, func(page []itop.Ticket) {
+		s.loadStatusHistory(page)
+		docs := s.mapTickets(page, holidayMap)
+		for i, t := range page {
+			key := hashTicketKey(t.ID, t.Ref, t.Class)
+			s.trackOpen(key, t)
+			est := docs[i]
+			if rollups != nil {
+				rollups.add(t, est)
+			}
+			if s.cfg.Sync.ExporterMode {
+				mapped = append(mapped, est)
+			}
+			// Compare content hashes, if not exist or different, upsert
+			// (a soft-deleted document that reappears in iTop is rewritten too)
+			s.upsertIfChanged(key, est)
+			seen[key] = true
+		}
+	})
+	if len(failed) == 0 {
+		// Forget tickets gone from iTop (or out of itop.oql)
+		for key := range s.openTickets {
+			if !seen[key] {
+				delete(s.openTickets, key)
+			}
+		}
+		s.pruneStatusHistory(seen)
+		s.pruneBreaches(seen)
+		if rollups != nil {
+			// Partial rollups would replace complete ones
+			s.writeRollups(rollups)
+		}
+	}
+	// Delete tickets in ES that no longer exist in iTop. Classes whose fetch
+	// failed are skipped so a transient iTop outage can't wipe the index.
+	for class := range failed {
+		s.log.Warn("Skipping deletes: fetch from iTop failed", "class", class)
+	}
+	var orphans []string
+	for key, d := range s.shadow {
+		if _, ok := failed[d.Class]; ok || d.Deleted || seen[key] {
+			continue
+		}
+		orphans = append(orphans, key)
+	}
+	if s.deleteAllowed(len(orphans), s.activeDocs()) {
+		now := time.Now().UTC()
+		for _, key := range orphans {
+			delete(s.openTickets, key)
+			s.remove(key, now)
+		}
+	}
+	// Data stream snapshots are removed by the lifecycle policy instead
+	if s.cfg.Sync.SoftDelete && !s.cfg.Elastic.DataStream && s.cfg.Output.Type == "elasticsearch" && s.cfg.Sync.PurgeAfterDays > 0 && s.primaryShard() && time.Since(s.lastPurge) >= time.Hour {
+		s.purgeSoftDeleted()
+		s.lastPurge = time.Now()
+	}
+	if s.cfg.Sync.ExporterMode {
+		exportSLAMetrics(mapped)
+	}
+	return len(failed) == 0
+}
+
+// purgeSoftDeleted removes documents soft-deleted more than purge_after_days ago
+func (s *syncer) purgeSoftDeleted() {
+	if s.cfg.Sync.DryRun {
+		s.log.Info("[dry-run] would purge soft-deleted documents", "purge_after_days", s.cfg.Sync.PurgeAfterDays)
+		return
+	}
+	query := map[string]interface{}{
+		"range": map[string]interface{}{
+			"deleted_at": map[string]interface{}{"lt": fmt.Sprintf("now-%dd", s.cfg.Sync.PurgeAfterDays)},
+		},
+	}
+	n, err := s.es.DeleteByQuery(query)
+	if err != nil {
+		s.log.Error("Failed to purge soft-deleted documents", "err", err)
+		return
+	}
+	if n > 0 && s.audit != nil {
+		s.queueAudit(auditEntry{Trigger: "sync", Action: "purge", Reason: "expired", Count: n,
+			Diff: fmt.Sprintf("deleted_at older than %d days", s.cfg.Sync.PurgeAfterDays)})
+	}
+	if n > 0 {
+		s.log.Info("Purged soft-deleted documents", "count", n, "purge_after_days", s.cfg.Sync.PurgeAfterDays)
+	}
+}
+
+// deleteAllowed applies the max delete ratio guard rail against misconfigured
+// OQL queries or empty iTop responses
+func (s *syncer) deleteAllowed(toDelete, total int) bool {
+	if toDelete == 0 || total == 0 {
+		return true
+	}
+	ratio := float64(toDelete) / float64(total)
+	if ratio <= s.cfg.Sync.MaxDeleteRatio {
+		return true
+	}
+	if s.cfg.Sync.ForceDeletes {
+		s.log.Warn("Deleting ES documents above max_delete_ratio (forced)", "deletes", toDelete, "total", total, "ratio", ratio)
+		return true
+	}
+	s.log.Error("Refusing to delete ES documents above max_delete_ratio; set FORCE_DELETES=true to override", "deletes", toDelete, "total", total, "ratio", ratio, "max_delete_ratio", s.cfg.Sync.MaxDeleteRatio)
+	metrics.DeletesBlocked.Inc()
+	return false
+}
+
+// incrementalSync upserts only tickets changed since the last checkpoint; deletes are left to fullSync.
+// It reports whether every class was fetched successfully.
+func (s *syncer) incrementalSync(holidayMap utils.Holidays) bool {
+	tickets, failed := s.fetchTickets(true, nil)
+	s.loadStatusHistory(tickets)
+	changed := make(map[string]struct{}, len(tickets))
+	for _, t := range tickets {
+		key := hashTicketKey(t.ID, t.Ref, t.Class)
+		changed[key] = struct{}{}
+		s.trackOpen(key, t)
+	}
+	// Unchanged open tickets are re-mapped too when their age_* fields are due
+	for key, t := range s.openTickets {
+		if _, ok := changed[key]; !ok && s.refreshAges {
+			tickets = append(tickets, t)
+		}
+	}
+	for i, doc := range s.mapTickets(tickets, holidayMap) {
+		t := tickets[i]
+		s.upsertIfChanged(hashTicketKey(t.ID, t.Ref, t.Class), doc)
+	}
+	return len(failed) == 0
+}
+
+// mapTickets maps tickets on sync.workers goroutines once the callers' teams
+// are prefetched in bulk; remaining lookups share the iTop client's rate
+// limiter. Results keep the input order.
+func (s *syncer) mapTickets(tickets []itop.Ticket, holidays utils.Holidays) []ESTicket {
+	defer s.summary.track("map", time.Now())
+	callers := make([]itop.PersonRef, 0, len(tickets))
+	for _, t := range tickets {
+		callers = append(callers, t.CallerRef())
+	}
+	if err := s.itop.PrefetchPersonTeams(callers); err != nil {
+		// Workers fall back to one lookup per caller
+		s.log.Warn("Failed to prefetch caller teams", "err", err)
+	}
+	docs := make([]ESTicket, len(tickets))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < s.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				docs[i] = s.mapTicketToES(tickets[i], holidays)
+			}
+		}()
+	}
+	for i := range tickets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return docs
+}
+
+// trackOpen remembers unresolved tickets for incremental age refreshes
+func (s *syncer) trackOpen(key string, t itop.Ticket) {
+	if t.ResolutionDate.IsZero() {
+		s.openTickets[key] = t
+	} else {
+		delete(s.openTickets, key)
+	}
+}
+
+// backfill upserts every ticket whose start_date falls in [from, to); nothing is deleted
+func (s *syncer) backfill(from, to time.Time) {
+	holidayMap := s.loadHolidays()
+	for _, class := range s.cfg.ITop.Classes {
+		tickets, err := s.itop.FetchTicketsByClassBetween(class, from, to)
+		if err != nil {
+			s.log.Error("Failed to fetch tickets from iTop", "class", class, "err", err)
+			continue
+		}
+		tickets = s.ownTickets(tickets)
+		s.log.Info("Backfill", "class", class, "tickets", len(tickets), "from", from.Format("2006-01-02"), "to", to.Format("2006-01-02"))
+		s.loadStatusHistory(tickets)
+		for i, doc := range s.mapTickets(tickets, holidayMap) {
+			t := tickets[i]
+			s.upsertIfChanged(hashTicketKey(t.ID, t.Ref, t.Class), doc)
+		}
+	}
+}
+
+// recalculate re-maps every ticket resolved in [from, to) with the current
+// holidays and SLTs, so a late holiday or SLT change reaches closed tickets;
+// the SLT cache is flushed first
+func (s *syncer) recalculate(from, to time.Time) {
+	s.itop.FlushSLTCache()
+	holidayMap := s.loadHolidays()
+	for _, class := range s.cfg.ITop.Classes {
+		tickets, err := s.itop.FetchResolvedTicketsByClassBetween(class, from, to)
+		if err != nil {
+			s.log.Error("Failed to fetch tickets from iTop", "class", class, "err", err)
+			continue
+		}
+		tickets = s.ownTickets(tickets)
+		s.log.Info("Recalculate", "class", class, "tickets", len(tickets), "from", from.Format("2006-01-02"), "to", to.Format("2006-01-02"))
+		s.loadStatusHistory(tickets)
+		for i, doc := range s.mapTickets(tickets, holidayMap) {
+			t := tickets[i]
+			s.upsertIfChanged(hashTicketKey(t.ID, t.Ref, t.Class), doc)
+		}
+	}
+}
+
+// fetchTickets fetches tickets of all configured classes concurrently and advances the checkpoints.
+// Classes whose fetch failed are returned in the failed set. Full fetches hand each page to
+// process (when not nil) as it arrives, on the calling goroutine. Only the tickets of this
+// replica's shard are returned or processed.
+func (s *syncer) fetchTickets(sinceCheckpoint bool, process func([]itop.Ticket)) ([]itop.Ticket, map[string]struct{}) {
+	// Time spent processing pages is accounted to their own phases
+	start := time.Now()
+	var busy time.Duration
+	defer func() { s.summary.track("fetch", start.Add(busy)) }()
+	type result struct {
+		class   string
+		tickets []itop.Ticket
+		err     error
+	}
+	ch := make(chan result, len(s.cfg.ITop.Classes))
+	pages := make(chan []itop.Ticket)
+	for _, class := range s.cfg.ITop.Classes {
+		since, ok := s.checkpoints[class]
+		go func(class string) {
+			var tickets []itop.Ticket
+			var err error
+			if sinceCheckpoint && ok {
+				tickets, err = s.itop.FetchTicketsByClassSince(class, since)
+			} else {
+				var each func([]itop.Ticket)
+				if process != nil {
+					each = func(page []itop.Ticket) { pages <- s.ownTickets(page) }
+				}
+				tickets, err = s.itop.FetchTicketsByClassPages(class, each)
+			}
+			ch <- result{class, tickets, err}
+		}(class)
+	}
+	var allTickets []itop.Ticket
+	failed := map[string]struct{}{}
+	for i := 0; i < len(s.cfg.ITop.Classes); {
+		var r result
+		select {
+		case page := <-pages:
+			t := time.Now()
+			process(page)
+			busy += time.Since(t)
+			continue
+		case r = <-ch:
+			i++
+		}
+		if r.err != nil {
+			s.log.Error("Failed to fetch tickets from iTop", "class", r.class, "err", r.err)
+			failed[r.class] = struct{}{}
+			s.summary.Errors++
+			continue
+		}
+		s.summary.Fetched[r.class] = len(r.tickets)
+		metrics.TicketsFetched.Add(float64(len(r.tickets)), r.class)
+		for _, t := range r.tickets {
+			if t.LastUpdate != nil && t.LastUpdate.After(s.checkpoints[r.class]) {
+				s.checkpoints[r.class] = *t.LastUpdate
+			}
+		}
+		allTickets = append(allTickets, s.ownTickets(r.tickets)...)
+	}
+	return allTickets, failed
+}
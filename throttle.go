@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	metrics "itop-sla-exporter/internal/metrics"
+)
+
+// adaptThrottle adjusts the slowdown factor (sync.throttle) to the latency
+// and failures of the iTop requests made since the last cycle
+func (s *syncer) adaptThrottle() {
+	st := s.itop.TakeStats()
+	conf := s.cfg.Sync
+	factor := s.throttle
+	switch {
+	case !conf.Throttle:
+		factor = 1
+	case st.Requests == 0:
+		// Nothing measured: keep the current pace
+	case st.Latency > conf.ThrottleLatency || st.ErrorRate() > conf.ThrottleErrorRate:
+		factor *= 2
+	case st.Latency <= conf.ThrottleLatency/2 && st.ErrorRate() <= conf.ThrottleErrorRate/2:
+		factor /= 2
+	}
+	if conf.Throttle {
+		factor = math.Max(1, math.Min(factor, conf.ThrottleMaxFactor))
+	}
+	if factor == s.throttle {
+		return
+	}
+	if factor > s.throttle {
+		s.log.Warn("iTop is struggling, slowing down", "factor", factor, "latency_ms", st.Latency.Milliseconds(), "error_rate", st.ErrorRate(), "requests", st.Requests)
+	} else {
+		s.log.Info("iTop is recovering, speeding up", "factor", factor, "latency_ms", st.Latency.Milliseconds(), "error_rate", st.ErrorRate(), "requests", st.Requests)
+	}
+	s.throttle = factor
+	s.itop.SlowDown(factor)
+	metrics.Throttle.Set(factor)
+}
+
+// throttled stretches an interval by the slowdown factor
+func (s *syncer) throttled(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * s.throttle)
+}
+
+// workers is sync.workers divided by the slowdown factor, at least 1
+func (s *syncer) workers() int {
+	n := int(float64(s.cfg.Sync.Workers) / s.throttle)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+	metrics "itop-sla-exporter/internal/metrics"
+	utils "itop-sla-exporter/internal/utils"
+)
+
+// dueTiers returns the tiers of sync.tiers due at now, and whether the full
+// tier is one of them. The full tier's last run is lastFull, so a requested
+// full sync or a reload makes it due.
+func (s *syncer) dueTiers(now time.Time) (due []config.SyncTier, full bool) {
+	for _, t := range s.cfg.Sync.Tiers {
+		last := s.tierRuns[t.Name]
+		if t.Full() {
+			last = s.lastFull
+		}
+		if last.IsZero() || now.Sub(last) >= s.throttled(t.Interval) {
+			due = append(due, t)
+			full = full || t.Full()
+		}
+	}
+	return due, full
+}
+
+// nextTier is the time until the next tier is due, at least a second (a
+// standby replica checks back then)
+func (s *syncer) nextTier(now time.Time) time.Duration {
+	next := time.Duration(-1)
+	for _, t := range s.cfg.Sync.Tiers {
+		last := s.tierRuns[t.Name]
+		if t.Full() {
+			last = s.lastFull
+		}
+		wait := time.Duration(0)
+		if !last.IsZero() {
+			wait = last.Add(s.throttled(t.Interval)).Sub(now)
+		}
+		if next < 0 || wait < next {
+			next = wait
+		}
+	}
+	if next < time.Second {
+		return time.Second
+	}
+	return next
+}
+
+// markTiers records a run of tiers at now
+func (s *syncer) markTiers(tiers []config.SyncTier, now time.Time) {
+	for _, t := range tiers {
+		s.tierRuns[t.Name] = now
+	}
+}
+
+// tierNames lists the names of tiers, for the cycle mode
+func tierNames(tiers []config.SyncTier) string {
+	names := make([]string, len(tiers))
+	for i, t := range tiers {
+		names[i] = t.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// syncTier upserts the changed tickets of a tier's window; deletes are left
+// to the full tier. It reports whether every class was fetched successfully.
+func (s *syncer) syncTier(tier config.SyncTier, holidays utils.Holidays) bool {
+	var since time.Time
+	if tier.UpdatedWithin > 0 {
+		since = time.Now().Add(-tier.UpdatedWithin)
+	}
+	ok := true
+	for _, class := range s.cfg.ITop.Classes {
+		start := time.Now()
+		tickets, err := s.itop.FetchTicketsByClassWhere(class, strings.TrimSpace(tier.Where), since)
+		s.summary.track("fetch", start)
+		if err != nil {
+			s.log.Error("Failed to fetch tickets from iTop", "class", class, "tier", tier.Name, "err", err)
+			s.summary.Errors++
+			ok = false
+			continue
+		}
+		s.summary.Fetched[class] += len(tickets)
+		metrics.TicketsFetched.Add(float64(len(tickets)), class)
+		tickets = s.ownTickets(tickets)
+		s.loadStatusHistory(tickets)
+		for i, doc := range s.mapTickets(tickets, holidays) {
+			t := tickets[i]
+			key := hashTicketKey(t.ID, t.Ref, t.Class)
+			s.trackOpen(key, t)
+			s.upsertIfChanged(key, doc)
+		}
+	}
+	return ok
+}
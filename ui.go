@@ -0,0 +1,120 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusPage is the status page served at /ui: the state of the last cycle
+// (see syncStatus), the recent errors, and buttons calling the admin
+// endpoints with the admin token typed in
+var statusPage = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"ago": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Format(time.RFC3339) + " (" + time.Since(*t).Round(time.Second).String() + " ago)"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>iTop SLA synchronizer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+td, th { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+.ok { color: #080; } .failing { color: #c00; }
+</style>
+</head>
+<body>
+<h1>iTop SLA synchronizer{{with .Pipeline}} - {{.}}{{end}}</h1>
+{{with .Status}}
+<p class="{{if .ConsecutiveFailures}}failing{{else}}ok{{end}}">
+{{if .ConsecutiveFailures}}Failing: {{.ConsecutiveFailures}} consecutive cycles{{else}}Healthy{{end}}
+</p>
+<table>
+<tr><th>Last successful cycle</th><td>{{ago .LastSuccess}}</td></tr>
+<tr><th>Last full sync</th><td>{{ago .LastFullSync}}</td></tr>
+<tr><th>Open tickets</th><td>{{.OpenTickets}}</td></tr>
+<tr><th>Pending writes</th><td>{{.PendingWrites}}</td></tr>
+<tr><th>Queued re-syncs</th><td>{{.QueuedResyncs}}</td></tr>
+<tr><th>Errors since start</th><td>{{.ErrorsTotal}}</td></tr>
+</table>
+{{with .LastCycle}}
+<h2>Last cycle</h2>
+<table>
+<tr><th>Cycle</th><td>{{.CycleID}} ({{.Mode}})</td></tr>
+<tr><th>Started</th><td>{{.StartedAt.Format "2006-01-02 15:04:05"}}, {{.DurationMS}} ms</td></tr>
+<tr><th>Upserts / skips / deletes</th><td>{{.Upserts}} / {{.Skips}} / {{.Deletes}}</td></tr>
+<tr><th>Errors</th><td>{{.Errors}}</td></tr>
+</table>
+{{end}}
+<h2>Tickets</h2>
+<table>
+<tr><th>Class</th><th>Documents</th><th>Checkpoint</th></tr>
+{{$cp := .Checkpoints}}{{range $class, $n := .Tickets}}<tr><td>{{$class}}</td><td>{{$n}}</td><td>{{$t := index $cp $class}}{{if not $t.IsZero}}{{$t.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{end}}
+</table>
+<h2>Caches</h2>
+<table>
+{{range $name, $n := .Caches}}<tr><th>{{$name}}</th><td>{{$n}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No sync cycle finished yet.</p>
+{{end}}
+{{if .Admin}}<p>
+<input id="token" type="password" placeholder="admin token">
+<button onclick="post('sync/full')">Run full sync now</button>
+<button onclick="post('sync/caches')">Flush caches</button>
+<span id="result"></span>
+</p>{{end}}
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Message</th><th>Details</th></tr>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Message}}</td><td>{{.Attrs}}</td></tr>
+{{else}}<tr><td colspan="3">none</td></tr>
+{{end}}
+</table>
+<script>
+function post(path) {
+  var headers = {};
+  var token = document.getElementById('token').value;
+  if (token) headers['Authorization'] = 'Bearer ' + token;
+  fetch(path, {method: 'POST', headers: headers})
+    .then(function (r) { return r.text().then(function (t) { document.getElementById('result').textContent = r.status + ' ' + t; }); })
+    .catch(function (e) { document.getElementById('result').textContent = e; });
+}
+</script>
+</body>
+</html>
+`))
+
+// uiHandler serves GET /ui, the status page
+func (s *syncer) uiHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var st *syncStatus
+		if prev := s.status.Load(); prev != nil {
+			cur := s.liveStatus(*prev)
+			st = &cur
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusPage.Execute(w, struct {
+			Pipeline string
+			Status   *syncStatus
+			Errors   []loggedError
+			Admin    bool // the admin endpoints are served
+		}{s.cfg.Pipeline, st, recentErrors.list(), s.cfg.HTTP.AdminToken != ""})
+		if err != nil {
+			slog.Warn("Failed to render the status page", "err", err)
+		}
+	})
+}
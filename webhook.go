@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+
+	itop "itop-sla-exporter/internal/itop"
+	metrics "itop-sla-exporter/internal/metrics"
+)
+
+// ticketRef identifies a ticket pushed by an iTop trigger; ID may be the
+// numeric id or the ticket ref
+type ticketRef struct {
+	Class string `json:"class"`
+	ID    string `json:"id"`
+	Ref   string `json:"ref"`
+}
+
+// syncRequest asks the run loop to re-sync one ticket; done, when set,
+// receives the written document or the error
+type syncRequest struct {
+	ref  ticketRef
+	done chan syncResult
+}
+
+type syncResult struct {
+	doc *ESTicket
+	err error
+}
+
+var errTicketNotFound = errors.New("ticket not found in iTop")
+
+// webhookHandler accepts iTop webhook payloads and queues the referenced
+// ticket for an immediate re-sync by the run loop
+func (s *syncer) webhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token := s.cfg.HTTP.WebhookToken; token != "" && !tokenMatches(r.Header.Get("X-Webhook-Token"), token) && !tokenMatches(r.URL.Query().Get("token"), token) {
+			metrics.Webhooks.Inc("unauthorized")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var ref ticketRef
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err == nil {
+			err = json.Unmarshal(body, &ref)
+		}
+		if ref.ID == "" {
+			ref.ID = ref.Ref
+		}
+		if err != nil || ref.Class == "" || ref.ID == "" || !s.classConfigured(ref.Class) {
+			metrics.Webhooks.Inc("invalid")
+			http.Error(w, "expected {\"class\": ..., \"id\": ...} for a synced class", http.StatusBadRequest)
+			return
+		}
+		select {
+		case s.hooks <- syncRequest{ref: ref}:
+			metrics.Webhooks.Inc("queued")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			// Queue full: the next reconciliation will pick the change up
+			slog.Warn("Webhook queue full, dropping ticket", "class", ref.Class, "ticket_ref", ref.ID)
+			metrics.Webhooks.Inc("dropped")
+			http.Error(w, "queue full", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+func (s *syncer) classConfigured(class string) bool {
+	for _, c := range s.cfg.ITop.Classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSyncRequest runs a queued re-sync and reports back to the caller if any
+func (s *syncer) handleSyncRequest(req syncRequest) {
+	if !s.isLeader() {
+		if req.done != nil {
+			req.done <- syncResult{nil, errStandby}
+		}
+		return
+	}
+	doc, err := s.syncTicket(req.ref)
+	if err == errOtherShard {
+		slog.Debug("Ticket re-sync skipped", "class", req.ref.Class, "ticket_ref", req.ref.ID, "err", err)
+	} else if err != nil {
+		slog.Error("Ticket re-sync failed", "class", req.ref.Class, "ticket_ref", req.ref.ID, "err", err)
+	}
+	if req.done != nil {
+		req.done <- syncResult{doc, err}
+	}
+}
+
+// syncTicket re-fetches one ticket from iTop, upserts it and flushes the writer.
+// Tickets missing from iTop are left to the next full reconciliation.
+func (s *syncer) syncTicket(ref ticketRef) (*ESTicket, error) {
+	t, err := s.itop.FetchTicket(ref.Class, ref.ID)
+	if err != nil {
+		return nil, fmt.Errorf("fetch from iTop: %v", err)
+	}
+	if t == nil {
+		return nil, errTicketNotFound
+	}
+	if !s.inShard(t.ID) {
+		// The replica of its shard picks the change up on its next poll
+		return nil, errOtherShard
+	}
+	tickets := []itop.Ticket{*t}
+	s.loadStatusHistory(tickets)
+	key := hashTicketKey(t.ID, t.Ref, t.Class)
+	s.trackOpen(key, tickets[0])
+	doc := s.mapTicketToES(tickets[0], s.loadHolidays())
+	s.checkBreaches(key, doc)
+	if err := s.writer.Upsert(s.indexFor(doc), key, doc); err != nil {
+		return nil, fmt.Errorf("upsert ES: %v", err)
+	}
+	metrics.Upserts.Inc()
+	if _, err := s.writer.Flush(); err != nil {
+		return nil, fmt.Errorf("ES bulk flush: %v", err)
+	}
+	s.auditUpsert("resync", key, s.indexFor(doc), doc)
+	s.remember(key, doc)
+	s.flushEvents()
+	s.flushAudit()
+	slog.Debug("Re-synced ticket", "class", t.Class, "ticket_ref", t.Ref)
+	return &doc, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	config "itop-sla-exporter/internal/config"
+)
+
+// workOrderDoc is a document of the work order index (elastic.work_orders):
+// work logged against a ticket, joined to the tickets by ticket_ref
+type workOrderDoc struct {
+	SyncedAt    time.Time  `json:"synced_at"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name" es:"text"`
+	Status      string     `json:"status"`
+	TicketID    string     `json:"ticket_id"`
+	TicketRef   string     `json:"ticket_ref"`
+	TeamID      string     `json:"team_id"`
+	Team        string     `json:"team_id_friendlyname"`
+	AgentID     string     `json:"agent_id"`
+	Agent       string     `json:"agent_id_friendlyname"`
+	StartDate   *time.Time `json:"start_date,omitempty"`
+	EndDate     *time.Time `json:"end_date,omitempty"`
+	DurationRaw float64    `json:"duration_raw"`                    // seconds from start to end, 0 while open
+	Description string     `json:"description,omitempty" es:"text"` // plain text
+}
+
+// newWorkOrdersSink creates the writer of the work order index, nil when
+// elastic.work_orders is off
+func newWorkOrdersSink(cfg *config.Config, writer sink) (sink, error) {
+	conf, ok := cfg.WorkOrders()
+	if !ok {
+		return nil, nil
+	}
+	return newSideSink(cfg, conf, "es_work_orders", reflect.TypeOf(workOrderDoc{}), writer)
+}
+
+// syncWorkOrders writes every work order, then removes those gone from iTop
+func (s *syncer) syncWorkOrders() {
+	if s.workOrders == nil {
+		return
+	}
+	orders, err := s.itop.FetchWorkOrders()
+	if err != nil {
+		s.log.Error("Failed to fetch work orders from iTop", "err", err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, w := range orders {
+		doc := workOrderDoc{SyncedAt: now, ID: w.ID, Name: w.Name, Status: w.Status, TicketID: w.TicketID, TicketRef: w.TicketRef,
+			TeamID: w.TeamID, Team: w.Team, AgentID: w.AgentID, Agent: w.Agent,
+			StartDate: toESDate(w.StartDate, s.loc), EndDate: toESDate(w.EndDate, s.loc), Description: stripHTML(w.Description)}
+		if !w.StartDate.IsZero() && w.EndDate.After(w.StartDate) {
+			doc.DurationRaw = w.EndDate.Sub(w.StartDate).Seconds()
+		}
+		if err := s.workOrders.Upsert("", w.ID, doc); err != nil {
+			s.log.Error("Failed to queue work order", "id", w.ID, "err", err)
+			return
+		}
+	}
+	n, err := replaceSideDocs(s.workOrders, now)
+	if err != nil {
+		s.log.Error("Failed to write work orders", "err", err)
+		return
+	}
+	s.log.Info("Synced work orders", "work_orders", len(orders), "removed", n)
+}